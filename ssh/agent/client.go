@@ -81,7 +81,8 @@ type ExtendedAgent interface {
 	// If agent extensions are unsupported entirely this method MUST return an
 	// ErrExtensionUnsupported error. Similarly, if just the specific extensionType in
 	// the request is unsupported by the agent then ErrExtensionUnsupported MUST be
-	// returned.
+	// returned. The client returns ErrExtensionFailure if the agent supports the
+	// extension but failed to process the request.
 	//
 	// In the case of success, since [PROTOCOL.agent] section 4.7 specifies that the contents
 	// of the response are unspecified (including the type of the message), the complete
@@ -229,6 +230,12 @@ const agentExtensionFailure = 28
 // specific extension being unsupported and extensions being unsupported entirely.
 var ErrExtensionUnsupported = errors.New("agent: extension unsupported")
 
+// ErrExtensionFailure indicates that the agent supports an extension
+// requested with SSH_AGENTC_EXTENSION, but failed to process the request:
+// it returned a SSH_AGENT_EXTENSION_FAILURE message, as defined in
+// [PROTOCOL.agent] section 4.7.
+var ErrExtensionFailure = errors.New("agent: generic extension failure")
+
 type extensionAgentMsg struct {
 	ExtensionType string `sshtype:"27"`
 	// NOTE: this matches OpenSSH's PROTOCOL.agent, not the IETF draft [PROTOCOL.agent],
@@ -661,6 +668,13 @@ func (c *client) Add(key AddedKey) error {
 		constraints = append(constraints, agentConstrainConfirm)
 	}
 
+	for _, ext := range key.ConstraintExtensions {
+		constraints = append(constraints, ssh.Marshal(constrainExtensionAgentMsg{
+			ExtensionName:    ext.ExtensionName,
+			ExtensionDetails: ext.ExtensionDetails,
+		})...)
+	}
+
 	cert := key.Certificate
 	if cert == nil {
 		return c.insertKey(key.PrivateKey, key.Comment, constraints)
@@ -793,7 +807,15 @@ func (s *agentKeyringSigner) SignWithAlgorithm(rand io.Reader, data []byte, algo
 		return nil, fmt.Errorf("agent: unsupported algorithm %q", algorithm)
 	}
 
-	return s.agent.SignWithFlags(s.pub, data, flags)
+	sig, err := s.agent.SignWithFlags(s.pub, data, flags)
+	if err != nil {
+		return nil, err
+	}
+	// Agents that don't know the flags ignore them, and sign with SHA-1.
+	if sig.Format != algorithm {
+		return nil, fmt.Errorf("agent: agent returned a %q signature, want %q", sig.Format, algorithm)
+	}
+	return sig, nil
 }
 
 var _ ssh.AlgorithmSigner = &agentKeyringSigner{}
@@ -847,7 +869,7 @@ func (c *client) Extension(extensionType string, contents []byte) ([]byte, error
 		return nil, ErrExtensionUnsupported
 	}
 	if buf[0] == agentExtensionFailure {
-		return nil, errors.New("agent: generic extension failure")
+		return nil, ErrExtensionFailure
 	}
 
 	return buf, nil
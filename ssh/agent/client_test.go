@@ -7,12 +7,14 @@ package agent
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -257,6 +259,152 @@ func TestAgent(t *testing.T) {
 	}
 }
 
+// recordingAgent is an agent that records the keys added to it.
+type recordingAgent struct {
+	Agent
+	added []AddedKey
+}
+
+func (r *recordingAgent) Add(key AddedKey) error {
+	r.added = append(r.added, key)
+	return r.Agent.Add(key)
+}
+
+func TestAddConstraints(t *testing.T) {
+	rec := &recordingAgent{Agent: NewKeyring()}
+	agent, cleanup := startAgent(t, rec)
+	defer cleanup()
+
+	exts := []ConstraintExtension{
+		{ExtensionName: "restrict-destination-v00@openssh.com", ExtensionDetails: []byte("details")},
+		{ExtensionName: "private@example.com", ExtensionDetails: []byte{}},
+	}
+	keys := []AddedKey{
+		{PrivateKey: testPrivateKeys["ed25519"]},
+		{PrivateKey: testPrivateKeys["rsa"], LifetimeSecs: 3600, ConfirmBeforeUse: true, ConstraintExtensions: exts},
+	}
+	for _, key := range keys {
+		if err := agent.Add(key); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if len(rec.added) != len(keys) {
+		t.Fatalf("agent got %d keys, want %d", len(rec.added), len(keys))
+	}
+	for i, got := range rec.added {
+		want := keys[i]
+		if got.LifetimeSecs != want.LifetimeSecs || got.ConfirmBeforeUse != want.ConfirmBeforeUse || !reflect.DeepEqual(got.ConstraintExtensions, want.ConstraintExtensions) {
+			t.Errorf("key %d: got constraints %d, %t, %v; want %d, %t, %v", i,
+				got.LifetimeSecs, got.ConfirmBeforeUse, got.ConstraintExtensions,
+				want.LifetimeSecs, want.ConfirmBeforeUse, want.ConstraintExtensions)
+		}
+	}
+
+	keyList, err := agent.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(keyList) != len(keys) {
+		t.Errorf("got %d keys, want %d", len(keyList), len(keys))
+	}
+
+	// Keys without constraints are added with SSH_AGENTC_ADD_IDENTITY.
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	opcodes := make(chan byte, 2)
+	go func() {
+		for {
+			var length [4]byte
+			if _, err := io.ReadFull(c2, length[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint32(length[:]))
+			if _, err := io.ReadFull(c2, req); err != nil {
+				return
+			}
+			opcodes <- req[0]
+			c2.Write([]byte{0, 0, 0, 1, agentSuccess})
+		}
+	}()
+	client := NewClient(c1)
+	for _, key := range keys {
+		if err := client.Add(key); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if got := <-opcodes; got != agentAddIdentity {
+		t.Errorf("got opcode %d for a key without constraints, want %d", got, agentAddIdentity)
+	}
+	if got := <-opcodes; got != agentAddIDConstrained {
+		t.Errorf("got opcode %d for a key with constraints, want %d", got, agentAddIDConstrained)
+	}
+}
+
+// legacyAgent is an agent that doesn't know signature flags, and so
+// ignores them.
+type legacyAgent struct {
+	Agent
+}
+
+func testSignersSignWithAlgorithm(t *testing.T, agent ExtendedAgent, flagsSupported bool) {
+	if err := agent.Add(AddedKey{PrivateKey: testPrivateKeys["rsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	signers, err := agent.Signers()
+	if err != nil {
+		t.Fatalf("Signers: %v", err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("got %d signers, want 1", len(signers))
+	}
+	signer, ok := signers[0].(ssh.AlgorithmSigner)
+	if !ok {
+		t.Fatalf("signer %T is not an ssh.AlgorithmSigner", signers[0])
+	}
+
+	data := []byte("hello")
+	for _, algo := range []string{ssh.KeyAlgoRSA, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512} {
+		sig, err := signer.SignWithAlgorithm(rand.Reader, data, algo)
+		if !flagsSupported && algo != ssh.KeyAlgoRSA {
+			if err == nil {
+				t.Errorf("SignWithAlgorithm(%s) succeeded with an agent ignoring flags, signature format %q", algo, sig.Format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("SignWithAlgorithm(%s): %v", algo, err)
+		}
+		if sig.Format != algo {
+			t.Errorf("got signature format %q, want %q", sig.Format, algo)
+		}
+		if err := signer.PublicKey().Verify(data, sig); err != nil {
+			t.Errorf("Verify(%s): %v", algo, err)
+		}
+	}
+}
+
+func TestSignersSignWithAlgorithm(t *testing.T) {
+	t.Run("openssh", func(t *testing.T) {
+		agent, _, cleanup := startOpenSSHAgent(t)
+		defer cleanup()
+		testSignersSignWithAlgorithm(t, agent, true)
+	})
+	t.Run("keyring", func(t *testing.T) {
+		agent, cleanup := startKeyringAgent(t)
+		defer cleanup()
+		testSignersSignWithAlgorithm(t, agent, true)
+	})
+	t.Run("legacy", func(t *testing.T) {
+		agent, cleanup := startAgent(t, legacyAgent{NewKeyring()})
+		defer cleanup()
+		testSignersSignWithAlgorithm(t, agent, false)
+	})
+}
+
 func TestCert(t *testing.T) {
 	cert := &ssh.Certificate{
 		Key:         testPublicKeys["rsa"],
@@ -393,6 +541,83 @@ func TestAuth(t *testing.T) {
 	conn.Close()
 }
 
+func TestAuthCert(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			testAuthCert(t, keyType)
+		})
+	}
+}
+
+func testAuthCert(t *testing.T, keyType string) {
+	cert := &ssh.Certificate{
+		Key:             testPublicKeys[keyType],
+		KeyId:           "id",
+		ValidPrincipals: []string{"user"},
+		ValidBefore:     ssh.CertTimeInfinity,
+		CertType:        ssh.UserCert,
+	}
+	if err := cert.SignCert(rand.Reader, testSigners["ecdsa"]); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+
+	agent, cleanup := startKeyringAgent(t)
+	defer cleanup()
+	if err := agent.Add(AddedKey{PrivateKey: testPrivateKeys[keyType], Certificate: cert, Comment: "comment"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// The agent lists, and signs with, the certificate only.
+	keys, err := agent.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Blob, cert.Marshal()) {
+		t.Fatalf("got keys %v, want the certificate", keys)
+	}
+	signers, err := agent.Signers()
+	if err != nil {
+		t.Fatalf("Signers: %v", err)
+	}
+	if len(signers) != 1 || !bytes.Equal(signers[0].PublicKey().Marshal(), cert.Marshal()) {
+		t.Fatalf("got signers %v, want the certificate", signers)
+	}
+
+	a, b, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+	}
+	serverConf := ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		conn, _, _, err := ssh.NewServerConn(a, &serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn error: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	conf := ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.Signers)},
+	}
+	conn, _, _, err := ssh.NewClientConn(b, "", &conf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	conn.Close()
+}
+
 func TestLockOpenSSHAgent(t *testing.T) {
 	agent, _, cleanup := startOpenSSHAgent(t)
 	defer cleanup()
@@ -538,7 +763,18 @@ func TestAgentExtensions(t *testing.T) {
 	}
 
 	_, err = agent.Extension("bad-extension@example.com", []byte{0x00, 0x01, 0x02})
-	if err == nil {
-		t.Fatal("should have gotten agent extension failure")
+	if err != ErrExtensionFailure {
+		t.Fatalf("got %v, want ErrExtensionFailure", err)
+	}
+
+	// The keyring supports no extensions, and keeps serving requests
+	// after rejecting one.
+	agent, cleanup = startKeyringAgent(t)
+	defer cleanup()
+	if _, err := agent.Extension("session-bind@openssh.com", nil); err != ErrExtensionUnsupported {
+		t.Fatalf("got %v, want ErrExtensionUnsupported", err)
+	}
+	if _, err := agent.List(); err != nil {
+		t.Fatalf("List after extension request: %v", err)
 	}
 }
@@ -15,7 +15,8 @@ import (
 
 // RequestAgentForwarding sets up agent forwarding for the session.
 // ForwardToAgent or ForwardToRemote should be called to route
-// the authentication requests.
+// the authentication requests. The client rejects agent channels
+// opened by the server until a session has requested forwarding.
 func RequestAgentForwarding(session *ssh.Session) error {
 	ok, err := session.SendRequest("auth-agent-req@openssh.com", true, nil)
 	if err != nil {
@@ -28,6 +29,8 @@ func RequestAgentForwarding(session *ssh.Session) error {
 }
 
 // ForwardToAgent routes authentication requests to the given keyring.
+// Each agent channel is served concurrently, and is closed once the
+// server stops sending requests on it.
 func ForwardToAgent(client *ssh.Client, keyring Agent) error {
 	channels := client.HandleChannelOpen(channelType)
 	if channels == nil {
@@ -144,8 +144,9 @@ func (r *keyring) List() ([]*Key, error) {
 }
 
 // Insert adds a private key to the keyring. If a certificate
-// is given, that certificate is added as public key. Note that
-// any constraints given are ignored.
+// is given, that certificate is added as public key: List returns the
+// certificate blob, and signing requests must name the certificate. Of
+// the constraints, only LifetimeSecs is honored; the others are ignored.
 func (r *keyring) Add(key AddedKey) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -8,6 +8,7 @@ import (
 	"crypto"
 	"crypto/rand"
 	"fmt"
+	"io"
 	pseudorand "math/rand"
 	"reflect"
 	"strings"
@@ -34,17 +35,19 @@ func TestLockServer(t *testing.T) {
 	testLockAgent(NewKeyring(), t)
 }
 
-func TestSetupForwardAgent(t *testing.T) {
+// forwardingClient connects a client to a server that accepts sessions and
+// agent forwarding requests on them, and returns both ends. If forward is
+// not nil, it is called for each agent forwarding request, and its result
+// is the reply.
+func forwardingClient(t *testing.T, forward func(server *ssh.ServerConn) bool) (*ssh.Client, *ssh.ServerConn) {
 	a, b, err := netPipe()
 	if err != nil {
 		t.Fatalf("netPipe: %v", err)
 	}
-
-	defer a.Close()
-	defer b.Close()
-
-	_, socket, cleanup := startOpenSSHAgent(t)
-	defer cleanup()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
 
 	serverConf := ssh.ServerConfig{
 		NoClientAuth: true,
@@ -52,12 +55,33 @@ func TestSetupForwardAgent(t *testing.T) {
 	serverConf.AddHostKey(testSigners["rsa"])
 	incoming := make(chan *ssh.ServerConn, 1)
 	go func() {
-		conn, _, _, err := ssh.NewServerConn(a, &serverConf)
+		conn, chans, reqs, err := ssh.NewServerConn(a, &serverConf)
 		incoming <- conn
 		if err != nil {
 			t.Errorf("NewServerConn error: %v", err)
 			return
 		}
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			if newCh.ChannelType() != "session" {
+				newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+				continue
+			}
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for req := range reqs {
+					if req.Type != "auth-agent-req@openssh.com" {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(forward == nil || forward(conn), nil)
+				}
+				ch.Close()
+			}()
+		}
 	}()
 
 	conf := ssh.ClientConfig{
@@ -68,14 +92,35 @@ func TestSetupForwardAgent(t *testing.T) {
 		t.Fatalf("NewClientConn: %v", err)
 	}
 	client := ssh.NewClient(conn, chans, reqs)
-
-	if err := ForwardToRemote(client, socket); err != nil {
-		t.Fatalf("SetupForwardAgent: %v", err)
-	}
+	t.Cleanup(func() { client.Close() })
 	server := <-incoming
 	if server == nil {
 		t.Fatal("Unable to get server")
 	}
+	return client, server
+}
+
+// requestForwarding requests agent forwarding on a new session of client.
+func requestForwarding(t *testing.T, client *ssh.Client) {
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	if err := RequestAgentForwarding(session); err != nil {
+		t.Fatalf("RequestAgentForwarding: %v", err)
+	}
+}
+
+func TestSetupForwardAgent(t *testing.T) {
+	_, socket, cleanup := startOpenSSHAgent(t)
+	defer cleanup()
+
+	client, server := forwardingClient(t, nil)
+	if err := ForwardToRemote(client, socket); err != nil {
+		t.Fatalf("SetupForwardAgent: %v", err)
+	}
+	requestForwarding(t, client)
 	ch, reqs, err := server.OpenChannel(channelType, nil)
 	if err != nil {
 		t.Fatalf("OpenChannel(%q): %v", channelType, err)
@@ -84,7 +129,91 @@ func TestSetupForwardAgent(t *testing.T) {
 
 	agentClient := NewClient(ch)
 	testAgentInterface(t, agentClient, testPrivateKeys["rsa"], nil, 0)
-	conn.Close()
+}
+
+func TestForwardToAgent(t *testing.T) {
+	keyring := NewKeyring()
+	if err := keyring.Add(AddedKey{PrivateKey: testPrivateKeys["rsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	client, server := forwardingClient(t, nil)
+	if err := ForwardToAgent(client, keyring); err != nil {
+		t.Fatalf("ForwardToAgent: %v", err)
+	}
+	if _, _, err := server.OpenChannel(channelType, nil); err == nil {
+		t.Fatal("agent channel accepted before forwarding was requested")
+	}
+
+	requestForwarding(t, client)
+	var channels []ssh.Channel
+	for i := 0; i < 3; i++ {
+		ch, reqs, err := server.OpenChannel(channelType, nil)
+		if err != nil {
+			t.Fatalf("OpenChannel(%q): %v", channelType, err)
+		}
+		go ssh.DiscardRequests(reqs)
+		channels = append(channels, ch)
+	}
+	for _, ch := range channels {
+		keys, err := NewClient(ch).List()
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(keys) != 1 {
+			t.Errorf("got %d keys, want 1", len(keys))
+		}
+	}
+
+	// The client closes its end of a channel once the server closes its
+	// writing side.
+	for _, ch := range channels {
+		ch.CloseWrite()
+		if _, err := ch.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("got %v reading a finished agent channel, want io.EOF", err)
+		}
+		ch.Close()
+	}
+}
+
+func TestForwardToAgentBeforeReply(t *testing.T) {
+	// The server opens an agent channel before it replies to the
+	// forwarding request, which the client must already accept.
+	opened := make(chan error, 1)
+	client, _ := forwardingClient(t, func(server *ssh.ServerConn) bool {
+		ch, reqs, err := server.OpenChannel(channelType, nil)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+			ch.Close()
+		}
+		opened <- err
+		return true
+	})
+	if err := ForwardToAgent(client, NewKeyring()); err != nil {
+		t.Fatalf("ForwardToAgent: %v", err)
+	}
+	requestForwarding(t, client)
+	if err := <-opened; err != nil {
+		t.Errorf("OpenChannel(%q) before the reply: %v", channelType, err)
+	}
+}
+
+func TestForwardToAgentRefused(t *testing.T) {
+	client, server := forwardingClient(t, func(*ssh.ServerConn) bool { return false })
+	if err := ForwardToAgent(client, NewKeyring()); err != nil {
+		t.Fatalf("ForwardToAgent: %v", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := RequestAgentForwarding(session); err == nil {
+		t.Fatal("RequestAgentForwarding succeeded, want an error")
+	}
+	if _, _, err := server.OpenChannel(channelType, nil); err == nil {
+		t.Error("agent channel accepted after forwarding was refused")
+	}
 }
 
 func TestV1ProtocolMessages(t *testing.T) {
@@ -263,4 +392,9 @@ func TestParseConstraints(t *testing.T) {
 	if err == nil || !strings.Contains(err.Error(), "unknown constraint") {
 		t.Errorf("unexpected error: %v", err)
 	}
+
+	// Test Truncated Lifetime
+	if _, _, _, err := parseConstraints([]byte{agentConstrainLifetime, 0, 0}); err == nil {
+		t.Error("parseConstraints succeeded for a truncated lifetime")
+	}
 }
@@ -6,7 +6,9 @@ package ssh
 
 import (
 	"io"
+	"os"
 	"sync"
+	"time"
 )
 
 // buffer provides a linked list buffer for data exchange
@@ -20,6 +22,8 @@ type buffer struct {
 	tail *element // the buffer that will be read last
 
 	closed bool
+
+	deadline condDeadline
 }
 
 // An element represents a single link in a linked list.
@@ -59,8 +63,32 @@ func (b *buffer) eof() {
 	b.Cond.L.Unlock()
 }
 
+// drained reports whether the buffer is closed, and all its data has
+// been read.
+func (b *buffer) drained() bool {
+	b.Cond.L.Lock()
+	defer b.Cond.L.Unlock()
+	if !b.closed {
+		return false
+	}
+	for e := b.head; e != nil; e = e.next {
+		if len(e.buf) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// setDeadline sets the deadline for reads.
+func (b *buffer) setDeadline(t time.Time) {
+	b.Cond.L.Lock()
+	b.deadline.set(b.Cond, t)
+	b.Cond.L.Unlock()
+}
+
 // Read reads data from the internal buffer in buf.  Reads will block
-// if no data is available, or until the buffer is closed.
+// if no data is available, or until the buffer is closed or the
+// deadline passes.
 func (b *buffer) Read(buf []byte) (n int, err error) {
 	b.Cond.L.Lock()
 	defer b.Cond.L.Unlock()
@@ -90,6 +118,10 @@ func (b *buffer) Read(buf []byte) (n int, err error) {
 			err = io.EOF
 			break
 		}
+		if b.deadline.exceeded() {
+			err = os.ErrDeadlineExceeded
+			break
+		}
 		// out of buffers, wait for producer
 		b.Cond.Wait()
 	}
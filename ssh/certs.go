@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -285,6 +286,17 @@ func (s *algorithmOpenSSHCertSigner) SignWithAlgorithm(rand io.Reader, data []by
 
 const sourceAddressCriticalOption = "source-address"
 
+// ForceCommandCriticalOption is the user certificate critical option
+// that restricts sessions to a single command. See Permissions.Command.
+const ForceCommandCriticalOption = "force-command"
+
+// NoTouchRequiredExtension is the certificate extension, also used as
+// an authorized_keys option by OpenSSH, that lets a security key sign
+// without the user touching it. Without it in Permissions.Extensions, a
+// server rejects public key authentication with a KeyAlgoSKECDSA256 or
+// KeyAlgoSKED25519 signature that lacks SKFlagUserPresent.
+const NoTouchRequiredExtension = "no-touch-required"
+
 // CertChecker does the work of verifying a certificate. Its methods
 // can be plugged into ClientConfig.HostKeyCallback and
 // ServerConfig.PublicKeyCallback. For the CertChecker to work,
@@ -292,9 +304,21 @@ const sourceAddressCriticalOption = "source-address"
 type CertChecker struct {
 	// SupportedCriticalOptions lists the CriticalOptions that the
 	// server application layer understands. These are only used
-	// for user certificates.
+	// for user certificates. Certificates with other critical options,
+	// except source-address, are rejected unless CheckCriticalOptions
+	// accepts them.
 	SupportedCriticalOptions []string
 
+	// CheckCriticalOptions, if not nil, is called by Authenticate after
+	// the certificate has been checked, to enforce its critical options,
+	// for example force-command. It is called after source-address has
+	// been enforced against conn.RemoteAddr(). unsupported lists, in
+	// sorted order, the critical options of cert that are neither
+	// source-address nor in SupportedCriticalOptions; returning nil
+	// accepts them, so a callback that doesn't understand them must
+	// return an error. A non-nil error rejects the certificate.
+	CheckCriticalOptions func(cert *Certificate, conn ConnMetadata, unsupported []string) error
+
 	// IsUserAuthority should return true if the key is recognized as an
 	// authority for the given user certificate. This allows for
 	// certificates to be signed by other certificates. This must be set
@@ -309,7 +333,10 @@ type CertChecker struct {
 	IsHostAuthority func(auth PublicKey, address string) bool
 
 	// Clock is used for verifying time stamps. If nil, time.Now
-	// is used.
+	// is used. A certificate is valid from ValidAfter up to, but not
+	// including, ValidBefore, for user and host certificates alike, so
+	// setting Clock checks certificates as of another instant, such as
+	// when replaying an audit log or in tests.
 	Clock func() time.Time
 
 	// UserKeyFallback is called when CertChecker.Authenticate encounters a
@@ -325,8 +352,84 @@ type CertChecker struct {
 	// IsRevoked is called for each certificate so that revocation checking
 	// can be implemented. It should return true if the given certificate
 	// is revoked and false otherwise. If nil, no certificates are
-	// considered to have been revoked.
+	// considered to have been revoked. Revoked certificates are rejected
+	// with an error wrapping ErrCertificateRevoked. The IsRevoked method
+	// of a RevocationList can be used.
 	IsRevoked func(cert *Certificate) bool
+
+	// UserPrincipalPatterns, if set, makes CheckCert treat the principals
+	// of user certificates as patterns, as it always does for host
+	// certificates. By default, as in OpenSSH, user certificate
+	// principals must match the user name exactly.
+	UserPrincipalPatterns bool
+}
+
+// ErrCertificateRevoked is wrapped by the errors of CertChecker for
+// certificates that CertChecker.IsRevoked reports as revoked.
+var ErrCertificateRevoked = errors.New("ssh: certificate revoked")
+
+// A RevocationList is a set of revoked certificates, identified by their
+// serial number or key ID together with the authority that signed them,
+// like the serial and key ID sections of an OpenSSH KRL. Its IsRevoked
+// method can be used as CertChecker.IsRevoked. A RevocationList is safe
+// for concurrent use, and the zero value is empty.
+type RevocationList struct {
+	mu      sync.Mutex
+	serials map[string]map[uint64]bool
+	keyIDs  map[string]map[string]bool
+}
+
+// revocationScope returns the key under which the revocations of
+// authority are stored. A nil authority has its own scope, which
+// applies to all certificates.
+func revocationScope(authority PublicKey) string {
+	if authority == nil {
+		return ""
+	}
+	return string(authority.Marshal())
+}
+
+// RevokeSerial revokes the certificates with the given serial number
+// signed by authority, or by any authority if authority is nil.
+func (l *RevocationList) RevokeSerial(authority PublicKey, serial uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scope := revocationScope(authority)
+	if l.serials == nil {
+		l.serials = make(map[string]map[uint64]bool)
+	}
+	if l.serials[scope] == nil {
+		l.serials[scope] = make(map[uint64]bool)
+	}
+	l.serials[scope][serial] = true
+}
+
+// RevokeKeyID revokes the certificates with the given key ID signed by
+// authority, or by any authority if authority is nil.
+func (l *RevocationList) RevokeKeyID(authority PublicKey, keyID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	scope := revocationScope(authority)
+	if l.keyIDs == nil {
+		l.keyIDs = make(map[string]map[string]bool)
+	}
+	if l.keyIDs[scope] == nil {
+		l.keyIDs[scope] = make(map[string]bool)
+	}
+	l.keyIDs[scope][keyID] = true
+}
+
+// IsRevoked reports whether the serial number or key ID of cert has been
+// revoked for its signature key, or for all authorities.
+func (l *RevocationList) IsRevoked(cert *Certificate) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, scope := range []string{revocationScope(cert.SignatureKey), ""} {
+		if l.serials[scope][cert.Serial] || l.keyIDs[scope][cert.KeyId] {
+			return true
+		}
+	}
+	return false
 }
 
 // CheckHostKey checks a host key certificate. This method can be
@@ -373,23 +476,76 @@ func (c *CertChecker) Authenticate(conn ConnMetadata, pubKey PublicKey) (*Permis
 		return nil, fmt.Errorf("ssh: certificate signed by unrecognized authority")
 	}
 
-	if err := c.CheckCert(conn.User(), cert); err != nil {
+	unsupported, err := c.checkCert(conn.User(), cert, c.CheckCriticalOptions != nil)
+	if err != nil {
 		return nil, err
 	}
 
+	if addrs, ok := cert.CriticalOptions[sourceAddressCriticalOption]; ok {
+		if err := checkSourceAddress(conn.RemoteAddr(), addrs); err != nil {
+			return nil, err
+		}
+	}
+	if c.CheckCriticalOptions != nil {
+		if err := c.CheckCriticalOptions(cert, conn, unsupported); err != nil {
+			return nil, err
+		}
+	}
+
 	return &cert.Permissions, nil
 }
 
+// matchPrincipal reports whether principal matches pattern, in which '*'
+// matches any sequence of characters and '?' matches any single
+// character. As in OpenSSH's match_pattern, '*' also matches dots, so
+// "*.example.com" matches "a.b.example.com" but not "example.com".
+func matchPrincipal(principal, pattern string) bool {
+	// star and next are the positions in pattern and principal to go
+	// back to if the remaining pattern doesn't match.
+	star, next := -1, 0
+	p, i := 0, 0
+	for i < len(principal) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == principal[i]):
+			p++
+			i++
+		case star >= 0:
+			// Let the last '*' match one more character.
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
 // CheckCert checks CriticalOptions, ValidPrincipals, revocation, timestamp and
-// the signature of the certificate.
+// the signature of the certificate. The principals of host certificates
+// may contain the '*' and '?' wildcards. An empty principals list makes
+// the certificate valid for any principal.
 func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
+	_, err := c.checkCert(principal, cert, false)
+	return err
+}
+
+// checkCert implements CheckCert. If allowUnsupported is set, critical
+// options that CheckCert would reject as unsupported are returned,
+// sorted, instead, for the caller to decide on.
+func (c *CertChecker) checkCert(principal string, cert *Certificate, allowUnsupported bool) (unsupported []string, err error) {
 	if c.IsRevoked != nil && c.IsRevoked(cert) {
-		return fmt.Errorf("ssh: certificate serial %d revoked", cert.Serial)
+		return nil, fmt.Errorf("%w: serial %d, key ID %q", ErrCertificateRevoked, cert.Serial, cert.KeyId)
 	}
 
 	for opt := range cert.CriticalOptions {
 		// sourceAddressCriticalOption will be enforced by
-		// serverAuthenticate
+		// Authenticate and serverAuthenticate
 		if opt == sourceAddressCriticalOption {
 			continue
 		}
@@ -402,21 +558,26 @@ func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
 			}
 		}
 		if !found {
-			return fmt.Errorf("ssh: unsupported critical option %q in certificate", opt)
+			if !allowUnsupported {
+				return nil, fmt.Errorf("ssh: unsupported critical option %q in certificate", opt)
+			}
+			unsupported = append(unsupported, opt)
 		}
 	}
+	sort.Strings(unsupported)
 
 	if len(cert.ValidPrincipals) > 0 {
 		// By default, certs are valid for all users/hosts.
+		patterns := cert.CertType == HostCert || c.UserPrincipalPatterns
 		found := false
 		for _, p := range cert.ValidPrincipals {
-			if p == principal {
+			if p == principal || patterns && matchPrincipal(principal, p) {
 				found = true
 				break
 			}
 		}
 		if !found {
-			return fmt.Errorf("ssh: principal %q not in the set of valid principals for given certificate: %q", principal, cert.ValidPrincipals)
+			return nil, fmt.Errorf("ssh: principal %q not in the set of valid principals for given certificate: %q", principal, cert.ValidPrincipals)
 		}
 	}
 
@@ -427,16 +588,16 @@ func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
 
 	unixNow := clock().Unix()
 	if after := int64(cert.ValidAfter); after < 0 || unixNow < int64(cert.ValidAfter) {
-		return fmt.Errorf("ssh: cert is not yet valid")
+		return nil, fmt.Errorf("ssh: cert is not yet valid")
 	}
 	if before := int64(cert.ValidBefore); cert.ValidBefore != uint64(CertTimeInfinity) && (unixNow >= before || before < 0) {
-		return fmt.Errorf("ssh: cert has expired")
+		return nil, fmt.Errorf("ssh: cert has expired")
 	}
 	if err := cert.SignatureKey.Verify(cert.bytesForSigning(), cert.Signature); err != nil {
-		return fmt.Errorf("ssh: certificate signature does not verify")
+		return nil, fmt.Errorf("ssh: certificate signature does not verify")
 	}
 
-	return nil
+	return unsupported, nil
 }
 
 // SignCert signs the certificate with an authority, setting the Nonce,
@@ -480,6 +641,30 @@ func (c *Certificate) SignCert(rand io.Reader, authority Signer) error {
 	return nil
 }
 
+// SignCertWithAlgorithm is like SignCert, but always signs with the given
+// signature algorithm, which must be one of those supported by the
+// authority's key type, for example KeyAlgoRSASHA256 for an RSA
+// authority. This allows choosing the RFC 8332 algorithm of an RSA
+// certificate authority without wrapping it with NewSignerWithAlgorithms.
+func (c *Certificate) SignCertWithAlgorithm(rand io.Reader, authority AlgorithmSigner, algorithm string) error {
+	keyType := authority.PublicKey().Type()
+	if !contains(algorithmsForKeyFormat(keyType), algorithm) {
+		return fmt.Errorf("ssh: signature algorithm %q is not supported for %s keys", algorithm, keyType)
+	}
+	c.Nonce = make([]byte, 32)
+	if _, err := io.ReadFull(rand, c.Nonce); err != nil {
+		return err
+	}
+	c.SignatureKey = authority.PublicKey()
+
+	sig, err := authority.SignWithAlgorithm(rand, c.bytesForSigning(), algorithm)
+	if err != nil {
+		return err
+	}
+	c.Signature = sig
+	return nil
+}
+
 // certKeyAlgoNames is a mapping from known certificate algorithm names to the
 // corresponding public key signature algorithm.
 //
@@ -574,6 +759,23 @@ func (c *Certificate) Verify(data []byte, sig *Signature) error {
 	return c.Key.Verify(data, sig)
 }
 
+// KeyFingerprintSHA256 returns the SHA256 fingerprint of the certified
+// key, c.Key, in the format of FingerprintSHA256. Unlike the fingerprint
+// of c itself, it stays the same when the key is certified again.
+func (c *Certificate) KeyFingerprintSHA256() string {
+	return FingerprintSHA256(c.Key)
+}
+
+// AuthorityFingerprintSHA256 returns the SHA256 fingerprint of the key of
+// the authority that signed c, c.SignatureKey, in the format of
+// FingerprintSHA256. It returns "" if c has not been signed.
+func (c *Certificate) AuthorityFingerprintSHA256() string {
+	if c.SignatureKey == nil {
+		return ""
+	}
+	return FingerprintSHA256(c.SignatureKey)
+}
+
 func parseSignatureBody(in []byte) (out *Signature, rest []byte, ok bool) {
 	format, in, ok := parseString(in)
 	if !ok {
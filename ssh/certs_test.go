@@ -9,6 +9,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -130,6 +131,52 @@ func TestValidateCert(t *testing.T) {
 	}
 }
 
+func TestRevocationList(t *testing.T) {
+	newCert := func(serial uint64, keyID string, authority Signer) *Certificate {
+		cert := &Certificate{
+			Key:         testPublicKeys["rsa"],
+			Serial:      serial,
+			KeyId:       keyID,
+			ValidBefore: CertTimeInfinity,
+			CertType:    UserCert,
+		}
+		if err := cert.SignCert(rand.Reader, authority); err != nil {
+			t.Fatalf("SignCert: %v", err)
+		}
+		return cert
+	}
+	ca, otherCA := testSigners["ecdsa"], testSigners["ed25519"]
+
+	var revoked RevocationList
+	revoked.RevokeSerial(ca.PublicKey(), 7)
+	revoked.RevokeKeyID(ca.PublicKey(), "lost laptop")
+	revoked.RevokeSerial(nil, 99)
+	checker := CertChecker{
+		IsUserAuthority: func(PublicKey) bool { return true },
+		IsRevoked:       revoked.IsRevoked,
+	}
+	for _, tt := range []struct {
+		name    string
+		cert    *Certificate
+		revoked bool
+	}{
+		{"revoked serial", newCert(7, "a", ca), true},
+		{"revoked key ID", newCert(8, "lost laptop", ca), true},
+		{"serial of another CA", newCert(7, "a", otherCA), false},
+		{"key ID of another CA", newCert(8, "lost laptop", otherCA), false},
+		{"serial revoked for all CAs", newCert(99, "b", otherCA), true},
+		{"valid", newCert(8, "b", ca), false},
+	} {
+		err := checker.CheckCert("user", tt.cert)
+		if got := errors.Is(err, ErrCertificateRevoked); got != tt.revoked {
+			t.Errorf("%s: got error %v, want revoked %v", tt.name, err, tt.revoked)
+		}
+		if !tt.revoked && err != nil {
+			t.Errorf("%s: CheckCert: %v", tt.name, err)
+		}
+	}
+}
+
 func TestValidateCertTime(t *testing.T) {
 	cert := Certificate{
 		ValidPrincipals: []string{"user"},
@@ -159,6 +206,41 @@ func TestValidateCertTime(t *testing.T) {
 			t.Errorf("Authenticate(%d): %v", ts, v)
 		}
 	}
+
+	// Host certificates are checked against the same clock, and
+	// CertTimeInfinity never expires.
+	hostCert := Certificate{
+		ValidPrincipals: []string{"host"},
+		Key:             testPublicKeys["rsa"],
+		CertType:        HostCert,
+		ValidAfter:      50,
+		ValidBefore:     100,
+	}
+	hostCert.SignCert(rand.Reader, testSigners["ecdsa"])
+	infiniteCert := cert
+	infiniteCert.ValidBefore = CertTimeInfinity
+	infiniteCert.SignCert(rand.Reader, testSigners["ecdsa"])
+	for ts, ok := range map[int64]bool{
+		25:  false,
+		75:  true,
+		100: false,
+	} {
+		checker := CertChecker{
+			Clock: func() time.Time { return time.Unix(ts, 0) },
+			IsHostAuthority: func(k PublicKey, addr string) bool {
+				return bytes.Equal(k.Marshal(), testPublicKeys["ecdsa"].Marshal())
+			},
+			IsUserAuthority: func(k PublicKey) bool {
+				return bytes.Equal(k.Marshal(), testPublicKeys["ecdsa"].Marshal())
+			},
+		}
+		if err := checker.CheckHostKey("host:22", &net.TCPAddr{}, &hostCert); (err == nil) != ok {
+			t.Errorf("CheckHostKey(%d): %v", ts, err)
+		}
+		if err := checker.CheckCert("user", &infiniteCert); (err == nil) != (ts >= 50) {
+			t.Errorf("CheckCert(%d) with CertTimeInfinity: %v", ts, err)
+		}
+	}
 }
 
 // TODO(hanwen): tests for
@@ -259,6 +341,97 @@ func TestHostKeyCert(t *testing.T) {
 	}
 }
 
+func TestCertHostKeyCallback(t *testing.T) {
+	cert := &Certificate{
+		ValidPrincipals: []string{"hostname"},
+		Key:             testPublicKeys["ecdsa"],
+		ValidBefore:     CertTimeInfinity,
+		CertType:        HostCert,
+	}
+	cert.SignCert(rand.Reader, testSigners["ed25519"])
+	certSigner, err := NewCertSigner(cert, testSigners["ecdsa"])
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+
+	for _, hostKey := range []Signer{certSigner, testSigners["ecdsa"]} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		defer c1.Close()
+		defer c2.Close()
+
+		go func() {
+			conf := ServerConfig{NoClientAuth: true}
+			conf.AddHostKey(hostKey)
+			NewServerConn(c1, &conf)
+		}()
+
+		var gotCert *Certificate
+		var gotRawKey, gotPlainKey PublicKey
+		config := &ClientConfig{
+			User: "user",
+			HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+				gotPlainKey = key
+				return nil
+			},
+			CertHostKeyCallback: func(hostname string, remote net.Addr, cert *Certificate, rawKey PublicKey) error {
+				if hostname != "hostname:22" {
+					t.Errorf("got hostname %q, want %q", hostname, "hostname:22")
+				}
+				gotCert, gotRawKey = cert, rawKey
+				return nil
+			},
+		}
+		if _, _, _, err := NewClientConn(c2, "hostname:22", config); err != nil {
+			t.Fatalf("NewClientConn: %v", err)
+		}
+
+		if hostKey == certSigner {
+			if gotPlainKey != nil {
+				t.Errorf("HostKeyCallback called with certificate")
+			}
+			if gotCert == nil || !bytes.Equal(gotCert.Marshal(), cert.Marshal()) {
+				t.Errorf("got certificate %v, want %v", gotCert, cert)
+			}
+			if gotRawKey == nil || !bytes.Equal(gotRawKey.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+				t.Errorf("got raw key %v, want the certified key", gotRawKey)
+			}
+		} else {
+			if gotCert != nil {
+				t.Errorf("CertHostKeyCallback called with plain key")
+			}
+			if gotPlainKey == nil || !bytes.Equal(gotPlainKey.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+				t.Errorf("got plain key %v, want the host key", gotPlainKey)
+			}
+		}
+	}
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		conf := ServerConfig{NoClientAuth: true}
+		conf.AddHostKey(certSigner)
+		NewServerConn(c1, &conf)
+	}()
+	rejected := errors.New("certificate rejected")
+	config := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		CertHostKeyCallback: func(hostname string, remote net.Addr, cert *Certificate, rawKey PublicKey) error {
+			return rejected
+		},
+	}
+	if _, _, _, err := NewClientConn(c2, "hostname:22", config); !errors.Is(err, rejected) {
+		t.Errorf("NewClientConn: got %v, want %v", err, rejected)
+	}
+}
+
 type legacyRSASigner struct {
 	Signer
 }
@@ -406,3 +579,351 @@ func TestCertSignWithMultiAlgorithmSigner(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchPrincipal(t *testing.T) {
+	for _, tt := range []struct {
+		principal, pattern string
+		want               bool
+	}{
+		{"host.prod.example.com", "*.prod.example.com", true},
+		{"a.b.prod.example.com", "*.prod.example.com", true},
+		{"prod.example.com", "*.prod.example.com", false},
+		{"evilprod.example.com", "*.prod.example.com", false},
+		{"host.prod.example.com.evil", "*.prod.example.com", false},
+		{"web1.example.com", "web?.example.com", true},
+		{"web12.example.com", "web?.example.com", false},
+		{"anything", "*", true},
+		{"", "*", true},
+		{"", "?", false},
+		{"host", "host", true},
+		{"host", "h*s*t", true},
+		{"hosts", "h*s*t", false},
+		{"aaab", "*a*b", true},
+	} {
+		if got := matchPrincipal(tt.principal, tt.pattern); got != tt.want {
+			t.Errorf("matchPrincipal(%q, %q) = %v, want %v", tt.principal, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCertPrincipalPatterns(t *testing.T) {
+	checker := &CertChecker{}
+	hostCert := &Certificate{
+		Key:             testPublicKeys["rsa"],
+		ValidPrincipals: []string{"*.prod.example.com"},
+		ValidBefore:     CertTimeInfinity,
+		CertType:        HostCert,
+	}
+	hostCert.SignCert(rand.Reader, testSigners["ecdsa"])
+	if err := checker.CheckCert("db.prod.example.com", hostCert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+	if err := checker.CheckCert("db.dev.example.com", hostCert); err == nil {
+		t.Error("CheckCert accepted a host outside the pattern")
+	}
+
+	userCert := &Certificate{
+		Key:             testPublicKeys["rsa"],
+		ValidPrincipals: []string{"deploy-*"},
+		ValidBefore:     CertTimeInfinity,
+		CertType:        UserCert,
+	}
+	userCert.SignCert(rand.Reader, testSigners["ecdsa"])
+	if err := checker.CheckCert("deploy-web", userCert); err == nil {
+		t.Error("CheckCert matched a user principal pattern by default")
+	}
+	if err := checker.CheckCert("deploy-*", userCert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+	checker.UserPrincipalPatterns = true
+	if err := checker.CheckCert("deploy-web", userCert); err != nil {
+		t.Errorf("CheckCert with UserPrincipalPatterns: %v", err)
+	}
+
+	// An empty principals list is valid for everyone.
+	userCert.ValidPrincipals = nil
+	userCert.SignCert(rand.Reader, testSigners["ecdsa"])
+	if err := checker.CheckCert("anyone", userCert); err != nil {
+		t.Errorf("CheckCert with no principals: %v", err)
+	}
+}
+
+type certTestConnMetadata struct {
+	ConnMetadata
+	remote net.Addr
+}
+
+func (m certTestConnMetadata) User() string         { return "user" }
+func (m certTestConnMetadata) RemoteAddr() net.Addr { return m.remote }
+
+func TestCertCheckerCriticalOptions(t *testing.T) {
+	var checked []string
+	checker := &CertChecker{
+		SupportedCriticalOptions: []string{"force-command"},
+		IsUserAuthority: func(auth PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+		CheckCriticalOptions: func(cert *Certificate, conn ConnMetadata, unsupported []string) error {
+			cmd := cert.CriticalOptions["force-command"]
+			checked = append(checked, cmd)
+			if cmd == "reject" {
+				return errors.New("rejected")
+			}
+			for _, opt := range unsupported {
+				if opt != "verify-required" {
+					return fmt.Errorf("unsupported critical option %q", opt)
+				}
+			}
+			return nil
+		},
+	}
+
+	inside := certTestConnMetadata{remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 22}}
+	outside := certTestConnMetadata{remote: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 22}}
+	for _, tt := range []struct {
+		options map[string]string
+		conn    ConnMetadata
+		succeed bool
+		checked bool
+	}{
+		{map[string]string{"force-command": "ok", "source-address": "10.0.0.0/8"}, inside, true, true},
+		{map[string]string{"force-command": "ok", "source-address": "10.0.0.0/8"}, outside, false, false},
+		{map[string]string{"force-command": "reject"}, inside, false, true},
+		// Options that aren't supported are passed to the callback,
+		// which accepts verify-required only.
+		{map[string]string{"verify-required": ""}, inside, true, true},
+		{map[string]string{"verify-required": "", "no-such-option": ""}, inside, false, true},
+	} {
+		cert := &Certificate{
+			Key:         testPublicKeys["rsa"],
+			ValidBefore: CertTimeInfinity,
+			CertType:    UserCert,
+			Permissions: Permissions{CriticalOptions: tt.options},
+		}
+		cert.SignCert(rand.Reader, testSigners["ecdsa"])
+
+		checked = nil
+		_, err := checker.Authenticate(tt.conn, cert)
+		if (err == nil) != tt.succeed {
+			t.Errorf("options %v from %v: got error %v, want success %v", tt.options, tt.conn.RemoteAddr(), err, tt.succeed)
+		}
+		if (len(checked) > 0) != tt.checked {
+			t.Errorf("options %v from %v: CheckCriticalOptions called %v, want %v", tt.options, tt.conn.RemoteAddr(), len(checked) > 0, tt.checked)
+		}
+	}
+}
+
+func TestPermissionsCommand(t *testing.T) {
+	checker := &CertChecker{
+		SupportedCriticalOptions: []string{ForceCommandCriticalOption},
+		IsUserAuthority: func(auth PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+	}
+	conn := certTestConnMetadata{remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 22}}
+	for _, tt := range []struct {
+		options   map[string]string
+		requested string
+		want      string
+	}{
+		{nil, "ls", "ls"},
+		{nil, "", ""},
+		{map[string]string{ForceCommandCriticalOption: "uptime"}, "ls", "uptime"},
+		{map[string]string{ForceCommandCriticalOption: "uptime"}, "", "uptime"},
+	} {
+		cert := &Certificate{
+			Key:         testPublicKeys["rsa"],
+			ValidBefore: CertTimeInfinity,
+			CertType:    UserCert,
+			Permissions: Permissions{CriticalOptions: tt.options},
+		}
+		cert.SignCert(rand.Reader, testSigners["ecdsa"])
+		perms, err := checker.Authenticate(conn, cert)
+		if err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+		if got := perms.Command(tt.requested); got != tt.want {
+			t.Errorf("options %v: Command(%q) = %q, want %q", tt.options, tt.requested, got, tt.want)
+		}
+		if got := cert.Command(tt.requested); got != tt.want {
+			t.Errorf("options %v: Certificate.Command(%q) = %q, want %q", tt.options, tt.requested, got, tt.want)
+		}
+	}
+
+	var perms *Permissions
+	if got := perms.Command("ls"); got != "ls" {
+		t.Errorf("nil Permissions: Command(%q) = %q, want %q", "ls", got, "ls")
+	}
+}
+
+func TestPermissionsMerge(t *testing.T) {
+	cert := &Permissions{
+		CriticalOptions: map[string]string{
+			ForceCommandCriticalOption: "backup",
+			"source-address":           "10.0.0.0/8",
+		},
+		Extensions: map[string]string{"permit-pty": ""},
+	}
+	policy := &Permissions{
+		CriticalOptions: map[string]string{ForceCommandCriticalOption: "backup"},
+		Extensions:      map[string]string{"permit-port-forwarding": "", "user-id": "42"},
+	}
+	got, err := cert.Merge(policy)
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	want := &Permissions{
+		CriticalOptions: map[string]string{
+			ForceCommandCriticalOption: "backup",
+			"source-address":           "10.0.0.0/8",
+		},
+		Extensions: map[string]string{
+			"permit-pty":             "",
+			"permit-port-forwarding": "",
+			"user-id":                "42",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge: got %+v, want %+v", got, want)
+	}
+	if len(cert.Extensions) != 1 || len(policy.CriticalOptions) != 1 {
+		t.Error("Merge modified its inputs")
+	}
+
+	var none *Permissions
+	if got, err := none.Merge(policy); err != nil || !reflect.DeepEqual(got, policy) {
+		t.Errorf("nil.Merge: got %+v, %v, want %+v", got, err, policy)
+	}
+	if got, err := none.Merge(nil); err != nil || !reflect.DeepEqual(got, &Permissions{}) {
+		t.Errorf("nil.Merge(nil): got %+v, %v, want empty Permissions", got, err)
+	}
+
+	for _, other := range []*Permissions{
+		{CriticalOptions: map[string]string{ForceCommandCriticalOption: "rm -rf /"}},
+		{Extensions: map[string]string{"permit-pty": "no"}},
+	} {
+		if _, err := cert.Merge(other); err == nil {
+			t.Errorf("Merge(%+v) succeeded despite a conflict", other)
+		}
+	}
+}
+
+func TestCertCheckerUnsupportedCriticalOptions(t *testing.T) {
+	cert := &Certificate{
+		Key:         testPublicKeys["rsa"],
+		ValidBefore: CertTimeInfinity,
+		CertType:    UserCert,
+		Permissions: Permissions{CriticalOptions: map[string]string{
+			"verify-required": "", "no-such-option": "", "force-command": "true",
+		}},
+	}
+	cert.SignCert(rand.Reader, testSigners["ecdsa"])
+	conn := certTestConnMetadata{remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 22}}
+
+	var got []string
+	checker := &CertChecker{
+		SupportedCriticalOptions: []string{"force-command"},
+		IsUserAuthority: func(auth PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+	}
+	// Without a callback, unsupported options are rejected.
+	if _, err := checker.Authenticate(conn, cert); err == nil {
+		t.Error("Authenticate accepted unsupported critical options without CheckCriticalOptions")
+	}
+	if err := checker.CheckCert("", cert); err == nil {
+		t.Error("CheckCert accepted unsupported critical options")
+	}
+
+	checker.CheckCriticalOptions = func(cert *Certificate, conn ConnMetadata, unsupported []string) error {
+		got = unsupported
+		return nil
+	}
+	if _, err := checker.Authenticate(conn, cert); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if want := []string{"no-such-option", "verify-required"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got unsupported options %q, want %q", got, want)
+	}
+}
+
+func TestSignCertWithAlgorithm(t *testing.T) {
+	for _, tt := range []struct {
+		ca        string
+		algorithm string
+	}{
+		{"rsa", KeyAlgoRSASHA256},
+		{"rsa", KeyAlgoRSASHA512},
+		{"rsa", KeyAlgoRSA},
+		{"ed25519", KeyAlgoED25519},
+		{"ecdsa", KeyAlgoECDSA256},
+	} {
+		authority := testSigners[tt.ca].(AlgorithmSigner)
+		cert := &Certificate{
+			Key:             testPublicKeys["ed25519"],
+			ValidPrincipals: []string{"user"},
+			ValidBefore:     CertTimeInfinity,
+			CertType:        UserCert,
+		}
+		if err := cert.SignCertWithAlgorithm(rand.Reader, authority, tt.algorithm); err != nil {
+			t.Errorf("%s/%s: SignCertWithAlgorithm: %v", tt.ca, tt.algorithm, err)
+			continue
+		}
+		if cert.Signature.Format != tt.algorithm {
+			t.Errorf("%s/%s: got signature format %q", tt.ca, tt.algorithm, cert.Signature.Format)
+		}
+		if got, want := cert.SignatureKey.Type(), authority.PublicKey().Type(); got != want {
+			t.Errorf("%s/%s: got signature key type %q, want %q", tt.ca, tt.algorithm, got, want)
+		}
+
+		// The certificate survives a round trip and verifies.
+		parsed, err := ParsePublicKey(cert.Marshal())
+		if err != nil {
+			t.Fatalf("%s/%s: ParsePublicKey: %v", tt.ca, tt.algorithm, err)
+		}
+		checker := &CertChecker{
+			IsUserAuthority: func(auth PublicKey) bool {
+				return bytes.Equal(auth.Marshal(), authority.PublicKey().Marshal())
+			},
+		}
+		if err := checker.CheckCert("user", parsed.(*Certificate)); err != nil {
+			t.Errorf("%s/%s: CheckCert: %v", tt.ca, tt.algorithm, err)
+		}
+	}
+
+	cert := &Certificate{Key: testPublicKeys["rsa"], ValidBefore: CertTimeInfinity, CertType: UserCert}
+	if err := cert.SignCertWithAlgorithm(rand.Reader, testSigners["ed25519"].(AlgorithmSigner), KeyAlgoRSASHA256); err == nil {
+		t.Error("signing with an algorithm of another key type succeeded")
+	}
+}
+
+func TestCertificateFingerprints(t *testing.T) {
+	cert := &Certificate{Key: testPublicKeys["ecdsa"], ValidBefore: CertTimeInfinity, CertType: UserCert}
+	if got := cert.AuthorityFingerprintSHA256(); got != "" {
+		t.Errorf("AuthorityFingerprintSHA256 of unsigned cert = %q, want empty", got)
+	}
+
+	var fps []string
+	for _, serial := range []uint64{1, 2} {
+		cert.Serial = serial
+		if err := cert.SignCert(rand.Reader, testSigners["ed25519"]); err != nil {
+			t.Fatalf("SignCert: %v", err)
+		}
+		parsed, err := ParsePublicKey(cert.Marshal())
+		if err != nil {
+			t.Fatalf("ParsePublicKey: %v", err)
+		}
+		c := parsed.(*Certificate)
+		if got, want := c.KeyFingerprintSHA256(), FingerprintSHA256(testPublicKeys["ecdsa"]); got != want {
+			t.Errorf("KeyFingerprintSHA256 = %q, want %q", got, want)
+		}
+		if got, want := c.AuthorityFingerprintSHA256(), FingerprintSHA256(testPublicKeys["ed25519"]); got != want {
+			t.Errorf("AuthorityFingerprintSHA256 = %q, want %q", got, want)
+		}
+		fps = append(fps, FingerprintSHA256(c))
+	}
+	// The fingerprint of the certificate itself changes on reissuance.
+	if fps[0] == fps[1] {
+		t.Error("reissued certificates have the same fingerprint")
+	}
+}
@@ -5,12 +5,15 @@
 package ssh
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -21,8 +24,169 @@ const (
 	channelMaxPacket = 1 << 15
 	// We follow OpenSSH here.
 	channelWindowSize = 64 * channelMaxPacket
+	// channelMaxPacketLimit is the largest maximum packet size that can be
+	// configured for a channel. It leaves room for the data message
+	// header and padding within maxPacketLimit.
+	channelMaxPacketLimit = maxPacketLimit - 1024
 )
 
+// ChannelOptions configures the flow control of a channel. The zero
+// value selects the defaults.
+type ChannelOptions struct {
+	// WindowSize is the initial window size, the number of bytes the
+	// peer may send before it has to wait for a window adjustment. It
+	// must be at least MaxPacketSize. If zero, 2 MiB is used.
+	WindowSize uint32
+
+	// MaxPacketSize is the largest data payload the peer may send in a
+	// single packet. It must be at least 32 KiB, which RFC 4253,
+	// section 6.1, requires every implementation to accept, and at
+	// most 1023 KiB. If zero, 32 KiB is used. Above 255 KiB, the
+	// connection's Config.MaxPacketSize must be raised to match, or the
+	// peer's full-size packets end the connection.
+	MaxPacketSize uint32
+}
+
+// values returns the window and maximum packet sizes selected by o.
+func (o *ChannelOptions) values() (window, maxPacketSize uint32, err error) {
+	window, maxPacketSize = channelWindowSize, channelMaxPacket
+	if o.MaxPacketSize != 0 {
+		maxPacketSize = o.MaxPacketSize
+	}
+	if o.WindowSize != 0 {
+		window = o.WindowSize
+	}
+	if maxPacketSize < channelMaxPacket || maxPacketSize > channelMaxPacketLimit {
+		return 0, 0, fmt.Errorf("ssh: invalid channel maximum packet size %d", maxPacketSize)
+	}
+	if window < maxPacketSize {
+		return 0, 0, fmt.Errorf("ssh: channel window size %d is smaller than the maximum packet size %d", window, maxPacketSize)
+	}
+	return window, maxPacketSize, nil
+}
+
+// ChannelOptionsNewChannel is a NewChannel that can be accepted with
+// non-default channel options. The NewChannels delivered by the
+// connections in this package implement it.
+type ChannelOptionsNewChannel interface {
+	NewChannel
+
+	// AcceptWithOptions is like Accept, but uses the window and maximum
+	// packet sizes from opts. If opts is invalid, the channel is not
+	// accepted, and may still be rejected.
+	AcceptWithOptions(opts ChannelOptions) (Channel, <-chan *Request, error)
+}
+
+// DeadlineChannel is a Channel with deadlines for reading and writing.
+// The Channels returned by this package implement it.
+type DeadlineChannel interface {
+	Channel
+
+	// SetReadDeadline sets the deadline for Read, and reads from
+	// Stderr. Once it passes, a read waiting for data returns
+	// os.ErrDeadlineExceeded, which implements net.Error with
+	// Timeout() == true. The channel remains usable, and data that
+	// arrives later can be read after extending the deadline. A zero
+	// value for t means reads will not time out.
+	SetReadDeadline(t time.Time) error
+
+	// SetWriteDeadline sets the deadline for Write, and writes to
+	// Stderr, to wait for the remote side to open its window. Once it
+	// passes, a write blocked by flow control returns the number of
+	// bytes already sent and os.ErrDeadlineExceeded.
+	// The deadline does not interrupt a write to the underlying
+	// connection. A zero value for t means writes will not time out.
+	SetWriteDeadline(t time.Time) error
+}
+
+// RequestContextChannel is a Channel whose requests can be bounded by a
+// context. The Channels returned by this package implement it.
+type RequestContextChannel interface {
+	Channel
+
+	// SendRequestContext is like SendRequest, but if wantReply is true
+	// and ctx is done before the reply arrives, or before an earlier
+	// request sent with wantReply is answered, it returns ctx.Err().
+	// A reply that arrives after that is discarded, rather than taken
+	// as the reply to a later request on the channel.
+	SendRequestContext(ctx context.Context, name string, wantReply bool, payload []byte) (bool, error)
+}
+
+// GracefulCloseChannel is a Channel that can be closed once the remote
+// side has finished sending. The Channels returned by this package
+// implement it.
+type GracefulCloseChannel interface {
+	Channel
+
+	// CloseGraceful sends EOF, as CloseWrite does, and closes the
+	// channel once Read has returned io.EOF; that is, once all the
+	// data the remote side sent before its EOF or close, including
+	// data sent after our EOF, has been read. The caller must keep
+	// calling Read until it returns io.EOF. Close can still be called
+	// to close the channel at once.
+	CloseGraceful() error
+}
+
+// EnvChannel is a Channel that records the environment variables sent
+// with "env" requests. The Channels returned by this package implement
+// it.
+type EnvChannel interface {
+	Channel
+
+	// Env returns the variables accepted so far, by name. It is only
+	// filled in for "session" channels accepted by a server whose
+	// ServerConfig.AcceptEnv is set, and returns nil otherwise. The
+	// requests are handled in order with the others on the channel, so
+	// once an "exec" or "shell" request is received, Env includes all
+	// the variables the client sent before it.
+	Env() map[string]string
+}
+
+// ChannelStats holds the traffic counters and flow-control state of a
+// channel.
+type ChannelStats struct {
+	// BytesRead and BytesWritten count the data, including extended
+	// data such as stderr, received from and sent to the peer.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// LocalWindow is the number of bytes the peer may still send
+	// before it has to wait for a window adjustment from us, and
+	// RemoteWindow the number we may send before waiting for one from
+	// the peer. A RemoteWindow that stays near zero means writes are
+	// throttled by the peer's flow control.
+	LocalWindow  uint32
+	RemoteWindow uint32
+
+	// WindowAdjustsSent and WindowAdjustsReceived count the
+	// SSH_MSG_CHANNEL_WINDOW_ADJUST messages sent and received.
+	WindowAdjustsSent     uint64
+	WindowAdjustsReceived uint64
+}
+
+// StatsChannel is a Channel that reports its traffic counters and
+// flow-control windows. The Channels returned by this package implement
+// it.
+type StatsChannel interface {
+	Channel
+
+	// Stats returns a snapshot of the channel statistics. It is cheap,
+	// and safe to call at any time, including after the channel is
+	// closed.
+	Stats() ChannelStats
+}
+
+// LanguageNewChannel is a NewChannel that can be rejected with a
+// language tag for the rejection message. The NewChannels delivered by
+// the connections in this package implement it.
+type LanguageNewChannel interface {
+	NewChannel
+
+	// RejectWithLang is like Reject, but sends lang, a language tag as
+	// in RFC 3066, instead of "en" as the language of message.
+	RejectWithLang(reason RejectionReason, message, lang string) error
+}
+
 // NewChannel represents an incoming request to a channel. It must either be
 // accepted for use by calling Accept, or rejected by calling Reject.
 type NewChannel interface {
@@ -88,21 +252,108 @@ type Request struct {
 
 	ch  *channel
 	mux *mux
+
+	// queued is set for requests added to a replyQueue; replied and
+	// reply are set once they are answered. They are protected by the
+	// queue's mutex.
+	queued  bool
+	replied bool
+	reply   interface{}
 }
 
 // Reply sends a response to a request. It must be called for all requests
 // where WantReply is true and is a no-op otherwise. The payload argument is
-// ignored for replies to channel-specific requests.
+// ignored for replies to channel-specific requests. As RFC 4254 requires,
+// replies are sent in the order of the requests, globally and on each
+// channel: a reply is held until the earlier requests have been
+// answered, and the error of sending it may then not be reported.
 func (r *Request) Reply(ok bool, payload []byte) error {
 	if !r.WantReply {
 		return nil
 	}
 
 	if r.ch == nil {
-		return r.mux.ackRequest(ok, payload)
+		var msg interface{} = globalRequestFailureMsg{Data: payload}
+		if ok {
+			msg = globalRequestSuccessMsg{Data: payload}
+		}
+		return r.mux.replies.reply(r, msg, r.mux.sendMessage)
 	}
 
-	return r.ch.ackRequest(ok)
+	return r.ch.ackRequest(r, ok)
+}
+
+// replyQueue holds the incoming requests that want a reply, so that
+// replies are sent in the order of the requests, whichever order they
+// are made in.
+type replyQueue struct {
+	mu       sync.Mutex
+	requests []*Request
+	// sending is set while a reply call sends the replies at the head
+	// of the queue. The lock is released while sending, so that adding
+	// requests doesn't wait on the connection.
+	sending bool
+}
+
+// add appends r to the queue.
+func (q *replyQueue) add(r *Request) {
+	q.mu.Lock()
+	r.queued = true
+	q.requests = append(q.requests, r)
+	q.mu.Unlock()
+}
+
+// len returns the number of requests whose replies were not sent yet.
+func (q *replyQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.requests)
+}
+
+// reply records msg as the reply to r, and then sends, using send, the
+// replies at the head of the queue that are ready. A nil msg answers r
+// without sending a reply. Requests that were not added to the queue
+// are replied to at once, and replies after the first are dropped.
+func (q *replyQueue) reply(r *Request, msg interface{}, send func(interface{}) error) error {
+	q.mu.Lock()
+	if !r.queued {
+		q.mu.Unlock()
+		if msg == nil {
+			return nil
+		}
+		return send(msg)
+	}
+	if r.replied {
+		q.mu.Unlock()
+		return nil
+	}
+	r.replied = true
+	r.reply = msg
+	if q.sending {
+		// The sending call picks up msg in turn.
+		q.mu.Unlock()
+		return nil
+	}
+
+	q.sending = true
+	var err error
+	for len(q.requests) > 0 && q.requests[0].replied {
+		head := q.requests[0]
+		q.requests[0] = nil
+		q.requests = q.requests[1:]
+		if head.reply == nil {
+			continue
+		}
+		q.mu.Unlock()
+		if sendErr := send(head.reply); head == r {
+			err = sendErr
+		}
+		q.mu.Lock()
+		head.reply = nil
+	}
+	q.sending = false
+	q.mu.Unlock()
+	return err
 }
 
 // RejectionReason is an enumeration used when rejecting channel creation
@@ -153,6 +404,10 @@ type channel struct {
 	extraData         []byte
 	localId, remoteId uint32
 
+	// remoteKnown is set with remoteId, once the peer has assigned it.
+	// Set by the mux loop, and read with the chanList lock held.
+	remoteKnown bool
+
 	// maxIncomingPayload and maxRemotePayload are the maximum
 	// payload sizes of normal and extended data packets for
 	// receiving and sending, respectively. The wire packet will
@@ -173,25 +428,45 @@ type channel struct {
 	// Pending internal channel messages.
 	msg chan interface{}
 
+	// openMu protects abandoned, which is set for an outbound channel
+	// when the opener gives up waiting for the peer's response, and
+	// orders it with the delivery of that response to msg.
+	openMu    sync.Mutex
+	abandoned bool
+
 	// Since requests have no ID, there can be only one request
-	// with WantReply=true outstanding.  This lock is held by a
+	// with WantReply=true outstanding.  This semaphore is held by a
 	// goroutine that has such an outgoing request pending.
-	sentRequestMu sync.Mutex
+	sentRequest chan struct{}
+
+	// replyMu protects staleReplies, the number of replies that are
+	// still due for requests whose sender gave up waiting, and orders
+	// it with the delivery of replies to msg.
+	replyMu      sync.Mutex
+	staleReplies int
 
 	incomingRequests chan *Request
 
 	sentEOF bool
 
+	// closeOnEOF is set by CloseGraceful, to close the channel once
+	// Read returns io.EOF.
+	closeOnEOF     atomic.Bool
+	closeOnEOFOnce sync.Once
+
 	// thread-safe data
 	remoteWin  window
 	pending    *buffer
 	extPending *buffer
 
 	// windowMu protects myWindow, the flow-control window, and myConsumed,
-	// the number of bytes consumed since we last increased myWindow
+	// the number of bytes consumed since we last increased myWindow.
+	// windowSize is the initial window, which myWindow+myConsumed
+	// never exceeds.
 	windowMu   sync.Mutex
 	myWindow   uint32
 	myConsumed uint32
+	windowSize uint32
 
 	// writeMu serializes calls to mux.conn.writePacket() and
 	// protects sentClose and packetPool. This mutex must be
@@ -199,10 +474,24 @@ type channel struct {
 	// is a key exchange pending.
 	writeMu   sync.Mutex
 	sentClose bool
+	closeErr  error // returned by writePacket once sentClose, if set
 
 	// packetPool has a buffer for each extended channel ID to
 	// save allocations during writes.
 	packetPool map[uint32][]byte
+
+	// envMu protects env, the variables accepted from "env" requests.
+	envMu sync.Mutex
+	env   map[string]string
+
+	// replies orders the replies to the peer's requests.
+	replies replyQueue
+
+	// Counters for Stats.
+	bytesRead             atomic.Uint64
+	bytesWritten          atomic.Uint64
+	windowAdjustsSent     atomic.Uint64
+	windowAdjustsReceived atomic.Uint64
 }
 
 // writePacket sends a packet. If the packet is a channel close, it updates
@@ -210,8 +499,12 @@ type channel struct {
 func (ch *channel) writePacket(packet []byte) error {
 	ch.writeMu.Lock()
 	if ch.sentClose {
+		err := ch.closeErr
 		ch.writeMu.Unlock()
-		return io.EOF
+		if err == nil {
+			err = io.EOF
+		}
+		return err
 	}
 	ch.sentClose = (packet[0] == msgChannelClose)
 	err := ch.mux.conn.writePacket(packet)
@@ -273,6 +566,7 @@ func (ch *channel) WriteExtended(data []byte, extendedCode uint32) (n int, err e
 		if err = ch.writePacket(packet); err != nil {
 			return n, err
 		}
+		ch.bytesWritten.Add(uint64(len(todo)))
 
 		n += len(todo)
 		data = data[len(todo):]
@@ -323,6 +617,7 @@ func (ch *channel) handleData(packet []byte) error {
 	}
 	ch.myWindow -= length
 	ch.windowMu.Unlock()
+	ch.bytesRead.Add(uint64(length))
 
 	if extended == 1 {
 		ch.extPending.write(data)
@@ -340,8 +635,8 @@ func (c *channel) adjustWindow(adj uint32) error {
 	// exceed the initial window setting, we don't worry about overflow.
 	c.myConsumed += adj
 	var sendAdj uint32
-	if (channelWindowSize-c.myWindow > 3*c.maxIncomingPayload) ||
-		(c.myWindow < channelWindowSize/2) {
+	if (c.windowSize-c.myWindow > 3*c.maxIncomingPayload) ||
+		(c.myWindow < c.windowSize/2) {
 		sendAdj = c.myConsumed
 		c.myConsumed = 0
 		c.myWindow += sendAdj
@@ -350,9 +645,13 @@ func (c *channel) adjustWindow(adj uint32) error {
 	if sendAdj == 0 {
 		return nil
 	}
-	return c.sendMessage(windowAdjustMsg{
+	if err := c.sendMessage(windowAdjustMsg{
 		AdditionalBytes: sendAdj,
-	})
+	}); err != nil {
+		return err
+	}
+	c.windowAdjustsSent.Add(1)
+	return nil
 }
 
 func (c *channel) ReadExtended(data []byte, extended uint32) (n int, err error) {
@@ -365,6 +664,10 @@ func (c *channel) ReadExtended(data []byte, extended uint32) (n int, err error)
 		return 0, fmt.Errorf("ssh: extended code %d unimplemented", extended)
 	}
 
+	if extended == 0 && err == io.EOF && c.closeOnEOF.Load() {
+		c.closeOnEOFOnce.Do(func() { c.Close() })
+	}
+
 	if n > 0 {
 		err = c.adjustWindow(uint32(n))
 		// sendWindowAdjust can return io.EOF if the remote
@@ -380,6 +683,13 @@ func (c *channel) ReadExtended(data []byte, extended uint32) (n int, err error)
 }
 
 func (c *channel) close() {
+	c.closeWithError(nil)
+}
+
+// closeWithError is like close, but if err is not nil, writes fail with
+// it instead of io.EOF. Reads still end with io.EOF. It is used when the
+// connection goes away.
+func (c *channel) closeWithError(err error) {
 	c.pending.eof()
 	c.extPending.eof()
 	close(c.msg)
@@ -387,10 +697,13 @@ func (c *channel) close() {
 	c.writeMu.Lock()
 	// This is not necessary for a normal channel teardown, but if
 	// there was another error, it is.
+	if !c.sentClose {
+		c.closeErr = err
+	}
 	c.sentClose = true
 	c.writeMu.Unlock()
 	// Unblock writers.
-	c.remoteWin.close()
+	c.remoteWin.closeWithError(err)
 }
 
 // responseMessageReceived is called when a success or failure message is
@@ -398,15 +711,51 @@ func (c *channel) close() {
 // given channel.
 func (ch *channel) responseMessageReceived() error {
 	if ch.direction == channelInbound {
-		return errors.New("ssh: channel response message received on inbound channel")
+		return ch.mux.protocolError("channel open response received for inbound channel %d", ch.localId)
 	}
 	if ch.decided {
-		return errors.New("ssh: duplicate response received for channel")
+		return ch.mux.protocolError("duplicate channel open response received for channel %d", ch.localId)
 	}
 	ch.decided = true
 	return nil
 }
 
+// deliverOpenResponse passes the peer's response to a channel open to
+// the opener, or, if the opener has abandoned the channel, disposes of it.
+func (ch *channel) deliverOpenResponse(msg interface{}) {
+	ch.openMu.Lock()
+	defer ch.openMu.Unlock()
+	if ch.abandoned {
+		ch.discardOpenResponse(msg)
+		return
+	}
+	ch.msg <- msg
+}
+
+// abandon gives up on an outbound channel whose open is still pending.
+// A response that has already arrived, or that arrives later, is
+// discarded.
+func (ch *channel) abandon() {
+	ch.openMu.Lock()
+	defer ch.openMu.Unlock()
+	ch.abandoned = true
+	select {
+	case msg := <-ch.msg:
+		ch.discardOpenResponse(msg)
+	default:
+	}
+}
+
+// discardOpenResponse disposes of the response to an abandoned channel
+// open. The local ID of a rejected channel has already been released; a
+// confirmed channel is closed, and its ID is released once the peer
+// acknowledges the close.
+func (ch *channel) discardOpenResponse(msg interface{}) {
+	if _, ok := msg.(*channelOpenConfirmMsg); ok {
+		ch.sendMessage(channelCloseMsg{PeersID: ch.remoteId})
+	}
+}
+
 func (ch *channel) handlePacket(packet []byte) error {
 	switch packet[0] {
 	case msgChannelData, msgChannelExtendedData:
@@ -435,7 +784,7 @@ func (ch *channel) handlePacket(packet []byte) error {
 			return err
 		}
 		ch.mux.chanList.remove(msg.PeersID)
-		ch.msg <- msg
+		ch.deliverOpenResponse(msg)
 	case *channelOpenConfirmMsg:
 		if err := ch.responseMessageReceived(); err != nil {
 			return err
@@ -443,44 +792,91 @@ func (ch *channel) handlePacket(packet []byte) error {
 		if msg.MaxPacketSize < minPacketLength || msg.MaxPacketSize > 1<<31 {
 			return fmt.Errorf("ssh: invalid MaxPacketSize %d from peer", msg.MaxPacketSize)
 		}
-		ch.remoteId = msg.MyID
+		ch.mux.chanList.setRemote(ch, msg.MyID)
 		ch.maxRemotePayload = msg.MaxPacketSize
 		ch.remoteWin.add(msg.MyWindow)
-		ch.msg <- msg
+		ch.deliverOpenResponse(msg)
 	case *windowAdjustMsg:
+		ch.windowAdjustsReceived.Add(1)
 		if !ch.remoteWin.add(msg.AdditionalBytes) {
-			return fmt.Errorf("ssh: invalid window update for %d bytes", msg.AdditionalBytes)
+			// A window above 2^32-1 bytes is a protocol violation
+			// (RFC 4254, section 5.2).
+			return ch.mux.protocolError("invalid window update for %d bytes", msg.AdditionalBytes)
 		}
 	case *channelRequestMsg:
-		req := Request{
+		req := &Request{
 			Type:      msg.Request,
 			WantReply: msg.WantReply,
 			Payload:   msg.RequestSpecificData,
 			ch:        ch,
 		}
+		if req.WantReply {
+			ch.replies.add(req)
+		}
 
-		ch.incomingRequests <- &req
+		if req.Type == "env" && ch.mux.acceptEnv != nil && ch.direction == channelInbound && ch.chanType == "session" {
+			return req.Reply(ch.setenv(req.Payload), nil)
+		}
+		if req.Type == "pty-req" && ch.mux.checkPtyRequests && ch.direction == channelInbound && ch.chanType == "session" && !validPtyRequest(req.Payload) {
+			return req.Reply(false, nil)
+		}
+		ch.incomingRequests <- req
+	case *channelRequestSuccessMsg, *channelRequestFailureMsg:
+		ch.deliverRequestReply(msg)
 	default:
 		ch.msg <- msg
 	}
 	return nil
 }
 
+// deliverRequestReply passes the peer's reply to a channel request to
+// the sender, or discards it if the sender has given up waiting for it.
+// Replies arrive in the order of the requests, so the stale ones come
+// first.
+func (ch *channel) deliverRequestReply(msg interface{}) {
+	ch.replyMu.Lock()
+	defer ch.replyMu.Unlock()
+	if ch.staleReplies > 0 {
+		ch.staleReplies--
+		return
+	}
+	ch.msg <- msg
+}
+
+// abandonReply gives up on the reply to the pending channel request. A
+// reply that has already arrived is discarded, and one that arrives
+// later is counted to be discarded on delivery.
+func (ch *channel) abandonReply() {
+	ch.replyMu.Lock()
+	defer ch.replyMu.Unlock()
+	select {
+	case <-ch.msg:
+	default:
+		ch.staleReplies++
+	}
+}
+
+// newChannel creates a channel and assigns it a local ID. It returns nil
+// if the mux already has its maximum number of channels.
 func (m *mux) newChannel(chanType string, direction channelDirection, extraData []byte) *channel {
 	ch := &channel{
 		remoteWin:        window{Cond: newCond()},
 		myWindow:         channelWindowSize,
+		windowSize:       channelWindowSize,
 		pending:          newBuffer(),
 		extPending:       newBuffer(),
 		direction:        direction,
 		incomingRequests: make(chan *Request, chanSize),
 		msg:              make(chan interface{}, chanSize),
+		sentRequest:      make(chan struct{}, 1),
 		chanType:         chanType,
 		extraData:        extraData,
 		mux:              m,
 		packetPool:       make(map[uint32][]byte),
 	}
-	ch.localId = m.chanList.add(ch)
+	if _, ok := m.chanList.add(ch, m.maxChannels); !ok {
+		return nil
+	}
 	return ch
 }
 
@@ -501,10 +897,21 @@ func (e *extChannel) Read(data []byte) (n int, err error) {
 }
 
 func (ch *channel) Accept() (Channel, <-chan *Request, error) {
+	return ch.AcceptWithOptions(ChannelOptions{})
+}
+
+func (ch *channel) AcceptWithOptions(opts ChannelOptions) (Channel, <-chan *Request, error) {
 	if ch.decided {
 		return nil, nil, errDecidedAlready
 	}
-	ch.maxIncomingPayload = channelMaxPacket
+	window, maxPacketSize, err := opts.values()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The peer can't send data before the confirmation, so the window
+	// may be changed without holding windowMu.
+	ch.myWindow, ch.windowSize = window, window
+	ch.maxIncomingPayload = maxPacketSize
 	confirm := channelOpenConfirmMsg{
 		PeersID:       ch.remoteId,
 		MyID:          ch.localId,
@@ -520,6 +927,10 @@ func (ch *channel) Accept() (Channel, <-chan *Request, error) {
 }
 
 func (ch *channel) Reject(reason RejectionReason, message string) error {
+	return ch.RejectWithLang(reason, message, "en")
+}
+
+func (ch *channel) RejectWithLang(reason RejectionReason, message, lang string) error {
 	if ch.decided {
 		return errDecidedAlready
 	}
@@ -527,9 +938,12 @@ func (ch *channel) Reject(reason RejectionReason, message string) error {
 		PeersID:  ch.remoteId,
 		Reason:   reason,
 		Message:  message,
-		Language: "en",
+		Language: lang,
 	}
 	ch.decided = true
+	// The peer never learns the local ID of a rejected channel, so it
+	// can be reused at once.
+	ch.mux.chanList.remove(ch.localId)
 	return ch.sendMessage(reject)
 }
 
@@ -547,6 +961,86 @@ func (ch *channel) Write(data []byte) (int, error) {
 	return ch.WriteExtended(data, 0)
 }
 
+func (ch *channel) SetReadDeadline(t time.Time) error {
+	if !ch.decided {
+		return errUndecided
+	}
+	ch.pending.setDeadline(t)
+	ch.extPending.setDeadline(t)
+	return nil
+}
+
+func (ch *channel) SetWriteDeadline(t time.Time) error {
+	if !ch.decided {
+		return errUndecided
+	}
+	ch.remoteWin.setDeadline(t)
+	return nil
+}
+
+func (ch *channel) CloseGraceful() error {
+	if !ch.decided {
+		return errUndecided
+	}
+	ch.closeOnEOF.Store(true)
+	if !ch.sentEOF {
+		if err := ch.CloseWrite(); err != nil {
+			return err
+		}
+	}
+	// Read may already have returned io.EOF.
+	if ch.pending.drained() {
+		ch.closeOnEOFOnce.Do(func() { ch.Close() })
+	}
+	return nil
+}
+
+// setenv records the variable of an "env" request if the mux accepts
+// it, and reports whether it did.
+func (ch *channel) setenv(payload []byte) bool {
+	var msg setenvRequest
+	if err := Unmarshal(payload, &msg); err != nil || !ch.mux.acceptEnv(msg.Name) {
+		return false
+	}
+	ch.envMu.Lock()
+	defer ch.envMu.Unlock()
+	if ch.env == nil {
+		ch.env = make(map[string]string)
+	}
+	ch.env[msg.Name] = msg.Value
+	return true
+}
+
+// Stats returns the traffic counters of the channel and the current
+// sizes of its flow-control windows.
+func (ch *channel) Stats() ChannelStats {
+	ch.windowMu.Lock()
+	local := ch.myWindow
+	ch.windowMu.Unlock()
+	return ChannelStats{
+		BytesRead:             ch.bytesRead.Load(),
+		BytesWritten:          ch.bytesWritten.Load(),
+		LocalWindow:           local,
+		RemoteWindow:          ch.remoteWin.size(),
+		WindowAdjustsSent:     ch.windowAdjustsSent.Load(),
+		WindowAdjustsReceived: ch.windowAdjustsReceived.Load(),
+	}
+}
+
+// Env returns a copy of the variables recorded by setenv.
+func (ch *channel) Env() map[string]string {
+	ch.envMu.Lock()
+	defer ch.envMu.Unlock()
+	if ch.env == nil {
+		return nil
+	}
+	env := make(map[string]string, len(ch.env))
+	for k, v := range ch.env {
+		env[k] = v
+	}
+	return env
+}
+
 func (ch *channel) CloseWrite() error {
 	if !ch.decided {
 		return errUndecided
@@ -579,13 +1073,24 @@ func (ch *channel) Stderr() io.ReadWriter {
 }
 
 func (ch *channel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return ch.SendRequestContext(context.Background(), name, wantReply, payload)
+}
+
+func (ch *channel) SendRequestContext(ctx context.Context, name string, wantReply bool, payload []byte) (bool, error) {
 	if !ch.decided {
 		return false, errUndecided
 	}
 
 	if wantReply {
-		ch.sentRequestMu.Lock()
-		defer ch.sentRequestMu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		select {
+		case ch.sentRequest <- struct{}{}:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		defer func() { <-ch.sentRequest }()
 	}
 
 	msg := channelRequestMsg{
@@ -600,7 +1105,14 @@ func (ch *channel) SendRequest(name string, wantReply bool, payload []byte) (boo
 	}
 
 	if wantReply {
-		m, ok := (<-ch.msg)
+		var m interface{}
+		var ok bool
+		select {
+		case m, ok = <-ch.msg:
+		case <-ctx.Done():
+			ch.abandonReply()
+			return false, ctx.Err()
+		}
 		if !ok {
 			return false, io.EOF
 		}
@@ -617,8 +1129,9 @@ func (ch *channel) SendRequest(name string, wantReply bool, payload []byte) (boo
 	return false, nil
 }
 
-// ackRequest either sends an ack or nack to the channel request.
-func (ch *channel) ackRequest(ok bool) error {
+// ackRequest either sends an ack or nack to the channel request r, in
+// turn with the replies to the earlier requests.
+func (ch *channel) ackRequest(r *Request, ok bool) error {
 	if !ch.decided {
 		return errUndecided
 	}
@@ -633,7 +1146,7 @@ func (ch *channel) ackRequest(ok bool) error {
 			PeersID: ch.remoteId,
 		}
 	}
-	return ch.sendMessage(msg)
+	return ch.replies.reply(r, msg, ch.sendMessage)
 }
 
 func (ch *channel) ChannelType() string {
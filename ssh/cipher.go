@@ -33,6 +33,11 @@ const (
 	// length fields do not overflow, so it should remain well
 	// below 4G.
 	maxPacket = 256 * 1024
+
+	// maxPacketLimit is the largest packet accepted when
+	// Config.MaxPacketSize allows packets above maxPacket, for peers
+	// that send jumbo packets.
+	maxPacketLimit = 4 * maxPacket
 )
 
 // noneCipher implements cipher.Stream and provides no encryption. It is used
@@ -58,11 +63,11 @@ func newRC4(key, iv []byte) (cipher.Stream, error) {
 type cipherMode struct {
 	keySize int
 	ivSize  int
-	create  func(key, iv []byte, macKey []byte, algs directionAlgorithms) (packetCipher, error)
+	create  func(key, iv []byte, macKey []byte, algs DirectionAlgorithms) (packetCipher, error)
 }
 
-func streamCipherMode(skip int, createFunc func(key, iv []byte) (cipher.Stream, error)) func(key, iv []byte, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
-	return func(key, iv, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
+func streamCipherMode(skip int, createFunc func(key, iv []byte) (cipher.Stream, error)) func(key, iv []byte, macKey []byte, algs DirectionAlgorithms) (packetCipher, error) {
+	return func(key, iv, macKey []byte, algs DirectionAlgorithms) (packetCipher, error) {
 		stream, err := createFunc(key, iv)
 		if err != nil {
 			return nil, err
@@ -114,8 +119,8 @@ var cipherModes = map[string]*cipherMode{
 	"arcfour": {16, 0, streamCipherMode(0, newRC4)},
 
 	// AEAD ciphers
-	gcm128CipherID:     {16, 12, newGCMCipher},
-	gcm256CipherID:     {32, 12, newGCMCipher},
+	gcm128CipherID:     {16, gcmNonceSize, newGCMCipher},
+	gcm256CipherID:     {32, gcmNonceSize, newGCMCipher},
 	chacha20Poly1305ID: {64, 0, newChaCha20Cipher},
 
 	// CBC mode is insecure and so is not included in the default config.
@@ -130,6 +135,81 @@ var cipherModes = map[string]*cipherMode{
 	tripledescbcID: {24, des.BlockSize, newTripleDESCBCCipher},
 }
 
+// A CipherFactory describes an encryption algorithm for RegisterCipher.
+// Exactly one of NewAEAD and NewStream must be set.
+type CipherFactory struct {
+	// KeySize is the length of the key derived for each direction.
+	KeySize int
+
+	// NewAEAD returns an AEAD for key. The packets are framed as with
+	// aes128-gcm@openssh.com (RFC 5647): the packet length is sent in
+	// the clear and authenticated as additional data, and the nonce is
+	// a 12 byte IV derived in the key exchange, whose last 8 bytes are
+	// incremented as a counter after each packet. The AEAD must use 12
+	// byte nonces. No MAC is negotiated for the cipher.
+	NewAEAD func(key []byte) (cipher.AEAD, error)
+
+	// NewStream returns a stream cipher for key and iv, which encrypts
+	// whole packets, including their length, as aes128-ctr does. A MAC
+	// is negotiated separately.
+	NewStream func(key, iv []byte) (cipher.Stream, error)
+
+	// IVSize is the length of the iv passed to NewStream. It is
+	// ignored for AEAD ciphers.
+	IVSize int
+}
+
+// RegisterCipher makes the cipher c available under name, so that it can
+// be negotiated by listing name in Config.Ciphers. It is never used by
+// default. RegisterCipher returns an error if name is not a valid
+// algorithm name, is already taken by a built-in or registered cipher,
+// or if c is incomplete.
+//
+// This is an advanced API: the package does not check the security of
+// the cipher, and a weak or incorrect one compromises the connections
+// that negotiate it. RegisterCipher must be called before the cipher is
+// used, typically from an init function; it is not safe to call
+// concurrently with connections being set up.
+func RegisterCipher(name string, c CipherFactory) error {
+	if !validAlgorithmName(name) {
+		return fmt.Errorf("ssh: invalid cipher name %q", name)
+	}
+	if _, ok := cipherModes[name]; ok {
+		return fmt.Errorf("ssh: cipher %q is already registered", name)
+	}
+	if c.KeySize <= 0 {
+		return fmt.Errorf("ssh: cipher %q has invalid key size %d", name, c.KeySize)
+	}
+	switch {
+	case c.NewAEAD != nil && c.NewStream == nil:
+		cipherModes[name] = &cipherMode{c.KeySize, gcmNonceSize, aeadCipherMode(c.NewAEAD)}
+		aeadCiphers[name] = true
+	case c.NewStream != nil && c.NewAEAD == nil:
+		if c.IVSize < 0 {
+			return fmt.Errorf("ssh: cipher %q has invalid IV size %d", name, c.IVSize)
+		}
+		cipherModes[name] = &cipherMode{c.KeySize, c.IVSize, streamCipherMode(0, c.NewStream)}
+	default:
+		return fmt.Errorf("ssh: cipher %q must set exactly one of NewAEAD and NewStream", name)
+	}
+	return nil
+}
+
+// validAlgorithmName reports whether name can be used as an algorithm
+// name: a non-empty string of at most 64 printable US-ASCII characters,
+// other than comma and space (RFC 4251, section 6).
+func validAlgorithmName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c >= 0x7f || c == ',' {
+			return false
+		}
+	}
+	return true
+}
+
 // prefixLen is the length of the packet prefix that contains the packet length
 // and number of padding bytes.
 const prefixLen = 5
@@ -140,10 +220,13 @@ type streamPacketCipher struct {
 	cipher cipher.Stream
 	etm    bool
 
+	packetPadding
+	packetLimit
+
 	// The following members are to avoid per-packet allocations.
 	prefix      [prefixLen]byte
 	seqNumBytes [4]byte
-	padding     [2 * packetSizeMultiple]byte
+	padding     [maxPaddingLength]byte
 	packetData  []byte
 	macResult   []byte
 }
@@ -183,11 +266,11 @@ func (s *streamPacketCipher) readCipherPacket(seqNum uint32, r io.Reader) ([]byt
 		return nil, errors.New("ssh: invalid packet length, packet too small")
 	}
 
-	if length > maxPacket {
+	if length > s.maxLength() {
 		return nil, errors.New("ssh: invalid packet length, packet too large")
 	}
 
-	// the maxPacket check above ensures that length-1+macSize
+	// the maxLength check above ensures that length-1+macSize
 	// does not overflow.
 	if uint32(cap(s.packetData)) < length-1+macSize {
 		s.packetData = make([]byte, length-1+macSize)
@@ -236,6 +319,7 @@ func (s *streamPacketCipher) writeCipherPacket(seqNum uint32, w io.Writer, rand
 	if paddingLength < 4 {
 		paddingLength += packetSizeMultiple
 	}
+	paddingLength = s.extend(prefixLen+len(packet)-aadlen+paddingLength, paddingLength, packetSizeMultiple)
 
 	length := len(packet) + 1 + paddingLength
 	binary.BigEndian.PutUint32(s.prefix[:], uint32(length))
@@ -300,14 +384,90 @@ func (s *streamPacketCipher) writeCipherPacket(seqNum uint32, w io.Writer, rand
 	return nil
 }
 
+// maxPaddingLength is the most padding a packet can have, as its length
+// is sent in a single byte.
+const maxPaddingLength = 255
+
+// packetPadding implements the padding policy of Config.PadPacketsTo for
+// the packetCiphers that embed it.
+type packetPadding struct {
+	padTo int
+}
+
+func (p *packetPadding) setPadTo(n int) {
+	p.padTo = n
+}
+
+// packetLimit bounds the length of the packets read by the
+// packetCiphers that embed it.
+type packetLimit struct {
+	length uint32
+}
+
+// setMaxPacket allows packets with payloads of up to n bytes, if that is
+// more than maxPacket, see Config.MaxPacketSize.
+func (l *packetLimit) setMaxPacket(n uint32) {
+	if n > maxPacket {
+		l.length = n + 1 + maxPaddingLength
+	}
+}
+
+// maxLength returns the largest packet length field that is read.
+func (l *packetLimit) maxLength() uint32 {
+	if l.length == 0 {
+		return maxPacket
+	}
+	return l.length
+}
+
+// extend returns padding, the padding of a packet whose padded part is
+// length bytes long, increased by a multiple of blockSize so that length
+// becomes a multiple of padTo. The padding stays within
+// maxPaddingLength, and the packet within maxPacket.
+func (p *packetPadding) extend(length, padding, blockSize int) int {
+	if p.padTo <= 0 || length%p.padTo == 0 {
+		return padding
+	}
+	target := (length + p.padTo - 1) / p.padTo * p.padTo
+	extra := (target - length + blockSize - 1) / blockSize * blockSize
+	if limit := (maxPaddingLength - padding) / blockSize * blockSize; extra > limit {
+		extra = limit
+	}
+	if limit := (maxPacket - length) / blockSize * blockSize; extra > limit {
+		extra = limit
+	}
+	if extra < 0 {
+		return padding
+	}
+	return padding + extra
+}
+
+// gcmCipher implements aes128-gcm@openssh.com and aes256-gcm@openssh.com
+// (RFC 5647). The nonce is the 4 byte fixed field of the IV followed by
+// an 8 byte invocation counter, which incIV increments after each packet.
 type gcmCipher struct {
+	packetPadding
+	packetLimit
+
 	aead   cipher.AEAD
 	prefix [4]byte
 	iv     []byte
 	buf    []byte
+
+	// invocations counts the packets processed with this key. Once it
+	// reaches gcmMaxInvocations, every further packet fails.
+	invocations uint64
+	exhausted   bool
 }
 
-func newGCMCipher(key, iv, unusedMacKey []byte, unusedAlgs directionAlgorithms) (packetCipher, error) {
+// gcmMaxInvocations is the number of packets after which a GCM key is
+// no longer used. Key exchanges start at packetRekeyThreshold, half of
+// it, so it is only reached if the peer never completes one.
+const gcmMaxInvocations = 1 << 32
+
+var errGCMInvocationsExhausted = errors.New("ssh: GCM invocation counter exhausted, a key exchange is required")
+
+func newGCMCipher(key, iv, unusedMacKey []byte, unusedAlgs DirectionAlgorithms) (packetCipher, error) {
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -324,15 +484,38 @@ func newGCMCipher(key, iv, unusedMacKey []byte, unusedAlgs directionAlgorithms)
 	}, nil
 }
 
-const gcmTagSize = 16
+const gcmNonceSize = 12
+
+// aeadCipherMode returns the create function of a cipher framed as
+// aes128-gcm@openssh.com, using the AEAD returned by newAEAD.
+func aeadCipherMode(newAEAD func(key []byte) (cipher.AEAD, error)) func(key, iv, macKey []byte, algs DirectionAlgorithms) (packetCipher, error) {
+	return func(key, iv, unusedMacKey []byte, unusedAlgs DirectionAlgorithms) (packetCipher, error) {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if aead.NonceSize() != gcmNonceSize {
+			return nil, fmt.Errorf("ssh: AEAD nonce size is %d, want %d", aead.NonceSize(), gcmNonceSize)
+		}
+		return &gcmCipher{
+			aead: aead,
+			iv:   iv,
+		}, nil
+	}
+}
 
 func (c *gcmCipher) writeCipherPacket(seqNum uint32, w io.Writer, rand io.Reader, packet []byte) error {
+	if c.exhausted {
+		return errGCMInvocationsExhausted
+	}
+
 	// Pad out to multiple of 16 bytes. This is different from the
 	// stream cipher because that encrypts the length too.
-	padding := byte(packetSizeMultiple - (1+len(packet))%packetSizeMultiple)
+	padding := packetSizeMultiple - (1+len(packet))%packetSizeMultiple
 	if padding < 4 {
 		padding += packetSizeMultiple
 	}
+	padding = c.extend(1+len(packet)+padding, padding, packetSizeMultiple)
 
 	length := uint32(len(packet) + int(padding) + 1)
 	binary.BigEndian.PutUint32(c.prefix[:], length)
@@ -346,7 +529,7 @@ func (c *gcmCipher) writeCipherPacket(seqNum uint32, w io.Writer, rand io.Reader
 		c.buf = c.buf[:length]
 	}
 
-	c.buf[0] = padding
+	c.buf[0] = byte(padding)
 	copy(c.buf[1:], packet)
 	if _, err := io.ReadFull(rand, c.buf[1+len(packet):]); err != nil {
 		return err
@@ -361,6 +544,10 @@ func (c *gcmCipher) writeCipherPacket(seqNum uint32, w io.Writer, rand io.Reader
 }
 
 func (c *gcmCipher) incIV() {
+	c.invocations++
+	if c.invocations >= gcmMaxInvocations {
+		c.exhausted = true
+	}
 	for i := 4 + 7; i >= 4; i-- {
 		c.iv[i]++
 		if c.iv[i] != 0 {
@@ -370,18 +557,22 @@ func (c *gcmCipher) incIV() {
 }
 
 func (c *gcmCipher) readCipherPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	if c.exhausted {
+		return nil, errGCMInvocationsExhausted
+	}
 	if _, err := io.ReadFull(r, c.prefix[:]); err != nil {
 		return nil, err
 	}
 	length := binary.BigEndian.Uint32(c.prefix[:])
-	if length > maxPacket {
+	if length > c.maxLength() {
 		return nil, errors.New("ssh: max packet length exceeded")
 	}
 
-	if cap(c.buf) < int(length+gcmTagSize) {
-		c.buf = make([]byte, length+gcmTagSize)
+	tagSize := uint32(c.aead.Overhead())
+	if cap(c.buf) < int(length+tagSize) {
+		c.buf = make([]byte, length+tagSize)
 	} else {
-		c.buf = c.buf[:length+gcmTagSize]
+		c.buf = c.buf[:length+tagSize]
 	}
 
 	if _, err := io.ReadFull(r, c.buf); err != nil {
@@ -414,6 +605,9 @@ func (c *gcmCipher) readCipherPacket(seqNum uint32, r io.Reader) ([]byte, error)
 
 // cbcCipher implements aes128-cbc cipher defined in RFC 4253 section 6.1
 type cbcCipher struct {
+	packetPadding
+	packetLimit
+
 	mac       hash.Hash
 	macSize   uint32
 	decrypter cipher.BlockMode
@@ -429,7 +623,7 @@ type cbcCipher struct {
 	oracleCamouflage uint32
 }
 
-func newCBCCipher(c cipher.Block, key, iv, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
+func newCBCCipher(c cipher.Block, key, iv, macKey []byte, algs DirectionAlgorithms) (packetCipher, error) {
 	cbc := &cbcCipher{
 		mac:        macModes[algs.MAC].new(macKey),
 		decrypter:  cipher.NewCBCDecrypter(c, iv),
@@ -443,7 +637,7 @@ func newCBCCipher(c cipher.Block, key, iv, macKey []byte, algs directionAlgorith
 	return cbc, nil
 }
 
-func newAESCBCCipher(key, iv, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
+func newAESCBCCipher(key, iv, macKey []byte, algs DirectionAlgorithms) (packetCipher, error) {
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -457,7 +651,7 @@ func newAESCBCCipher(key, iv, macKey []byte, algs directionAlgorithms) (packetCi
 	return cbc, nil
 }
 
-func newTripleDESCBCCipher(key, iv, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
+func newTripleDESCBCCipher(key, iv, macKey []byte, algs DirectionAlgorithms) (packetCipher, error) {
 	c, err := des.NewTripleDESCipher(key)
 	if err != nil {
 		return nil, err
@@ -515,11 +709,11 @@ func (c *cbcCipher) readCipherPacketLeaky(seqNum uint32, r io.Reader) ([]byte, e
 		return nil, err
 	}
 
-	c.oracleCamouflage = maxPacket + 4 + c.macSize - firstBlockLength
+	c.oracleCamouflage = c.maxLength() + 4 + c.macSize - firstBlockLength
 
 	c.decrypter.CryptBlocks(firstBlock, firstBlock)
 	length := binary.BigEndian.Uint32(firstBlock[:4])
-	if length > maxPacket {
+	if length > c.maxLength() {
 		return nil, cbcError("ssh: packet too large")
 	}
 	if length+4 < maxUInt32(cbcMinPacketSize, blockSize) {
@@ -590,6 +784,11 @@ func (c *cbcCipher) writeCipherPacket(seqNum uint32, w io.Writer, rand io.Reader
 
 	length := encLength - 4
 	paddingLength := int(length) - (1 + len(packet))
+	if extended := c.extend(int(encLength), paddingLength, int(effectiveBlockSize)); extended != paddingLength {
+		encLength += uint32(extended - paddingLength)
+		length = encLength - 4
+		paddingLength = extended
+	}
 
 	// Overall buffer contains: header, payload, padding, mac.
 	// Space for the MAC is reserved in the capacity but not the slice length.
@@ -645,12 +844,15 @@ const chacha20Poly1305ID = "chacha20-poly1305@openssh.com"
 // the methods here also implement padding, which RFC 4253 Section 6
 // also requires of stream ciphers.
 type chacha20Poly1305Cipher struct {
+	packetPadding
+	packetLimit
+
 	lengthKey  [32]byte
 	contentKey [32]byte
 	buf        []byte
 }
 
-func newChaCha20Cipher(key, unusedIV, unusedMACKey []byte, unusedAlgs directionAlgorithms) (packetCipher, error) {
+func newChaCha20Cipher(key, unusedIV, unusedMACKey []byte, unusedAlgs DirectionAlgorithms) (packetCipher, error) {
 	if len(key) != 64 {
 		panic(len(key))
 	}
@@ -688,7 +890,7 @@ func (c *chacha20Poly1305Cipher) readCipherPacket(seqNum uint32, r io.Reader) ([
 	ls.XORKeyStream(lenBytes[:], encryptedLength)
 
 	length := binary.BigEndian.Uint32(lenBytes[:])
-	if length > maxPacket {
+	if length > c.maxLength() {
 		return nil, errors.New("ssh: invalid packet length, packet too large")
 	}
 
@@ -753,6 +955,7 @@ func (c *chacha20Poly1305Cipher) writeCipherPacket(seqNum uint32, w io.Writer, r
 	if padding < 4 {
 		padding += packetSizeMultiple
 	}
+	padding = c.extend(1+len(payload)+padding, padding, packetSizeMultiple)
 
 	// size (4 bytes), padding (1), payload, padding, tag.
 	totalLength := 4 + 1 + len(payload) + padding + poly1305.TagSize
@@ -7,12 +7,17 @@ package ssh
 import (
 	"bytes"
 	"crypto"
+	"crypto/aes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"hash"
 	"io"
 	"testing"
 
 	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/internal/poly1305"
 )
 
@@ -42,9 +47,54 @@ func TestPacketCiphers(t *testing.T) {
 	}
 }
 
+func TestPacketCipherPadTo(t *testing.T) {
+	kr := &kexResult{Hash: crypto.SHA1}
+	for cipher := range cipherModes {
+		algs := DirectionAlgorithms{
+			Cipher:      cipher,
+			MAC:         "hmac-sha2-256",
+			Compression: "none",
+		}
+		client, err := newPacketCipher(clientKeys, algs, kr)
+		if err != nil {
+			t.Fatalf("newPacketCipher(client, %q): %v", cipher, err)
+		}
+		server, err := newPacketCipher(clientKeys, algs, kr)
+		if err != nil {
+			t.Fatalf("newPacketCipher(server, %q): %v", cipher, err)
+		}
+		client.setPadTo(64)
+
+		// Short packets all have the same length on the wire, and long
+		// ones are still limited to 255 bytes of padding.
+		wireLen := -1
+		for seq, n := range []int{1, 7, 16, 33, 40, 2000} {
+			want := bytes.Repeat([]byte{'x'}, n)
+			input := append([]byte(nil), want...)
+			buf := &bytes.Buffer{}
+			if err := client.writeCipherPacket(uint32(seq), buf, rand.Reader, input); err != nil {
+				t.Fatalf("%s: writeCipherPacket(%d bytes): %v", cipher, n, err)
+			}
+			if n <= 40 {
+				if wireLen >= 0 && buf.Len() != wireLen {
+					t.Errorf("%s: %d byte packet is %d bytes on the wire, want %d", cipher, n, buf.Len(), wireLen)
+				}
+				wireLen = buf.Len()
+			}
+			packet, err := server.readCipherPacket(uint32(seq), buf)
+			if err != nil {
+				t.Fatalf("%s: readCipherPacket(%d bytes): %v", cipher, n, err)
+			}
+			if !bytes.Equal(packet, want) {
+				t.Errorf("%s: roundtrip of %d bytes: got %d bytes back", cipher, n, len(packet))
+			}
+		}
+	}
+}
+
 func testPacketCipher(t *testing.T, cipher, mac string) {
 	kr := &kexResult{Hash: crypto.SHA1}
-	algs := directionAlgorithms{
+	algs := DirectionAlgorithms{
 		Cipher:      cipher,
 		MAC:         mac,
 		Compression: "none",
@@ -75,9 +125,40 @@ func testPacketCipher(t *testing.T, cipher, mac string) {
 	}
 }
 
+func TestGCMInvocationCounterExhausted(t *testing.T) {
+	kr := &kexResult{Hash: crypto.SHA1}
+	algs := DirectionAlgorithms{Cipher: gcm256CipherID, Compression: "none"}
+	client, err := newPacketCipher(clientKeys, algs, kr)
+	if err != nil {
+		t.Fatalf("newPacketCipher: %v", err)
+	}
+	server, err := newPacketCipher(clientKeys, algs, kr)
+	if err != nil {
+		t.Fatalf("newPacketCipher: %v", err)
+	}
+
+	// Pretend that all but one of the allowed packets have been sent.
+	client.(*gcmCipher).invocations = gcmMaxInvocations - 1
+	server.(*gcmCipher).invocations = gcmMaxInvocations - 1
+
+	buf := &bytes.Buffer{}
+	if err := client.writeCipherPacket(0, buf, rand.Reader, []byte("last")); err != nil {
+		t.Fatalf("writeCipherPacket: %v", err)
+	}
+	if _, err := server.readCipherPacket(0, buf); err != nil {
+		t.Fatalf("readCipherPacket: %v", err)
+	}
+	if err := client.writeCipherPacket(0, buf, rand.Reader, []byte("one too many")); err != errGCMInvocationsExhausted {
+		t.Errorf("writeCipherPacket: got %v, want %v", err, errGCMInvocationsExhausted)
+	}
+	if _, err := server.readCipherPacket(0, buf); err != errGCMInvocationsExhausted {
+		t.Errorf("readCipherPacket: got %v, want %v", err, errGCMInvocationsExhausted)
+	}
+}
+
 func TestCBCOracleCounterMeasure(t *testing.T) {
 	kr := &kexResult{Hash: crypto.SHA1}
-	algs := directionAlgorithms{
+	algs := DirectionAlgorithms{
 		Cipher:      aes128cbcID,
 		MAC:         "hmac-sha1",
 		Compression: "none",
@@ -204,7 +285,7 @@ func TestCVE202143565(t *testing.T) {
 		mac := "hmac-sha2-256"
 
 		kr := &kexResult{Hash: crypto.SHA1}
-		algs := directionAlgorithms{
+		algs := DirectionAlgorithms{
 			Cipher:      tc.cipher,
 			MAC:         mac,
 			Compression: "none",
@@ -229,3 +310,114 @@ func TestCVE202143565(t *testing.T) {
 		}
 	}
 }
+
+const (
+	testAEADCipher   = "chacha20-poly1305-test@example.com"
+	testStreamCipher = "aes128-ctr-test@example.com"
+	testMAC          = "hmac-sha2-256-test@example.com"
+)
+
+// The algorithms are registered once, so that the tests below, and the
+// ones ranging over cipherModes and macModes, can be run repeatedly.
+func init() {
+	if err := RegisterCipher(testAEADCipher, CipherFactory{
+		KeySize: chacha20poly1305.KeySize,
+		NewAEAD: chacha20poly1305.New,
+	}); err != nil {
+		panic(err)
+	}
+	if err := RegisterCipher(testStreamCipher, CipherFactory{
+		KeySize:   16,
+		IVSize:    aes.BlockSize,
+		NewStream: newAESCTR,
+	}); err != nil {
+		panic(err)
+	}
+	if err := RegisterMAC(testMAC, MACFactory{
+		KeySize:        32,
+		EncryptThenMAC: true,
+		New:            func(key []byte) hash.Hash { return hmac.New(sha256.New, key) },
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisteredAlgorithms(t *testing.T) {
+	for _, tt := range []struct {
+		cipher, mac string
+	}{
+		{testAEADCipher, ""},
+		{testStreamCipher, testMAC},
+	} {
+		t.Run(tt.cipher, func(t *testing.T) {
+			config := Config{Ciphers: []string{tt.cipher}, MACs: []string{testMAC}}
+			serverConf := &ServerConfig{Config: config, NoClientAuth: true}
+			serverConf.AddHostKey(testSigners["ecdsa"])
+			client, server, _, reqs, err := NewPipeClientServer(&ClientConfig{
+				Config:          config,
+				User:            "user",
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			}, serverConf)
+			if err != nil {
+				t.Fatalf("NewPipeClientServer: %v", err)
+			}
+			defer client.Close()
+			defer server.Close()
+			go DiscardRequests(reqs)
+
+			algs := client.Conn.(AlgorithmsConnMetadata).Algorithms()
+			for _, dir := range []DirectionAlgorithms{algs.Read, algs.Write} {
+				if dir.Cipher != tt.cipher || dir.MAC != tt.mac {
+					t.Errorf("negotiated %q/%q, want %q/%q", dir.Cipher, dir.MAC, tt.cipher, tt.mac)
+				}
+			}
+			// Packets flow both ways with the registered algorithms.
+			if _, _, err := client.SendRequest("ping", true, nil); err != nil {
+				t.Errorf("SendRequest: %v", err)
+			}
+		})
+	}
+
+	// The registered algorithms are not used by default.
+	var config Config
+	config.SetDefaults()
+	for _, c := range append(config.Ciphers, config.MACs...) {
+		if c == testAEADCipher || c == testStreamCipher || c == testMAC {
+			t.Errorf("%q is enabled by default", c)
+		}
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	stream := CipherFactory{KeySize: 16, IVSize: 16, NewStream: newAESCTR}
+	for _, tt := range []struct {
+		name string
+		c    CipherFactory
+	}{
+		{gcm128CipherID, CipherFactory{KeySize: 16, NewAEAD: chacha20poly1305.New}},
+		{testAEADCipher, stream},
+		{"", stream},
+		{"a,b", stream},
+		{"with space", stream},
+		{"nokey@example.com", CipherFactory{NewStream: newAESCTR}},
+		{"none@example.com", CipherFactory{KeySize: 16}},
+		{"both@example.com", CipherFactory{KeySize: 16, NewStream: newAESCTR, NewAEAD: chacha20poly1305.New}},
+	} {
+		if err := RegisterCipher(tt.name, tt.c); err == nil {
+			t.Errorf("RegisterCipher(%q) succeeded", tt.name)
+		}
+	}
+	if _, ok := cipherModes["both@example.com"]; ok {
+		t.Error("rejected cipher was registered")
+	}
+
+	mac := MACFactory{KeySize: 32, New: func(key []byte) hash.Hash { return hmac.New(sha256.New, key) }}
+	for _, name := range []string{"hmac-sha2-256", testMAC, ""} {
+		if err := RegisterMAC(name, mac); err == nil {
+			t.Errorf("RegisterMAC(%q) succeeded", name)
+		}
+	}
+	if err := RegisterMAC("nonew@example.com", MACFactory{KeySize: 32}); err == nil {
+		t.Error("RegisterMAC without New succeeded")
+	}
+}
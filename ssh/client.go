@@ -6,11 +6,13 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,11 +26,24 @@ type Client struct {
 	forwards        forwardList // forwarded tcpip connections from the remote side
 	mu              sync.Mutex
 	channelHandlers map[string]chan NewChannel
+
+	// agentForwarding counts the agent forwarding requests of this
+	// client's sessions that are pending or were accepted.
+	agentForwarding atomic.Int32
 }
 
+const (
+	agentForwardRequest = "auth-agent-req@openssh.com"
+	agentChannelType    = "auth-agent@openssh.com"
+)
+
 // HandleChannelOpen returns a channel on which NewChannel requests
 // for the given type are sent. If the type already is being handled,
 // nil is returned. The channel is closed when the connection is closed.
+//
+// Requests for "auth-agent@openssh.com" channels are rejected, like
+// OpenSSH does, until a session of the client has requested agent
+// forwarding with "auth-agent-req@openssh.com".
 func (c *Client) HandleChannelOpen(channelType string) <-chan NewChannel {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -65,6 +80,34 @@ func NewClient(c Conn, chans <-chan NewChannel, reqs <-chan *Request) *Client {
 	return conn
 }
 
+// hostKeyAlgorithms returns the host key algorithms the client offers.
+func (c *ClientConfig) hostKeyAlgorithms() []string {
+	if len(c.HostKeyAlgorithms) == 0 {
+		return supportedHostKeyAlgos
+	}
+	var algos []string
+	for _, algo := range c.HostKeyAlgorithms {
+		if algo != "" && !contains(algos, algo) {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// hostKeyCallback returns the callback that verifies the server's host
+// key, passing host certificates to CertHostKeyCallback if it is set.
+func (c *ClientConfig) hostKeyCallback() HostKeyCallback {
+	if c.CertHostKeyCallback == nil {
+		return c.HostKeyCallback
+	}
+	return func(hostname string, remote net.Addr, key PublicKey) error {
+		if cert, ok := key.(*Certificate); ok {
+			return c.CertHostKeyCallback(hostname, remote, cert, cert.Key)
+		}
+		return c.HostKeyCallback(hostname, remote, key)
+	}
+}
+
 // NewClientConn establishes an authenticated SSH connection using c
 // as the underlying transport.  The Request and NewChannel channels
 // must be serviced or the connection will hang.
@@ -75,6 +118,18 @@ func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan
 		c.Close()
 		return nil, nil, nil, errors.New("ssh: must specify HostKeyCallback")
 	}
+	if len(fullConf.HostKeyAlgorithms) > 0 && len(fullConf.hostKeyAlgorithms()) == 0 {
+		c.Close()
+		return nil, nil, nil, errors.New("ssh: HostKeyAlgorithms contains only empty strings")
+	}
+	if fullConf.ClientVersion != "" {
+		if err := validateVersion(fullConf.ClientVersion); err != nil {
+			c.Close()
+			return nil, nil, nil, fmt.Errorf("ssh: invalid ClientVersion: %v", err)
+		}
+	}
+
+	fullConf.setTCPOptions(c)
 
 	conn := &connection{
 		sshConn: sshConn{conn: c, user: fullConf.User},
@@ -84,10 +139,78 @@ func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan
 		c.Close()
 		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %w", err)
 	}
-	conn.mux = newMux(conn.transport)
+	var handleRequest func(*Request) bool
+	if cb := fullConf.HostKeysCallback; cb != nil {
+		logger := fullConf.Logger
+		handleRequest = func(r *Request) bool {
+			if r.Type != hostKeysRequest {
+				return false
+			}
+			keys := parseHostKeys(r.Payload)
+			r.Reply(len(keys) > 0, nil)
+			if len(keys) > 0 {
+				go func() {
+					if err := cb(keys); err != nil && logger != nil {
+						logger.Log(LogInfo, "host keys callback failed", "err", err)
+					}
+				}()
+			}
+			return true
+		}
+	}
+	conn.mux = newMuxWithOptions(conn.muxConn(&fullConf.Config), muxOptions{
+		handleRequest:      handleRequest,
+		unhandledRequest:   fullConf.unhandledGlobalRequest(),
+		maxChannels:        fullConf.MaxChannels,
+		maxPendingRequests: fullConf.maxPendingGlobalRequests(),
+		logger:             fullConf.Logger,
+	})
+	if fullConf.IdleTimeout > 0 {
+		go conn.idleTimeout(fullConf.IdleTimeout)
+	}
+	if fullConf.KeepAliveInterval > 0 {
+		go conn.keepAlive(fullConf.KeepAliveInterval, fullConf.KeepAliveCountMax, fullConf.KeepAliveCallback)
+	}
+	if fullConf.ObfuscationInterval > 0 {
+		go conn.sendIgnores(fullConf.ObfuscationInterval, fullConf.Rand)
+	}
 	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
 }
 
+// NewClientConnContext is like NewClientConn, but the handshake and
+// authentication are aborted if ctx is done before they complete. In that
+// case c is closed and the returned error wraps ctx.Err().
+func NewClientConnContext(ctx context.Context, c net.Conn, addr string, config *ClientConfig) (Conn, <-chan NewChannel, <-chan *Request, error) {
+	if ctx.Done() == nil {
+		return NewClientConn(c, addr, config)
+	}
+	if err := ctx.Err(); err != nil {
+		c.Close()
+		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %w", err)
+	}
+
+	stop := make(chan struct{})
+	cancelled := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Closing the connection unblocks any pending read or
+			// write in the handshake.
+			c.Close()
+			cancelled <- ctx.Err()
+		case <-stop:
+			cancelled <- nil
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c, addr, config)
+	close(stop)
+	if ctxErr := <-cancelled; ctxErr != nil {
+		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %w", ctxErr)
+	}
+	return conn, chans, reqs, err
+}
+
 // clientHandshake performs the client side key exchange. See RFC 4253 Section
 // 7.
 func (c *connection) clientHandshake(dialAddress string, config *ClientConfig) error {
@@ -96,20 +219,28 @@ func (c *connection) clientHandshake(dialAddress string, config *ClientConfig) e
 	} else {
 		c.clientVersion = []byte(packageVersion)
 	}
+	timer := startHandshakeTimer(c.sshConn.conn, config.HandshakeTimeout)
 	var err error
 	c.serverVersion, err = exchangeVersions(c.sshConn.conn, c.clientVersion)
 	if err != nil {
-		return err
+		return timer.stop(err)
 	}
 
-	c.transport = newClientTransport(
-		newTransport(c.sshConn.conn, config.Rand, true /* is client */),
-		c.clientVersion, c.serverVersion, config, dialAddress, c.sshConn.RemoteAddr())
-	if err := c.transport.waitSession(); err != nil {
+	tr := newTransport(c.sshConn.conn, config.Rand, true /* is client */)
+	tr.debugCallback = config.DebugCallback
+	tr.reader.maxPacket = config.maxPacketSize()
+	tr.writer.padTo = config.PadPacketsTo
+	if config.UnimplementedCallback != nil {
+		tr.unimplementedCallback = config.UnimplementedCallback
+		tr.sent = new(sentTypes)
+	}
+	c.transport = newClientTransport(tr, c.clientVersion, c.serverVersion, config, dialAddress, c.sshConn.RemoteAddr())
+	if err := timer.stop(c.transport.waitSession()); err != nil {
 		return err
 	}
 
 	c.sessionID = c.transport.getSessionID()
+	c.sessionHash = c.transport.getSessionHash()
 	return c.clientAuthenticate(config)
 }
 
@@ -135,7 +266,22 @@ func (c *Client) NewSession() (*Session, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newSession(ch, in)
+	s, err := newSession(ch, in)
+	if err != nil {
+		return nil, err
+	}
+	s.client = c
+	return s, nil
+}
+
+// SendNoMoreSessions sends the no-more-sessions@openssh.com global
+// request, telling the server to refuse any further session channels on
+// this connection. Sessions that are already open, and channels of other
+// types such as port forwardings, are not affected. Servers that do not
+// implement the extension ignore the request.
+func (c *Client) SendNoMoreSessions() error {
+	_, _, err := c.SendRequest(noMoreSessionsRequest, false, nil)
+	return err
 }
 
 func (c *Client) handleGlobalRequests(incoming <-chan *Request) {
@@ -153,7 +299,9 @@ func (c *Client) handleChannelOpens(in <-chan NewChannel) {
 		handler := c.channelHandlers[ch.ChannelType()]
 		c.mu.Unlock()
 
-		if handler != nil {
+		if ch.ChannelType() == agentChannelType && handler != nil && c.agentForwarding.Load() == 0 {
+			ch.Reject(Prohibited, "agent forwarding not requested")
+		} else if handler != nil {
 			handler <- ch
 		} else {
 			ch.Reject(UnknownChannelType, fmt.Sprintf("unknown channel type: %v", ch.ChannelType()))
@@ -174,11 +322,20 @@ func (c *Client) handleChannelOpens(in <-chan NewChannel) {
 // to incoming channels and requests, use net.Dial with NewClientConn
 // instead.
 func Dial(network, addr string, config *ClientConfig) (*Client, error) {
-	conn, err := net.DialTimeout(network, addr, config.Timeout)
+	return DialContext(context.Background(), network, addr, config)
+}
+
+// DialContext is like Dial, but ctx bounds name resolution, the network
+// connection, the SSH handshake and authentication. If config.Timeout is
+// non-zero, it still limits the time taken to establish the network
+// connection.
+func DialContext(ctx context.Context, network, addr string, config *ClientConfig) (*Client, error) {
+	d := net.Dialer{Timeout: config.Timeout}
+	conn, err := d.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	c, chans, reqs, err := NewClientConn(conn, addr, config)
+	c, chans, reqs, err := NewClientConnContext(ctx, conn, addr, config)
 	if err != nil {
 		return nil, err
 	}
@@ -192,6 +349,22 @@ func Dial(network, addr string, config *ClientConfig) (*Client, error) {
 // net.Conn underlying the SSH connection.
 type HostKeyCallback func(hostname string, remote net.Addr, key PublicKey) error
 
+// CertHostKeyCallback is the function type used for verifying server
+// host certificates. It receives the same hostname and remote address as
+// a HostKeyCallback, the certificate presented by the server, and rawKey,
+// the host key it certifies. Its signature has been verified against
+// cert.Key, but nothing else about it has been checked: the callback must
+// check its type, validity period, principals and signing authority, for
+// example with CertChecker.CheckCert.
+type CertHostKeyCallback func(hostname string, remote net.Addr, cert *Certificate, rawKey PublicKey) error
+
+// HostKeyAlgorithmCallback is the function type used for checking the
+// host key algorithm negotiated in a key exchange. It receives the same
+// hostname and remote address as a HostKeyCallback, the algorithm, one
+// of the KeyAlgo or CertAlgo constants such as KeyAlgoRSASHA512 or
+// KeyAlgoRSA, and the host key or certificate the server presented.
+type HostKeyAlgorithmCallback func(hostname string, remote net.Addr, algorithm string, key PublicKey) error
+
 // BannerCallback is the function type used for treat the banner sent by
 // the server. A BannerCallback receives the message sent by the remote server.
 type BannerCallback func(message string) error
@@ -218,14 +391,35 @@ type ClientConfig struct {
 	// FixedHostKey can be used for simplistic host key checks.
 	HostKeyCallback HostKeyCallback
 
+	// CertHostKeyCallback, if not nil, is called instead of
+	// HostKeyCallback when the server presents a host certificate.
+	// HostKeyCallback is still required, and still verifies plain host
+	// keys.
+	CertHostKeyCallback CertHostKeyCallback
+
+	// HostKeyAlgorithmCallback, if not nil, is called in every key
+	// exchange once the server's signature has been verified, before
+	// HostKeyCallback or CertHostKeyCallback. If it returns an error,
+	// the key exchange fails with that error. It can be used to refuse
+	// SHA-1 signatures ("ssh-rsa") even for keys that HostKeyCallback
+	// would accept.
+	HostKeyAlgorithmCallback HostKeyAlgorithmCallback
+
 	// BannerCallback is called during the SSH dance to display a custom
 	// server's message. The client configuration can supply this callback to
 	// handle it as wished. The function BannerDisplayStderr can be used for
-	// simplistic display on Stderr.
+	// simplistic display on Stderr. It is called for each banner the server
+	// sends during authentication; if it returns an error, authentication
+	// is aborted and the connection fails with that error. If nil, banners
+	// are ignored.
 	BannerCallback BannerCallback
 
 	// ClientVersion contains the version identification string that will
 	// be used for the connection. If empty, a reasonable default is used.
+	// It must start with "SSH-2.0-" and consist of printable US-ASCII
+	// characters, with no whitespace before an optional comment that
+	// follows a single space (RFC 4253, section 4.2); otherwise
+	// NewClientConn fails without sending it.
 	ClientVersion string
 
 	// HostKeyAlgorithms lists the public key algorithms that the client will
@@ -233,12 +427,63 @@ type ClientConfig struct {
 	// preference. If empty, a reasonable default is used. Any
 	// string returned from a PublicKey.Type method may be used, or
 	// any of the CertAlgo and KeyAlgo constants.
+	//
+	// The list is offered to the server as given, without empty strings
+	// and duplicates, and nothing is added to it: in particular, RSA host
+	// keys are accepted with SHA-1 signatures only if KeyAlgoRSA (or
+	// CertAlgoRSAv01 for certificates) is listed. If the server supports
+	// none of the algorithms, the handshake fails with an error listing
+	// both sides' algorithms.
 	HostKeyAlgorithms []string
 
-	// Timeout is the maximum amount of time for the TCP connection to establish.
+	// Timeout is the maximum amount of time for the TCP connection to
+	// establish. See Config.HandshakeTimeout for the SSH handshake.
 	//
 	// A Timeout of zero means no timeout.
 	Timeout time.Duration
+
+	// HostKeysCallback, if not nil, is called with the host keys the
+	// server advertises in a "hostkeys-00@openssh.com" global request,
+	// which OpenSSH servers send after authentication so that clients
+	// can learn about added or rotated host keys. Keys of unknown
+	// types are skipped. The request is then not passed on to the
+	// application. The callback runs in its own goroutine, so it may
+	// use the connection; an error it returns is only logged to
+	// Config.Logger.
+	//
+	// The keys are not yet proven to belong to the server. Before
+	// recording new keys, OpenSSH sends a
+	// "hostkeys-prove-00@openssh.com" global request, wanting a reply,
+	// whose payload is the wire encoding of each key to prove as a
+	// string. The server replies with one signature per key, in order,
+	// each a string holding a Signature in wire format over the string
+	// "hostkeys-prove-00@openssh.com", the session ID and the key, each
+	// encoded as a string. RSA keys are signed with rsa-sha2-512 or
+	// rsa-sha2-256 if the session's host key algorithm was one of
+	// those.
+	HostKeysCallback func(keys []PublicKey) error
+}
+
+// hostKeysRequest is the global request OpenSSH servers use to
+// advertise their host keys.
+const hostKeysRequest = "hostkeys-00@openssh.com"
+
+// parseHostKeys parses the payload of a hostkeys-00@openssh.com
+// request, a sequence of strings each holding a public key. Keys that
+// cannot be parsed are skipped, and a malformed payload yields no keys.
+func parseHostKeys(payload []byte) []PublicKey {
+	var keys []PublicKey
+	for len(payload) > 0 {
+		blob, rest, ok := parseString(payload)
+		if !ok {
+			return nil
+		}
+		payload = rest
+		if key, err := ParsePublicKey(blob); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
 
 // InsecureIgnoreHostKey returns a function that can be used for
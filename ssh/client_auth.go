@@ -20,6 +20,18 @@ const (
 	authSuccess
 )
 
+func (r authResult) String() string {
+	switch r {
+	case authFailure:
+		return "failure"
+	case authPartialSuccess:
+		return "partial success"
+	case authSuccess:
+		return "success"
+	}
+	return fmt.Sprintf("authResult(%d)", int(r))
+}
+
 // clientAuthenticate authenticates with the remote server. See RFC 4252.
 func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	// initiate user auth session
@@ -34,7 +46,14 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	// advertised willingness to receive one, which we always do) or not. See
 	// RFC 8308, Section 2.4.
 	extensions := make(map[string][]byte)
-	if len(packet) > 0 && packet[0] == msgExtInfo {
+	if len(packet) > 0 && packet[0] == msgExtInfo && config.DisableExtInfo {
+		// We didn't ask for extensions, so a server sending them anyway
+		// doesn't get to influence authentication.
+		packet, err = c.transport.readPacket()
+		if err != nil {
+			return err
+		}
+	} else if len(packet) > 0 && packet[0] == msgExtInfo {
 		var extInfo extInfoMsg
 		if err := Unmarshal(packet, &extInfo); err != nil {
 			return err
@@ -57,6 +76,9 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 			return err
 		}
 	}
+	if algs, ok := extensions["server-sig-algs"]; ok {
+		c.serverSigAlgs = strings.Split(string(algs), ",")
+	}
 	var serviceAccept serviceAcceptMsg
 	if err := Unmarshal(packet, &serviceAccept); err != nil {
 		return err
@@ -66,22 +88,42 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	// then any untried methods suggested by the server.
 	var tried []string
 	var lastMethods []string
+	authErr := &AuthError{}
 
 	sessionID := c.transport.getSessionID()
 	for auth := AuthMethod(new(noneAuth)); auth != nil; {
 		ok, methods, err := auth.auth(sessionID, config.User, c.transport, config.Rand, extensions)
 		if err != nil {
 			// On disconnect, return error immediately
-			if _, ok := err.(*disconnectMsg); ok {
+			if _, ok := err.(*DisconnectError); ok {
 				return err
 			}
+			var bannerErr *bannerCallbackError
+			if errors.As(err, &bannerErr) {
+				return bannerErr.err
+			}
 			// We return the error later if there is no other method left to
 			// try.
 			ok = authFailure
 		}
+		if l := config.Logger; l != nil {
+			l.Log(LogInfo, "authentication attempt", "user", config.User, "method", auth.method(), "result", ok.String(), "err", err)
+		}
 		if ok == authSuccess {
 			// success
 			return nil
+		}
+		authErr.Attempts = append(authErr.Attempts, AuthAttempt{
+			Method:         auth.method(),
+			PartialSuccess: ok == authPartialSuccess,
+			Methods:        methods,
+			Err:            err,
+		})
+		if ok == authPartialSuccess {
+			// The server accepted this method but requires more; the
+			// methods it lists are the ones that can complete the
+			// authentication.
+			authErr.PartialSuccess = true
 		} else if ok == authFailure {
 			if m := auth.method(); !contains(tried, m) {
 				tried = append(tried, m)
@@ -91,6 +133,7 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 			methods = lastMethods
 		}
 		lastMethods = methods
+		authErr.Methods = methods
 
 		auth = nil
 
@@ -108,13 +151,80 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 			}
 		}
 
-		if auth == nil && err != nil {
-			// We have an error and there are no other authentication methods to
-			// try, so we return it.
-			return err
+	}
+	return authErr
+}
+
+// AuthAttempt describes one attempt at an authentication method.
+type AuthAttempt struct {
+	// Method is the RFC 4252 name of the method.
+	Method string
+
+	// PartialSuccess is the partial success flag of the server's last
+	// reply to the method.
+	PartialSuccess bool
+
+	// Methods lists the methods that the server's last reply to the
+	// method said can continue the authentication, or is nil if the
+	// method stopped before a reply.
+	Methods []string
+
+	// Err is the error that stopped the method, if it failed other than
+	// by the server rejecting it.
+	Err error
+}
+
+// An AuthError is returned, wrapped, by NewClientConn and Dial when the
+// client runs out of authentication methods to try.
+//
+// To find out which methods a server accepts before prompting the user,
+// connect with an empty ClientConfig.Auth. If the server accepts the
+// "none" method, the connection succeeds. Otherwise the returned error
+// wraps an *AuthError whose first attempt is "none", and the Methods of
+// that attempt are the methods the server offers.
+type AuthError struct {
+	// Attempts lists the methods attempted, in order, starting with
+	// "none". A RetryableAuthMethod appears once.
+	Attempts []AuthAttempt
+
+	// PartialSuccess reports whether the server accepted a method but
+	// required further authentication.
+	PartialSuccess bool
+
+	// Methods lists the methods that the server last said can continue
+	// the authentication.
+	Methods []string
+}
+
+// Error returns the error of the last attempt if it stopped with one,
+// for compatibility with earlier versions, and a summary of the attempted
+// methods otherwise.
+func (e *AuthError) Error() string {
+	if n := len(e.Attempts); n > 0 && e.Attempts[n-1].Err != nil {
+		return e.Attempts[n-1].Err.Error()
+	}
+	var methods []string
+	for _, a := range e.Attempts {
+		if !contains(methods, a.Method) {
+			methods = append(methods, a.Method)
 		}
 	}
-	return fmt.Errorf("ssh: unable to authenticate, attempted methods %v, no supported methods remain", tried)
+	msg := fmt.Sprintf("ssh: unable to authenticate, attempted methods %v, no supported methods remain", methods)
+	if e.PartialSuccess {
+		msg += fmt.Sprintf("; partial success, server still accepts %v", e.Methods)
+	}
+	return msg
+}
+
+// Unwrap returns the errors that stopped the attempted methods.
+func (e *AuthError) Unwrap() []error {
+	var errs []error
+	for _, a := range e.Attempts {
+		if a.Err != nil {
+			errs = append(errs, a.Err)
+		}
+	}
+	return errs
 }
 
 func contains(list []string, e string) bool {
@@ -311,6 +421,9 @@ func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand
 	}
 	var methods []string
 	var errSigAlgo error
+	// partial records a partial success from an earlier key, for when the
+	// server lets us try further keys.
+	partial := false
 
 	origSignersLen := len(signers)
 	for idx := 0; idx < len(signers); idx++ {
@@ -386,10 +499,19 @@ func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand
 		// other keys.  According to RFC 4252 Section 7, the latter can occur when
 		// additional authentication methods are required.
 		if success == authSuccess || !contains(methods, cb.method()) {
+			if partial && success == authFailure {
+				success = authPartialSuccess
+			}
 			return success, methods, err
 		}
+		if success == authPartialSuccess {
+			partial = true
+		}
 	}
 
+	if partial {
+		return authPartialSuccess, methods, nil
+	}
 	return authFailure, methods, errSigAlgo
 }
 
@@ -461,6 +583,64 @@ func PublicKeysCallback(getSigners func() (signers []Signer, err error)) AuthMet
 	return publicKeyCallback(getSigners)
 }
 
+type hostBasedAuthMsg struct {
+	User       string `sshtype:"50"`
+	Service    string
+	Method     string
+	Algoname   string
+	PubKey     []byte
+	ClientHost string
+	ClientUser string
+	Sig        []byte
+}
+
+// hostBasedCallback is an AuthMethod that authenticates with the
+// client host's key.
+type hostBasedCallback struct {
+	signer     Signer
+	clientHost string
+	clientUser string
+}
+
+func (cb hostBasedCallback) method() string {
+	return "hostbased"
+}
+
+func (cb hostBasedCallback) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (authResult, []string, error) {
+	as, algo, err := pickSignatureAlgorithm(cb.signer, extensions)
+	if err != nil {
+		return authFailure, nil, err
+	}
+	msg := hostBasedAuthMsg{
+		User:       user,
+		Service:    serviceSSH,
+		Method:     cb.method(),
+		Algoname:   algo,
+		PubKey:     cb.signer.PublicKey().Marshal(),
+		ClientHost: cb.clientHost,
+		ClientUser: cb.clientUser,
+	}
+	sign, err := as.SignWithAlgorithm(rand, buildDataSignedForHostBased(session, msg), underlyingAlgo(algo))
+	if err != nil {
+		return authFailure, nil, err
+	}
+	msg.Sig = Marshal(sign)
+	if err := c.writePacket(Marshal(&msg)); err != nil {
+		return authFailure, nil, err
+	}
+	return handleAuthResponse(c)
+}
+
+// HostBased returns an AuthMethod for hostbased authentication (RFC
+// 4252, section 9). signer holds the client host's key, which may be a
+// host certificate. clientHost is the fully qualified name of the client
+// host, and clientUser the name of the user on it. The server decides,
+// from these and the host key, whether to let clientUser log in as the
+// user in ClientConfig.User.
+func HostBased(signer Signer, clientHost, clientUser string) AuthMethod {
+	return hostBasedCallback{signer, clientHost, clientUser}
+}
+
 // handleAuthResponse returns whether the preceding authentication request succeeded
 // along with a list of remaining authentication methods to try next and
 // an error if an unexpected response was received.
@@ -512,12 +692,24 @@ func handleBannerResponse(c packetConn, packet []byte) error {
 	}
 
 	if transport.bannerCallback != nil {
-		return transport.bannerCallback(msg.Message)
+		if err := transport.bannerCallback(msg.Message); err != nil {
+			return &bannerCallbackError{err}
+		}
 	}
 
 	return nil
 }
 
+// bannerCallbackError marks an error from ClientConfig.BannerCallback,
+// which aborts authentication rather than just the current method.
+type bannerCallbackError struct {
+	err error
+}
+
+func (e *bannerCallbackError) Error() string { return e.err.Error() }
+
+func (e *bannerCallbackError) Unwrap() error { return e.err }
+
 // KeyboardInteractiveChallenge should print questions, optionally
 // disabling echoing (e.g. for passwords), and return all the answers.
 // Challenge may be called multiple times in a single session. After
@@ -687,9 +879,21 @@ func GSSAPIWithMICAuthMethod(gssAPIClient GSSAPIClient, target string) AuthMetho
 	return &gssAPIWithMICCallback{gssAPIClient: gssAPIClient, target: target}
 }
 
+// GSSAPIWithMICDelegationAuthMethod is like GSSAPIWithMICAuthMethod, but
+// asks gssAPIClient to delegate the user's credentials to the server, by
+// passing isGSSDelegCreds to InitSecContext. The server receives them
+// through its GSSAPIServer.
+func GSSAPIWithMICDelegationAuthMethod(gssAPIClient GSSAPIClient, target string) AuthMethod {
+	if gssAPIClient == nil {
+		panic("gss-api client must be not nil with enable gssapi-with-mic")
+	}
+	return &gssAPIWithMICCallback{gssAPIClient: gssAPIClient, target: target, delegate: true}
+}
+
 type gssAPIWithMICCallback struct {
 	gssAPIClient GSSAPIClient
 	target       string
+	delegate     bool
 }
 
 func (g *gssAPIWithMICCallback) auth(session []byte, user string, c packetConn, rand io.Reader, _ map[string][]byte) (authResult, []string, error) {
@@ -709,23 +913,32 @@ func (g *gssAPIWithMICCallback) auth(session []byte, user string, c packetConn,
 	// SSH_MSG_USERAUTH_FAILURE if none of the mechanisms are supported or
 	// with an SSH_MSG_USERAUTH_GSSAPI_RESPONSE.
 	// See RFC 4462 section 3.3.
-	// OpenSSH supports Kerberos V5 mechanism only for GSS-API authentication,so I don't want to check
-	// selected mech if it is valid.
 	packet, err := c.readPacket()
 	if err != nil {
 		return authFailure, nil, err
 	}
+	if packet[0] == msgUserAuthFailure {
+		var msg userAuthFailureMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return authFailure, nil, err
+		}
+		return authFailure, msg.Methods, nil
+	}
 	userAuthGSSAPIResp := &userAuthGSSAPIResponse{}
 	if err := Unmarshal(packet, userAuthGSSAPIResp); err != nil {
 		return authFailure, nil, err
 	}
+	// We only offered the Kerberos V5 mechanism.
+	if !bytes.Equal(userAuthGSSAPIResp.SupportMech, krb5OID) {
+		return authFailure, nil, errors.New("ssh: server selected a GSS-API mechanism that was not offered")
+	}
 	// Start the loop into the exchange token.
 	// See RFC 4462 section 3.4.
 	var token []byte
 	defer g.gssAPIClient.DeleteSecContext()
 	for {
 		// Initiates the establishment of a security context between the application and a remote peer.
-		nextToken, needContinue, err := g.gssAPIClient.InitSecContext("host@"+g.target, token, false)
+		nextToken, needContinue, err := g.gssAPIClient.InitSecContext("host@"+g.target, token, g.delegate)
 		if err != nil {
 			return authFailure, nil, err
 		}
@@ -13,6 +13,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -137,6 +138,23 @@ func TestClientAuthPublicKey(t *testing.T) {
 	}
 }
 
+func TestClientAuthPublicKeyCachedSigner(t *testing.T) {
+	signer := &loggingAlgorithmSigner{AlgorithmSigner: testSigners["rsa"].(AlgorithmSigner)}
+	config := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			PublicKeys(NewCachedSigner(signer)),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if err := tryAuth(t, config); err != nil {
+		t.Fatalf("unable to dial remote side: %s", err)
+	}
+	if len(signer.used) != 1 || signer.used[0] != KeyAlgoRSASHA256 {
+		t.Errorf("unexpected Sign/SignWithAlgorithm calls: %q", signer.used)
+	}
+}
+
 // TestClientAuthNoSHA2 tests a ssh-rsa Signer that doesn't implement AlgorithmSigner.
 func TestClientAuthNoSHA2(t *testing.T) {
 	config := &ClientConfig{
@@ -256,6 +274,74 @@ func TestAuthMethodWrongKeyboardInteractive(t *testing.T) {
 	}
 }
 
+func TestClientAuthError(t *testing.T) {
+	errPrompt := errors.New("no password available")
+	config := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			Password("WRONG"),
+			PublicKeys(testSigners["dsa"]),
+			PasswordCallback(func() (string, error) { return "", errPrompt }),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	err := tryAuth(t, config)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got %v, want an *AuthError", err)
+	}
+	var methods []string
+	for _, a := range authErr.Attempts {
+		methods = append(methods, a.Method)
+		if a.PartialSuccess || a.Err != nil {
+			t.Errorf("attempt %+v has a partial success or error", a)
+		}
+	}
+	if want := []string{"none", "password", "publickey"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("got attempts %v, want %v", methods, want)
+	}
+	if authErr.PartialSuccess || !contains(authErr.Methods, "publickey") {
+		t.Errorf("got partial success %v and methods %v, want false and publickey among them", authErr.PartialSuccess, authErr.Methods)
+	}
+
+	// A method that fails with an error is the last attempt, and the error
+	// is kept.
+	config.Auth = config.Auth[2:]
+	err = tryAuth(t, config)
+	if !errors.As(err, &authErr) || !errors.Is(err, errPrompt) {
+		t.Fatalf("got %v, want an *AuthError wrapping %v", err, errPrompt)
+	}
+	if n := len(authErr.Attempts); n != 2 || authErr.Attempts[1].Err != errPrompt {
+		t.Errorf("got attempts %+v, want none followed by the failing password", authErr.Attempts)
+	}
+}
+
+func TestClientAuthMethodsProbe(t *testing.T) {
+	config := &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	err := tryAuth(t, config)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got %v, want an *AuthError", err)
+	}
+	if len(authErr.Attempts) != 1 || authErr.Attempts[0].Method != "none" {
+		t.Fatalf("got attempts %+v, want only none", authErr.Attempts)
+	}
+	want := []string{"password", "publickey", "keyboard-interactive"}
+	if got := authErr.Attempts[0].Methods; !reflect.DeepEqual(got, want) {
+		t.Errorf("got methods %v, want %v", got, want)
+	}
+
+	// A server that accepts none lets the probe connect.
+	serverConfig := &ServerConfig{NoClientAuth: true}
+	if _, err := doClientServerAuth(t, serverConfig, config); err != nil {
+		t.Errorf("probe against a server accepting none: %v", err)
+	}
+}
+
 // the mock server will only authenticate ssh-rsa keys
 func TestAuthMethodInvalidPublicKey(t *testing.T) {
 	config := &ClientConfig{
@@ -502,6 +588,9 @@ func testPermissionsPassing(withPermissions bool, t *testing.T) {
 	if p := serverConn.Permissions; (p != nil) != withPermissions {
 		t.Fatalf("withPermissions is %t, but Permissions object is %#v", withPermissions, p)
 	}
+	if p := serverConn.Conn.(PermissionsConn).Permissions(); p != serverConn.Permissions {
+		t.Fatalf("PermissionsConn.Permissions() = %#v, want %#v", p, serverConn.Permissions)
+	}
 }
 
 func TestPermissionsPassing(t *testing.T) {
@@ -613,8 +702,8 @@ func TestClientAuthMaxAuthTries(t *testing.T) {
 	}
 	serverConfig.AddHostKey(testSigners["rsa"])
 
-	expectedErr := fmt.Errorf("ssh: handshake failed: %v", &disconnectMsg{
-		Reason:  2,
+	expectedErr := fmt.Errorf("ssh: handshake failed: %v", &DisconnectError{
+		Reason:  DisconnectProtocolError,
 		Message: "too many authentication failures",
 	})
 
@@ -676,8 +765,8 @@ func TestClientAuthMaxAuthTriesPublicKey(t *testing.T) {
 		t.Fatalf("unable to dial remote side: %s", err)
 	}
 
-	expectedErr := fmt.Errorf("ssh: handshake failed: %v", &disconnectMsg{
-		Reason:  2,
+	expectedErr := fmt.Errorf("ssh: handshake failed: %v", &DisconnectError{
+		Reason:  DisconnectProtocolError,
 		Message: "too many authentication failures",
 	})
 	invalidConfig := &ClientConfig{
@@ -956,6 +1045,47 @@ func TestAuthMethodGSSAPIWithMIC(t *testing.T) {
 	}
 }
 
+func TestAuthMethodGSSAPIWithMICDelegation(t *testing.T) {
+	for _, delegate := range []bool{false, true} {
+		client := &FakeClient{
+			exchanges: []*exchange{
+				{outToken: "client-valid-token-1"},
+				{expectedToken: "server-valid-token-1"},
+			},
+			mic:      []byte("valid-mic"),
+			maxRound: 2,
+		}
+		method := GSSAPIWithMICAuthMethod(client, "testtarget")
+		if delegate {
+			method = GSSAPIWithMICDelegationAuthMethod(client, "testtarget")
+		}
+		config := &ClientConfig{
+			User:            "testuser",
+			Auth:            []AuthMethod{method},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		}
+		gssConfig := &GSSAPIWithMICConfig{
+			AllowLogin: func(conn ConnMetadata, srcName string) (*Permissions, error) {
+				return nil, nil
+			},
+			Server: &FakeServer{
+				exchanges: []*exchange{
+					{outToken: "server-valid-token-1", expectedToken: "client-valid-token-1"},
+				},
+				maxRound:    1,
+				expectedMIC: []byte("valid-mic"),
+				srcName:     "testuser@DOMAIN",
+			},
+		}
+		if err := tryAuthWithGSSAPIWithMICConfig(t, config, gssConfig); err != nil {
+			t.Fatalf("delegate %t: %v", delegate, err)
+		}
+		if client.delegated != delegate {
+			t.Errorf("InitSecContext got isGSSDelegCreds %t, want %t", client.delegated, delegate)
+		}
+	}
+}
+
 func TestCompatibleAlgoAndSignatures(t *testing.T) {
 	type testcase struct {
 		algo       string
@@ -1282,3 +1412,68 @@ func TestCertAuthOpenSSHCompat(t *testing.T) {
 		t.Fatalf("unable to dial remote side: %s", err)
 	}
 }
+
+// wrongKeySigner claims a public key but signs with another key.
+type wrongKeySigner struct {
+	Signer
+	pub PublicKey
+}
+
+func (s wrongKeySigner) PublicKey() PublicKey { return s.pub }
+
+func TestClientAuthHostBased(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		signer     Signer
+		clientHost string
+		wantOK     bool
+	}{
+		{"rsa", testSigners["rsa"], "client.example.com.", true},
+		{"ed25519", testSigners["ed25519"], "client.example.com.", true},
+		{"wrong host", testSigners["rsa"], "other.example.com.", false},
+		{"bad signature", wrongKeySigner{testSigners["ecdsa"], testPublicKeys["ed25519"]}, "client.example.com.", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			serverConfig := &ServerConfig{
+				HostBasedCallback: func(conn ConnMetadata, key PublicKey, clientHost, clientUser string) (*Permissions, error) {
+					if conn.User() != "testuser" || clientUser != "alice" || clientHost != "client.example.com." {
+						return nil, fmt.Errorf("%s@%s may not log in as %s", clientUser, clientHost, conn.User())
+					}
+					if !bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) && !bytes.Equal(key.Marshal(), testPublicKeys["ed25519"].Marshal()) {
+						return nil, errors.New("unknown host key")
+					}
+					return &Permissions{Extensions: map[string]string{"host": clientHost}}, nil
+				},
+			}
+			serverConfig.AddHostKey(testSigners["rsa"])
+			serverDone := make(chan *ServerConn, 1)
+			go func() {
+				conn, _, _, _ := NewServerConn(c1, serverConfig)
+				serverDone <- conn
+			}()
+
+			clientConfig := &ClientConfig{
+				User:            "testuser",
+				Auth:            []AuthMethod{HostBased(tt.signer, tt.clientHost, "alice")},
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			}
+			_, _, _, err = NewClientConn(c2, "", clientConfig)
+			if gotOK := err == nil; gotOK != tt.wantOK {
+				t.Fatalf("NewClientConn: got %v, want success %t", err, tt.wantOK)
+			}
+			if !tt.wantOK {
+				return
+			}
+			if conn := <-serverDone; conn == nil || conn.Permissions.Extensions["host"] != tt.clientHost {
+				t.Errorf("server did not authenticate the client host")
+			}
+		})
+	}
+}
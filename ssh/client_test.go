@@ -6,12 +6,18 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestClientVersion(t *testing.T) {
@@ -29,6 +35,20 @@ func TestClientVersion(t *testing.T) {
 			name:    "custom version",
 			version: "SSH-2.0-CustomClientVersionString",
 		},
+		{
+			name:    "version with comment",
+			version: "SSH-2.0-Custom_1.0 some comment",
+		},
+		{
+			name:    "version with newline",
+			version: "SSH-2.0-Custom\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "version without prefix",
+			version: "SSH-1.99-Custom",
+			wantErr: true,
+		},
 		{
 			name:      "good multi line version",
 			version:   packageVersion,
@@ -209,6 +229,133 @@ func TestBannerCallback(t *testing.T) {
 	}
 }
 
+func TestBannerCallbackEmpty(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		BannerCallback: func(conn ConnMetadata) string {
+			return ""
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go NewServerConn(c1, serverConf)
+
+	clientConf := ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			t.Errorf("got banner %q, want none", message)
+			return nil
+		},
+	}
+	if _, _, _, err := NewClientConn(c2, "", &clientConf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBannerCallbackRepeated(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			if string(password) != "right" {
+				return nil, &BannerError{Err: errors.New("wrong password"), Message: "Try again"}
+			}
+			return &Permissions{}, nil
+		},
+		BannerCallback: func(conn ConnMetadata) string {
+			return "Hello World"
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go NewServerConn(c1, serverConf)
+
+	passwords := []string{"wrong", "right"}
+	var banners []string
+	clientConf := ClientConfig{
+		Auth: []AuthMethod{
+			RetryableAuthMethod(PasswordCallback(func() (string, error) {
+				p := passwords[0]
+				passwords = passwords[1:]
+				return p, nil
+			}), 2),
+		},
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banners = append(banners, message)
+			return nil
+		},
+	}
+
+	if _, _, _, err := NewClientConn(c2, "", &clientConf); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Hello World", "Try again"}; !reflect.DeepEqual(banners, want) {
+		t.Errorf("got banners %q, want %q", banners, want)
+	}
+}
+
+func TestBannerCallbackError(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	var methods []string
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			return &Permissions{}, nil
+		},
+		BannerCallback: func(conn ConnMetadata) string {
+			return "Hello World"
+		},
+		AuthLogCallback: func(conn ConnMetadata, method string, err error) {
+			methods = append(methods, method)
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverDone := make(chan struct{})
+	go func() {
+		NewServerConn(c1, serverConf)
+		close(serverDone)
+	}()
+
+	errBanner := errors.New("banner refused")
+	clientConf := ClientConfig{
+		Auth: []AuthMethod{
+			Password("123"),
+		},
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			return errBanner
+		},
+	}
+
+	_, _, _, err = NewClientConn(c2, "", &clientConf)
+	if !errors.Is(err, errBanner) {
+		t.Fatalf("got %v, want %v", err, errBanner)
+	}
+	<-serverDone
+	if want := []string{"none"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("server saw methods %v after the banner was refused, want %v", methods, want)
+	}
+}
+
 func TestNewClientConn(t *testing.T) {
 	errHostKeyMismatch := errors.New("host key mismatch")
 
@@ -365,3 +512,1449 @@ func TestUnsupportedAlgorithm(t *testing.T) {
 		})
 	}
 }
+
+// testClientServerConn connects a client and a server over netPipe and
+// returns the client's Conn and global requests, and the ServerConn,
+// once both handshakes have completed. A nil serverConf accepts any
+// client, and a nil clientConf connects as "user" without checking the
+// host key. The server discards its global requests, and both ends are
+// closed at the end of the test.
+func testClientServerConn(t *testing.T, serverConf *ServerConfig, clientConf *ClientConfig) (Conn, <-chan *Request, *ServerConn) {
+	t.Helper()
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	if serverConf == nil {
+		serverConf = &ServerConfig{
+			NoClientAuth: true,
+		}
+		serverConf.AddHostKey(testSigners["rsa"])
+	}
+	if clientConf == nil {
+		clientConf = &ClientConfig{
+			User:            "user",
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		}
+	}
+
+	serverDone := make(chan *ServerConn, 1)
+	go func() {
+		conn, _, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+		}
+		serverDone <- conn
+		if err == nil {
+			DiscardRequests(reqs)
+		}
+	}()
+
+	conn, _, reqs, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	serverConn := <-serverDone
+	if serverConn == nil {
+		t.FailNow()
+	}
+	return conn, reqs, serverConn
+}
+
+func TestServerSigAlgs(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.PublicKeyAuthAlgorithms = []string{KeyAlgoED25519, KeyAlgoRSASHA512}
+	serverConf.AddHostKey(testSigners["rsa"])
+	clientConn, _, serverConn := testClientServerConn(t, serverConf, nil)
+
+	want := []string{KeyAlgoED25519, KeyAlgoRSASHA512}
+	if got := clientConn.(ServerSigAlgsConn).ServerSigAlgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := serverConn.Conn.(ServerSigAlgsConn).ServerSigAlgs(); got != nil {
+		t.Errorf("server reported %v, want nil", got)
+	}
+}
+
+func TestDisableExtInfo(t *testing.T) {
+	for _, side := range []string{"client", "server"} {
+		t.Run(side, func(t *testing.T) {
+			serverConf := &ServerConfig{NoClientAuth: true}
+			serverConf.AddHostKey(testSigners["rsa"])
+			clientConf := &ClientConfig{
+				User:            "user",
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			}
+			if side == "client" {
+				clientConf.DisableExtInfo = true
+			} else {
+				serverConf.DisableExtInfo = true
+			}
+			clientConn, _, _ := testClientServerConn(t, serverConf, clientConf)
+			if got := clientConn.(ServerSigAlgsConn).ServerSigAlgs(); got != nil {
+				t.Errorf("client got server-sig-algs %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestClientHostKeyAlgorithms(t *testing.T) {
+	for _, tt := range []struct {
+		algos    []string
+		hostKeys []string
+		want     string
+		wantErr  string
+	}{
+		{algos: []string{KeyAlgoED25519, KeyAlgoRSASHA512}, hostKeys: []string{"rsa", "ed25519"}, want: KeyAlgoED25519},
+		{algos: []string{KeyAlgoRSASHA512, KeyAlgoED25519}, hostKeys: []string{"rsa", "ed25519"}, want: KeyAlgoRSASHA512},
+		{algos: []string{"", KeyAlgoRSASHA256}, hostKeys: []string{"rsa"}, want: KeyAlgoRSASHA256},
+		{
+			algos:    []string{"", KeyAlgoED25519, KeyAlgoED25519},
+			hostKeys: []string{"rsa"},
+			wantErr:  "no common algorithm for host key; client offered: [ssh-ed25519], server offered: [rsa-sha2-256 rsa-sha2-512 ssh-rsa]",
+		},
+		{algos: []string{""}, hostKeys: []string{"rsa"}, wantErr: "only empty strings"},
+	} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		serverConf := &ServerConfig{NoClientAuth: true}
+		for _, k := range tt.hostKeys {
+			serverConf.AddHostKey(testSigners[k])
+		}
+		go NewServerConn(c1, serverConf)
+
+		conn, _, _, err := NewClientConn(c2, "", &ClientConfig{
+			User:              "user",
+			HostKeyCallback:   InsecureIgnoreHostKey(),
+			HostKeyAlgorithms: tt.algos,
+		})
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%v: got error %v, want one containing %q", tt.algos, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%v: NewClientConn: %v", tt.algos, err)
+		default:
+			if got := conn.(AlgorithmsConnMetadata).Algorithms().HostKey; got != tt.want {
+				t.Errorf("%v: got host key algorithm %s, want %s", tt.algos, got, tt.want)
+			}
+			conn.Close()
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestServerHostKeySelection(t *testing.T) {
+	orders := [][]string{
+		{"ed25519", "ecdsa", "rsa"},
+		{"rsa", "ecdsa", "ed25519"},
+		{"ecdsa", "rsa", "ed25519"},
+	}
+	for _, tt := range []struct {
+		algos   []string
+		want    string
+		wantKey string
+	}{
+		{[]string{KeyAlgoED25519, KeyAlgoECDSA256, KeyAlgoRSASHA256}, KeyAlgoED25519, KeyAlgoED25519},
+		{[]string{KeyAlgoECDSA256, KeyAlgoED25519}, KeyAlgoECDSA256, KeyAlgoECDSA256},
+		{[]string{KeyAlgoRSASHA512, KeyAlgoED25519}, KeyAlgoRSASHA512, KeyAlgoRSA},
+		{[]string{KeyAlgoRSASHA256, KeyAlgoRSASHA512}, KeyAlgoRSASHA256, KeyAlgoRSA},
+		{[]string{KeyAlgoRSA, KeyAlgoECDSA256}, KeyAlgoRSA, KeyAlgoRSA},
+		// Algorithms the server has no key for are skipped.
+		{[]string{KeyAlgoECDSA384, CertAlgoED25519v01, KeyAlgoED25519}, KeyAlgoED25519, KeyAlgoED25519},
+		{[]string{KeyAlgoECDSA521}, "", ""},
+	} {
+		for _, order := range orders {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			serverConf := &ServerConfig{NoClientAuth: true}
+			for _, k := range order {
+				serverConf.AddHostKey(testSigners[k])
+			}
+			go NewServerConn(c1, serverConf)
+
+			var gotKey string
+			conn, _, _, err := NewClientConn(c2, "", &ClientConfig{
+				User: "user",
+				HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+					gotKey = key.Type()
+					return nil
+				},
+				HostKeyAlgorithms: tt.algos,
+			})
+			switch {
+			case tt.want == "":
+				if err == nil || !strings.Contains(err.Error(), "no common algorithm for host key") {
+					t.Errorf("%v with keys %v: got error %v, want host key negotiation error", tt.algos, order, err)
+				}
+			case err != nil:
+				t.Errorf("%v with keys %v: NewClientConn: %v", tt.algos, order, err)
+			default:
+				if got := conn.(AlgorithmsConnMetadata).Algorithms().HostKey; got != tt.want || gotKey != tt.wantKey {
+					t.Errorf("%v with keys %v: got algorithm %s with %s key, want %s with %s key", tt.algos, order, got, gotKey, tt.want, tt.wantKey)
+				}
+				conn.Close()
+			}
+			c1.Close()
+			c2.Close()
+		}
+	}
+}
+
+func TestNegotiatedAlgorithms(t *testing.T) {
+	want := NegotiatedAlgorithms{
+		KeyExchange: kexAlgoECDH256,
+		HostKey:     KeyAlgoRSASHA256,
+		Read: DirectionAlgorithms{
+			Cipher:      "aes128-ctr",
+			MAC:         "hmac-sha2-256",
+			Compression: compressionNone,
+		},
+		Write: DirectionAlgorithms{
+			Cipher:      "aes128-ctr",
+			MAC:         "hmac-sha2-256",
+			Compression: compressionNone,
+		},
+		StrictKex: true,
+	}
+
+	var authAlgs NegotiatedAlgorithms
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			authAlgs = conn.(AlgorithmsConnMetadata).Algorithms()
+			return &Permissions{}, nil
+		},
+	}
+	serverConf.KeyExchanges = []string{kexAlgoECDH256}
+	serverConf.Ciphers = []string{"aes128-ctr"}
+	serverConf.MACs = []string{"hmac-sha2-256"}
+	serverConf.AddHostKey(testSigners["rsa"])
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		Auth:            []AuthMethod{Password("testpw")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConn, _, serverConn := testClientServerConn(t, serverConf, clientConf)
+
+	if authAlgs != want {
+		t.Errorf("algorithms during auth: got %+v, want %+v", authAlgs, want)
+	}
+	for _, conn := range []Conn{clientConn, serverConn.Conn} {
+		if got := conn.(AlgorithmsConnMetadata).Algorithms(); got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	// Reading the algorithms must be safe while a key exchange is in
+	// progress.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			clientConn.(AlgorithmsConnMetadata).Algorithms()
+		}
+	}()
+	clientConn.(*connection).transport.requestKeyExchange()
+	if _, _, err := clientConn.SendRequest("ping", true, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	<-done
+	if got := clientConn.(AlgorithmsConnMetadata).Algorithms(); got != want {
+		t.Errorf("after rekey: got %+v, want %+v", got, want)
+	}
+}
+
+func TestNewClientConnContextCancel(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	// The server side never sends its version, so the handshake blocks
+	// until the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	_, _, _, err = NewClientConnContext(ctx, c2, "", clientConf)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if _, err := c2.Write([]byte{0}); err == nil {
+		t.Error("connection was not closed after cancellation")
+	}
+}
+
+func TestNewClientConnContextDone(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if _, _, _, err := NewClientConnContext(ctx, c2, "", clientConf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestNewClientConnContext(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		_, _, reqs, err := NewServerConn(c1, serverConf)
+		if err == nil {
+			DiscardRequests(reqs)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	conn, _, _, err := NewClientConnContext(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Cancelling the context after the handshake must not affect the
+	// connection.
+	cancel()
+	if _, _, err := conn.SendRequest("test", true, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+}
+
+func TestDialContextDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	// Accept connections but never respond to them.
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Timeout:         time.Minute,
+	}
+	if _, err := DialContext(ctx, "tcp", l.Addr().String(), clientConf); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		reply bool
+	}{
+		{"answered", true},
+		{"unanswered", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			serverConf := &ServerConfig{
+				NoClientAuth: true,
+			}
+			serverConf.AddHostKey(testSigners["rsa"])
+			keepAlives := make(chan struct{}, 10)
+			go func() {
+				_, _, reqs, err := NewServerConn(c1, serverConf)
+				if err != nil {
+					return
+				}
+				for req := range reqs {
+					if req.Type != keepAliveRequest {
+						continue
+					}
+					select {
+					case keepAlives <- struct{}{}:
+					default:
+					}
+					if tt.reply {
+						req.Reply(false, nil)
+					}
+				}
+			}()
+
+			clientConf := &ClientConfig{
+				User:            "user",
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			}
+			clientConf.KeepAliveInterval = 20 * time.Millisecond
+			clientConf.KeepAliveCountMax = 2
+			conn, _, _, err := NewClientConn(c2, "", clientConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			waitErr := make(chan error, 1)
+			go func() {
+				waitErr <- conn.Wait()
+			}()
+
+			if tt.reply {
+				for i := 0; i < 5; i++ {
+					select {
+					case <-keepAlives:
+					case <-time.After(5 * time.Second):
+						t.Fatal("timed out waiting for keepalive")
+					}
+				}
+				select {
+				case err := <-waitErr:
+					t.Fatalf("connection closed although keepalives were answered: %v", err)
+				default:
+				}
+				return
+			}
+
+			select {
+			case <-waitErr:
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection was not closed after unanswered keepalives")
+			}
+		})
+	}
+}
+
+func TestKeepAliveCallback(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, _, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		// Answer the first two keepalives only.
+		go func() {
+			answered := 0
+			for req := range reqs {
+				if req.Type == keepAliveRequest && answered < 2 {
+					answered++
+					req.Reply(false, nil)
+				}
+			}
+		}()
+		serverErr <- conn.Wait()
+	}()
+
+	type probe struct {
+		latency  time.Duration
+		failures int
+	}
+	var probes []probe
+	errDead := errors.New("peer is dead")
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.KeepAliveInterval = 20 * time.Millisecond
+	clientConf.KeepAliveCallback = func(latency time.Duration, consecutiveFailures int) error {
+		probes = append(probes, probe{latency, consecutiveFailures})
+		// Tolerate more failures than the default KeepAliveCountMax.
+		if consecutiveFailures == 5 {
+			return errDead
+		}
+		return nil
+	}
+	conn, _, _, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var discErr *DisconnectError
+	select {
+	case err := <-serverErr:
+		if !errors.As(err, &discErr) || discErr.Reason != DisconnectByApplication || discErr.Message != errDead.Error() {
+			t.Fatalf("server got %v, want a disconnect with %q", err, errDead)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after KeepAliveCallback failed")
+	}
+	conn.Wait()
+
+	if len(probes) != 7 {
+		t.Fatalf("got %d probes, want 7: %v", len(probes), probes)
+	}
+	for i, p := range probes {
+		wantFailures := 0
+		if i >= 2 {
+			wantFailures = i - 1
+		}
+		if p.failures != wantFailures {
+			t.Errorf("probe %d: got %d consecutive failures, want %d", i, p.failures, wantFailures)
+		}
+		if i >= 2 && p.latency < clientConf.KeepAliveInterval {
+			t.Errorf("probe %d: got latency %v for an unanswered request", i, p.latency)
+		}
+		if i < 2 && (p.latency <= 0 || p.latency >= clientConf.KeepAliveInterval) {
+			t.Errorf("probe %d: got latency %v for an answered request", i, p.latency)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		keepAlive        bool
+		ignoreKeepAlives bool
+		wantClose        bool
+	}{
+		{"idle", false, false, true},
+		{"keepalives", true, false, false},
+		{"keepalives ignored", true, true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConf := &ServerConfig{NoClientAuth: true}
+			serverConf.AddHostKey(testSigners["rsa"])
+			serverConf.IdleTimeout = 200 * time.Millisecond
+			serverConf.IdleTimeoutIgnoreKeepAlives = tt.ignoreKeepAlives
+			clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+			if tt.keepAlive {
+				clientConf.KeepAliveInterval = 20 * time.Millisecond
+			}
+			conn, _, _ := testClientServerConn(t, serverConf, clientConf)
+
+			waitErr := make(chan error, 1)
+			go func() {
+				waitErr <- conn.Wait()
+			}()
+			if !tt.wantClose {
+				select {
+				case err := <-waitErr:
+					t.Fatalf("connection closed although keepalives count as activity: %v", err)
+				case <-time.After(time.Second):
+				}
+				return
+			}
+			select {
+			case err := <-waitErr:
+				if discErr, ok := err.(*DisconnectError); !ok || discErr.Reason != DisconnectByApplication {
+					t.Errorf("Wait: got %v, want DisconnectError with DisconnectByApplication", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("idle connection was not closed")
+			}
+		})
+	}
+}
+
+func TestDebugMessages(t *testing.T) {
+	type debug struct {
+		alwaysDisplay bool
+		message, lang string
+	}
+	received := make(chan debug, 10)
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverConf.DebugCallback = func(alwaysDisplay bool, message, lang string) {
+		received <- debug{alwaysDisplay, message, lang}
+	}
+	conn, _, _ := testClientServerConn(t, serverConf, nil)
+
+	if err := conn.(DebugConn).SendDebug(true, "hello"); err != nil {
+		t.Fatalf("SendDebug: %v", err)
+	}
+	if err := conn.(*connection).transport.writePacket(Marshal(&debugMsg{Message: "bonjour", Language: "fr"})); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	// Debug messages must not disturb the connection protocol.
+	if _, _, err := conn.SendRequest("ping", true, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+
+	for _, want := range []debug{{true, "hello", ""}, {false, "bonjour", "fr"}} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("DebugCallback: got %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %+v", want)
+		}
+	}
+}
+
+func TestPeerDisconnectError(t *testing.T) {
+	conn, reqs, serverConn := testClientServerConn(t, nil, nil)
+
+	// Queue a request ahead of the disconnect; it must still be
+	// delivered.
+	if _, _, err := serverConn.SendRequest("before", false, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	msg := &disconnectMsg{
+		Reason:  uint32(DisconnectByApplication),
+		Message: "bye",
+	}
+	if err := serverConn.Conn.(*connection).transport.writePacket(Marshal(msg)); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+
+	if req, ok := <-reqs; !ok || req.Type != "before" {
+		t.Errorf("got request %v, want \"before\"", req)
+	}
+
+	for i := 0; i < 2; i++ {
+		var discErr *DisconnectError
+		if err := conn.Wait(); !errors.As(err, &discErr) {
+			t.Fatalf("Wait: got %v, want *DisconnectError", err)
+		}
+		if discErr.Reason != DisconnectByApplication || discErr.Message != "bye" {
+			t.Errorf("got %+v, want reason %v, message %q", discErr, DisconnectByApplication, "bye")
+		}
+	}
+	if _, _, err := conn.SendRequest("after", true, nil); err == nil {
+		t.Error("SendRequest after disconnect succeeded")
+	}
+}
+
+func TestSNTRUP761KeyExchange(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		serverKexs []string
+		want       string
+	}{
+		{"supported", []string{kexAlgoSNTRUP761X25519SHA512OpenSSH, kexAlgoCurve25519SHA256}, kexAlgoSNTRUP761X25519SHA512OpenSSH},
+		{"fallback", []string{kexAlgoCurve25519SHA256}, kexAlgoCurve25519SHA256},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			serverConf := &ServerConfig{
+				NoClientAuth: true,
+			}
+			serverConf.KeyExchanges = tt.serverKexs
+			serverConf.AddHostKey(testSigners["ecdsa"])
+			go newServer(c1, serverConf)
+
+			clientConf := &ClientConfig{
+				User:            "user",
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			}
+			clientConf.KeyExchanges = []string{kexAlgoSNTRUP761X25519SHA512, kexAlgoSNTRUP761X25519SHA512OpenSSH, kexAlgoCurve25519SHA256}
+			conn, _, _, err := NewClientConn(c2, "", clientConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.(AlgorithmsConnMetadata).Algorithms().KeyExchange; got != tt.want {
+				t.Errorf("got key exchange %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransportStats(t *testing.T) {
+	conn, _, serverConn := testClientServerConn(t, nil, nil)
+
+	before := conn.(TransportStatsConn).TransportStats()
+	payload := make([]byte, 1000)
+	if _, _, err := conn.SendRequest("stats", true, payload); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	after := conn.(TransportStatsConn).TransportStats()
+	if after.PacketsWritten != before.PacketsWritten+1 || after.PacketsRead != before.PacketsRead+1 {
+		t.Errorf("got %d packets written, %d read, want %d, %d", after.PacketsWritten, after.PacketsRead, before.PacketsWritten+1, before.PacketsRead+1)
+	}
+	if after.BytesWritten <= before.BytesWritten+uint64(len(payload)) {
+		t.Errorf("got %d bytes written, want more than %d", after.BytesWritten, before.BytesWritten+uint64(len(payload)))
+	}
+	if after.WireBytesWritten <= after.BytesWritten {
+		t.Errorf("got %d wire bytes written, want more than the %d payload bytes", after.WireBytesWritten, after.BytesWritten)
+	}
+
+	// The server has read everything the client wrote before replying.
+	server := serverConn.Conn.(TransportStatsConn).TransportStats()
+	if server.PacketsRead != after.PacketsWritten || server.BytesRead != after.BytesWritten || server.WireBytesRead != after.WireBytesWritten {
+		t.Errorf("server read %+v, client wrote %+v", server, after)
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	conn, _, serverConn := testClientServerConn(t, nil, nil)
+
+	state := conn.(ConnectionStateConn).ConnectionState()
+	if state.User != "user" {
+		t.Errorf("got user %q, want %q", state.User, "user")
+	}
+	if !bytes.Equal(state.SessionID, conn.SessionID()) || !bytes.Equal(state.ClientVersion, conn.ClientVersion()) || !bytes.Equal(state.ServerVersion, conn.ServerVersion()) {
+		t.Errorf("got state %+v, inconsistent with ConnMetadata", state)
+	}
+	if !reflect.DeepEqual(state.Algorithms, conn.(AlgorithmsConnMetadata).Algorithms()) {
+		t.Errorf("got algorithms %+v, want %+v", state.Algorithms, conn.(AlgorithmsConnMetadata).Algorithms())
+	}
+	if state.Stats.PacketsWritten == 0 {
+		t.Error("got no packets written")
+	}
+	if state.LastKeyExchange.IsZero() {
+		t.Error("got zero LastKeyExchange")
+	}
+
+	// The snapshot must not share memory with the connection.
+	state.SessionID[0] ^= 0xff
+	if bytes.Equal(state.SessionID, conn.SessionID()) {
+		t.Error("modifying the snapshot changed the session ID")
+	}
+
+	if err := conn.(RekeyConn).RekeyNow(); err != nil {
+		t.Fatalf("RekeyNow: %v", err)
+	}
+	after := conn.(ConnectionStateConn).ConnectionState()
+	if !after.LastKeyExchange.After(state.LastKeyExchange) {
+		t.Errorf("LastKeyExchange %v not after %v following a rekey", after.LastKeyExchange, state.LastKeyExchange)
+	}
+
+	server := serverConn.Conn.(ConnectionStateConn).ConnectionState()
+	if !bytes.Equal(server.SessionID, conn.SessionID()) {
+		t.Error("client and server session IDs differ")
+	}
+}
+
+func TestObfuscationInterval(t *testing.T) {
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.ObfuscationInterval = 5 * time.Millisecond
+	conn, _, serverConn := testClientServerConn(t, nil, clientConf)
+
+	// The server discards the ignore messages, but counts them.
+	start := serverConn.Conn.(TransportStatsConn).TransportStats().PacketsRead
+	deadline := time.Now().Add(10 * time.Second)
+	for serverConn.Conn.(TransportStatsConn).TransportStats().PacketsRead < start+5 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ignore messages")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, _, err := conn.SendRequest("ping", true, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+}
+
+func TestClientSendNoMoreSessions(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			defer ch.Close()
+			go func() {
+				for req := range reqs {
+					req.Reply(true, nil)
+				}
+			}()
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := client.SendNoMoreSessions(); err != nil {
+		t.Fatalf("SendNoMoreSessions: %v", err)
+	}
+
+	if _, err := client.NewSession(); err == nil {
+		t.Error("NewSession succeeded after SendNoMoreSessions")
+	} else if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != Prohibited {
+		t.Errorf("NewSession: got %v, want Prohibited", err)
+	}
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Errorf("Setenv on existing session: %v", err)
+	}
+	if _, _, err := client.OpenChannel("direct-tcpip", nil); err != nil {
+		t.Errorf("OpenChannel(direct-tcpip): %v", err)
+	}
+}
+
+func TestMACPreference(t *testing.T) {
+	etm := []string{"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com"}
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverConf.Ciphers = []string{"aes128-ctr"}
+	serverConf.MACs = []string{"hmac-sha2-256", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com"}
+	clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.MACs = etm
+	clientConn, _, serverConn := testClientServerConn(t, serverConf, clientConf)
+
+	for _, conn := range []Conn{clientConn, serverConn.Conn} {
+		algs := conn.(AlgorithmsConnMetadata).Algorithms()
+		if algs.Read.MAC != etm[0] || algs.Write.MAC != etm[0] {
+			t.Errorf("got MACs %q/%q, want %q", algs.Read.MAC, algs.Write.MAC, etm[0])
+		}
+	}
+
+	// Peers without an encrypt-then-MAC algorithm are refused.
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf.MACs = []string{"hmac-sha2-256", "hmac-sha2-512"}
+	go NewServerConn(c1, serverConf)
+	_, _, _, err = NewClientConn(c2, "", clientConf)
+	if err == nil || !strings.Contains(err.Error(), "no common algorithm for client to server MAC") {
+		t.Errorf("NewClientConn: got %v, want MAC negotiation error", err)
+	}
+}
+
+func TestGCMOnlyCiphers(t *testing.T) {
+	gcm := []string{gcm256CipherID, gcm128CipherID}
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.Ciphers = gcm
+	clientConn, _, _ := testClientServerConn(t, serverConf, clientConf)
+	if algs := clientConn.(AlgorithmsConnMetadata).Algorithms(); algs.Read.Cipher != gcm256CipherID || algs.Write.Cipher != gcm256CipherID {
+		t.Errorf("got ciphers %q/%q, want %q", algs.Read.Cipher, algs.Write.Cipher, gcm256CipherID)
+	}
+
+	// Peers without a GCM cipher are refused.
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf.Ciphers = []string{"aes128-ctr", chacha20Poly1305ID}
+	go NewServerConn(c1, serverConf)
+	_, _, _, err = NewClientConn(c2, "", clientConf)
+	if err == nil || !strings.Contains(err.Error(), "no common algorithm for client to server cipher") {
+		t.Errorf("NewClientConn: got %v, want cipher negotiation error", err)
+	}
+}
+
+func TestDirectionalCiphers(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.CiphersClientToServer = []string{"aes256-gcm@openssh.com"}
+	clientConf.CiphersServerToClient = []string{"aes128-ctr"}
+	clientConf.MACsServerToClient = []string{"hmac-sha2-512-etm@openssh.com"}
+	clientConn, _, serverConn := testClientServerConn(t, serverConf, clientConf)
+
+	ctos := DirectionAlgorithms{Cipher: "aes256-gcm@openssh.com", Compression: compressionNone}
+	stoc := DirectionAlgorithms{Cipher: "aes128-ctr", MAC: "hmac-sha2-512-etm@openssh.com", Compression: compressionNone}
+	if algs := clientConn.(AlgorithmsConnMetadata).Algorithms(); algs.Write != ctos || algs.Read != stoc {
+		t.Errorf("client: got write %+v, read %+v", algs.Write, algs.Read)
+	}
+	if algs := serverConn.Conn.(AlgorithmsConnMetadata).Algorithms(); algs.Read != ctos || algs.Write != stoc {
+		t.Errorf("server: got read %+v, write %+v", algs.Read, algs.Write)
+	}
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf.CiphersServerToClient = []string{"aes256-ctr"}
+	go NewServerConn(c1, serverConf)
+	_, _, _, err = NewClientConn(c2, "", clientConf)
+	if err == nil || !strings.Contains(err.Error(), "no common algorithm for server to client cipher") {
+		t.Errorf("NewClientConn: got %v, want server to client cipher negotiation error", err)
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	for _, tt := range []struct{ set, want uint32 }{
+		{0, maxPacket},
+		{1000, minMaxPacketSize},
+		{40000, 40000},
+		{1 << 30, maxPacketLimit},
+	} {
+		if got := (&Config{MaxPacketSize: tt.set}).maxPacketSize(); got != tt.want {
+			t.Errorf("MaxPacketSize %d: got %d, want %d", tt.set, got, tt.want)
+		}
+	}
+
+	clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.MaxPacketSize = 40000
+	clientConn, _, serverConn := testClientServerConn(t, nil, clientConf)
+
+	if _, _, err := serverConn.SendRequest("small", false, make([]byte, 39000)); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if _, _, err := serverConn.SendRequest("large", false, make([]byte, 41000)); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	err := clientConn.Wait()
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum packet size 40000") {
+		t.Errorf("Wait: got %v, want maximum packet size error", err)
+	}
+}
+
+func TestMaxPacketSizeJumbo(t *testing.T) {
+	clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.MaxPacketSize = 600 * 1024
+	clientConn, reqs, serverConn := testClientServerConn(t, nil, clientConf)
+
+	if _, _, err := serverConn.SendRequest("jumbo", false, make([]byte, 500*1024)); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	req := <-reqs
+	if req == nil || len(req.Payload) != 500*1024 {
+		t.Fatalf("got request %v, want a 500 KiB payload", req)
+	}
+
+	// Without the option, the packet is too large.
+	clientConn, _, serverConn = testClientServerConn(t, nil, nil)
+	if _, _, err := serverConn.SendRequest("jumbo", false, make([]byte, 500*1024)); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if err := clientConn.Wait(); err == nil || !strings.Contains(err.Error(), "packet") {
+		t.Errorf("Wait: got %v, want packet size error", err)
+	}
+}
+
+func TestMaxPacketSizeMinimum(t *testing.T) {
+	// With the smallest MaxPacketSize, full-size channel data from a
+	// peer using the default channel options is still accepted.
+	clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.MaxPacketSize = 1
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	client, server, chans, reqs, err := NewPipeClientServer(clientConf, serverConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	defer client.Close()
+	defer server.Close()
+	go DiscardRequests(reqs)
+	go func() {
+		newCh := <-chans
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		ch.Write(make([]byte, channelMaxPacket))
+		ch.Stderr().Write(make([]byte, channelMaxPacket))
+		ch.Close()
+	}()
+
+	ch, chReqs, err := client.OpenChannel("chan", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(chReqs)
+	var stderr []byte
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		stderr, err = io.ReadAll(ch.Stderr())
+		done <- err
+	}()
+	data, err := io.ReadAll(ch)
+	if err != nil || len(data) != channelMaxPacket {
+		t.Errorf("read %d bytes, %v, want %d, nil", len(data), err, channelMaxPacket)
+	}
+	if err := <-done; err != nil || len(stderr) != channelMaxPacket {
+		t.Errorf("read %d bytes of stderr, %v, want %d, nil", len(stderr), err, channelMaxPacket)
+	}
+}
+
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, fmt.Sprint(level, " ", msg, " ", keyvals))
+}
+
+func (l *recordingLogger) find(t *testing.T, who, prefix string) string {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.events {
+		if strings.HasPrefix(e, prefix) {
+			return e
+		}
+	}
+	t.Errorf("%s: no event starting with %q in %q", who, prefix, l.events)
+	return ""
+}
+
+func TestLogger(t *testing.T) {
+	const password = "sekrit-password"
+	serverLog, clientLog := &recordingLogger{}, &recordingLogger{}
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, pass []byte) (*Permissions, error) {
+			if string(pass) != password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverConf.Logger = serverLog
+	clientConf := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{Password(password)},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.Logger = clientLog
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			newCh.Reject(Prohibited, "no channels")
+		}
+	}()
+	clientConn, _, _, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer clientConn.Close()
+	clientConn.OpenChannel("chan", nil)
+
+	for _, tt := range []struct {
+		who    string
+		log    *recordingLogger
+		prefix string
+		want   string
+	}{
+		{"client", clientLog, "info key exchange complete", "initial true"},
+		{"client", clientLog, "info authentication attempt [user testuser method password", "result success"},
+		{"server", serverLog, "info key exchange complete", "initial true"},
+		{"server", serverLog, "info authentication attempt [user testuser method password", "err <nil>"},
+		{"server", serverLog, "debug channel open", "type chan"},
+	} {
+		if e := tt.log.find(t, tt.who, tt.prefix); e != "" && !strings.Contains(e, tt.want) {
+			t.Errorf("%s: got event %q, want it to contain %q", tt.who, e, tt.want)
+		}
+	}
+	for _, l := range []*recordingLogger{clientLog, serverLog} {
+		if events := fmt.Sprint(l.events); strings.Contains(events, password) {
+			t.Errorf("password logged: %s", events)
+		}
+	}
+}
+
+func TestClientHostKeysCallback(t *testing.T) {
+	got := make(chan []PublicKey, 1)
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		HostKeysCallback: func(keys []PublicKey) error {
+			got <- keys
+			return nil
+		},
+	}
+	_, reqs, server := testClientServerConn(t, nil, clientConf)
+
+	want := []PublicKey{testPublicKeys["rsa"], testPublicKeys["ed25519"]}
+	var payload []byte
+	payload = appendString(payload, string(want[0].Marshal()))
+	payload = appendString(payload, string(Marshal(&struct{ Type string }{"unknown-key@example.com"})))
+	payload = appendString(payload, string(want[1].Marshal()))
+	if _, _, err := server.SendRequest("hostkeys-00@openssh.com", false, payload); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if _, _, err := server.SendRequest("other", false, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+
+	keys := <-got
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(keys[i].Marshal(), want[i].Marshal()) {
+			t.Errorf("key %d: got %s, want %s", i, keys[i].Type(), want[i].Type())
+		}
+	}
+	// The hostkeys request is consumed; later requests are passed on.
+	if req := <-reqs; req.Type != "other" {
+		t.Errorf("got request %q, want other", req.Type)
+	}
+}
+
+// failFirstReader fails its first Read, and reads from crypto/rand
+// afterwards.
+type failFirstReader struct {
+	failed bool
+}
+
+func (r *failFirstReader) Read(p []byte) (int, error) {
+	if !r.failed {
+		r.failed = true
+		return 0, errors.New("entropy source failed")
+	}
+	return rand.Read(p)
+}
+
+func TestClientConfigRandUsedForKexInit(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go NewServerConn(c1, serverConf)
+
+	// The KEXINIT cookie is the first thing read from Rand, and a
+	// failure to read it fails the handshake.
+	_, _, _, err = NewClientConn(c2, "", &ClientConfig{
+		Config:          Config{Rand: &failFirstReader{}},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Error("handshake succeeded without a KEXINIT cookie")
+	}
+}
+
+func TestHostKeyAlgorithmCallback(t *testing.T) {
+	errSHA1 := errors.New("SHA-1 host key signature")
+	for _, tt := range []struct {
+		algos []string
+		want  string
+	}{
+		{[]string{KeyAlgoRSASHA512}, KeyAlgoRSASHA512},
+		{[]string{KeyAlgoRSA}, KeyAlgoRSA},
+	} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		serverConf := &ServerConfig{NoClientAuth: true}
+		serverConf.AddHostKey(testSigners["rsa"])
+		go NewServerConn(c1, serverConf)
+
+		var got string
+		hostKeyChecked := false
+		_, _, _, err = NewClientConn(c2, "", &ClientConfig{
+			HostKeyAlgorithms: tt.algos,
+			HostKeyAlgorithmCallback: func(hostname string, remote net.Addr, algorithm string, key PublicKey) error {
+				got = algorithm
+				if !bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+					t.Errorf("got key %s, want the rsa test key", key.Type())
+				}
+				if algorithm == KeyAlgoRSA {
+					return errSHA1
+				}
+				return nil
+			},
+			HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+				hostKeyChecked = true
+				return nil
+			},
+		})
+		c1.Close()
+		c2.Close()
+		if got != tt.want {
+			t.Errorf("%v: got algorithm %q, want %q", tt.algos, got, tt.want)
+		}
+		if tt.want == KeyAlgoRSA {
+			if !errors.Is(err, errSHA1) {
+				t.Errorf("%v: got %v, want %v", tt.algos, err, errSHA1)
+			}
+			if hostKeyChecked {
+				t.Errorf("%v: HostKeyCallback called after HostKeyAlgorithmCallback failed", tt.algos)
+			}
+		} else if err != nil || !hostKeyChecked {
+			t.Errorf("%v: got %v, HostKeyCallback called %v; want success", tt.algos, err, hostKeyChecked)
+		}
+	}
+}
+
+func TestPadPacketsTo(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.PadPacketsTo = 256
+	serverConf.AddHostKey(testSigners["rsa"])
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.PadPacketsTo = 256
+	_, reqs, server := testClientServerConn(t, serverConf, clientConf)
+	go func() {
+		for req := range reqs {
+			req.Reply(true, req.Payload)
+		}
+	}()
+	for _, n := range []int{0, 100, 1000} {
+		payload := bytes.Repeat([]byte{'p'}, n)
+		ok, resp, err := server.SendRequest("echo", true, payload)
+		if err != nil || !ok || !bytes.Equal(resp, payload) {
+			t.Errorf("SendRequest(%d bytes): got %v, %d bytes, %v", n, ok, len(resp), err)
+		}
+	}
+}
+
+func TestPeerKexInit(t *testing.T) {
+	cookie := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.Rand = io.MultiReader(bytes.NewReader(cookie[:]), rand.Reader)
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	clientConf := &ClientConfig{
+		User:              "user",
+		HostKeyCallback:   InsecureIgnoreHostKey(),
+		HostKeyAlgorithms: []string{KeyAlgoECDSA256},
+	}
+	clientConf.Ciphers = []string{"aes128-ctr", chacha20Poly1305ID}
+	clientConf.MACs = []string{"hmac-sha2-256"}
+	client, _, server := testClientServerConn(t, serverConf, clientConf)
+
+	got := client.(PeerKexInitConn).PeerKexInit()
+	if got.Cookie != cookie {
+		t.Errorf("got server cookie %x, want %x", got.Cookie, cookie)
+	}
+	if want := []string{KeyAlgoECDSA256}; !reflect.DeepEqual(got.ServerHostKeyAlgos, want) {
+		t.Errorf("got server host key algorithms %v, want %v", got.ServerHostKeyAlgos, want)
+	}
+	if !contains(got.KexAlgos, kexStrictServer) {
+		t.Errorf("server key exchange algorithms %v lack %s", got.KexAlgos, kexStrictServer)
+	}
+
+	got = server.Conn.(PeerKexInitConn).PeerKexInit()
+	if !reflect.DeepEqual(got.CiphersClientServer, clientConf.Ciphers) || !reflect.DeepEqual(got.CiphersServerClient, clientConf.Ciphers) {
+		t.Errorf("got client ciphers %v and %v, want %v", got.CiphersClientServer, got.CiphersServerClient, clientConf.Ciphers)
+	}
+	if !reflect.DeepEqual(got.MACsClientServer, clientConf.MACs) || !reflect.DeepEqual(got.MACsServerClient, clientConf.MACs) {
+		t.Errorf("got client MACs %v and %v, want %v", got.MACsClientServer, got.MACsServerClient, clientConf.MACs)
+	}
+	if want := []string{compressionNone}; !reflect.DeepEqual(got.CompressionClientServer, want) {
+		t.Errorf("got client compression %v, want %v", got.CompressionClientServer, want)
+	}
+	if !contains(got.KexAlgos, kexStrictClient) || !contains(got.KexAlgos, "ext-info-c") {
+		t.Errorf("client key exchange algorithms %v lack the strict kex or ext-info markers", got.KexAlgos)
+	}
+
+	// The result is a copy.
+	got.CiphersClientServer[0] = "mutated"
+	if again := server.Conn.(PeerKexInitConn).PeerKexInit(); again.CiphersClientServer[0] != clientConf.Ciphers[0] {
+		t.Errorf("PeerKexInit shares memory with the connection")
+	}
+}
+
+func TestSessionIDHash(t *testing.T) {
+	for _, tt := range []struct {
+		kex, hash string
+		size      int
+	}{
+		{kexAlgoCurve25519SHA256, "sha256", 32},
+		{kexAlgoECDH384, "sha384", 48},
+		{kexAlgoDH16SHA512, "sha512", 64},
+		{kexAlgoDH14SHA1, "sha1", 20},
+	} {
+		t.Run(tt.kex, func(t *testing.T) {
+			var authHash string
+			serverConf := &ServerConfig{
+				NoClientAuth: true,
+				NoClientAuthCallback: func(conn ConnMetadata) (*Permissions, error) {
+					authHash = conn.(SessionIDHashConn).SessionIDHash()
+					return nil, nil
+				},
+			}
+			serverConf.AddHostKey(testSigners["rsa"])
+			clientConf := &ClientConfig{
+				User:            "user",
+				HostKeyCallback: InsecureIgnoreHostKey(),
+				Config:          Config{KeyExchanges: []string{tt.kex}},
+			}
+			client, _, server := testClientServerConn(t, serverConf, clientConf)
+			for name, conn := range map[string]Conn{"client": client, "server": server.Conn} {
+				if got := conn.(SessionIDHashConn).SessionIDHash(); got != tt.hash {
+					t.Errorf("%s: got %q, want %q", name, got, tt.hash)
+				}
+				if got := len(conn.SessionID()); got != tt.size {
+					t.Errorf("%s: got a %d-byte session ID, want %d bytes", name, got, tt.size)
+				}
+			}
+			if authHash != tt.hash {
+				t.Errorf("auth callback: got %q, want %q", authHash, tt.hash)
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverConf.HandshakeTimeout = 50 * time.Millisecond
+	clientConf := &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{HandshakeTimeout: 50 * time.Millisecond},
+	}
+	for name, handshake := range map[string]func(net.Conn) error{
+		"client": func(c net.Conn) error {
+			_, _, _, err := NewClientConn(c, "", clientConf)
+			return err
+		},
+		"server": func(c net.Conn) error {
+			_, _, _, err := NewServerConn(c, serverConf)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+			// The peer accepts the connection, and reads, but never
+			// sends its version.
+			go io.Copy(io.Discard, c2)
+
+			start := time.Now()
+			err = handshake(c1)
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("got %v, want a timeout", err)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("handshake took %v", d)
+			}
+		})
+	}
+
+	// A handshake that completes in time is not affected.
+	serverConf.HandshakeTimeout = time.Minute
+	testClientServerConn(t, serverConf, &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{HandshakeTimeout: time.Minute},
+	})
+}
+
+func TestConnRole(t *testing.T) {
+	var authIsServer bool
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		NoClientAuthCallback: func(conn ConnMetadata) (*Permissions, error) {
+			authIsServer = conn.(RoleConnMetadata).IsServer()
+			return nil, nil
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	client, _, server := testClientServerConn(t, serverConf, nil)
+	if client.(RoleConnMetadata).IsServer() {
+		t.Error("client: IsServer returned true")
+	}
+	if !server.Conn.(RoleConnMetadata).IsServer() {
+		t.Error("server: IsServer returned false")
+	}
+	if !authIsServer {
+		t.Error("server auth callback: IsServer returned false")
+	}
+}
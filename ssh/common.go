@@ -10,7 +10,10 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
+	"os"
 	"sync"
+	"time"
 
 	_ "crypto/sha1"
 	_ "crypto/sha256"
@@ -22,6 +25,12 @@ const (
 	compressionNone = "none"
 	serviceUserAuth = "ssh-userauth"
 	serviceSSH      = "ssh-connection"
+
+	// publicKeyHostBoundMethod is the variant of "publickey" whose
+	// signature also covers the server's host key, advertised with the
+	// publicKeyHostBoundExtension extension. See [PROTOCOL], Section 3.9.
+	publicKeyHostBoundMethod    = "publickey-hostbound-v00@openssh.com"
+	publicKeyHostBoundExtension = "publickey-hostbound@openssh.com"
 )
 
 // supportedCiphers lists ciphers we support but might not recommend.
@@ -44,11 +53,12 @@ var preferredCiphers = []string{
 // supportedKexAlgos specifies the supported key-exchange algorithms in
 // preference order.
 var supportedKexAlgos = []string{
+	kexAlgoSNTRUP761X25519SHA512, kexAlgoSNTRUP761X25519SHA512OpenSSH,
 	kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH,
 	// P384 and P521 are not constant-time yet, but since we don't
 	// reuse ephemeral keys, using them for ECDH should be OK.
 	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
-	kexAlgoDH14SHA256, kexAlgoDH16SHA512, kexAlgoDH14SHA1,
+	kexAlgoDH16SHA512, kexAlgoDH18SHA512, kexAlgoDH14SHA256, kexAlgoDH14SHA1,
 	kexAlgoDH1SHA1,
 }
 
@@ -60,12 +70,14 @@ var serverForbiddenKexAlgos = map[string]struct{}{
 }
 
 // preferredKexAlgos specifies the default preference for key-exchange
-// algorithms in preference order. The diffie-hellman-group16-sha512 algorithm
-// is disabled by default because it is a bit slower than the others.
+// algorithms in preference order. The larger MODP groups follow the
+// curve-based key exchanges, as in OpenSSH. The sntrup761x25519-sha512
+// algorithms are disabled by default because their key generation is much
+// slower than the others.
 var preferredKexAlgos = []string{
 	kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH,
 	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
-	kexAlgoDH14SHA256, kexAlgoDH14SHA1,
+	kexAlgoDH16SHA512, kexAlgoDH18SHA512, kexAlgoDH14SHA256, kexAlgoDH14SHA1,
 }
 
 // supportedHostKeyAlgos specifies the supported host-key algorithms (i.e. methods
@@ -89,7 +101,12 @@ var supportedMACs = []string{
 	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
 }
 
-var supportedCompressions = []string{compressionNone}
+// supportedCompressions lists the compression algorithms we support.
+var supportedCompressions = []string{compressionNone, compressionZlibOpenSSH}
+
+// preferredCompressions specifies the default preference for compression
+// algorithms. Compression is off by default.
+var preferredCompressions = []string{compressionNone}
 
 // hashFuncs keeps the mapping of supported signature algorithms to their
 // respective hashes needed for signing and verification.
@@ -169,22 +186,26 @@ func findCommon(what string, client []string, server []string) (common string, e
 	return "", fmt.Errorf("ssh: no common algorithm for %s; client offered: %v, server offered: %v", what, client, server)
 }
 
-// directionAlgorithms records algorithm choices in one direction (either read or write)
-type directionAlgorithms struct {
+// DirectionAlgorithms records algorithm choices in one direction (either read or write).
+type DirectionAlgorithms struct {
 	Cipher      string
 	MAC         string
 	Compression string
 }
 
 // rekeyBytes returns a rekeying intervals in bytes.
-func (a *directionAlgorithms) rekeyBytes() int64 {
+func (a *DirectionAlgorithms) rekeyBytes() int64 {
 	// According to RFC 4344 block ciphers should rekey after
 	// 2^(BLOCKSIZE/4) blocks. For all AES flavors BLOCKSIZE is
 	// 128.
 	switch a.Cipher {
 	case "aes128-ctr", "aes192-ctr", "aes256-ctr", gcm128CipherID, gcm256CipherID, aes128cbcID:
 		return 16 * (1 << 32)
-
+	case chacha20Poly1305ID:
+		// ChaCha20 has a 64 bit block size, for which OpenSSH also
+		// rekeys after 1 GB. The 32 bit sequence number used as nonce
+		// is protected by packetRekeyThreshold.
+		return 1 << 30
 	}
 
 	// For others, stick with RFC 4253 recommendation to rekey after 1 Gb of data.
@@ -197,27 +218,75 @@ var aeadCiphers = map[string]bool{
 	chacha20Poly1305ID: true,
 }
 
-type algorithms struct {
-	kex     string
-	hostKey string
-	w       directionAlgorithms
-	r       directionAlgorithms
+// NegotiatedAlgorithms defines algorithms negotiated between client and server.
+//
+// Read and Write are relative to the side of the connection that
+// reports them: on a client, Write holds the client-to-server
+// algorithms and Read the server-to-client ones; on a server it is the
+// other way around.
+type NegotiatedAlgorithms struct {
+	KeyExchange string
+	HostKey     string
+	Read        DirectionAlgorithms
+	Write       DirectionAlgorithms
+
+	// StrictKex reports whether strict key exchange
+	// (kex-strict-*-v00@openssh.com) was agreed with the peer in the
+	// initial key exchange. It applies to the whole connection, so it
+	// is unchanged by later rekeys.
+	StrictKex bool
+}
+
+// KexInit is the content of an SSH_MSG_KEXINIT message (RFC 4253,
+// section 7.1). The name-lists are as sent, in the sender's order of
+// preference, and include pseudo-algorithms such as
+// "ext-info-c" or "kex-strict-s-v00@openssh.com".
+type KexInit struct {
+	Cookie                  [16]byte
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// clone returns a copy of k that shares no memory with it.
+func (k KexInit) clone() KexInit {
+	for _, l := range []*[]string{
+		&k.KexAlgos, &k.ServerHostKeyAlgos,
+		&k.CiphersClientServer, &k.CiphersServerClient,
+		&k.MACsClientServer, &k.MACsServerClient,
+		&k.CompressionClientServer, &k.CompressionServerClient,
+		&k.LanguagesClientServer, &k.LanguagesServerClient,
+	} {
+		if *l != nil {
+			*l = append([]string(nil), *l...)
+		}
+	}
+	return k
 }
 
-func findAgreedAlgorithms(isClient bool, clientKexInit, serverKexInit *kexInitMsg) (algs *algorithms, err error) {
-	result := &algorithms{}
+func findAgreedAlgorithms(isClient bool, clientKexInit, serverKexInit *kexInitMsg) (algs *NegotiatedAlgorithms, err error) {
+	result := &NegotiatedAlgorithms{}
 
-	result.kex, err = findCommon("key exchange", clientKexInit.KexAlgos, serverKexInit.KexAlgos)
+	result.KeyExchange, err = findCommon("key exchange", clientKexInit.KexAlgos, serverKexInit.KexAlgos)
 	if err != nil {
 		return
 	}
 
-	result.hostKey, err = findCommon("host key", clientKexInit.ServerHostKeyAlgos, serverKexInit.ServerHostKeyAlgos)
+	result.HostKey, err = findCommon("host key", clientKexInit.ServerHostKeyAlgos, serverKexInit.ServerHostKeyAlgos)
 	if err != nil {
 		return
 	}
 
-	stoc, ctos := &result.w, &result.r
+	stoc, ctos := &result.Write, &result.Read
 	if isClient {
 		ctos, stoc = stoc, ctos
 	}
@@ -259,34 +328,542 @@ func findAgreedAlgorithms(isClient bool, clientKexInit, serverKexInit *kexInitMs
 	return result, nil
 }
 
+// RekeyStats describes a completed key re-exchange. See
+// Config.RekeyCallback.
+type RekeyStats struct {
+	// Algorithms holds the algorithms negotiated in the key exchange.
+	Algorithms NegotiatedAlgorithms
+
+	// PacketsWritten and BytesWritten count the packets and payload
+	// bytes sent since the previous key exchange.
+	PacketsWritten uint64
+	BytesWritten   uint64
+
+	// PacketsRead and BytesRead count the packets and payload bytes
+	// received since the previous key exchange.
+	PacketsRead uint64
+	BytesRead   uint64
+}
+
+// TransportStats holds the cumulative traffic counters of a connection.
+// See Conn.TransportStats.
+type TransportStats struct {
+	// PacketsWritten and PacketsRead count all packets sent and
+	// received, including key exchange messages.
+	PacketsWritten uint64
+	PacketsRead    uint64
+
+	// BytesWritten and BytesRead count packet payload bytes, before
+	// compression and encryption for sending, and after decryption and
+	// decompression for receiving.
+	BytesWritten uint64
+	BytesRead    uint64
+
+	// WireBytesWritten and WireBytesRead count the bytes written to and
+	// read from the underlying connection after the version exchange.
+	WireBytesWritten uint64
+	WireBytesRead    uint64
+}
+
 // If rekeythreshold is too small, we can't make any progress sending
 // stuff.
 const minRekeyThreshold uint64 = 256
 
+// LogLevel is the severity of an event passed to a Logger.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Logger receives diagnostic events from a connection, see Config.Logger.
+// keyvals holds alternating keys, which are strings, and values. Events
+// never include secrets such as passwords, private keys or session
+// keys. Log may be called concurrently from the goroutines of a
+// connection, and must not block or call back into the connection.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
 // Config contains configuration data common to both ServerConfig and
 // ClientConfig.
 type Config struct {
 	// Rand provides the source of entropy for cryptographic
-	// primitives. If Rand is nil, the cryptographic random reader
-	// in package crypto/rand will be used.
+	// primitives: the KEXINIT cookies, key exchange secrets, packet
+	// padding, and the signatures made by host keys and client
+	// authentication. If Rand is nil, the cryptographic random reader
+	// in package crypto/rand will be used. ML-KEM encapsulation, done
+	// by servers in the mlkem768x25519-sha256 key exchange, always
+	// uses crypto/rand. Rand can be replaced for tests or to use a
+	// certified module; a predictable or weak source makes the
+	// connection insecure.
 	Rand io.Reader
 
 	// The maximum number of bytes sent or received after which a
 	// new key is negotiated. It must be at least 256. If
 	// unspecified, a size suitable for the chosen cipher is used.
+	// The bytes sent and received are counted separately, and
+	// reaching the threshold in either direction starts a key
+	// exchange. Both counts restart after every key exchange. A
+	// threshold above the limit of the chosen cipher, such as 1 GB
+	// for chacha20-poly1305@openssh.com, is lowered to that limit.
 	RekeyThreshold uint64
 
+	// RekeyInterval, if positive, is the maximum time after a key
+	// exchange before a new key is negotiated. A key exchange starts
+	// when either RekeyInterval or RekeyThreshold is reached,
+	// whichever comes first.
+	RekeyInterval time.Duration
+
+	// RekeyCallback, if not nil, is called after each key re-exchange
+	// completes, that is after SSH_MSG_NEWKEYS has been sent and
+	// received. It is not called for the initial key exchange. Calls
+	// are made one at a time, in order, from a goroutine of their own,
+	// so a slow callback delays only later callbacks, not key
+	// exchanges or other traffic. A panic in the callback is recovered
+	// and ignored.
+	RekeyCallback func(stats RekeyStats)
+
 	// The allowed key exchanges algorithms. If unspecified then a default set
 	// of algorithms is used. Unsupported values are silently ignored.
 	KeyExchanges []string
 
 	// The allowed cipher algorithms. If unspecified then a sensible default is
-	// used. Unsupported values are silently ignored.
+	// used. Unsupported values are silently ignored. Ciphers added with
+	// RegisterCipher are only used if listed here.
 	Ciphers []string
 
-	// The allowed MAC algorithms. If unspecified then a sensible default is
-	// used. Unsupported values are silently ignored.
+	// The allowed MAC algorithms, in preference order. If unspecified
+	// then a sensible default is used, which prefers the
+	// encrypt-then-MAC variants. Unsupported values are silently
+	// ignored. Only the listed algorithms are offered; as with the other
+	// algorithm lists, the first one in the client's list that the
+	// server also offers is used. No MAC is negotiated for AEAD ciphers
+	// such as aes128-gcm@openssh.com, which authenticate the packets
+	// themselves. MACs added with RegisterMAC are only used if listed
+	// here.
 	MACs []string
+
+	// CiphersClientToServer and CiphersServerToClient, if not nil,
+	// replace Ciphers for one direction of the connection, so that the
+	// two directions can use different ciphers. Likewise,
+	// MACsClientToServer and MACsServerToClient replace MACs. Each
+	// direction is negotiated separately, and the handshake fails if
+	// either has no algorithm in common with the peer.
+	CiphersClientToServer []string
+	CiphersServerToClient []string
+	MACsClientToServer    []string
+	MACsServerToClient    []string
+
+	// The allowed compression algorithms, in preference order. The
+	// supported values are "none" and "zlib@openssh.com", which
+	// compresses all packets after successful user authentication. If
+	// unspecified, compression is disabled. "none" is added if missing,
+	// so that connections to peers that don't support compression
+	// still succeed. Unsupported values are silently ignored.
+	Compression []string
+
+	// CompressionClientToServer and CompressionServerToClient, if not
+	// nil, replace Compression for one direction of the connection, so
+	// that, for example, only the server's output is compressed. They
+	// are treated like Compression, and each direction is negotiated
+	// separately. A direction that negotiates "none" has no compression
+	// state.
+	CompressionClientToServer []string
+	CompressionServerToClient []string
+
+	// PacketTraceReader and PacketTraceWriter, if not nil, are called
+	// with a copy of every packet received, after decryption, and
+	// sent, before encryption, respectively. A packet consists of the
+	// message type byte followed by the payload. Received
+	// SSH_MSG_IGNORE and SSH_MSG_DEBUG messages are discarded before
+	// they reach PacketTraceReader. The hooks are called from the
+	// goroutines reading and writing the connection, so they must not
+	// block or call back into the connection.
+	PacketTraceReader func(packet []byte)
+	PacketTraceWriter func(packet []byte)
+
+	// KeepAliveInterval, if positive, is the interval at which a
+	// keepalive@openssh.com global request is sent to the peer once
+	// the connection is established.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveCountMax is the number of consecutive keepalive
+	// requests that may go unanswered, each for KeepAliveInterval,
+	// before the connection is closed. If zero, 3 is used. It has no
+	// effect unless KeepAliveInterval is positive, or if
+	// KeepAliveCallback is set.
+	KeepAliveCountMax int
+
+	// KeepAliveCallback, if not nil, is called after each keepalive
+	// request sent for KeepAliveInterval, and decides when the peer is
+	// considered dead instead of KeepAliveCountMax. latency is the time
+	// the reply took, or KeepAliveInterval if there was none in time,
+	// and consecutiveFailures is the number of requests in a row,
+	// including this one, left unanswered; it is zero after a reply.
+	// If the callback returns an error, an SSH_MSG_DISCONNECT with
+	// DisconnectByApplication and the error text is sent and the
+	// connection is closed. It is called from its own goroutine, one
+	// call at a time.
+	KeepAliveCallback func(latency time.Duration, consecutiveFailures int) error
+
+	// ObfuscationInterval, if positive, is the average interval at
+	// which SSH_MSG_IGNORE messages with random payloads of up to 255
+	// bytes are sent once the connection is established, to make
+	// timing and size analysis of the traffic harder. Each interval is
+	// chosen at random between half and one and a half times
+	// ObfuscationInterval.
+	ObfuscationInterval time.Duration
+
+	// DisableExtInfo, if true, turns off the RFC 8308 extension
+	// negotiation: a client doesn't advertise "ext-info-c" and ignores
+	// any SSH_MSG_EXT_INFO it receives, and a server doesn't send
+	// SSH_MSG_EXT_INFO. Without the "server-sig-algs" extension, a client
+	// signs public key authentication requests with the algorithm named
+	// after each key's format, which is ssh-rsa (SHA-1) for RSA keys.
+	DisableExtInfo bool
+
+	// RequireStrictKex, if true, fails the initial key exchange unless
+	// the peer also offers the strict key exchange extension
+	// (kex-strict-c-v00@openssh.com or kex-strict-s-v00@openssh.com),
+	// the mitigation for the Terrapin attack (CVE-2023-48795). Strict
+	// key exchange is always offered, and used whenever the peer
+	// supports it; this only rejects peers that don't.
+	RequireStrictKex bool
+
+	// IdleTimeout, if positive, is how long the connection may go
+	// without any channel data or requests being sent or received. Once
+	// it is exceeded, an SSH_MSG_DISCONNECT with DisconnectByApplication
+	// is sent and the connection is closed. SSH_MSG_IGNORE and
+	// SSH_MSG_DEBUG messages, including those sent for
+	// ObfuscationInterval, never count as activity.
+	IdleTimeout time.Duration
+
+	// IdleTimeoutIgnoreKeepAlives, if true, stops keepalive@openssh.com
+	// requests, such as those sent for KeepAliveInterval, and request
+	// replies from counting as activity for IdleTimeout.
+	IdleTimeoutIgnoreKeepAlives bool
+
+	// DebugCallback, if not nil, is called with each SSH_MSG_DEBUG
+	// message received after the initial key exchange. The message is
+	// otherwise discarded. It is called from the goroutine reading the
+	// connection, so it must not block or call back into the
+	// connection. Messages can be sent with DebugConn.SendDebug.
+	DebugCallback func(alwaysDisplay bool, message, lang string)
+
+	// MaxPacketSize is the largest packet payload accepted from the
+	// peer, after decompression; a larger packet ends the connection
+	// with an error. If zero, 262144 is used, OpenSSH's limit. It can
+	// be raised to accept jumbo packets, up to 1048576, or lowered to
+	// 32781, which fits a channel data message of 32768 bytes, the
+	// channel maximum packet size RFC 4253 requires and that this
+	// package uses by default. Values outside that range are clamped
+	// to it. It must leave room for the channel maximum packet sizes in
+	// use, see ChannelOptions.MaxPacketSize, plus a few bytes of header.
+	MaxPacketSize uint32
+
+	// UnimplementedCallback, if not nil, is called for each
+	// SSH_MSG_UNIMPLEMENTED message received after the initial key
+	// exchange, which a peer sends in reply to a message type it does
+	// not know. seqNum is the sequence number of the rejected packet,
+	// and msgType the type of the packet sent with that number, if it
+	// is among the last 256 packets sent, or 0 otherwise. Sequence
+	// numbers restart from zero after each key exchange when strict key
+	// exchange is in use. The message is otherwise ignored. The callback
+	// is called from the goroutine reading the connection, so it must
+	// not block or call back into the connection.
+	UnimplementedCallback func(seqNum uint32, msgType byte)
+
+	// Logger, if not nil, receives events for key exchanges,
+	// authentication attempts and channel opens. Nothing is logged if
+	// it is nil.
+	Logger Logger
+
+	// GuessKeyExchange, if true, makes a client send the first message
+	// of its preferred key exchange right after its SSH_MSG_KEXINIT,
+	// with first_kex_packet_follows set (RFC 4253, section 7.1). This
+	// saves a round trip if the server's preferred key exchange and
+	// host key algorithms are the client's. Otherwise, the server
+	// discards the guessed message and the key exchange continues as
+	// usual, so it only helps if the guess is usually right. It is
+	// ignored by servers.
+	GuessKeyExchange bool
+
+	// PadPacketsTo, if greater than the cipher block size, makes the
+	// packets sent after the first key exchange carry extra random
+	// padding (RFC 4253, section 6), so that their padded length is a
+	// multiple of PadPacketsTo bytes. This hides the exact length of
+	// short messages, such as keystrokes. Padding is limited to 255
+	// bytes per packet, so longer packets are padded as far as that
+	// allows. If zero, packets get the minimum padding.
+	PadPacketsTo int
+
+	// MaxChannels, if positive, limits the number of channels open on
+	// a connection at once, counting those opened by either side.
+	// Channels the peer opens beyond the limit are rejected with
+	// ResourceShortage, and OpenChannel fails once it is reached. A
+	// channel stops counting once both sides have closed it, or when
+	// it is rejected. See ChannelCountConn for the current number. If
+	// zero, the number of channels is not limited.
+	MaxChannels int
+
+	// MinDHGroupBits, if above 2048, is the smallest prime size, in
+	// bits, a client accepts in the diffie-hellman-group-exchange-sha1
+	// and diffie-hellman-group-exchange-sha256 key exchanges. The
+	// client asks the server for a group at least that large, and the
+	// key exchange fails if the server sends a smaller one. The server
+	// in this package then uses a 4096-bit group. Key exchanges with a
+	// fixed group, such as diffie-hellman-group14-sha256, are not
+	// affected.
+	MinDHGroupBits int
+
+	// HandshakeTimeout, if positive, bounds the time NewClientConn and
+	// NewServerConn spend on the version exchange and the initial key
+	// exchange, for example with a peer that accepts the connection and
+	// never sends its version. If it expires, the connection is closed
+	// and the error returned satisfies errors.Is(err,
+	// os.ErrDeadlineExceeded). Authentication is not covered. If zero,
+	// the handshake is not limited.
+	HandshakeTimeout time.Duration
+
+	// MaxPendingGlobalRequests limits the number of global requests
+	// from the peer that want a reply and have not been replied to yet,
+	// counting those waiting to be read from the Request channel. A
+	// peer that sends one more is disconnected with
+	// DisconnectByApplication and the message "too many pending global
+	// requests", as replies must keep the order of the requests. If
+	// zero, the limit is 64; if negative, the number of pending
+	// requests is not limited.
+	MaxPendingGlobalRequests int
+
+	// UnhandledGlobalRequests selects what is done with the global
+	// requests from the peer that the package doesn't handle itself,
+	// or with a handler registered with
+	// ServerConfig.RegisterGlobalRequestHandler. With the default,
+	// GlobalRequestReplyFailure, they are delivered on the Request
+	// channel as before; a Client replies failure to them. With
+	// GlobalRequestIgnore or GlobalRequestCallHandler, they are not
+	// delivered on the Request channel.
+	UnhandledGlobalRequests GlobalRequestDisposition
+
+	// UnhandledGlobalRequestHandler is called with the unhandled
+	// global requests if UnhandledGlobalRequests is
+	// GlobalRequestCallHandler, and must call Reply on those that want
+	// a reply. It is called while the connection's packets are read,
+	// so it must not block, and must not wait on the connection. If it
+	// is nil, GlobalRequestCallHandler acts as
+	// GlobalRequestReplyFailure.
+	UnhandledGlobalRequestHandler func(req *Request)
+
+	// The net package enables TCP_NODELAY on every TCP connection it
+	// creates, so small packets, such as keystrokes and RPC messages,
+	// are not delayed by Nagle's algorithm; NewClientConn and
+	// NewServerConn also enable it on a *net.TCPConn that was set up
+	// otherwise. DisableTCPNoDelay clears TCP_NODELAY instead, turning
+	// Nagle's algorithm back on.
+	DisableTCPNoDelay bool
+
+	// TCPKeepAlivePeriod, if positive, makes NewClientConn and
+	// NewServerConn enable SO_KEEPALIVE with this period on connections
+	// that are a *net.TCPConn; if negative, it disables SO_KEEPALIVE.
+	// If zero, the setting made by the net package, which enables it
+	// for dialed and accepted connections by default, is kept. TCP
+	// keepalives only detect dead peers and keep middleboxes' state,
+	// and are invisible to the SSH peer; KeepAliveInterval, in
+	// contrast, checks that the peer's SSH implementation responds,
+	// and works over any net.Conn.
+	TCPKeepAlivePeriod time.Duration
+}
+
+// setTCPOptions applies DisableTCPNoDelay and TCPKeepAlivePeriod to conn.
+// Other connection types are left alone, and errors are ignored, as
+// the options are only tuning.
+func (c *Config) setTCPOptions(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(!c.DisableTCPNoDelay)
+	switch {
+	case c.TCPKeepAlivePeriod > 0:
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(c.TCPKeepAlivePeriod)
+	case c.TCPKeepAlivePeriod < 0:
+		tc.SetKeepAlive(false)
+	}
+}
+
+// GlobalRequestDisposition is what is done with unhandled global
+// requests; see Config.UnhandledGlobalRequests.
+type GlobalRequestDisposition int
+
+const (
+	// GlobalRequestReplyFailure delivers the requests on the Request
+	// channel, where DiscardRequests and Client reply failure to
+	// those that want a reply.
+	GlobalRequestReplyFailure GlobalRequestDisposition = iota
+
+	// GlobalRequestIgnore drops the requests without replying, even
+	// if they want a reply. As replies are matched to requests by
+	// their order, this is only suitable for peers that don't wait
+	// for one.
+	GlobalRequestIgnore
+
+	// GlobalRequestCallHandler passes the requests to
+	// Config.UnhandledGlobalRequestHandler.
+	GlobalRequestCallHandler
+)
+
+// minPacketSize is the payload size that RFC 4253, section 6.1, requires
+// implementations to accept.
+const minPacketSize = 32768
+
+// minMaxPacketSize is the smallest MaxPacketSize. It fits a channel
+// extended data message, whose header takes 13 bytes, that carries
+// channelMaxPacket bytes, the most a peer sends on a channel opened
+// with the default options.
+const minMaxPacketSize = channelMaxPacket + 13
+
+// rekeyThreshold returns the number of bytes after which a new key is
+// negotiated for a direction using algs, which is nil before the first
+// key exchange. RekeyThreshold can lower the limit of the cipher, but
+// not raise it.
+func (c *Config) rekeyThreshold(algs *DirectionAlgorithms) int64 {
+	limit := int64(1 << 30)
+	if algs != nil {
+		limit = algs.rekeyBytes()
+	}
+	if c.RekeyThreshold > 0 && c.RekeyThreshold < uint64(limit) {
+		return int64(c.RekeyThreshold)
+	}
+	return limit
+}
+
+// defaultMaxPendingGlobalRequests is the default of
+// Config.MaxPendingGlobalRequests.
+const defaultMaxPendingGlobalRequests = 64
+
+// maxPendingGlobalRequests returns the limit on pending global requests,
+// or zero if there is none.
+func (c *Config) maxPendingGlobalRequests() int {
+	switch {
+	case c.MaxPendingGlobalRequests == 0:
+		return defaultMaxPendingGlobalRequests
+	case c.MaxPendingGlobalRequests < 0:
+		return 0
+	}
+	return c.MaxPendingGlobalRequests
+}
+
+// unhandledGlobalRequest returns the function that disposes of
+// unhandled global requests per UnhandledGlobalRequests, or nil to
+// deliver them on the Request channel.
+func (c *Config) unhandledGlobalRequest() func(*Request) {
+	switch c.UnhandledGlobalRequests {
+	case GlobalRequestIgnore:
+		return func(r *Request) {
+			// The request won't be replied to, so it mustn't
+			// hold up the replies to later ones.
+			r.mux.replies.reply(r, nil, r.mux.sendMessage)
+		}
+	case GlobalRequestCallHandler:
+		return c.UnhandledGlobalRequestHandler
+	}
+	return nil
+}
+
+// maxPacketSize returns MaxPacketSize clamped to the supported range.
+func (c *Config) maxPacketSize() uint32 {
+	switch {
+	case c.MaxPacketSize == 0:
+		return maxPacket
+	case c.MaxPacketSize > maxPacketLimit:
+		return maxPacketLimit
+	case c.MaxPacketSize < minMaxPacketSize:
+		return minMaxPacketSize
+	}
+	return c.MaxPacketSize
+}
+
+// supportedAlgorithms returns the algorithms for which supported returns
+// true. It returns nil if algos is nil, so that an unset list stays
+// unset.
+func supportedAlgorithms(algos []string, supported func(string) bool) []string {
+	if algos == nil {
+		return nil
+	}
+	result := []string{}
+	for _, a := range algos {
+		if supported(a) {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// directionalAlgorithms returns the cipher and MAC lists to offer for
+// each direction.
+func (c *Config) directionalAlgorithms() (ciphersCtoS, ciphersStoC, macsCtoS, macsStoC []string) {
+	ciphersCtoS, ciphersStoC = c.Ciphers, c.Ciphers
+	if c.CiphersClientToServer != nil {
+		ciphersCtoS = c.CiphersClientToServer
+	}
+	if c.CiphersServerToClient != nil {
+		ciphersStoC = c.CiphersServerToClient
+	}
+	macsCtoS, macsStoC = c.MACs, c.MACs
+	if c.MACsClientToServer != nil {
+		macsCtoS = c.MACsClientToServer
+	}
+	if c.MACsServerToClient != nil {
+		macsStoC = c.MACsServerToClient
+	}
+	return
+}
+
+// directionalCompressions returns the compression lists to offer for each
+// direction.
+func (c *Config) directionalCompressions() (ctos, stoc []string) {
+	ctos, stoc = c.Compression, c.Compression
+	if c.CompressionClientToServer != nil {
+		ctos = c.CompressionClientToServer
+	}
+	if c.CompressionServerToClient != nil {
+		stoc = c.CompressionServerToClient
+	}
+	return
+}
+
+// supportedCompressionList returns the supported algorithms of
+// compressions, with "none" appended if it is missing.
+func supportedCompressionList(compressions []string) []string {
+	var result []string
+	hasNone := false
+	for _, comp := range compressions {
+		if contains(supportedCompressions, comp) {
+			// Ignore the compression if we don't support it.
+			result = append(result, comp)
+			hasNone = hasNone || comp == compressionNone
+		}
+	}
+	if !hasNone {
+		result = append(result, compressionNone)
+	}
+	return result
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
@@ -332,6 +909,22 @@ func (c *Config) SetDefaults() {
 	}
 	c.MACs = macs
 
+	c.CiphersClientToServer = supportedAlgorithms(c.CiphersClientToServer, func(a string) bool { return cipherModes[a] != nil })
+	c.CiphersServerToClient = supportedAlgorithms(c.CiphersServerToClient, func(a string) bool { return cipherModes[a] != nil })
+	c.MACsClientToServer = supportedAlgorithms(c.MACsClientToServer, func(a string) bool { return macModes[a] != nil })
+	c.MACsServerToClient = supportedAlgorithms(c.MACsServerToClient, func(a string) bool { return macModes[a] != nil })
+
+	if c.Compression == nil {
+		c.Compression = preferredCompressions
+	}
+	c.Compression = supportedCompressionList(c.Compression)
+	if c.CompressionClientToServer != nil {
+		c.CompressionClientToServer = supportedCompressionList(c.CompressionClientToServer)
+	}
+	if c.CompressionServerToClient != nil {
+		c.CompressionServerToClient = supportedCompressionList(c.CompressionServerToClient)
+	}
+
 	if c.RekeyThreshold == 0 {
 		// cipher specific default
 	} else if c.RekeyThreshold < minRekeyThreshold {
@@ -340,6 +933,10 @@ func (c *Config) SetDefaults() {
 		// Avoid weirdness if somebody uses -1 as a threshold.
 		c.RekeyThreshold = math.MaxInt64
 	}
+
+	if c.KeepAliveCountMax <= 0 {
+		c.KeepAliveCountMax = 3
+	}
 }
 
 // buildDataSignedForAuth returns the data that is signed in order to prove
@@ -368,6 +965,34 @@ func buildDataSignedForAuth(sessionID []byte, req userAuthRequestMsg, algo strin
 	return Marshal(data)
 }
 
+// buildDataSignedForHostBased returns the data signed for a "hostbased"
+// request, which is msg without its signature, preceded by the session
+// ID. See RFC 4252, section 9.
+func buildDataSignedForHostBased(sessionID []byte, msg hostBasedAuthMsg) []byte {
+	data := struct {
+		Session    []byte
+		Type       byte
+		User       string
+		Service    string
+		Method     string
+		Algo       string
+		PubKey     []byte
+		ClientHost string
+		ClientUser string
+	}{
+		sessionID,
+		msgUserAuthRequest,
+		msg.User,
+		msg.Service,
+		msg.Method,
+		msg.Algoname,
+		msg.PubKey,
+		msg.ClientHost,
+		msg.ClientUser,
+	}
+	return Marshal(data)
+}
+
 func appendU16(buf []byte, n uint16) []byte {
 	return append(buf, byte(n>>8), byte(n))
 }
@@ -403,6 +1028,38 @@ func appendBool(buf []byte, b bool) []byte {
 // value for sync.Cond.
 func newCond() *sync.Cond { return sync.NewCond(new(sync.Mutex)) }
 
+// condDeadline is a deadline for goroutines waiting on a sync.Cond. It
+// is protected by the lock of the Cond.
+type condDeadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+// set sets the deadline to t, and wakes up the waiters on c when it
+// passes. A zero t clears the deadline. The caller must hold c.L.
+func (d *condDeadline) set(c *sync.Cond, t time.Time) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.t = t
+	// Let waiters check a deadline set in the past.
+	c.Broadcast()
+	if dur := time.Until(t); !t.IsZero() && dur > 0 {
+		d.timer = time.AfterFunc(dur, func() {
+			c.L.Lock()
+			c.Broadcast()
+			c.L.Unlock()
+		})
+	}
+}
+
+// exceeded reports whether the deadline has passed. The caller must hold
+// the lock of the Cond.
+func (d *condDeadline) exceeded() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
 // window represents the buffer available to clients
 // wishing to write to a channel.
 type window struct {
@@ -410,6 +1067,8 @@ type window struct {
 	win          uint32 // RFC 4254 5.2 says the window size can grow to 2^32-1
 	writeWaiters int
 	closed       bool
+	closeErr     error // returned instead of io.EOF once closed, if set
+	deadline     condDeadline
 }
 
 // add adds win to the amount of window available
@@ -433,24 +1092,52 @@ func (w *window) add(win uint32) bool {
 	return true
 }
 
+// size returns the amount of window available.
+func (w *window) size() uint32 {
+	w.L.Lock()
+	defer w.L.Unlock()
+	return w.win
+}
+
 // close sets the window to closed, so all reservations fail
 // immediately.
 func (w *window) close() {
+	w.closeWithError(nil)
+}
+
+// closeWithError is like close, but reservations fail with err rather
+// than io.EOF if it is not nil.
+func (w *window) closeWithError(err error) {
 	w.L.Lock()
+	if !w.closed {
+		w.closeErr = err
+	}
 	w.closed = true
 	w.Broadcast()
 	w.L.Unlock()
 }
 
+// setDeadline sets the deadline for reservations.
+func (w *window) setDeadline(t time.Time) {
+	w.L.Lock()
+	w.deadline.set(w.Cond, t)
+	w.L.Unlock()
+}
+
 // reserve reserves win from the available window capacity.
-// If no capacity remains, reserve will block. reserve may
-// return less than requested.
+// If no capacity remains, reserve will block until the deadline, if
+// any. reserve may return less than requested.
 func (w *window) reserve(win uint32) (uint32, error) {
 	var err error
 	w.L.Lock()
 	w.writeWaiters++
 	w.Broadcast()
 	for w.win == 0 && !w.closed {
+		if w.deadline.exceeded() {
+			w.writeWaiters--
+			w.L.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
 		w.Wait()
 	}
 	w.writeWaiters--
@@ -460,6 +1147,9 @@ func (w *window) reserve(win uint32) (uint32, error) {
 	w.win -= win
 	if w.closed {
 		err = io.EOF
+		if w.closeErr != nil {
+			err = w.closeErr
+		}
 	}
 	w.L.Unlock()
 	return win, err
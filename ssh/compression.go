@@ -0,0 +1,511 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+)
+
+// compressionZlibOpenSSH is the delayed zlib compression defined by
+// OpenSSH. It is negotiated like any other compression algorithm, but
+// only starts after successful user authentication, so that
+// unauthenticated peers can't reach the zlib code.
+const compressionZlibOpenSSH = "zlib@openssh.com"
+
+var errDecompressorClosed = errors.New("ssh: connection closed")
+
+// compressor compresses outgoing packets. All packets in one direction
+// form a single zlib stream, which is flushed at the end of every packet
+// so that the peer can decode it without waiting for more data.
+type compressor struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func newCompressor() *compressor {
+	c := &compressor{}
+	c.w = zlib.NewWriter(&c.buf)
+	return c
+}
+
+// compress returns the compressed form of packet. The result is only
+// valid until the next call.
+func (c *compressor) compress(packet []byte) ([]byte, error) {
+	c.buf.Reset()
+	if _, err := c.w.Write(packet); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+// decompressor inflates incoming packets. A packet need not end on a
+// byte boundary of the deflate bit stream, and OpenSSH ends packets with
+// Z_PARTIAL_FLUSH, after which compress/flate only returns the decoded
+// data together with io.ErrUnexpectedEOF. That error is sticky, and Reset
+// can't resume in the middle of a byte. The stream is therefore decoded by a
+// goroutine running a small inflater, which hands over its output
+// whenever it has consumed all the input received so far.
+type decompressor struct {
+	in     chan []byte
+	out    chan decompressResult
+	closed <-chan struct{} // closed with the transport
+	stop   chan struct{}   // closed by close
+	err    error
+	limit  int // the largest decompressed packet
+
+	// Owned by the goroutine.
+	cur      []byte
+	started  bool
+	bitBuf   uint32
+	bitCount uint
+	window   [1 << 15]byte
+	wpos     int
+	wfull    bool
+	pending  []byte
+}
+
+// decompressResult is the decompressed form of one packet, or an error.
+type decompressResult struct {
+	data []byte
+	err  error
+}
+
+var errCorruptCompression = errors.New("ssh: corrupt compressed data")
+
+// newDecompressor returns a decompressor that fails on packets that
+// decompress to more than limit bytes, or maxPacket bytes if limit is
+// zero.
+func newDecompressor(closed <-chan struct{}, limit uint32) *decompressor {
+	if limit == 0 {
+		limit = maxPacket
+	}
+	d := &decompressor{
+		in:     make(chan []byte),
+		out:    make(chan decompressResult),
+		closed: closed,
+		stop:   make(chan struct{}),
+		limit:  int(limit),
+	}
+	go d.run()
+	return d
+}
+
+// decompress returns the decompressed form of packet.
+func (d *decompressor) decompress(packet []byte) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	select {
+	case d.in <- packet:
+	case <-d.closed:
+		return nil, errDecompressorClosed
+	case <-d.stop:
+		return nil, errDecompressorClosed
+	}
+	select {
+	case r := <-d.out:
+		if r.err != nil {
+			d.err = r.err
+		}
+		return r.data, r.err
+	case <-d.closed:
+		return nil, errDecompressorClosed
+	case <-d.stop:
+		return nil, errDecompressorClosed
+	}
+}
+
+func (d *decompressor) run() {
+	err := d.inflate()
+	select {
+	case d.out <- decompressResult{err: err}:
+	case <-d.closed:
+	case <-d.stop:
+	}
+}
+
+// close stops the goroutine. The decompressor can't be used afterwards.
+func (d *decompressor) close() {
+	close(d.stop)
+}
+
+// next hands over the output for the packet that has been consumed, and
+// waits for the next one.
+func (d *decompressor) next() error {
+	if d.started {
+		select {
+		case d.out <- decompressResult{data: d.pending}:
+		case <-d.closed:
+			return errDecompressorClosed
+		case <-d.stop:
+			return errDecompressorClosed
+		}
+		d.pending = nil
+	}
+	d.started = true
+	select {
+	case d.cur = <-d.in:
+		return nil
+	case <-d.closed:
+		return errDecompressorClosed
+	case <-d.stop:
+		return errDecompressorClosed
+	}
+}
+
+func (d *decompressor) readByte() (byte, error) {
+	for len(d.cur) == 0 {
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	b := d.cur[0]
+	d.cur = d.cur[1:]
+	return b, nil
+}
+
+// bits returns the next n bits of the stream, least significant first.
+func (d *decompressor) bits(n uint) (int, error) {
+	for d.bitCount < n {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		d.bitBuf |= uint32(b) << d.bitCount
+		d.bitCount += 8
+	}
+	v := int(d.bitBuf & (1<<n - 1))
+	d.bitBuf >>= n
+	d.bitCount -= n
+	return v, nil
+}
+
+func (d *decompressor) emit(b byte) error {
+	if len(d.pending) >= d.limit {
+		return errors.New("ssh: decompressed packet too large")
+	}
+	d.pending = append(d.pending, b)
+	d.window[d.wpos] = b
+	d.wpos++
+	if d.wpos == len(d.window) {
+		d.wpos = 0
+		d.wfull = true
+	}
+	return nil
+}
+
+// inflate decodes the zlib stream (RFC 1950 and RFC 1951) until an error
+// occurs. The stream of an SSH connection never ends, so the final block
+// is an error too.
+func (d *decompressor) inflate() error {
+	cmf, err := d.bits(8)
+	if err != nil {
+		return err
+	}
+	flg, err := d.bits(8)
+	if err != nil {
+		return err
+	}
+	if cmf&0x0f != 8 || (cmf<<8|flg)%31 != 0 || flg&0x20 != 0 {
+		return errCorruptCompression
+	}
+
+	for {
+		final, err := d.bits(1)
+		if err != nil {
+			return err
+		}
+		typ, err := d.bits(2)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+			err = d.stored()
+		case 1:
+			err = d.codes(&fixedLitLen, &fixedDist)
+		case 2:
+			err = d.dynamic()
+		default:
+			err = errCorruptCompression
+		}
+		if err != nil {
+			return err
+		}
+		if final == 1 {
+			return errors.New("ssh: unexpected end of compressed stream")
+		}
+	}
+}
+
+func (d *decompressor) stored() error {
+	d.bitBuf, d.bitCount = 0, 0
+	var hdr [4]byte
+	for i := range hdr {
+		b, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		hdr[i] = b
+	}
+	n := int(hdr[0]) | int(hdr[1])<<8
+	if n != ^(int(hdr[2])|int(hdr[3])<<8)&0xffff {
+		return errCorruptCompression
+	}
+	for ; n > 0; n-- {
+		b, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		if err := d.emit(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	lengthBase  = [...]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// Order of the code length code lengths in a dynamic block header.
+	codeLengthOrder = [...]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLitLen, fixedDist huffman
+)
+
+func init() {
+	var lengths [288]int
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLitLen.build(lengths[:])
+	// The fixed distance code includes the invalid symbols 30 and 31,
+	// so that they are decoded and rejected rather than waited on.
+	for i := 0; i < 32; i++ {
+		lengths[i] = 5
+	}
+	fixedDist.build(lengths[:32])
+}
+
+// huffman is a canonical Huffman code, stored as the number of codes of
+// each length and the symbols ordered by code.
+type huffman struct {
+	count  [16]int
+	symbol []int
+}
+
+// build sets up h for the given code lengths. It returns a negative
+// number if the code is over-subscribed, a positive number if it is
+// incomplete, and 0 if it is complete.
+func (h *huffman) build(lengths []int) int {
+	h.count = [16]int{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.symbol = make([]int, len(lengths))
+	if h.count[0] == len(lengths) {
+		return 0
+	}
+	left := 1
+	for l := 1; l < len(h.count); l++ {
+		left <<= 1
+		left -= h.count[l]
+		if left < 0 {
+			return left
+		}
+	}
+	var offs [16]int
+	for l := 1; l < len(h.count)-1; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = sym
+			offs[l]++
+		}
+	}
+	return left
+}
+
+// decode reads one symbol coded with h.
+func (d *decompressor) decode(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l < len(h.count); l++ {
+		if d.bitCount == 0 {
+			b, err := d.readByte()
+			if err != nil {
+				return 0, err
+			}
+			d.bitBuf, d.bitCount = uint32(b), 8
+		}
+		code |= int(d.bitBuf & 1)
+		d.bitBuf >>= 1
+		d.bitCount--
+		count := h.count[l]
+		if code-count < first {
+			return h.symbol[index+code-first], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorruptCompression
+}
+
+func (d *decompressor) dynamic() error {
+	nlen, err := d.bits(5)
+	if err != nil {
+		return err
+	}
+	ndist, err := d.bits(5)
+	if err != nil {
+		return err
+	}
+	ncode, err := d.bits(4)
+	if err != nil {
+		return err
+	}
+	nlen += 257
+	ndist++
+	ncode += 4
+	if nlen > 286 || ndist > 30 {
+		return errCorruptCompression
+	}
+
+	var lengths [286 + 30]int
+	for i := 0; i < ncode; i++ {
+		if lengths[codeLengthOrder[i]], err = d.bits(3); err != nil {
+			return err
+		}
+	}
+	var lencode, distcode huffman
+	if lencode.build(lengths[:19]) != 0 {
+		return errCorruptCompression
+	}
+
+	lengths = [286 + 30]int{}
+	for i := 0; i < nlen+ndist; {
+		sym, err := d.decode(&lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = sym
+			i++
+			continue
+		}
+		var l, rep int
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorruptCompression
+			}
+			l = lengths[i-1]
+			rep, err = d.bits(2)
+			rep += 3
+		case 17:
+			rep, err = d.bits(3)
+			rep += 3
+		default:
+			rep, err = d.bits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+rep > nlen+ndist {
+			return errCorruptCompression
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errCorruptCompression
+	}
+
+	// As in zlib, incomplete codes are only allowed if they consist of
+	// a single code of length 1.
+	if left := lencode.build(lengths[:nlen]); left < 0 || (left > 0 && (lencode.count[1] != 1 || nlen-lencode.count[0] != 1)) {
+		return errCorruptCompression
+	}
+	if left := distcode.build(lengths[nlen : nlen+ndist]); left < 0 || (left > 0 && (distcode.count[1] != 1 || ndist-distcode.count[0] != 1)) {
+		return errCorruptCompression
+	}
+	return d.codes(&lencode, &distcode)
+}
+
+// codes decodes the literals and back references of a compressed block.
+func (d *decompressor) codes(lencode, distcode *huffman) error {
+	for {
+		sym, err := d.decode(lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			if err := d.emit(byte(sym)); err != nil {
+				return err
+			}
+			continue
+		}
+		if sym == 256 {
+			return nil
+		}
+
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errCorruptCompression
+		}
+		extra, err := d.bits(lengthExtra[sym])
+		if err != nil {
+			return err
+		}
+		length := lengthBase[sym] + extra
+
+		sym, err = d.decode(distcode)
+		if err != nil {
+			return err
+		}
+		if sym >= len(distBase) {
+			return errCorruptCompression
+		}
+		if extra, err = d.bits(distExtra[sym]); err != nil {
+			return err
+		}
+		dist := distBase[sym] + extra
+		if !d.wfull && dist > d.wpos {
+			return errCorruptCompression
+		}
+
+		for ; length > 0; length-- {
+			pos := d.wpos - dist
+			if pos < 0 {
+				pos += len(d.window)
+			}
+			if err := d.emit(d.window[pos]); err != nil {
+				return err
+			}
+		}
+	}
+}
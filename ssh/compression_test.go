@@ -0,0 +1,408 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestDecompressPartialFlush(t *testing.T) {
+	// Produced by zlib with Z_PARTIAL_FLUSH after each packet, as
+	// OpenSSH does. The packets don't end on byte boundaries.
+	packets := []struct {
+		compressed string
+		want       string
+	}{
+		{"789cca48cdc9c95728cf2fca49c9c0ca0408", "hello worldhello worldhello world"},
+		{"a0e2d4e4fcbc148582c4e4ecd4128000", "second packet"},
+		{"aa1805a360140c7b0010", string(bytes.Repeat([]byte("x"), 1000))},
+	}
+
+	closed := make(chan struct{})
+	defer close(closed)
+	d := newDecompressor(closed, maxPacket)
+	for i, p := range packets {
+		in, _ := hex.DecodeString(p.compressed)
+		got, err := d.decompress(in)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if string(got) != p.want {
+			t.Errorf("packet %d: got %q, want %q", i, got, p.want)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+	c := newCompressor()
+	d := newDecompressor(closed, maxPacket)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 40; i++ {
+		packet := make([]byte, 1+r.Intn(64*1024))
+		if i%2 == 0 {
+			r.Read(packet)
+		} else {
+			for j := range packet {
+				packet[j] = "ssh\n"[r.Intn(4)]
+			}
+		}
+		compressed, err := c.compress(packet)
+		if err != nil {
+			t.Fatalf("compress: %v", err)
+		}
+		got, err := d.decompress(compressed)
+		if err != nil {
+			t.Fatalf("packet %d: decompress: %v", i, err)
+		}
+		if !bytes.Equal(got, packet) {
+			t.Fatalf("packet %d: round trip mismatch", i)
+		}
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+	d := newDecompressor(closed, maxPacket)
+	if _, err := d.decompress([]byte{0x78, 0x9c, 0xff, 0xff}); err == nil {
+		t.Fatal("decompress succeeded on corrupt input")
+	}
+	// The error is sticky.
+	if _, err := d.decompress([]byte{0x78, 0x9c}); err == nil {
+		t.Fatal("decompress succeeded after an error")
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+	c := newCompressor()
+	d := newDecompressor(closed, maxPacket)
+	compressed, err := c.compress(make([]byte, maxPacket+1))
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if _, err := d.decompress(compressed); err == nil {
+		t.Fatal("decompress succeeded on an oversized packet")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, tt := range []struct {
+		name                       string
+		clientConfig, serverConfig []string
+		want                       string
+	}{
+		{"both", []string{compressionZlibOpenSSH}, []string{compressionNone, compressionZlibOpenSSH}, compressionZlibOpenSSH},
+		{"fallback", []string{compressionZlibOpenSSH}, nil, compressionNone},
+		{"client default", nil, []string{compressionZlibOpenSSH}, compressionNone},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testCompression(t, Config{Compression: tt.clientConfig}, Config{Compression: tt.serverConfig}, tt.want, tt.want)
+		})
+	}
+}
+
+func TestCompressionPerDirection(t *testing.T) {
+	zlib := []string{compressionZlibOpenSSH}
+	none := []string{compressionNone}
+	t.Run("server to client only", func(t *testing.T) {
+		testCompression(t,
+			Config{Compression: zlib, CompressionClientToServer: none},
+			Config{Compression: zlib},
+			compressionNone, compressionZlibOpenSSH)
+	})
+	t.Run("client to server only", func(t *testing.T) {
+		testCompression(t,
+			Config{Compression: zlib},
+			Config{CompressionClientToServer: zlib},
+			compressionZlibOpenSSH, compressionNone)
+	})
+}
+
+// testCompression runs an echo session with the compression settings of
+// clientAlgs and serverAlgs, and checks the algorithms negotiated for each
+// direction.
+func testCompression(t *testing.T, clientAlgs, serverAlgs Config, wantCtoS, wantStoC string) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			return &Permissions{}, nil
+		},
+	}
+	serverConf.Compression = serverAlgs.Compression
+	serverConf.CompressionClientToServer = serverAlgs.CompressionClientToServer
+	serverConf.CompressionServerToClient = serverAlgs.CompressionServerToClient
+	// Rekey often, so that the zlib streams are restarted.
+	serverConf.RekeyThreshold = minRekeyThreshold
+	serverConf.AddHostKey(testSigners["ecdsa"])
+
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				return
+			}
+			go DiscardRequests(chReqs)
+			go func() {
+				io.Copy(ch, ch)
+				ch.CloseWrite()
+			}()
+		}
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		Auth:            []AuthMethod{Password("testpw")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.Compression = clientAlgs.Compression
+	clientConf.CompressionClientToServer = clientAlgs.CompressionClientToServer
+	clientConf.CompressionServerToClient = clientAlgs.CompressionServerToClient
+	conn, chans, reqs, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	algs := conn.(AlgorithmsConnMetadata).Algorithms()
+	if algs.Write.Compression != wantCtoS || algs.Read.Compression != wantStoC {
+		t.Errorf("got compression %q/%q, want %q/%q", algs.Write.Compression, algs.Read.Compression, wantCtoS, wantStoC)
+	}
+
+	ch, chReqs, err := client.OpenChannel("echo", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(chReqs)
+
+	data := bytes.Repeat([]byte("compressible data "), 20000)
+	go func() {
+		ch.Write(data)
+		ch.CloseWrite()
+	}()
+	got, err := io.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echoed data differs: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestCompressionDefaults(t *testing.T) {
+	for _, tt := range []struct {
+		in, want []string
+	}{
+		{nil, []string{compressionNone}},
+		{[]string{compressionZlibOpenSSH}, []string{compressionZlibOpenSSH, compressionNone}},
+		{[]string{"zlib", compressionNone, compressionZlibOpenSSH}, []string{compressionNone, compressionZlibOpenSSH}},
+	} {
+		c := Config{Compression: tt.in}
+		c.SetDefaults()
+		if !reflect.DeepEqual(c.Compression, tt.want) {
+			t.Errorf("SetDefaults(%q): got %q, want %q", tt.in, c.Compression, tt.want)
+		}
+		if tt.in == nil {
+			continue
+		}
+		c = Config{CompressionServerToClient: tt.in}
+		c.SetDefaults()
+		if !reflect.DeepEqual(c.CompressionServerToClient, tt.want) {
+			t.Errorf("SetDefaults(CompressionServerToClient: %q): got %q, want %q", tt.in, c.CompressionServerToClient, tt.want)
+		}
+		if c.CompressionClientToServer != nil {
+			t.Errorf("SetDefaults set CompressionClientToServer to %q", c.CompressionClientToServer)
+		}
+	}
+}
+
+func TestDecompressCorruptStreams(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+	}{
+		{"bad method", "7a9c"},
+		{"bad header checksum", "789d"},
+		{"preset dictionary", "78bb"},
+		{"reserved block type", "789c07"},
+		{"stored length mismatch", "789c000500fbff"},
+		{"distance too far back", "789c0202"},
+		{"invalid fixed distance code", "789c4279"},
+		{"final block", "789c030000"},
+		{"oversubscribed code length code", "789c04e09324499224499200"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := hex.DecodeString(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closed := make(chan struct{})
+			defer close(closed)
+			d := newDecompressor(closed, maxPacket)
+			if got, err := d.decompress(in); err == nil {
+				t.Errorf("decompress(%s) = %x, want error", tt.in, got)
+			}
+		})
+	}
+}
+
+// FuzzDecompress checks the inflater against compress/flate. Valid
+// streams are produced by compress/zlib, flushed after every packet, and
+// arbitrary input must be accepted exactly when compress/zlib decodes it
+// without finding corruption, with the same output.
+func FuzzDecompress(f *testing.F) {
+	f.Add([]byte("hello world hello world"), uint8(6), uint16(5))
+	f.Add(bytes.Repeat([]byte("abc"), 1000), uint8(9), uint16(700))
+	f.Add([]byte{0x78, 0x9c, 0xca, 0x48, 0xcd, 0xc9, 0xc9, 0x57, 0x28, 0xcf}, uint8(0), uint16(0))
+	f.Add([]byte{0x78, 0x20, 0x30, 0x30}, uint8(1), uint16(1))
+	f.Fuzz(func(t *testing.T, data []byte, level uint8, split uint16) {
+		// Round trip through compress/zlib, split into packets.
+		w, err := zlib.NewWriterLevel(io.Discard, int(level%10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w.Reset(&buf)
+		closed := make(chan struct{})
+		defer close(closed)
+		d := newDecompressor(closed, maxPacket)
+		for rest := data; len(rest) > 0; {
+			n := int(split)%len(rest) + 1
+			packet := rest[:n]
+			rest = rest[n:]
+			buf.Reset()
+			w.Write(packet)
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := d.decompress(buf.Bytes())
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if !bytes.Equal(got, packet) {
+				t.Fatalf("got %x, want %x", got, packet)
+			}
+		}
+
+		// The data as a compressed stream of its own.
+		d = newDecompressor(closed, maxPacket)
+		got, err := d.decompress(data)
+		r, zerr := zlib.NewReader(bytes.NewReader(data))
+		var want []byte
+		if zerr == nil {
+			want, zerr = io.ReadAll(r)
+		}
+		switch {
+		case len(data) >= 2 && data[1]&0x20 != 0:
+			// compress/zlib waits for a preset dictionary, which
+			// the inflater rejects straight away.
+			if err == nil {
+				t.Fatalf("decompress(%x) accepted a preset dictionary", data)
+			}
+		case zerr == io.ErrUnexpectedEOF && len(want) <= maxPacket:
+			if err != nil {
+				t.Fatalf("decompress(%x): %v; compress/zlib decoded %x", data, err, want)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("decompress(%x) = %x, compress/zlib decoded %x", data, got, want)
+			}
+		case zerr == io.ErrUnexpectedEOF:
+		default:
+			// Corrupt, over-long, or a complete stream, which an SSH
+			// connection never sends.
+			if err == nil {
+				t.Fatalf("decompress(%x) = %x, compress/zlib failed with %v", data, got, zerr)
+			}
+		}
+	})
+}
+
+// BenchmarkDecompress compares the inflater with compress/zlib on the
+// same packets. compress/zlib can only be used here because the
+// packets are sync flushed; see decompressor.
+func BenchmarkDecompress(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"ssh", "channel", "window", "data", "packet", "session", "\n"}
+	var text bytes.Buffer
+	for text.Len() < 1<<20 {
+		text.WriteString(words[rnd.Intn(len(words))])
+		text.WriteByte(' ')
+	}
+	const packetSize = 16 << 10
+	c := newCompressor()
+	var packets, compressed [][]byte
+	for rest := text.Bytes(); len(rest) > 0; {
+		n := packetSize
+		if n > len(rest) {
+			n = len(rest)
+		}
+		out, err := c.compress(rest[:n])
+		if err != nil {
+			b.Fatal(err)
+		}
+		packets = append(packets, rest[:n])
+		compressed = append(compressed, append([]byte(nil), out...))
+		rest = rest[n:]
+	}
+
+	b.Run("inflater", func(b *testing.B) {
+		b.SetBytes(int64(text.Len()))
+		closed := make(chan struct{})
+		defer close(closed)
+		for i := 0; i < b.N; i++ {
+			d := newDecompressor(closed, maxPacket)
+			for _, p := range compressed {
+				if _, err := d.decompress(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+			d.close()
+		}
+	})
+	b.Run("compress/zlib", func(b *testing.B) {
+		b.SetBytes(int64(text.Len()))
+		out := make([]byte, packetSize)
+		for i := 0; i < b.N; i++ {
+			var in bytes.Buffer
+			in.Write(compressed[0])
+			r, err := zlib.NewReader(&in)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for j, p := range packets {
+				if j > 0 {
+					in.Write(compressed[j])
+				}
+				if _, err := io.ReadFull(r, out[:len(p)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
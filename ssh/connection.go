@@ -5,21 +5,105 @@
 package ssh
 
 import (
+	"context"
+	"crypto"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 // OpenChannelError is returned if the other side rejects an
-// OpenChannel request.
+// OpenChannel request. Error names the reason, for example
+// "administratively prohibited", see RejectionReason.String.
 type OpenChannelError struct {
 	Reason  RejectionReason
 	Message string
+
+	// Language is the language tag of Message (RFC 3066), as sent
+	// by the peer. It is often empty.
+	Language string
 }
 
 func (e *OpenChannelError) Error() string {
 	return fmt.Sprintf("ssh: rejected: %s (%s)", e.Reason, e.Message)
 }
 
+// DisconnectReason is an enumeration used in SSH_MSG_DISCONNECT
+// messages. See RFC 4253, section 11.1.
+type DisconnectReason uint32
+
+const (
+	DisconnectHostNotAllowedToConnect DisconnectReason = iota + 1
+	DisconnectProtocolError
+	DisconnectKeyExchangeFailed
+	DisconnectReserved
+	DisconnectMACError
+	DisconnectCompressionError
+	DisconnectServiceNotAvailable
+	DisconnectProtocolVersionNotSupported
+	DisconnectHostKeyNotVerifiable
+	DisconnectConnectionLost
+	DisconnectByApplication
+	DisconnectTooManyConnections
+	DisconnectAuthCancelledByUser
+	DisconnectNoMoreAuthMethodsAvailable
+	DisconnectIllegalUserName
+)
+
+// String converts the disconnect reason to human readable form.
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectHostNotAllowedToConnect:
+		return "host not allowed to connect"
+	case DisconnectProtocolError:
+		return "protocol error"
+	case DisconnectKeyExchangeFailed:
+		return "key exchange failed"
+	case DisconnectReserved:
+		return "reserved"
+	case DisconnectMACError:
+		return "MAC error"
+	case DisconnectCompressionError:
+		return "compression error"
+	case DisconnectServiceNotAvailable:
+		return "service not available"
+	case DisconnectProtocolVersionNotSupported:
+		return "protocol version not supported"
+	case DisconnectHostKeyNotVerifiable:
+		return "host key not verifiable"
+	case DisconnectConnectionLost:
+		return "connection lost"
+	case DisconnectByApplication:
+		return "by application"
+	case DisconnectTooManyConnections:
+		return "too many connections"
+	case DisconnectAuthCancelledByUser:
+		return "auth cancelled by user"
+	case DisconnectNoMoreAuthMethodsAvailable:
+		return "no more auth methods available"
+	case DisconnectIllegalUserName:
+		return "illegal user name"
+	}
+	return fmt.Sprintf("unknown reason %d", int(r))
+}
+
+// DisconnectError describes an SSH_MSG_DISCONNECT message that ended the
+// connection. It is returned, for example from Conn.Wait, when the other
+// side sends one, and from NewServerConn when the server itself sends
+// one, as it does after ServerConfig.MaxAuthTries failed attempts.
+type DisconnectError struct {
+	Reason   DisconnectReason
+	Message  string
+	Language string
+}
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("ssh: disconnect, reason %d: %s", e.Reason, e.Message)
+}
+
 // ConnMetadata holds metadata for the connection.
 type ConnMetadata interface {
 	// User returns the user ID for this connection.
@@ -29,11 +113,13 @@ type ConnMetadata interface {
 	SessionID() []byte
 
 	// ClientVersion returns the client's version string as hashed
-	// into the session ID.
+	// into the session ID. This is the full identification line, without
+	// the CR LF, including any comment after a space.
 	ClientVersion() []byte
 
 	// ServerVersion returns the server's version string as hashed
-	// into the session ID.
+	// into the session ID. This is the full identification line, without
+	// the CR LF, including any comment after a space.
 	ServerVersion() []byte
 
 	// RemoteAddr returns the remote address for this connection.
@@ -43,6 +129,248 @@ type ConnMetadata interface {
 	LocalAddr() net.Addr
 }
 
+// AlgorithmsConnMetadata is a ConnMetadata that can return the algorithms
+// negotiated between client and server. The ConnMetadata passed to server
+// callbacks and the Conn returned by NewClientConn and NewServerConn
+// implement it.
+type AlgorithmsConnMetadata interface {
+	ConnMetadata
+
+	// Algorithms returns the algorithms negotiated in the most recent
+	// completed key exchange. The result is updated after each rekey.
+	// The Read and Write fields of the result are from this side's
+	// point of view, so for a client Write is client-to-server, and
+	// for a server Write is server-to-client.
+	Algorithms() NegotiatedAlgorithms
+}
+
+// RoleConnMetadata is a ConnMetadata that reports which side of the
+// connection it is. The ConnMetadata passed to server callbacks and the
+// Conn returned by NewClientConn and NewServerConn implement it.
+type RoleConnMetadata interface {
+	ConnMetadata
+
+	// IsServer reports whether this side of the connection is the
+	// server, that is whether it was created by NewServerConn rather
+	// than NewClientConn.
+	IsServer() bool
+}
+
+// SessionIDHashConn is a ConnMetadata that reports how its session ID was
+// computed. The ConnMetadata passed to the authentication callbacks of
+// ServerConfig, the Conn returned by NewClientConn, and the Conn embedded
+// in a Client or ServerConn created by this package, implement it.
+type SessionIDHashConn interface {
+	ConnMetadata
+
+	// SessionIDHash returns the name of the hash function of the key
+	// exchange that produced the session ID: "sha1", "sha256", "sha384"
+	// or "sha512". The session ID is an output of this hash, and stays
+	// the same when the keys are renegotiated.
+	SessionIDHash() string
+}
+
+// ContextConn is a Conn that can send global requests and open channels
+// with a context.
+// The Conn returned by NewClientConn, and the Conn embedded in a Client
+// or ServerConn created by this package, implement it.
+type ContextConn interface {
+	Conn
+
+	// SendRequestContext is like SendRequest, but if wantReply is
+	// true and ctx is done before the reply arrives, it returns
+	// ctx.Err(). A reply that arrives later is discarded.
+	SendRequestContext(ctx context.Context, name string, wantReply bool, payload []byte) (bool, []byte, error)
+
+	// OpenChannelContext is like OpenChannel, but if ctx is done before
+	// the peer responds, it returns ctx.Err(). If the peer confirms the
+	// channel later, it is closed; its local ID is reused once the peer
+	// has responded.
+	OpenChannelContext(ctx context.Context, name string, data []byte) (Channel, <-chan *Request, error)
+}
+
+// ChannelOptionsConn is a Conn that can open channels with non-default
+// channel options. The Conn returned by NewClientConn, and the Conn
+// embedded in a Client or ServerConn created by this package, implement
+// it.
+type ChannelOptionsConn interface {
+	Conn
+
+	// OpenChannelWithOptions is like OpenChannel, but uses the window
+	// and maximum packet sizes from opts.
+	OpenChannelWithOptions(name string, data []byte, opts ChannelOptions) (Channel, <-chan *Request, error)
+}
+
+// TransportStatsConn is a Conn that reports transport traffic counters.
+// The Conn returned by NewClientConn, and the Conn embedded in a Client
+// or ServerConn created by this package, implement it.
+type TransportStatsConn interface {
+	Conn
+
+	// TransportStats returns the cumulative traffic counters of the
+	// connection. It is cheap, and safe to call at any time.
+	TransportStats() TransportStats
+}
+
+// ChannelCountConn is a Conn that reports how many channels are open.
+// The Conn returned by NewClientConn, and the Conn embedded in a Client
+// or ServerConn created by this package, implement it.
+type ChannelCountConn interface {
+	Conn
+
+	// NumChannels returns the number of channels opened by either side
+	// that are not yet closed by both, including those still waiting
+	// to be accepted or rejected. These are the channels that
+	// Config.MaxChannels limits.
+	NumChannels() int
+}
+
+// ChannelInfo describes an open channel, for debugging; see ChannelsConn.
+type ChannelInfo struct {
+	// LocalID and RemoteID are the channel's IDs on this side and on
+	// the peer. RemoteID is zero while Opening is set.
+	LocalID  uint32
+	RemoteID uint32
+
+	// Type is the channel type, such as "session".
+	Type string
+
+	// Inbound is set for channels opened by the peer.
+	Inbound bool
+
+	// Opening is set for outbound channels that the peer has not
+	// confirmed yet.
+	Opening bool
+
+	// PendingRequests is the number of channel requests received and
+	// not yet read from the channel's <-chan *Request. If it stays
+	// non-zero, that channel is likely not being serviced, which
+	// eventually stalls the whole connection.
+	PendingRequests int
+}
+
+// ChannelsConn is a Conn that can list its open channels, for debugging.
+// The Conn returned by NewClientConn, and the Conn embedded in a Client
+// or ServerConn created by this package, implement it.
+type ChannelsConn interface {
+	Conn
+
+	// Channels returns the channels that NumChannels counts, in the
+	// order of their local IDs. It only takes a snapshot, and doesn't
+	// affect the channels.
+	Channels() []ChannelInfo
+}
+
+// RekeyConn is a Conn whose key exchange can be triggered on demand. The
+// Conn returned by NewClientConn, and the Conn embedded in a Client or
+// ServerConn created by this package, implement it.
+type RekeyConn interface {
+	Conn
+
+	// RekeyNow starts a new key exchange and blocks until it has
+	// completed in both directions, returning any error from the
+	// exchange. If Config.RekeyCallback is set, RekeyNow returns only
+	// after the callback for this key exchange has returned. Channel
+	// traffic may continue while it runs. If a key exchange is already
+	// in progress, RekeyNow returns an error without starting another.
+	RekeyNow() error
+}
+
+// DebugConn is a Conn that can send SSH_MSG_DEBUG messages. The Conn
+// returned by NewClientConn, and the Conn embedded in a Client or
+// ServerConn created by this package, implement it.
+type DebugConn interface {
+	Conn
+
+	// SendDebug sends an SSH_MSG_DEBUG message with an empty language
+	// tag. If alwaysDisplay is set, the peer should show the message
+	// to its user. Peers receive these messages through
+	// Config.DebugCallback.
+	SendDebug(alwaysDisplay bool, message string) error
+}
+
+// ConnectionState is a snapshot of the state of an SSH connection,
+// similar to crypto/tls.ConnectionState.
+type ConnectionState struct {
+	// User is the user name of the connection. On the server side it is
+	// the user that successfully authenticated.
+	User string
+
+	// SessionID is the session hash, also denoted by H.
+	SessionID []byte
+
+	// ClientVersion and ServerVersion are the version strings as hashed
+	// into the session ID.
+	ClientVersion []byte
+	ServerVersion []byte
+
+	// Algorithms are the algorithms negotiated in the most recent
+	// completed key exchange, including whether strict key exchange is
+	// in use, as returned by AlgorithmsConnMetadata.Algorithms.
+	Algorithms NegotiatedAlgorithms
+
+	// Stats are the cumulative traffic counters of the connection.
+	Stats TransportStats
+
+	// LastKeyExchange is the time at which the most recent key
+	// exchange, initial or rekey, completed.
+	LastKeyExchange time.Time
+}
+
+// ConnectionStateConn is a Conn that can return a snapshot of its state.
+// The Conn returned by NewClientConn, and the Conn embedded in a Client or
+// ServerConn created by this package, implement it.
+type ConnectionStateConn interface {
+	Conn
+
+	// ConnectionState returns a snapshot of the connection state. It is
+	// cheap, and safe to call at any time. The returned value shares no
+	// memory with the connection.
+	ConnectionState() ConnectionState
+}
+
+// PeerKexInitConn is a Conn that reports the SSH_MSG_KEXINIT message
+// sent by the peer, for example to check what a peer advertises. The
+// Conn returned by NewClientConn, and the Conn embedded in a Client or
+// ServerConn created by this package, implement it.
+type PeerKexInitConn interface {
+	Conn
+
+	// PeerKexInit returns the most recent SSH_MSG_KEXINIT received
+	// from the peer, including its cookie. After a rekey it is the
+	// peer's message for that key exchange. The returned value shares
+	// no memory with the connection.
+	PeerKexInit() KexInit
+}
+
+// PermissionsConn is a server Conn that reports the Permissions of its
+// successful authentication. The Conn embedded in a ServerConn created by
+// this package implements it, so code that is only handed the Conn, such
+// as a channel handler, can make authorization decisions.
+type PermissionsConn interface {
+	Conn
+
+	// Permissions returns the same value as the Permissions field of
+	// the ServerConn: the Permissions returned by the succeeding
+	// authentication callback, which may be nil.
+	Permissions() *Permissions
+}
+
+// ServerSigAlgsConn is a client Conn that reports the signature
+// algorithms the server accepts for public key authentication. The Conn
+// returned by NewClientConn, and the Conn embedded in a Client, implement
+// it.
+type ServerSigAlgsConn interface {
+	Conn
+
+	// ServerSigAlgs returns the algorithms listed in the
+	// "server-sig-algs" extension of the SSH_MSG_EXT_INFO message sent
+	// by the server (RFC 8308), or nil if it sent none. Without the
+	// extension, public key authentication assumes the server supports
+	// only the algorithm named after each key type.
+	ServerSigAlgs() []string
+}
+
 // Conn represents an SSH connection for both server and client roles.
 // Conn is the basis for implementing an application layer, such
 // as ClientConn, which implements the traditional shell access for
@@ -70,7 +398,6 @@ type Conn interface {
 	Wait() error
 
 	// TODO(hanwen): consider exposing:
-	//   RequestKeyChange
 	//   Disconnect
 }
 
@@ -89,21 +416,278 @@ type connection struct {
 	transport *handshakeTransport
 	sshConn
 
+	// serverSigAlgs is the "server-sig-algs" extension received by a
+	// client, if any.
+	serverSigAlgs []string
+
 	// The connection protocol.
 	*mux
+
+	// activity is the packetConn of mux if Config.IdleTimeout is set.
+	activity *activityConn
+
+	// permissions is the result of a server's successful
+	// authentication.
+	permissions *Permissions
 }
 
 func (c *connection) Close() error {
 	return c.sshConn.conn.Close()
 }
 
+func (c *connection) TransportStats() TransportStats {
+	return c.transport.conn.stats()
+}
+
+func (c *connection) NumChannels() int {
+	return c.mux.chanList.count()
+}
+
+func (c *connection) Channels() []ChannelInfo {
+	return c.mux.chanList.channels()
+}
+
+func (c *connection) RekeyNow() error {
+	return c.transport.rekeyNow()
+}
+
+func (c *connection) Algorithms() NegotiatedAlgorithms {
+	return c.transport.getAlgorithms()
+}
+
+func (c *connection) ConnectionState() ConnectionState {
+	algs, lastKex := c.transport.getLastKex()
+	return ConnectionState{
+		User:            c.User(),
+		SessionID:       c.SessionID(),
+		ClientVersion:   c.ClientVersion(),
+		ServerVersion:   c.ServerVersion(),
+		Algorithms:      algs,
+		Stats:           c.TransportStats(),
+		LastKeyExchange: lastKex,
+	}
+}
+
+func (c *connection) PeerKexInit() KexInit {
+	return c.transport.getPeerKexInit()
+}
+
+func (c *connection) Permissions() *Permissions {
+	return c.permissions
+}
+
+func (c *connection) ServerSigAlgs() []string {
+	if c.serverSigAlgs == nil {
+		return nil
+	}
+	return append([]string(nil), c.serverSigAlgs...)
+}
+
+// keepAliveRequest is the global request sent by keepAlive. Peers that
+// don't know it still reply with a failure, which is enough to show
+// that the connection is alive.
+const keepAliveRequest = "keepalive@openssh.com"
+
+// keepAlive sends a keepalive request every interval until the
+// connection shuts down. If callback is nil, it closes the connection
+// once countMax consecutive requests go unanswered; otherwise callback
+// is told the outcome of each request, and decides.
+func (c *connection) keepAlive(interval time.Duration, countMax int, callback func(time.Duration, int) error) {
+	done := make(chan struct{})
+	go func() {
+		c.mux.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		start := time.Now()
+		_, _, err := c.SendRequestContext(ctx, keepAliveRequest, true, nil)
+		latency := time.Since(start)
+		cancel()
+		switch {
+		case err == context.DeadlineExceeded:
+			missed++
+		case err != nil:
+			return
+		default:
+			missed = 0
+		}
+
+		if callback == nil {
+			if missed >= countMax {
+				c.Close()
+				return
+			}
+			continue
+		}
+		if err := callback(latency, missed); err != nil {
+			c.transport.writePacket(Marshal(&disconnectMsg{
+				Reason:  uint32(DisconnectByApplication),
+				Message: err.Error(),
+			}))
+			c.Close()
+			return
+		}
+	}
+}
+
+// sendIgnores sends SSH_MSG_IGNORE messages with random payloads at
+// random intervals, averaging interval, until the connection shuts down.
+// The messages go through the handshake transport, which orders them
+// with other packets and holds them back during key exchanges.
+func (c *connection) sendIgnores(interval time.Duration, rand io.Reader) {
+	done := make(chan struct{})
+	go func() {
+		c.mux.Wait()
+		close(done)
+	}()
+
+	for {
+		var r [3]byte
+		if _, err := io.ReadFull(rand, r[:]); err != nil {
+			return
+		}
+		wait := interval/2 + time.Duration(uint64(interval)*uint64(binary.BigEndian.Uint16(r[:2]))>>16)
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		msg := ignoreMsg{Data: make([]byte, r[2])}
+		if _, err := io.ReadFull(rand, msg.Data); err != nil {
+			return
+		}
+		if err := c.transport.writePacket(Marshal(&msg)); err != nil {
+			return
+		}
+	}
+}
+
+// activityConn is the packetConn of the connection protocol when
+// Config.IdleTimeout is set. It records when a packet was last sent or
+// received.
+type activityConn struct {
+	packetConn
+	ignoreKeepAlives bool
+
+	// last is the time of the last activity, in Unix nanoseconds.
+	last atomic.Int64
+}
+
+// muxConn returns the packetConn to run the connection protocol over,
+// which records activity if config.IdleTimeout is set.
+func (c *connection) muxConn(config *Config) packetConn {
+	if config.IdleTimeout <= 0 {
+		return c.transport
+	}
+	c.activity = newActivityConn(c.transport, config.IdleTimeoutIgnoreKeepAlives)
+	return c.activity
+}
+
+func newActivityConn(p packetConn, ignoreKeepAlives bool) *activityConn {
+	a := &activityConn{packetConn: p, ignoreKeepAlives: ignoreKeepAlives}
+	a.last.Store(time.Now().UnixNano())
+	return a
+}
+
+func (a *activityConn) record(packet []byte) {
+	if a.ignoreKeepAlives && isKeepAlive(packet) {
+		return
+	}
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activityConn) readPacket() ([]byte, error) {
+	p, err := a.packetConn.readPacket()
+	if err == nil {
+		a.record(p)
+	}
+	return p, err
+}
+
+func (a *activityConn) writePacket(packet []byte) error {
+	a.record(packet)
+	return a.packetConn.writePacket(packet)
+}
+
+// isKeepAlive reports whether packet is a keepalive request, or a reply
+// that may answer one.
+func isKeepAlive(packet []byte) bool {
+	switch packet[0] {
+	case msgRequestSuccess, msgRequestFailure, msgChannelSuccess, msgChannelFailure:
+		return true
+	case msgGlobalRequest:
+		var msg globalRequestMsg
+		return Unmarshal(packet, &msg) == nil && msg.Type == keepAliveRequest
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		return Unmarshal(packet, &msg) == nil && msg.Request == keepAliveRequest
+	}
+	return false
+}
+
+// idleTimeout disconnects with DisconnectByApplication once c.activity
+// has recorded nothing for timeout, or returns when the connection shuts
+// down.
+func (c *connection) idleTimeout(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		c.mux.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		if idle := time.Since(time.Unix(0, c.activity.last.Load())); idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+		c.transport.writePacket(Marshal(&disconnectMsg{
+			Reason:  uint32(DisconnectByApplication),
+			Message: "idle timeout",
+		}))
+		c.Close()
+		return
+	}
+}
+
+func (c *connection) SendDebug(alwaysDisplay bool, message string) error {
+	return c.transport.writePacket(Marshal(&debugMsg{
+		AlwaysDisplay: alwaysDisplay,
+		Message:       message,
+	}))
+}
+
 // sshConn provides net.Conn metadata, but disallows direct reads and
 // writes.
 type sshConn struct {
 	conn net.Conn
 
 	user          string
+	isServer      bool
 	sessionID     []byte
+	sessionHash   crypto.Hash
 	clientVersion []byte
 	serverVersion []byte
 }
@@ -134,6 +718,24 @@ func (c *sshConn) SessionID() []byte {
 	return dup(c.sessionID)
 }
 
+func (c *sshConn) IsServer() bool {
+	return c.isServer
+}
+
+func (c *sshConn) SessionIDHash() string {
+	switch c.sessionHash {
+	case crypto.SHA1:
+		return "sha1"
+	case crypto.SHA256:
+		return "sha256"
+	case crypto.SHA384:
+		return "sha384"
+	case crypto.SHA512:
+		return "sha512"
+	}
+	return ""
+}
+
 func (c *sshConn) ClientVersion() []byte {
 	return dup(c.clientVersion)
 }
@@ -5,14 +5,16 @@
 package ssh
 
 import (
-	"crypto/rand"
+	"crypto"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // debugHandshake, if set, prints messages sent and received.  Key
@@ -34,7 +36,7 @@ type keyingTransport interface {
 	// prepareKeyChange sets up a key change. The key change for a
 	// direction will be effected if a msgNewKeys message is sent
 	// or received.
-	prepareKeyChange(*algorithms, *kexResult) error
+	prepareKeyChange(*NegotiatedAlgorithms, *kexResult) error
 
 	// setStrictMode sets the strict KEX mode, notably triggering
 	// sequence number resets on sending or receiving msgNewKeys.
@@ -45,6 +47,10 @@ type keyingTransport interface {
 	// setInitialKEXDone indicates to the transport that the initial key exchange
 	// was completed
 	setInitialKEXDone()
+
+	// stats returns the traffic counters. It is safe to call
+	// concurrently with reads and writes.
+	stats() TransportStats
 }
 
 // handshakeTransport implements rekeying on top of a keyingTransport
@@ -65,6 +71,9 @@ type handshakeTransport struct {
 	// it contains the supported client public key authentication algorithms.
 	publicKeyAuthAlgorithms []string
 
+	// algorithmPolicy is ServerConfig.AlgorithmPolicy on servers.
+	algorithmPolicy func(client KexInit) error
+
 	// hostKeyAlgorithms is non-empty if we are the client. In that case,
 	// we accept these key types from the server as host key.
 	hostKeyAlgorithms []string
@@ -81,6 +90,27 @@ type handshakeTransport struct {
 	writePacketsLeft uint32
 	writeBytesLeft   int64
 
+	// kexGuess is the key exchange started by sendKexInit for
+	// Config.GuessKeyExchange, if any. It is owned by kexLoop.
+	kexGuess *kexGuess
+
+	// Packets and bytes written since the last key exchange, for
+	// RekeyCallback.
+	writtenPackets uint64
+	writtenBytes   uint64
+
+	// rekeyDone is non-nil while a RekeyNow call waits for the key
+	// exchange it requested. kexLoop sends the result on it.
+	rekeyDone chan error
+
+	// rekeyEvents holds completed key exchanges whose RekeyCallback
+	// has not run yet. kexLoop appends to it and pings
+	// rekeyEventsReady, which is nil if there is no RekeyCallback; the
+	// callbacks run in order on a separate goroutine, so that a slow
+	// callback doesn't stop kexLoop from servicing key exchanges.
+	rekeyEvents      []rekeyEvent
+	rekeyEventsReady chan struct{}
+
 	// If the read loop wants to schedule a kex, it pings this
 	// channel, and the write loop will send out a kex
 	// message.
@@ -96,20 +126,42 @@ type handshakeTransport struct {
 	dialAddress     string
 	remoteAddr      net.Addr
 
+	hostKeyAlgorithmCallback HostKeyAlgorithmCallback
+
 	// bannerCallback is non-empty if we are the client and it has been set in
 	// ClientConfig. In that case it is called during the user authentication
 	// dance to handle a custom server's message.
 	bannerCallback BannerCallback
 
 	// Algorithms agreed in the last key exchange.
-	algorithms *algorithms
+	algorithms *NegotiatedAlgorithms
+
+	// negotiatedMu protects negotiated, the algorithms in use after the
+	// last completed key exchange. It is separate from mu so that readers
+	// are not blocked while kexLoop flushes pending packets.
+	negotiatedMu sync.Mutex
+	negotiated   NegotiatedAlgorithms
+	lastKex      time.Time
+	peerKexInit  *kexInitMsg
 
 	// Counters exclusively owned by readLoop.
 	readPacketsLeft uint32
 	readBytesLeft   int64
 
-	// The session ID or nil if first kex did not complete yet.
-	sessionID []byte
+	// Packets and bytes read since the last key exchange, for
+	// RekeyCallback. Owned by readLoop, except while it is blocked
+	// on a key exchange.
+	readPackets uint64
+	readBytes   uint64
+
+	// The session ID or nil if first kex did not complete yet, and
+	// the hash function of the key exchange that produced it.
+	sessionID   []byte
+	sessionHash crypto.Hash
+
+	// sessionHostKey is the wire format of the server's host key in
+	// the first key exchange.
+	sessionHostKey []byte
 
 	// strictMode indicates if the other side of the handshake indicated
 	// that we should be following the strict KEX protocol restrictions.
@@ -121,7 +173,32 @@ type pendingKex struct {
 	done      chan error
 }
 
+// tracingTransport passes a copy of every packet to the trace hooks
+// from Config.
+type tracingTransport struct {
+	keyingTransport
+	read, write func(packet []byte)
+}
+
+func (t *tracingTransport) readPacket() ([]byte, error) {
+	p, err := t.keyingTransport.readPacket()
+	if err == nil && t.read != nil {
+		t.read(dup(p))
+	}
+	return p, err
+}
+
+func (t *tracingTransport) writePacket(p []byte) error {
+	if t.write != nil {
+		t.write(dup(p))
+	}
+	return t.keyingTransport.writePacket(p)
+}
+
 func newHandshakeTransport(conn keyingTransport, config *Config, clientVersion, serverVersion []byte) *handshakeTransport {
+	if config.PacketTraceReader != nil || config.PacketTraceWriter != nil {
+		conn = &tracingTransport{conn, config.PacketTraceReader, config.PacketTraceWriter}
+	}
 	t := &handshakeTransport{
 		conn:          conn,
 		serverVersion: serverVersion,
@@ -133,6 +210,9 @@ func newHandshakeTransport(conn keyingTransport, config *Config, clientVersion,
 
 		config: config,
 	}
+	if config.RekeyCallback != nil {
+		t.rekeyEventsReady = make(chan struct{}, 1)
+	}
 	t.resetReadThresholds()
 	t.resetWriteThresholds()
 
@@ -145,13 +225,10 @@ func newClientTransport(conn keyingTransport, clientVersion, serverVersion []byt
 	t := newHandshakeTransport(conn, &config.Config, clientVersion, serverVersion)
 	t.dialAddress = dialAddr
 	t.remoteAddr = addr
-	t.hostKeyCallback = config.HostKeyCallback
+	t.hostKeyCallback = config.hostKeyCallback()
+	t.hostKeyAlgorithmCallback = config.HostKeyAlgorithmCallback
 	t.bannerCallback = config.BannerCallback
-	if config.HostKeyAlgorithms != nil {
-		t.hostKeyAlgorithms = config.HostKeyAlgorithms
-	} else {
-		t.hostKeyAlgorithms = supportedHostKeyAlgos
-	}
+	t.hostKeyAlgorithms = config.hostKeyAlgorithms()
 	go t.readLoop()
 	go t.kexLoop()
 	return t
@@ -161,6 +238,7 @@ func newServerTransport(conn keyingTransport, clientVersion, serverVersion []byt
 	t := newHandshakeTransport(conn, &config.Config, clientVersion, serverVersion)
 	t.hostKeys = config.hostKeys
 	t.publicKeyAuthAlgorithms = config.PublicKeyAuthAlgorithms
+	t.algorithmPolicy = config.AlgorithmPolicy
 	go t.readLoop()
 	go t.kexLoop()
 	return t
@@ -170,6 +248,43 @@ func (t *handshakeTransport) getSessionID() []byte {
 	return t.sessionID
 }
 
+func (t *handshakeTransport) getSessionHash() crypto.Hash {
+	return t.sessionHash
+}
+
+// getSessionHostKey returns the host key of the first key exchange, in
+// wire format, or nil if it has not completed yet.
+func (t *handshakeTransport) getSessionHostKey() []byte {
+	return t.sessionHostKey
+}
+
+// getAlgorithms returns the algorithms negotiated in the last completed key
+// exchange. It is safe to call while a key exchange is in progress.
+func (t *handshakeTransport) getAlgorithms() NegotiatedAlgorithms {
+	t.negotiatedMu.Lock()
+	defer t.negotiatedMu.Unlock()
+	return t.negotiated
+}
+
+// getPeerKexInit returns the last SSH_MSG_KEXINIT received from the
+// peer, or the zero KexInit if none was received yet.
+func (t *handshakeTransport) getPeerKexInit() KexInit {
+	t.negotiatedMu.Lock()
+	defer t.negotiatedMu.Unlock()
+	if t.peerKexInit == nil {
+		return KexInit{}
+	}
+	return KexInit(*t.peerKexInit).clone()
+}
+
+// getLastKex is like getAlgorithms, but also returns the time at which
+// the last key exchange completed.
+func (t *handshakeTransport) getLastKex() (NegotiatedAlgorithms, time.Time) {
+	t.negotiatedMu.Lock()
+	defer t.negotiatedMu.Unlock()
+	return t.negotiated, t.lastKex
+}
+
 // waitSession waits for the session to be established. This should be
 // the first thing to call after instantiating handshakeTransport.
 func (t *handshakeTransport) waitSession() error {
@@ -271,17 +386,33 @@ func (t *handshakeTransport) requestKeyExchange() {
 }
 
 func (t *handshakeTransport) resetWriteThresholds() {
+	t.writtenPackets = 0
+	t.writtenBytes = 0
 	t.writePacketsLeft = packetRekeyThreshold
-	if t.config.RekeyThreshold > 0 {
-		t.writeBytesLeft = int64(t.config.RekeyThreshold)
-	} else if t.algorithms != nil {
-		t.writeBytesLeft = t.algorithms.w.rekeyBytes()
+	if t.algorithms != nil {
+		t.writeBytesLeft = t.config.rekeyThreshold(&t.algorithms.Write)
 	} else {
-		t.writeBytesLeft = 1 << 30
+		t.writeBytesLeft = t.config.rekeyThreshold(nil)
 	}
 }
 
 func (t *handshakeTransport) kexLoop() {
+	if t.rekeyEventsReady != nil {
+		go t.runRekeyCallbacks()
+		defer close(t.rekeyEventsReady)
+	}
+
+	// rekeyTimer requests a key exchange once RekeyInterval has passed
+	// since the last one.
+	var rekeyTimer *time.Timer
+	defer func() {
+		if rekeyTimer != nil {
+			rekeyTimer.Stop()
+		}
+		if t.kexGuess != nil {
+			t.kexGuess.decide(false, nil)
+		}
+	}()
 
 write:
 	for t.getWriteError() == nil {
@@ -323,14 +454,51 @@ write:
 		// another key change request, until we close the done
 		// channel on the pendingKex request.
 
+		firstKex := t.sessionID == nil
 		err := t.enterKeyExchange(request.otherInit)
+		if l := t.config.Logger; l != nil {
+			if err != nil {
+				l.Log(LogWarn, "key exchange failed", "initial", firstKex, "err", err)
+			} else {
+				algs := t.algorithms
+				l.Log(LogInfo, "key exchange complete", "initial", firstKex, "kex", algs.KeyExchange, "hostkey", algs.HostKey,
+					"read", algs.Read, "write", algs.Write, "strictkex", algs.StrictKex)
+			}
+		}
 
 		t.mu.Lock()
 		t.writeError = err
 		t.sentInitPacket = nil
 		t.sentInitMsg = nil
 
+		// The read loop is blocked until request.done is sent
+		// below, so its counters can be read here.
+		if t.rekeyEventsReady != nil && (t.rekeyDone != nil || err == nil && !firstKex) {
+			ev := rekeyEvent{done: t.rekeyDone, err: err}
+			if err == nil && !firstKex {
+				ev.stats = &RekeyStats{
+					Algorithms:     *t.algorithms,
+					PacketsWritten: t.writtenPackets,
+					BytesWritten:   t.writtenBytes,
+					PacketsRead:    t.readPackets,
+					BytesRead:      t.readBytes,
+				}
+			}
+			t.rekeyEvents = append(t.rekeyEvents, ev)
+			t.rekeyDone = nil
+			select {
+			case t.rekeyEventsReady <- struct{}{}:
+			default:
+			}
+		}
+
 		t.resetWriteThresholds()
+		if t.config.RekeyInterval > 0 {
+			if rekeyTimer != nil {
+				rekeyTimer.Stop()
+			}
+			rekeyTimer = time.AfterFunc(t.config.RekeyInterval, t.requestKeyExchange)
+		}
 
 		// we have completed the key exchange. Since the
 		// reader is still blocked, it is safe to clear out
@@ -349,6 +517,10 @@ write:
 		}
 
 		request.done <- t.writeError
+		if t.rekeyDone != nil {
+			t.rekeyDone <- err
+			t.rekeyDone = nil
+		}
 
 		// kex finished. Push packets that we received while
 		// the kex was in progress. Don't look at t.startKex
@@ -356,6 +528,8 @@ write:
 		// another kex while we are still busy with the last
 		// one, things will become very confusing.
 		for _, p := range t.pendingPackets {
+			t.writtenPackets++
+			t.writtenBytes += uint64(len(p))
 			t.writeError = t.pushPacket(p)
 			if t.writeError != nil {
 				break
@@ -365,6 +539,13 @@ write:
 		t.mu.Unlock()
 	}
 
+	t.mu.Lock()
+	if t.rekeyDone != nil {
+		t.rekeyDone <- t.writeError
+		t.rekeyDone = nil
+	}
+	t.mu.Unlock()
+
 	// Unblock reader.
 	t.conn.Close()
 
@@ -378,6 +559,75 @@ write:
 	close(t.kexLoopDone)
 }
 
+// rekeyNow starts a key exchange and blocks until it has completed in
+// both directions and its RekeyCallback, if any, has returned. It fails
+// if a key exchange is already in progress.
+func (t *handshakeTransport) rekeyNow() error {
+	t.mu.Lock()
+	if t.writeError != nil {
+		err := t.writeError
+		t.mu.Unlock()
+		return err
+	}
+	if t.sentInitMsg != nil || t.rekeyDone != nil {
+		t.mu.Unlock()
+		return errors.New("ssh: key exchange already in progress")
+	}
+	done := make(chan error, 1)
+	t.rekeyDone = done
+	t.mu.Unlock()
+
+	t.requestKeyExchange()
+	return <-done
+}
+
+// rekeyEvent is a completed key exchange queued for runRekeyCallbacks.
+type rekeyEvent struct {
+	// stats is nil for the initial key exchange and for failed ones,
+	// which don't get a RekeyCallback.
+	stats *RekeyStats
+
+	// done, if not nil, is the channel of the RekeyNow call waiting
+	// for this key exchange. It receives err after the callback has
+	// returned.
+	done chan error
+	err  error
+}
+
+// runRekeyCallbacks calls the RekeyCallback for each queued key
+// exchange, until kexLoop closes rekeyEventsReady.
+func (t *handshakeTransport) runRekeyCallbacks() {
+	for {
+		_, ok := <-t.rekeyEventsReady
+		t.mu.Lock()
+		events := t.rekeyEvents
+		t.rekeyEvents = nil
+		t.mu.Unlock()
+		for _, ev := range events {
+			if ev.stats != nil {
+				t.runRekeyCallback(*ev.stats)
+			}
+			if ev.done != nil {
+				ev.done <- ev.err
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// runRekeyCallback calls the RekeyCallback. It is called without holding
+// any locks, and a panic in the callback doesn't affect the connection.
+func (t *handshakeTransport) runRekeyCallback(stats RekeyStats) {
+	defer func() {
+		if r := recover(); r != nil && debugHandshake {
+			log.Printf("%s RekeyCallback panicked: %v", t.id(), r)
+		}
+	}()
+	t.config.RekeyCallback(stats)
+}
+
 // The protocol uses uint32 for packet counters, so we can't let them
 // reach 1<<32.  We will actually read and write more packets than
 // this, though: the other side may send more packets, and after we
@@ -386,13 +636,13 @@ write:
 const packetRekeyThreshold = (1 << 31)
 
 func (t *handshakeTransport) resetReadThresholds() {
+	t.readPackets = 0
+	t.readBytes = 0
 	t.readPacketsLeft = packetRekeyThreshold
-	if t.config.RekeyThreshold > 0 {
-		t.readBytesLeft = int64(t.config.RekeyThreshold)
-	} else if t.algorithms != nil {
-		t.readBytesLeft = t.algorithms.r.rekeyBytes()
+	if t.algorithms != nil {
+		t.readBytesLeft = t.config.rekeyThreshold(&t.algorithms.Read)
 	} else {
-		t.readBytesLeft = 1 << 30
+		t.readBytesLeft = t.config.rekeyThreshold(nil)
 	}
 }
 
@@ -402,6 +652,9 @@ func (t *handshakeTransport) readOnePacket(first bool) ([]byte, error) {
 		return nil, err
 	}
 
+	t.readPackets++
+	t.readBytes += uint64(len(p))
+
 	if t.readPacketsLeft > 0 {
 		t.readPacketsLeft--
 	} else {
@@ -475,15 +728,21 @@ func (t *handshakeTransport) sendKexInit() error {
 		return nil
 	}
 
+	isServer := len(t.hostKeys) > 0
+	ciphersCtoS, ciphersStoC, macsCtoS, macsStoC := t.config.directionalAlgorithms()
+	compressionsCtoS, compressionsStoC := t.config.directionalCompressions()
 	msg := &kexInitMsg{
-		CiphersClientServer:     t.config.Ciphers,
-		CiphersServerClient:     t.config.Ciphers,
-		MACsClientServer:        t.config.MACs,
-		MACsServerClient:        t.config.MACs,
-		CompressionClientServer: supportedCompressions,
-		CompressionServerClient: supportedCompressions,
+		FirstKexFollows:         !isServer && t.config.GuessKeyExchange,
+		CiphersClientServer:     ciphersCtoS,
+		CiphersServerClient:     ciphersStoC,
+		MACsClientServer:        macsCtoS,
+		MACsServerClient:        macsStoC,
+		CompressionClientServer: compressionsCtoS,
+		CompressionServerClient: compressionsStoC,
+	}
+	if _, err := io.ReadFull(t.config.Rand, msg.Cookie[:]); err != nil {
+		return err
 	}
-	io.ReadFull(rand.Reader, msg.Cookie[:])
 
 	// We mutate the KexAlgos slice, in order to add the kex-strict extension algorithm,
 	// and possibly to add the ext-info extension algorithm. Since the slice may be the
@@ -492,7 +751,6 @@ func (t *handshakeTransport) sendKexInit() error {
 	msg.KexAlgos = make([]string, 0, len(t.config.KeyExchanges)+2) // room for kex-strict and ext-info
 	msg.KexAlgos = append(msg.KexAlgos, t.config.KeyExchanges...)
 
-	isServer := len(t.hostKeys) > 0
 	if isServer {
 		for _, k := range t.hostKeys {
 			// If k is a MultiAlgorithmSigner, we restrict the signature
@@ -530,7 +788,9 @@ func (t *handshakeTransport) sendKexInit() error {
 		// We also send the strict KEX mode extension algorithm, in order to opt
 		// into the strict KEX mode.
 		if firstKeyExchange := t.sessionID == nil; firstKeyExchange {
-			msg.KexAlgos = append(msg.KexAlgos, "ext-info-c")
+			if !t.config.DisableExtInfo {
+				msg.KexAlgos = append(msg.KexAlgos, "ext-info-c")
+			}
 			msg.KexAlgos = append(msg.KexAlgos, kexStrictClient)
 		}
 
@@ -549,9 +809,118 @@ func (t *handshakeTransport) sendKexInit() error {
 	t.sentInitMsg = msg
 	t.sentInitPacket = packet
 
+	if !isServer && t.config.GuessKeyExchange {
+		return t.startKexGuess()
+	}
 	return nil
 }
 
+// errKexGuessWrong is returned to a guessed key exchange that the other
+// side discards.
+var errKexGuessWrong = errors.New("ssh: key exchange guess was wrong")
+
+// kexGuess is a client key exchange that runs before the server's
+// SSH_MSG_KEXINIT has been received. It is a packetConn for the kex
+// algorithm: writes go straight to the transport, and reads block until
+// the guess has been decided.
+type kexGuess struct {
+	conn   keyingTransport
+	magics handshakeMagics
+
+	// written is closed after the first packet of the guess is sent.
+	written     chan struct{}
+	writtenOnce sync.Once
+
+	// decided is closed once it is known whether the guess was right,
+	// and after magics.serverKexInit has been filled in.
+	decided   chan struct{}
+	isDecided bool
+	right     bool
+
+	// done is closed when the key exchange returned result and err.
+	done   chan struct{}
+	result *kexResult
+	err    error
+}
+
+func (g *kexGuess) writePacket(p []byte) error {
+	err := g.conn.writePacket(p)
+	g.writtenOnce.Do(func() { close(g.written) })
+	return err
+}
+
+func (g *kexGuess) readPacket() ([]byte, error) {
+	<-g.decided
+	if !g.right {
+		return nil, errKexGuessWrong
+	}
+	return g.conn.readPacket()
+}
+
+func (g *kexGuess) Close() error {
+	return g.conn.Close()
+}
+
+// decide lets the guessed key exchange continue if right, or makes it
+// fail otherwise, and waits for it to return. It may be called more
+// than once; only the first call takes effect.
+func (g *kexGuess) decide(right bool, serverKexInit []byte) {
+	if !g.isDecided {
+		g.isDecided = true
+		g.right = right
+		g.magics.serverKexInit = serverKexInit
+		close(g.decided)
+	}
+	<-g.done
+}
+
+// kexAlgorithm returns the implementation of the named key exchange
+// algorithm, set up for t.config.
+func (t *handshakeTransport) kexAlgorithm(name string) (kexAlgorithm, error) {
+	kex, ok := kexAlgoMap[name]
+	if !ok {
+		return nil, fmt.Errorf("ssh: unexpected key exchange algorithm %v", name)
+	}
+	if gex, ok := kex.(*dhGEXSHA); ok && t.config.MinDHGroupBits > 0 {
+		kex = &dhGEXSHA{hashFunc: gex.hashFunc, minBits: t.config.MinDHGroupBits}
+	}
+	return kex, nil
+}
+
+// startKexGuess starts the client side of the preferred key exchange
+// and waits for its first packet to be sent, so that it directly follows
+// the SSH_MSG_KEXINIT. t.mu must be held.
+func (t *handshakeTransport) startKexGuess() error {
+	kex, err := t.kexAlgorithm(t.sentInitMsg.KexAlgos[0])
+	if err != nil {
+		return err
+	}
+	g := &kexGuess{
+		conn: t.conn,
+		magics: handshakeMagics{
+			clientVersion: t.clientVersion,
+			serverVersion: t.serverVersion,
+			clientKexInit: t.sentInitPacket,
+		},
+		written: make(chan struct{}),
+		decided: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		g.result, g.err = kex.Client(g, t.config.Rand, &g.magics)
+		close(g.done)
+	}()
+	t.kexGuess = g
+	select {
+	case <-g.written:
+		return nil
+	case <-g.done:
+		// The guess failed before sending anything, but the
+		// SSH_MSG_KEXINIT promised that a packet follows.
+		return g.err
+	}
+}
+
 func (t *handshakeTransport) writePacket(p []byte) error {
 	switch p[0] {
 	case msgKexInit:
@@ -586,6 +955,9 @@ func (t *handshakeTransport) writePacket(p []byte) error {
 		t.requestKeyExchange()
 	}
 
+	t.writtenPackets++
+	t.writtenBytes += uint64(len(p))
+
 	if err := t.pushPacket(p); err != nil {
 		t.writeError = err
 	}
@@ -611,10 +983,21 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		log.Printf("%s entered key exchange", t.id())
 	}
 
+	// Whatever happens, a guessed key exchange must not outlive this
+	// one.
+	guess := t.kexGuess
+	t.kexGuess = nil
+	if guess != nil {
+		defer guess.decide(false, nil)
+	}
+
 	otherInit := &kexInitMsg{}
 	if err := Unmarshal(otherInitPacket, otherInit); err != nil {
 		return err
 	}
+	t.negotiatedMu.Lock()
+	t.peerKexInit = otherInit
+	t.negotiatedMu.Unlock()
 
 	magics := handshakeMagics{
 		clientVersion: t.clientVersion,
@@ -633,6 +1016,16 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		magics.serverKexInit = otherInitPacket
 	}
 
+	if t.algorithmPolicy != nil && !isClient {
+		if err := t.algorithmPolicy(KexInit(*otherInit).clone()); err != nil {
+			t.conn.writePacket(Marshal(&disconnectMsg{
+				Reason:  uint32(DisconnectProtocolError),
+				Message: err.Error(),
+			}))
+			return fmt.Errorf("ssh: client algorithms rejected: %w", err)
+		}
+	}
+
 	var err error
 	t.algorithms, err = findAgreedAlgorithms(isClient, clientInit, serverInit)
 	if err != nil {
@@ -644,10 +1037,11 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		if err := t.conn.setStrictMode(); err != nil {
 			return err
 		}
+	} else if t.sessionID == nil && t.config.RequireStrictKex {
+		return errors.New("ssh: peer does not support strict key exchange")
 	}
+	t.algorithms.StrictKex = t.strictMode
 
-	// We don't send FirstKexFollows, but we handle receiving it.
-	//
 	// RFC 4253 section 7 defines the kex and the agreement method for
 	// first_kex_packet_follows. It states that the guessed packet
 	// should be ignored if the "kex algorithm and/or the host
@@ -656,7 +1050,8 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	// algorithms cannot be agreed upon". The other algorithms have
 	// already been checked above so the kex algorithm and host key
 	// algorithm are checked here.
-	if otherInit.FirstKexFollows && (clientInit.KexAlgos[0] != serverInit.KexAlgos[0] || clientInit.ServerHostKeyAlgos[0] != serverInit.ServerHostKeyAlgos[0]) {
+	guessRight := clientInit.KexAlgos[0] == serverInit.KexAlgos[0] && clientInit.ServerHostKeyAlgos[0] == serverInit.ServerHostKeyAlgos[0]
+	if otherInit.FirstKexFollows && !guessRight {
 		// other side sent a kex message for the wrong algorithm,
 		// which we have to ignore.
 		if _, err := t.conn.readPacket(); err != nil {
@@ -664,15 +1059,24 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		}
 	}
 
-	kex, ok := kexAlgoMap[t.algorithms.kex]
-	if !ok {
-		return fmt.Errorf("ssh: unexpected key exchange algorithm %v", t.algorithms.kex)
+	kex, err := t.kexAlgorithm(t.algorithms.KeyExchange)
+	if err != nil {
+		return err
 	}
 
 	var result *kexResult
 	if len(t.hostKeys) > 0 {
 		result, err = t.server(kex, &magics)
+	} else if guess != nil && guessRight {
+		// The server takes our guessed packet as the start of
+		// the key exchange.
+		guess.decide(true, otherInitPacket)
+		result, err = t.verifyServer(guess.result, guess.err)
 	} else {
+		if guess != nil {
+			// The server discards our guessed packet.
+			guess.decide(false, nil)
+		}
 		result, err = t.client(kex, &magics)
 	}
 
@@ -683,6 +1087,8 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	firstKeyExchange := t.sessionID == nil
 	if firstKeyExchange {
 		t.sessionID = result.H
+		t.sessionHash = result.Hash
+		t.sessionHostKey = result.HostKey
 	}
 	result.SessionID = t.sessionID
 
@@ -695,17 +1101,23 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 
 	// On the server side, after the first SSH_MSG_NEWKEYS, send a SSH_MSG_EXT_INFO
 	// message with the server-sig-algs extension if the client supports it. See
-	// RFC 8308, Sections 2.4 and 3.1, and [PROTOCOL], Section 1.9.
-	if !isClient && firstKeyExchange && contains(clientInit.KexAlgos, "ext-info-c") {
+	// RFC 8308, Sections 2.4 and 3.1, and [PROTOCOL], Section 1.9. The
+	// publickey-hostbound extension tells the client that it may use
+	// publicKeyHostBoundMethod, see [PROTOCOL], Section 1.10.
+	if !isClient && firstKeyExchange && !t.config.DisableExtInfo && contains(clientInit.KexAlgos, "ext-info-c") {
 		supportedPubKeyAuthAlgosList := strings.Join(t.publicKeyAuthAlgorithms, ",")
 		extInfo := &extInfoMsg{
-			NumExtensions: 2,
-			Payload:       make([]byte, 0, 4+15+4+len(supportedPubKeyAuthAlgosList)+4+16+4+1),
+			NumExtensions: 3,
+			Payload:       make([]byte, 0, 4+15+4+len(supportedPubKeyAuthAlgosList)+4+31+4+1+4+16+4+1),
 		}
 		extInfo.Payload = appendInt(extInfo.Payload, len("server-sig-algs"))
 		extInfo.Payload = append(extInfo.Payload, "server-sig-algs"...)
 		extInfo.Payload = appendInt(extInfo.Payload, len(supportedPubKeyAuthAlgosList))
 		extInfo.Payload = append(extInfo.Payload, supportedPubKeyAuthAlgosList...)
+		extInfo.Payload = appendInt(extInfo.Payload, len(publicKeyHostBoundExtension))
+		extInfo.Payload = append(extInfo.Payload, publicKeyHostBoundExtension...)
+		extInfo.Payload = appendInt(extInfo.Payload, 1)
+		extInfo.Payload = append(extInfo.Payload, "0"...)
 		extInfo.Payload = appendInt(extInfo.Payload, len("ping@openssh.com"))
 		extInfo.Payload = append(extInfo.Payload, "ping@openssh.com"...)
 		extInfo.Payload = appendInt(extInfo.Payload, 1)
@@ -727,6 +1139,11 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		t.conn.setInitialKEXDone()
 	}
 
+	t.negotiatedMu.Lock()
+	t.negotiated = *t.algorithms
+	t.lastKex = time.Now()
+	t.negotiatedMu.Unlock()
+
 	return nil
 }
 
@@ -773,17 +1190,22 @@ func pickHostKey(hostKeys []Signer, algo string) AlgorithmSigner {
 }
 
 func (t *handshakeTransport) server(kex kexAlgorithm, magics *handshakeMagics) (*kexResult, error) {
-	hostKey := pickHostKey(t.hostKeys, t.algorithms.hostKey)
+	hostKey := pickHostKey(t.hostKeys, t.algorithms.HostKey)
 	if hostKey == nil {
 		return nil, errors.New("ssh: internal error: negotiated unsupported signature type")
 	}
 
-	r, err := kex.Server(t.conn, t.config.Rand, magics, hostKey, t.algorithms.hostKey)
+	r, err := kex.Server(t.conn, t.config.Rand, magics, hostKey, t.algorithms.HostKey)
 	return r, err
 }
 
 func (t *handshakeTransport) client(kex kexAlgorithm, magics *handshakeMagics) (*kexResult, error) {
-	result, err := kex.Client(t.conn, t.config.Rand, magics)
+	return t.verifyServer(kex.Client(t.conn, t.config.Rand, magics))
+}
+
+// verifyServer checks the host key and its signature in the result of
+// the client side of a key exchange.
+func (t *handshakeTransport) verifyServer(result *kexResult, err error) (*kexResult, error) {
 	if err != nil {
 		return nil, err
 	}
@@ -793,10 +1215,16 @@ func (t *handshakeTransport) client(kex kexAlgorithm, magics *handshakeMagics) (
 		return nil, err
 	}
 
-	if err := verifyHostKeySignature(hostKey, t.algorithms.hostKey, result); err != nil {
+	if err := verifyHostKeySignature(hostKey, t.algorithms.HostKey, result); err != nil {
 		return nil, err
 	}
 
+	if t.hostKeyAlgorithmCallback != nil {
+		if err := t.hostKeyAlgorithmCallback(t.dialAddress, t.remoteAddr, t.algorithms.HostKey, hostKey); err != nil {
+			return nil, err
+		}
+	}
+
 	err = t.hostKeyCallback(t.dialAddress, t.remoteAddr, hostKey)
 	if err != nil {
 		return nil, err
@@ -804,3 +1232,32 @@ func (t *handshakeTransport) client(kex kexAlgorithm, magics *handshakeMagics) (
 
 	return result, nil
 }
+
+// errHandshakeTimeout is returned when Config.HandshakeTimeout expires.
+var errHandshakeTimeout = fmt.Errorf("ssh: version exchange and key exchange timed out: %w", os.ErrDeadlineExceeded)
+
+// handshakeTimer closes a connection whose version exchange and initial
+// key exchange take longer than Config.HandshakeTimeout.
+type handshakeTimer struct {
+	t *time.Timer
+}
+
+// startHandshakeTimer starts a handshakeTimer for c. If d is zero or
+// negative, the handshake is not limited.
+func startHandshakeTimer(c net.Conn, d time.Duration) *handshakeTimer {
+	h := &handshakeTimer{}
+	if d > 0 {
+		h.t = time.AfterFunc(d, func() { c.Close() })
+	}
+	return h
+}
+
+// stop stops the timer, and must be called once. If the timer has
+// already closed the connection, it returns errHandshakeTimeout rather
+// than err, which is then likely a consequence of the close.
+func (h *handshakeTimer) stop(err error) error {
+	if h.t != nil && !h.t.Stop() {
+		return errHandshakeTimeout
+	}
+	return err
+}
@@ -15,7 +15,9 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type testChecker struct {
@@ -309,6 +311,62 @@ func TestHandshakeAutoRekeyWrite(t *testing.T) {
 	<-done
 }
 
+func TestHandshakeChaCha20RekeyLimit(t *testing.T) {
+	checker := &syncChecker{
+		called:   make(chan int, 10),
+		waitCall: nil,
+	}
+	clientConf := &ClientConfig{HostKeyCallback: checker.Check}
+	clientConf.Ciphers = []string{chacha20Poly1305ID}
+	// A larger threshold doesn't raise the limit of the cipher.
+	clientConf.RekeyThreshold = 1 << 40
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+	<-checker.called
+
+	trC.mu.Lock()
+	left := trC.writeBytesLeft
+	// Pretend that most of the 1 GB limit has been used up.
+	trC.writeBytesLeft = 600
+	trC.mu.Unlock()
+	if left > 1<<30 || left < 1<<30-1024 {
+		t.Fatalf("got %d bytes left before rekeying, want about %d", left, 1<<30)
+	}
+
+	input := make([]byte, 251)
+	input[0] = msgRequestSuccess
+	done := make(chan int, 1)
+	const numPacket = 5
+	go func() {
+		defer close(done)
+		for j := 0; j < numPacket; j++ {
+			if _, err := trS.readPacket(); err != nil {
+				t.Errorf("readPacket: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < numPacket; i++ {
+		p := make([]byte, len(input))
+		copy(p, input)
+		if err := trC.writePacket(p); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+
+	// Crossing the limit forces a key exchange.
+	select {
+	case <-checker.called:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no key exchange after reaching the ChaCha20-Poly1305 limit")
+	}
+	<-done
+}
+
 type syncChecker struct {
 	waitCall chan int
 	called   chan int
@@ -367,7 +425,7 @@ type errorKeyingTransport struct {
 	readLeft, writeLeft int
 }
 
-func (n *errorKeyingTransport) prepareKeyChange(*algorithms, *kexResult) error {
+func (n *errorKeyingTransport) prepareKeyChange(*NegotiatedAlgorithms, *kexResult) error {
 	return nil
 }
 
@@ -397,6 +455,8 @@ func (n *errorKeyingTransport) readPacket() ([]byte, error) {
 
 func (n *errorKeyingTransport) setStrictMode() error { return nil }
 
+func (n *errorKeyingTransport) stats() TransportStats { return TransportStats{} }
+
 func (n *errorKeyingTransport) setInitialKEXDone() {}
 
 func TestHandshakeErrorHandlingRead(t *testing.T) {
@@ -529,8 +589,8 @@ func TestDisconnect(t *testing.T) {
 	_, err = trS.readPacket()
 	if err == nil {
 		t.Errorf("readPacket 2 succeeded")
-	} else if !reflect.DeepEqual(err, errMsg) {
-		t.Errorf("got error %#v, want %#v", err, errMsg)
+	} else if want := errMsg.toError(); !reflect.DeepEqual(err, want) {
+		t.Errorf("got error %#v, want %#v", err, want)
 	}
 
 	_, err = trS.readPacket()
@@ -983,8 +1043,8 @@ func TestStrictKEXMixed(t *testing.T) {
 		CiphersServerClient:     transport.config.Ciphers,
 		MACsClientServer:        transport.config.MACs,
 		MACsServerClient:        transport.config.MACs,
-		CompressionClientServer: supportedCompressions,
-		CompressionServerClient: supportedCompressions,
+		CompressionClientServer: transport.config.Compression,
+		CompressionServerClient: transport.config.Compression,
 		ServerHostKeyAlgos:      []string{KeyAlgoRSASHA256, KeyAlgoRSASHA512, KeyAlgoRSA},
 	}
 	packet := Marshal(msg)
@@ -1019,3 +1079,442 @@ func TestStrictKEXMixed(t *testing.T) {
 		t.Fatalf("client.waitSession: %v", err)
 	}
 }
+
+func TestHandshakeRekeyInterval(t *testing.T) {
+	checker := &syncChecker{
+		called: make(chan int, 10),
+	}
+	clientConf := &ClientConfig{HostKeyCallback: checker.Check}
+	clientConf.RekeyInterval = 20 * time.Millisecond
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	// Consume the msgIgnore packets that stand in for completed key
+	// exchanges.
+	go func() {
+		for {
+			if _, err := trS.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := trC.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The first call is for the initial key exchange; the others
+	// are triggered by the interval alone, without any traffic.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-checker.called:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for key exchange %d", i)
+		}
+	}
+}
+
+func TestHandshakeRekeyCallback(t *testing.T) {
+	stats := make(chan RekeyStats, 1)
+	clientConf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.RekeyCallback = func(s RekeyStats) {
+		stats <- s
+		panic("must not affect the connection")
+	}
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	go func() {
+		for {
+			if _, err := trS.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	const numPackets = 3
+	payload := []byte{msgRequestSuccess, 1, 2, 3}
+	for i := 0; i < numPackets; i++ {
+		if err := trC.writePacket(payload); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+	select {
+	case <-stats:
+		t.Fatal("RekeyCallback called for the initial key exchange")
+	default:
+	}
+
+	trC.requestKeyExchange()
+	var s RekeyStats
+	select {
+	case s = <-stats:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for RekeyCallback")
+	}
+	if s.PacketsWritten != numPackets || s.BytesWritten != numPackets*uint64(len(payload)) {
+		t.Errorf("got %d packets, %d bytes written, want %d, %d", s.PacketsWritten, s.BytesWritten, numPackets, numPackets*len(payload))
+	}
+	if s.Algorithms.KeyExchange == "" || s.Algorithms.Write.Cipher == "" {
+		t.Errorf("algorithms not set: %+v", s.Algorithms)
+	}
+
+	// The connection survives the panic.
+	if err := trC.writePacket(payload); err != nil {
+		t.Fatalf("writePacket after panic: %v", err)
+	}
+	trS.writePacket(payload)
+	if _, err := trC.readPacket(); err != nil {
+		t.Fatalf("readPacket after panic: %v", err)
+	}
+}
+
+func TestHandshakeRekeyCallbackSlow(t *testing.T) {
+	release := make(chan struct{})
+	calls := make(chan uint64, 2)
+	clientConf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.RekeyCallback = func(s RekeyStats) {
+		<-release
+		calls <- s.PacketsRead
+	}
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	go func() {
+		for {
+			if _, err := trC.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := trS.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// While the client's callback blocks, the server can complete
+	// further key exchanges and traffic keeps flowing both ways.
+	for i := 0; i < 2; i++ {
+		if err := trS.rekeyNow(); err != nil {
+			t.Fatalf("rekeyNow: %v", err)
+		}
+		if err := trS.writePacket([]byte{msgRequestSuccess}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+		if err := trC.writePacket([]byte{msgRequestSuccess}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-calls:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for RekeyCallback %d", i)
+		}
+	}
+}
+
+func TestHandshakeRekeyNow(t *testing.T) {
+	var rekeys int32
+	clientConf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.RekeyCallback = func(RekeyStats) {
+		atomic.AddInt32(&rekeys, 1)
+	}
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trS.Close()
+
+	go func() {
+		for {
+			if _, err := trS.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := trC.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := trC.rekeyNow(); err != nil {
+		t.Fatalf("rekeyNow: %v", err)
+	}
+	if got := atomic.LoadInt32(&rekeys); got != 1 {
+		t.Errorf("got %d key exchanges, want 1", got)
+	}
+
+	// Concurrent calls either complete a key exchange or report that
+	// one is already in progress, while traffic keeps flowing.
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- trC.rekeyNow() }()
+	}
+	for i := 0; i < 10; i++ {
+		if err := trC.writePacket([]byte{msgRequestSuccess, byte(i)}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+	succeeded := 0
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		if err == nil {
+			succeeded++
+		} else if !strings.Contains(err.Error(), "already in progress") {
+			t.Errorf("rekeyNow: %v", err)
+		}
+	}
+	if succeeded == 0 {
+		t.Error("no concurrent rekeyNow call succeeded")
+	}
+
+	trC.Close()
+	if err := trC.rekeyNow(); err == nil {
+		t.Error("rekeyNow succeeded on a closed transport")
+	}
+}
+
+func TestHandshakePacketTrace(t *testing.T) {
+	var mu sync.Mutex
+	read := map[byte]int{}
+	written := map[byte]int{}
+	clientConf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.PacketTraceReader = func(p []byte) {
+		mu.Lock()
+		read[p[0]]++
+		mu.Unlock()
+		// Scribbling over the copy must not affect the connection.
+		for i := range p {
+			p[i] = 0xff
+		}
+	}
+	clientConf.PacketTraceWriter = func(p []byte) {
+		mu.Lock()
+		written[p[0]]++
+		mu.Unlock()
+		for i := range p {
+			p[i] = 0xff
+		}
+	}
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	payload := []byte{msgRequestSuccess, 1, 2, 3}
+	if err := trC.writePacket(payload); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if p, err := trS.readPacket(); err != nil || !bytes.Equal(p, []byte{msgRequestSuccess, 1, 2, 3}) {
+		t.Fatalf("server read %x, %v", p, err)
+	}
+	if err := trS.writePacket([]byte{msgRequestFailure}); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	for {
+		p, err := trC.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if p[0] == msgRequestFailure {
+			break
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, msg := range []byte{msgKexInit, msgNewKeys} {
+		if read[msg] != 1 || written[msg] != 1 {
+			t.Errorf("message %d: read %d, written %d times, want 1", msg, read[msg], written[msg])
+		}
+	}
+	if written[msgRequestSuccess] != 1 || read[msgRequestFailure] != 1 {
+		t.Errorf("application packets not traced: read %v, written %v", read, written)
+	}
+}
+
+func TestHandshakeDisableExtInfo(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		a, b, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		conf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+		conf.DisableExtInfo = disable
+		conf.SetDefaults()
+		v := []byte("version")
+		client := newClientTransport(newTransport(a, rand.Reader, true), v, v, conf, "addr", a.RemoteAddr())
+
+		packet, err := newTransport(b, rand.Reader, false).readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		var msg kexInitMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if got := contains(msg.KexAlgos, "ext-info-c"); got == disable {
+			t.Errorf("DisableExtInfo %v: got key exchanges %v", disable, msg.KexAlgos)
+		}
+		if !contains(msg.KexAlgos, kexStrictClient) {
+			t.Errorf("DisableExtInfo %v: strict key exchange not offered in %v", disable, msg.KexAlgos)
+		}
+		client.Close()
+		b.Close()
+	}
+}
+
+func TestHandshakeGuessKeyExchangeSent(t *testing.T) {
+	a, b, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	conf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	conf.KeyExchanges = []string{kexAlgoCurve25519SHA256}
+	conf.GuessKeyExchange = true
+	conf.SetDefaults()
+	v := []byte("version")
+	client := newClientTransport(newTransport(a, rand.Reader, true), v, v, conf, "addr", a.RemoteAddr())
+	defer client.Close()
+
+	// The guessed key exchange message follows the KEXINIT without
+	// waiting for the server's.
+	server := newTransport(b, rand.Reader, false)
+	packet, err := server.readPacket()
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	var msg kexInitMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !msg.FirstKexFollows {
+		t.Error("KEXINIT does not have first_kex_packet_follows set")
+	}
+	if packet, err = server.readPacket(); err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if packet[0] != msgKexECDHInit {
+		t.Errorf("got message type %d after KEXINIT, want %d", packet[0], msgKexECDHInit)
+	}
+}
+
+func TestHandshakeGuessKeyExchange(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		clientKex []string
+		serverKex []string
+		hostKeys  []string
+		want      string
+	}{
+		{"right", []string{kexAlgoCurve25519SHA256, kexAlgoECDH256}, []string{kexAlgoCurve25519SHA256, kexAlgoECDH256}, nil, kexAlgoCurve25519SHA256},
+		{"wrong kex", []string{kexAlgoCurve25519SHA256, kexAlgoECDH256}, []string{kexAlgoECDH256, kexAlgoCurve25519SHA256}, nil, kexAlgoCurve25519SHA256},
+		{"unsupported kex", []string{kexAlgoECDH384, kexAlgoECDH256}, []string{kexAlgoECDH256}, nil, kexAlgoECDH256},
+		{"wrong multi-message kex", []string{kexAlgoDHGEXSHA256, kexAlgoECDH256}, []string{kexAlgoECDH256}, nil, kexAlgoECDH256},
+		{"wrong host key", []string{kexAlgoCurve25519SHA256}, []string{kexAlgoCurve25519SHA256}, []string{KeyAlgoED25519, KeyAlgoECDSA256}, kexAlgoCurve25519SHA256},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConf := &ServerConfig{NoClientAuth: true}
+			serverConf.KeyExchanges = tt.serverKex
+			serverConf.AddHostKey(testSigners["ecdsa"])
+			clientConf := &ClientConfig{
+				User:              "user",
+				HostKeyCallback:   InsecureIgnoreHostKey(),
+				HostKeyAlgorithms: tt.hostKeys,
+			}
+			clientConf.KeyExchanges = tt.clientKex
+			clientConf.GuessKeyExchange = true
+			conn, _, _ := testClientServerConn(t, serverConf, clientConf)
+			if got := conn.(AlgorithmsConnMetadata).Algorithms().KeyExchange; got != tt.want {
+				t.Errorf("got key exchange %q, want %q", got, tt.want)
+			}
+
+			// Rekeys guess too.
+			if err := conn.(RekeyConn).RekeyNow(); err != nil {
+				t.Fatalf("RekeyNow: %v", err)
+			}
+			if _, _, err := conn.SendRequest("ping", true, nil); err != nil {
+				t.Fatalf("SendRequest: %v", err)
+			}
+		})
+	}
+}
+
+func TestHandshakeRequireStrictKex(t *testing.T) {
+	a, b, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	conf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	conf.RequireStrictKex = true
+	conf.SetDefaults()
+	v := []byte("version")
+	client := newClientTransport(newTransport(a, rand.Reader, true), v, v, conf, "addr", a.RemoteAddr())
+	defer client.Close()
+
+	// Answer with a KEXINIT that agrees on everything but doesn't
+	// offer strict key exchange.
+	server := newTransport(b, rand.Reader, false)
+	packet, err := server.readPacket()
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	var msg kexInitMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	var kexAlgos []string
+	for _, k := range msg.KexAlgos {
+		if k != kexStrictClient && k != "ext-info-c" {
+			kexAlgos = append(kexAlgos, k)
+		}
+	}
+	msg.KexAlgos = kexAlgos
+	if err := server.writePacket(Marshal(&msg)); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+
+	if err := client.waitSession(); err == nil || !strings.Contains(err.Error(), "strict key exchange") {
+		t.Errorf("waitSession: got %v, want strict key exchange error", err)
+	}
+
+	// Peers that both support strict key exchange connect as usual.
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.RequireStrictKex = true
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	clientConf := &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.RequireStrictKex = true
+	testClientServerConn(t, serverConf, clientConf)
+}
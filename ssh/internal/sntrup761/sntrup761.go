@@ -0,0 +1,680 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sntrup761 implements the Streamlined NTRU Prime 761 key
+// encapsulation mechanism, as used by the sntrup761x25519-sha512 SSH key
+// exchange.
+//
+// This is a port of the reference implementation from SUPERCOP, as found
+// in OpenSSH. See https://ntruprime.cr.yp.to/ and
+// https://cvsweb.openbsd.org/src/usr.bin/ssh/sntrup761.c.
+package sntrup761
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+const (
+	p = 761
+	q = 4591
+	w = 286
+
+	q12 = (q - 1) / 2
+
+	smallBytes   = (p + 3) / 4
+	rqBytes      = 1158
+	roundedBytes = 1007
+	hashBytes    = 32
+	inputsBytes  = smallBytes
+
+	// PublicKeySize is the size of an encoded public key.
+	PublicKeySize = rqBytes
+	// PrivateKeySize is the size of an encoded private key.
+	PrivateKeySize = 2*smallBytes + PublicKeySize + inputsBytes + hashBytes
+	// CiphertextSize is the size of a ciphertext.
+	CiphertextSize = roundedBytes + hashBytes
+	// SharedKeySize is the size of the shared key.
+	SharedKeySize = hashBytes
+)
+
+// The arithmetic below avoids secret-dependent branches and divisions,
+// following the reference implementation.
+
+func uint32DivmodUint14(x uint32, m uint16) (uint32, uint16) {
+	v := uint32(0x80000000) / uint32(m)
+	var quot uint32
+
+	qpart := uint32((uint64(x) * uint64(v)) >> 31)
+	x -= qpart * uint32(m)
+	quot += qpart
+
+	qpart = uint32((uint64(x) * uint64(v)) >> 31)
+	x -= qpart * uint32(m)
+	quot += qpart
+
+	x -= uint32(m)
+	quot++
+	mask := -(x >> 31)
+	x += mask & uint32(m)
+	quot += mask
+
+	return quot, uint16(x)
+}
+
+func uint32ModUint14(x uint32, m uint16) uint16 {
+	_, r := uint32DivmodUint14(x, m)
+	return r
+}
+
+func int32ModUint14(x int32, m uint16) uint16 {
+	_, ur := uint32DivmodUint14(0x80000000+uint32(x), m)
+	_, ur2 := uint32DivmodUint14(0x80000000, m)
+	ur -= ur2
+	mask := -uint32(ur >> 15)
+	ur += uint16(mask & uint32(m))
+	return ur
+}
+
+// nonzeroMask returns -1 if x is non-zero, and 0 otherwise.
+func nonzeroMask(x int16) int {
+	v := uint32(uint16(x))
+	v = -v
+	v >>= 31
+	return -int(v)
+}
+
+// negativeMask returns -1 if x is negative, and 0 otherwise.
+func negativeMask(x int16) int {
+	u := uint16(x) >> 15
+	return -int(u)
+}
+
+// f3Freeze reduces x to -1, 0 or 1 modulo 3.
+func f3Freeze(x int32) int8 {
+	return int8(int32ModUint14(x+1, 3)) - 1
+}
+
+// fqFreeze reduces x to -q12...q12 modulo q.
+func fqFreeze(x int32) int16 {
+	return int16(int32ModUint14(x+q12, q)) - q12
+}
+
+func fqRecip(a1 int16) int16 {
+	ai := a1
+	for i := 1; i < q-2; i++ {
+		ai = fqFreeze(int32(a1) * int32(ai))
+	}
+	return ai
+}
+
+// weightwMask returns 0 if r has exactly w non-zero coefficients, and -1
+// otherwise.
+func weightwMask(r *[p]int8) int {
+	weight := 0
+	for i := range r {
+		weight += int(r[i] & 1)
+	}
+	return nonzeroMask(int16(weight - w))
+}
+
+// r3FromRq reduces the coefficients of r modulo 3.
+func r3FromRq(out *[p]int8, r *[p]int16) {
+	for i := range r {
+		out[i] = f3Freeze(int32(r[i]))
+	}
+}
+
+// r3Mult sets h = f*g in the ring R/3.
+func r3Mult(h, f, g *[p]int8) {
+	var fg [p + p - 1]int32
+	for i := 0; i < p; i++ {
+		for j := 0; j < p; j++ {
+			fg[i+j] += int32(f[i]) * int32(g[j])
+		}
+	}
+	// Reduce modulo x^p - x - 1.
+	for i := p + p - 2; i >= p; i-- {
+		fg[i-p] += fg[i]
+		fg[i-p+1] += fg[i]
+	}
+	for i := range h {
+		h[i] = f3Freeze(fg[i])
+	}
+}
+
+// r3Recip sets out = 1/in in the ring R/3. It returns 0 on success and -1
+// if in is not invertible.
+func r3Recip(out, in *[p]int8) int {
+	var f, g, v, r [p + 1]int8
+
+	r[0] = 1
+	f[0] = 1
+	f[p-1] = -1
+	f[p] = -1
+	for i := 0; i < p; i++ {
+		g[p-1-i] = in[i]
+	}
+
+	delta := 1
+	for loop := 0; loop < 2*p-1; loop++ {
+		for i := p; i > 0; i-- {
+			v[i] = v[i-1]
+		}
+		v[0] = 0
+
+		sign := -int(g[0]) * int(f[0])
+		swap := negativeMask(int16(-delta)) & nonzeroMask(int16(g[0]))
+		delta ^= swap & (delta ^ -delta)
+		delta++
+
+		for i := 0; i < p+1; i++ {
+			t := int8(swap) & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = int8(swap) & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+
+		for i := 0; i < p+1; i++ {
+			g[i] = f3Freeze(int32(g[i]) + int32(sign)*int32(f[i]))
+		}
+		for i := 0; i < p+1; i++ {
+			r[i] = f3Freeze(int32(r[i]) + int32(sign)*int32(v[i]))
+		}
+
+		for i := 0; i < p; i++ {
+			g[i] = g[i+1]
+		}
+		g[p] = 0
+	}
+
+	sign := f[0]
+	for i := 0; i < p; i++ {
+		out[i] = sign * v[p-1-i]
+	}
+
+	return nonzeroMask(int16(delta))
+}
+
+// rqMultSmall sets h = f*g in the ring R/q.
+func rqMultSmall(h, f *[p]int16, g *[p]int8) {
+	var fg [p + p - 1]int32
+	for i := 0; i < p; i++ {
+		for j := 0; j < p; j++ {
+			fg[i+j] += int32(f[i]) * int32(g[j])
+		}
+	}
+	// Reduce modulo x^p - x - 1.
+	for i := p + p - 2; i >= p; i-- {
+		fg[i-p] += fg[i]
+		fg[i-p+1] += fg[i]
+	}
+	for i := range h {
+		h[i] = fqFreeze(fg[i])
+	}
+}
+
+// rqMult3 sets h = 3f in the ring R/q.
+func rqMult3(h, f *[p]int16) {
+	for i := range f {
+		h[i] = fqFreeze(3 * int32(f[i]))
+	}
+}
+
+// rqRecip3 sets out = 1/(3*in) in the ring R/q. It returns 0 on success and
+// -1 if in is not invertible.
+func rqRecip3(out *[p]int16, in *[p]int8) int {
+	var f, g, v, r [p + 1]int16
+
+	r[0] = fqRecip(3)
+	f[0] = 1
+	f[p-1] = -1
+	f[p] = -1
+	for i := 0; i < p; i++ {
+		g[p-1-i] = int16(in[i])
+	}
+
+	delta := 1
+	for loop := 0; loop < 2*p-1; loop++ {
+		for i := p; i > 0; i-- {
+			v[i] = v[i-1]
+		}
+		v[0] = 0
+
+		swap := negativeMask(int16(-delta)) & nonzeroMask(g[0])
+		delta ^= swap & (delta ^ -delta)
+		delta++
+
+		for i := 0; i < p+1; i++ {
+			t := int16(swap) & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = int16(swap) & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+
+		f0 := int32(f[0])
+		g0 := int32(g[0])
+		for i := 0; i < p+1; i++ {
+			g[i] = fqFreeze(f0*int32(g[i]) - g0*int32(f[i]))
+		}
+		for i := 0; i < p+1; i++ {
+			r[i] = fqFreeze(f0*int32(r[i]) - g0*int32(v[i]))
+		}
+
+		for i := 0; i < p; i++ {
+			g[i] = g[i+1]
+		}
+		g[p] = 0
+	}
+
+	scale := int32(fqRecip(f[0]))
+	for i := 0; i < p; i++ {
+		out[i] = fqFreeze(scale * int32(v[p-1-i]))
+	}
+
+	return nonzeroMask(int16(delta))
+}
+
+// round rounds each coefficient of a to the nearest multiple of 3.
+func round(out, a *[p]int16) {
+	for i := range a {
+		out[i] = a[i] - int16(f3Freeze(int32(a[i])))
+	}
+}
+
+// int32MinMax sets a, b = min(a, b), max(a, b) without branching.
+func int32MinMax(a, b *int32) {
+	ab := int64(*b) ^ int64(*a)
+	c := int64(*b) - int64(*a)
+	c ^= ab & (c ^ int64(*b))
+	c >>= 31
+	c &= ab
+	*a ^= int32(c)
+	*b ^= int32(c)
+}
+
+// sortUint32 sorts x with a sorting network, so that the memory access
+// pattern doesn't depend on the contents of x.
+func sortUint32(x []uint32) {
+	n := len(x)
+	if n < 2 {
+		return
+	}
+
+	y := make([]int32, n)
+	for i := range x {
+		y[i] = int32(x[i] ^ 0x80000000)
+	}
+
+	top := 1
+	for top < n-top {
+		top += top
+	}
+	for pp := top; pp > 0; pp >>= 1 {
+		for i := 0; i < n-pp; i++ {
+			if i&pp == 0 {
+				int32MinMax(&y[i], &y[i+pp])
+			}
+		}
+		i := 0
+		for qq := top; qq > pp; qq >>= 1 {
+			for ; i < n-qq; i++ {
+				if i&pp == 0 {
+					a := y[i+pp]
+					for r := qq; r > pp; r >>= 1 {
+						int32MinMax(&a, &y[i+r])
+					}
+					y[i+pp] = a
+				}
+			}
+		}
+	}
+
+	for i := range x {
+		x[i] = uint32(y[i]) ^ 0x80000000
+	}
+}
+
+// shortFromList sets out to a polynomial with exactly w non-zero
+// coefficients, each -1 or 1, determined by the random list in.
+func shortFromList(out *[p]int8, in *[p]uint32) {
+	var l [p]uint32
+	for i := 0; i < w; i++ {
+		l[i] = in[i] & ^uint32(1)
+	}
+	for i := w; i < p; i++ {
+		l[i] = (in[i] & ^uint32(2)) | 1
+	}
+	sortUint32(l[:])
+	for i := range out {
+		out[i] = int8(l[i]&3) - 1
+	}
+}
+
+func random32s(rand io.Reader, out *[p]uint32) error {
+	var buf [4 * p]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		return err
+	}
+	for i := range out {
+		b := buf[4*i:]
+		out[i] = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	}
+	return nil
+}
+
+func shortRandom(rand io.Reader, out *[p]int8) error {
+	var l [p]uint32
+	if err := random32s(rand, &l); err != nil {
+		return err
+	}
+	shortFromList(out, &l)
+	return nil
+}
+
+func smallRandom(rand io.Reader, out *[p]int8) error {
+	var l [p]uint32
+	if err := random32s(rand, &l); err != nil {
+		return err
+	}
+	for i := range out {
+		out[i] = int8(((l[i]&0x3fffffff)*3)>>30) - 1
+	}
+	return nil
+}
+
+// keyGen generates the public polynomial h and the private polynomials f
+// and ginv.
+func keyGen(rand io.Reader, h *[p]int16, f, ginv *[p]int8) error {
+	var g [p]int8
+	for {
+		if err := smallRandom(rand, &g); err != nil {
+			return err
+		}
+		if r3Recip(ginv, &g) == 0 {
+			break
+		}
+	}
+	if err := shortRandom(rand, f); err != nil {
+		return err
+	}
+	var finv [p]int16
+	rqRecip3(&finv, f) // always works
+	rqMultSmall(h, &finv, &g)
+	return nil
+}
+
+func encrypt(c *[p]int16, r *[p]int8, h *[p]int16) {
+	var hr [p]int16
+	rqMultSmall(&hr, h, r)
+	round(c, &hr)
+}
+
+func decrypt(r *[p]int8, c *[p]int16, f, ginv *[p]int8) {
+	var cf, cf3 [p]int16
+	var e, ev [p]int8
+
+	rqMultSmall(&cf, c, f)
+	rqMult3(&cf3, &cf)
+	r3FromRq(&e, &cf3)
+	r3Mult(&ev, &e, ginv)
+
+	mask := int8(weightwMask(&ev)) // 0 if weight w, else -1
+	for i := 0; i < w; i++ {
+		r[i] = ((ev[i] ^ 1) &^ mask) ^ 1
+	}
+	for i := w; i < p; i++ {
+		r[i] = ev[i] &^ mask
+	}
+}
+
+// encode appends the encoding of R to out, where 0 <= R[i] < M[i] < 16384.
+func encode(out []byte, R, M []uint16) []byte {
+	if len(M) == 1 {
+		r, m := uint32(R[0]), uint32(M[0])
+		for m > 1 {
+			out = append(out, byte(r))
+			r >>= 8
+			m = (m + 255) >> 8
+		}
+		return out
+	}
+
+	n := len(M)
+	R2 := make([]uint16, (n+1)/2)
+	M2 := make([]uint16, (n+1)/2)
+	i := 0
+	for ; i < n-1; i += 2 {
+		m0 := uint32(M[i])
+		r := uint32(R[i]) + uint32(R[i+1])*m0
+		m := uint32(M[i+1]) * m0
+		for m >= 16384 {
+			out = append(out, byte(r))
+			r >>= 8
+			m = (m + 255) >> 8
+		}
+		R2[i/2] = uint16(r)
+		M2[i/2] = uint16(m)
+	}
+	if i < n {
+		R2[i/2] = R[i]
+		M2[i/2] = M[i]
+	}
+	return encode(out, R2, M2)
+}
+
+// decode is the inverse of encode. It assumes 0 < M[i] < 16384 and
+// produces 0 <= out[i] < M[i].
+func decode(out []uint16, S []byte, M []uint16) {
+	n := len(M)
+	if n == 1 {
+		switch {
+		case M[0] == 1:
+			out[0] = 0
+		case M[0] <= 256:
+			out[0] = uint32ModUint14(uint32(S[0]), M[0])
+		default:
+			out[0] = uint32ModUint14(uint32(S[0])+uint32(S[1])<<8, M[0])
+		}
+		return
+	}
+
+	R2 := make([]uint16, (n+1)/2)
+	M2 := make([]uint16, (n+1)/2)
+	bottomr := make([]uint16, n/2)
+	bottomt := make([]uint32, n/2)
+	i := 0
+	for ; i < n-1; i += 2 {
+		m := uint32(M[i]) * uint32(M[i+1])
+		switch {
+		case m > 256*16383:
+			bottomt[i/2] = 256 * 256
+			bottomr[i/2] = uint16(S[0]) + 256*uint16(S[1])
+			S = S[2:]
+			M2[i/2] = uint16((((m + 255) >> 8) + 255) >> 8)
+		case m >= 16384:
+			bottomt[i/2] = 256
+			bottomr[i/2] = uint16(S[0])
+			S = S[1:]
+			M2[i/2] = uint16((m + 255) >> 8)
+		default:
+			bottomt[i/2] = 1
+			bottomr[i/2] = 0
+			M2[i/2] = uint16(m)
+		}
+	}
+	if i < n {
+		M2[i/2] = M[i]
+	}
+	decode(R2, S, M2)
+
+	for i = 0; i < n-1; i += 2 {
+		r := uint32(bottomr[i/2]) + bottomt[i/2]*uint32(R2[i/2])
+		r1, r0 := uint32DivmodUint14(r, M[i])
+		r1 = uint32(uint32ModUint14(r1, M[i+1])) // only needed for invalid inputs
+		out[i] = r0
+		out[i+1] = uint16(r1)
+	}
+	if i < n {
+		out[i] = R2[i/2]
+	}
+}
+
+func smallEncode(s []byte, f *[p]int8) {
+	for i := 0; i < p/4; i++ {
+		x := f[4*i] + 1
+		x += (f[4*i+1] + 1) << 2
+		x += (f[4*i+2] + 1) << 4
+		x += (f[4*i+3] + 1) << 6
+		s[i] = byte(x)
+	}
+	s[p/4] = byte(f[p-1] + 1)
+}
+
+func smallDecode(f *[p]int8, s []byte) {
+	for i := 0; i < p/4; i++ {
+		x := s[i]
+		f[4*i] = int8(x&3) - 1
+		x >>= 2
+		f[4*i+1] = int8(x&3) - 1
+		x >>= 2
+		f[4*i+2] = int8(x&3) - 1
+		x >>= 2
+		f[4*i+3] = int8(x&3) - 1
+	}
+	f[p-1] = int8(s[p/4]&3) - 1
+}
+
+func rqEncode(r *[p]int16) []byte {
+	var R, M [p]uint16
+	for i := range r {
+		R[i] = uint16(r[i] + q12)
+		M[i] = q
+	}
+	return encode(make([]byte, 0, rqBytes), R[:], M[:])
+}
+
+func rqDecode(r *[p]int16, s []byte) {
+	var R, M [p]uint16
+	for i := range M {
+		M[i] = q
+	}
+	decode(R[:], s, M[:])
+	for i := range r {
+		r[i] = int16(R[i]) - q12
+	}
+}
+
+func roundedEncode(r *[p]int16) []byte {
+	var R, M [p]uint16
+	for i := range r {
+		R[i] = uint16(((int32(r[i]) + q12) * 10923) >> 15)
+		M[i] = (q + 2) / 3
+	}
+	return encode(make([]byte, 0, roundedBytes), R[:], M[:])
+}
+
+func roundedDecode(r *[p]int16, s []byte) {
+	var R, M [p]uint16
+	for i := range M {
+		M[i] = (q + 2) / 3
+	}
+	decode(R[:], s, M[:])
+	for i := range r {
+		r[i] = int16(R[i])*3 - q12
+	}
+}
+
+// hashPrefix returns the first 32 bytes of SHA-512(b || in).
+func hashPrefix(b byte, in ...[]byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{b})
+	for _, x := range in {
+		h.Write(x)
+	}
+	return h.Sum(nil)[:hashBytes]
+}
+
+// hide returns the ciphertext and confirmation hash for r, and the
+// encoding of r. cache is hashPrefix(4, pk).
+func hide(r *[p]int8, pk, cache []byte) (c, rEnc []byte) {
+	rEnc = make([]byte, inputsBytes)
+	smallEncode(rEnc, r)
+
+	var h, ct [p]int16
+	rqDecode(&h, pk)
+	encrypt(&ct, r, &h)
+	c = roundedEncode(&ct)
+	c = append(c, hashPrefix(2, hashPrefix(3, rEnc), cache)...)
+	return c, rEnc
+}
+
+// GenerateKey generates a new key pair, reading randomness from rand.
+func GenerateKey(rand io.Reader) (publicKey, privateKey []byte, err error) {
+	var h [p]int16
+	var f, v [p]int8
+	if err := keyGen(rand, &h, &f, &v); err != nil {
+		return nil, nil, err
+	}
+
+	pk := rqEncode(&h)
+	sk := make([]byte, PrivateKeySize)
+	smallEncode(sk, &f)
+	smallEncode(sk[smallBytes:], &v)
+	copy(sk[2*smallBytes:], pk)
+	rho := sk[2*smallBytes+PublicKeySize:]
+	if _, err := io.ReadFull(rand, rho[:inputsBytes]); err != nil {
+		return nil, nil, err
+	}
+	copy(rho[inputsBytes:], hashPrefix(4, pk))
+	return pk, sk, nil
+}
+
+// Encapsulate generates a shared key and its encapsulation for publicKey,
+// reading randomness from rand.
+func Encapsulate(rand io.Reader, publicKey []byte) (ciphertext, sharedKey []byte, err error) {
+	if len(publicKey) != PublicKeySize {
+		return nil, nil, errors.New("sntrup761: invalid public key length")
+	}
+	var r [p]int8
+	if err := shortRandom(rand, &r); err != nil {
+		return nil, nil, err
+	}
+	c, rEnc := hide(&r, publicKey, hashPrefix(4, publicKey))
+	return c, hashPrefix(1, hashPrefix(3, rEnc), c), nil
+}
+
+// Decapsulate returns the shared key encapsulated in ciphertext. An
+// invalid ciphertext results in an unpredictable key rather than an error.
+func Decapsulate(privateKey, ciphertext []byte) (sharedKey []byte, err error) {
+	if len(privateKey) != PrivateKeySize {
+		return nil, errors.New("sntrup761: invalid private key length")
+	}
+	if len(ciphertext) != CiphertextSize {
+		return nil, errors.New("sntrup761: invalid ciphertext length")
+	}
+	pk := privateKey[2*smallBytes : 2*smallBytes+PublicKeySize]
+	rho := privateKey[2*smallBytes+PublicKeySize : 2*smallBytes+PublicKeySize+inputsBytes]
+	cache := privateKey[2*smallBytes+PublicKeySize+inputsBytes:]
+
+	var f, v, r [p]int8
+	var c [p]int16
+	smallDecode(&f, privateKey)
+	smallDecode(&v, privateKey[smallBytes:])
+	roundedDecode(&c, ciphertext)
+	decrypt(&r, &c, &f, &v)
+
+	cnew, rEnc := hide(&r, pk, cache)
+	ok := subtle.ConstantTimeCompare(ciphertext, cnew)
+	// On mismatch, use the random rho instead of r and prefix 0 instead of
+	// 1, as in the reference implementation.
+	subtle.ConstantTimeCopy(1-ok, rEnc, rho)
+	return hashPrefix(byte(ok), hashPrefix(3, rEnc), ciphertext), nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sntrup761
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		pk, sk, err := GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pk) != PublicKeySize || len(sk) != PrivateKeySize {
+			t.Fatalf("got key sizes %d, %d, want %d, %d", len(pk), len(sk), PublicKeySize, PrivateKeySize)
+		}
+		c, k1, err := Encapsulate(rand.Reader, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c) != CiphertextSize {
+			t.Fatalf("got ciphertext size %d, want %d", len(c), CiphertextSize)
+		}
+		k2, err := Decapsulate(sk, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(k1, k2) {
+			t.Fatalf("shared keys differ: %x vs %x", k1, k2)
+		}
+
+		c[0] ^= 1
+		k3, err := Decapsulate(sk, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(k1, k3) {
+			t.Fatal("tampered ciphertext gave the same shared key")
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 17, 286, p} {
+		x := make([]uint32, n)
+		b := make([]byte, 4*n)
+		rand.Read(b)
+		for i := range x {
+			x[i] = uint32(b[4*i]) | uint32(b[4*i+1])<<8 | uint32(b[4*i+2])<<16 | uint32(b[4*i+3])<<24
+		}
+		want := append([]uint32(nil), x...)
+		sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+		sortUint32(x)
+		for i := range x {
+			if x[i] != want[i] {
+				t.Fatalf("n=%d: sorted output differs at %d", n, i)
+			}
+		}
+	}
+}
+
+func BenchmarkGenerateKey(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		GenerateKey(rand.Reader)
+	}
+}
+
+func BenchmarkEncapsulate(b *testing.B) {
+	pk, _, _ := GenerateKey(rand.Reader)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encapsulate(rand.Reader, pk)
+	}
+}
+
+func BenchmarkDecapsulate(b *testing.B) {
+	pk, sk, _ := GenerateKey(rand.Reader)
+	c, _, _ := Encapsulate(rand.Reader, pk)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Decapsulate(sk, c)
+	}
+}
+
+// openSSHVector reads the vector in testdata/openssh.txt.
+func openSSHVector(t *testing.T) (pk, ct, ss []byte) {
+	data, err := os.ReadFile("testdata/openssh.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string][]byte)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			t.Fatalf("malformed line %q", line)
+		}
+		if values[name], err = hex.DecodeString(value); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	return values["pk"], values["ct"], values["ss"]
+}
+
+// shake128 returns the SHAKE128 stream of seed, starting at offset.
+func shake128(seed string, offset int64) io.Reader {
+	h := sha3.NewShake128()
+	h.Write([]byte(seed))
+	io.CopyN(io.Discard, h, offset)
+	return h
+}
+
+// TestOpenSSHVector checks key generation, encapsulation and decapsulation
+// against the values OpenSSH computed from the same randomness.
+func TestOpenSSHVector(t *testing.T) {
+	wantPK, wantCT, wantSS := openSSHVector(t)
+
+	pk, sk, err := GenerateKey(shake128("sntrup761", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pk, wantPK) {
+		t.Errorf("public key differs from OpenSSH's:\n got %x\nwant %x", pk, wantPK)
+	}
+	ss, err := Decapsulate(sk, wantCT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ss, wantSS) {
+		t.Errorf("decapsulated shared key %x, OpenSSH got %x", ss, wantSS)
+	}
+
+	ct, ss, err := Encapsulate(shake128("", 23), wantPK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ct, wantCT) {
+		t.Errorf("ciphertext differs from the recorded one:\n got %x\nwant %x", ct, wantCT)
+	}
+	if !bytes.Equal(ss, wantSS) {
+		t.Errorf("encapsulated shared key %x, OpenSSH got %x", ss, wantSS)
+	}
+}
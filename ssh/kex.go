@@ -24,6 +24,7 @@ const (
 	kexAlgoDH14SHA1               = "diffie-hellman-group14-sha1"
 	kexAlgoDH14SHA256             = "diffie-hellman-group14-sha256"
 	kexAlgoDH16SHA512             = "diffie-hellman-group16-sha512"
+	kexAlgoDH18SHA512             = "diffie-hellman-group18-sha512"
 	kexAlgoECDH256                = "ecdh-sha2-nistp256"
 	kexAlgoECDH384                = "ecdh-sha2-nistp384"
 	kexAlgoECDH521                = "ecdh-sha2-nistp521"
@@ -91,6 +92,29 @@ type kexAlgorithm interface {
 type dhGroup struct {
 	g, p, pMinus1 *big.Int
 	hashFunc      crypto.Hash
+
+	// privBits, if not zero, is the size of the private exponents, which
+	// are otherwise drawn from the whole group. Shorter exponents make
+	// the large groups affordable; RFC 3526, section 8 recommends twice
+	// the estimated strength of the group.
+	privBits int
+}
+
+// generatePrivate returns a random private exponent for group.
+func (group *dhGroup) generatePrivate(randSource io.Reader) (*big.Int, error) {
+	max := group.pMinus1
+	if group.privBits > 0 {
+		max = new(big.Int).Lsh(bigOne, uint(group.privBits))
+	}
+	for {
+		x, err := rand.Int(randSource, max)
+		if err != nil {
+			return nil, err
+		}
+		if x.Sign() > 0 {
+			return x, nil
+		}
+	}
 }
 
 func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int, error) {
@@ -101,15 +125,9 @@ func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int,
 }
 
 func (group *dhGroup) Client(c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
-	var x *big.Int
-	for {
-		var err error
-		if x, err = rand.Int(randSource, group.pMinus1); err != nil {
-			return nil, err
-		}
-		if x.Sign() > 0 {
-			break
-		}
+	x, err := group.generatePrivate(randSource)
+	if err != nil {
+		return nil, err
 	}
 
 	X := new(big.Int).Exp(group.g, x, group.p)
@@ -163,14 +181,9 @@ func (group *dhGroup) Server(c packetConn, randSource io.Reader, magics *handsha
 		return
 	}
 
-	var y *big.Int
-	for {
-		if y, err = rand.Int(randSource, group.pMinus1); err != nil {
-			return
-		}
-		if y.Sign() > 0 {
-			break
-		}
+	y, err := group.generatePrivate(randSource)
+	if err != nil {
+		return nil, err
 	}
 
 	Y := new(big.Int).Exp(group.g, y, group.p)
@@ -440,6 +453,24 @@ func init() {
 		p:        p,
 		pMinus1:  new(big.Int).Sub(p, bigOne),
 		hashFunc: crypto.SHA512,
+		// RFC 3526, section 8 estimates the strength of this group at
+		// 150 to 240 bits, which needs exponents of 300 to 480 bits;
+		// full-size exponents only make the key exchange slower.
+		privBits: 512,
+	}
+
+	// This is the group called diffie-hellman-group18-sha512 in RFC
+	// 8268 and Oakley Group 18 in RFC 3526.
+	p, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C93402849236C3FAB4D27C7026C1D4DCB2602646DEC9751E763DBA37BDF8FF9406AD9E530EE5DB382F413001AEB06A53ED9027D831179727B0865A8918DA3EDBEBCF9B14ED44CE6CBACED4BB1BDB7F1447E6CC254B332051512BD7AF426FB8F401378CD2BF5983CA01C64B92ECF032EA15D1721D03F482D7CE6E74FEF6D55E702F46980C82B5A84031900B1C9E59E7C97FBEC7E8F323A97A7E36CC88BE0F1D45B7FF585AC54BD407B22B4154AACC8F6D7EBF48E1D814CC5ED20F8037E0A79715EEF29BE32806A1D58BB7C5DA76F550AA3D8A1FBFF0EB19CCB1A313D55CDA56C9EC2EF29632387FE8D76E3C0468043E8F663F4860EE12BF2D5B0B7474D6E694F91E6DBE115974A3926F12FEE5E438777CB6A932DF8CD8BEC4D073B931BA3BC832B68D9DD300741FA7BF8AFC47ED2576F6936BA424663AAB639C5AE4F5683423B4742BF1C978238F16CBE39D652DE3FDB8BEFC848AD922222E04A4037C0713EB57A81A23F0C73473FC646CEA306B4BCBC8862F8385DDFA9D4B7FA2C087E879683303ED5BDD3A062B3CF5B3A278A66D2A13F83F44F82DDF310EE074AB6A364597E899A0255DC164F31CC50846851DF9AB48195DED7EA1B1D510BD7EE74D73FAF36BC31ECFA268359046F4EB879F924009438B481C6CD7889A002ED5EE382BC9190DA6FC026E479558E4475677E9AA9E3050E2765694DFC81F56E880B96E7160C980DD98EDD3DFFFFFFFFFFFFFFFFF", 16)
+
+	kexAlgoMap[kexAlgoDH18SHA512] = &dhGroup{
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA512,
+		// Estimated at 190 to 310 bits of strength by RFC 3526,
+		// section 8, so exponents of 380 to 620 bits.
+		privBits: 640,
 	}
 
 	kexAlgoMap[kexAlgoECDH521] = &ecdh{elliptic.P521()}
@@ -590,6 +621,10 @@ func (kex *curve25519sha256) Server(c packetConn, rand io.Reader, magics *handsh
 // as described in RFC 4419
 type dhGEXSHA struct {
 	hashFunc crypto.Hash
+
+	// minBits, if above dhGroupExchangeMinimumBits, is the smallest
+	// group the client asks for and accepts, see Config.MinDHGroupBits.
+	minBits int
 }
 
 const (
@@ -598,13 +633,28 @@ const (
 	dhGroupExchangeMaximumBits   = 8192
 )
 
-func (gex *dhGEXSHA) Client(c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
-	// Send GexRequest
-	kexDHGexRequest := kexDHGexRequestMsg{
+// request returns the group sizes asked for by the client.
+func (gex *dhGEXSHA) request() kexDHGexRequestMsg {
+	req := kexDHGexRequestMsg{
 		MinBits:      dhGroupExchangeMinimumBits,
 		PreferedBits: dhGroupExchangePreferredBits,
 		MaxBits:      dhGroupExchangeMaximumBits,
 	}
+	if gex.minBits > dhGroupExchangeMinimumBits {
+		req.MinBits = uint32(gex.minBits)
+		if req.MinBits > req.MaxBits {
+			req.MaxBits = req.MinBits
+		}
+		if req.PreferedBits < req.MinBits {
+			req.PreferedBits = req.MinBits
+		}
+	}
+	return req
+}
+
+func (gex *dhGEXSHA) Client(c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	// Send GexRequest
+	kexDHGexRequest := gex.request()
 	if err := c.writePacket(Marshal(&kexDHGexRequest)); err != nil {
 		return nil, err
 	}
@@ -620,8 +670,11 @@ func (gex *dhGEXSHA) Client(c packetConn, randSource io.Reader, magics *handshak
 		return nil, err
 	}
 
-	// reject if p's bit length < dhGroupExchangeMinimumBits or > dhGroupExchangeMaximumBits
-	if msg.P.BitLen() < dhGroupExchangeMinimumBits || msg.P.BitLen() > dhGroupExchangeMaximumBits {
+	// reject if p's bit length is outside of the requested range
+	if msg.P.BitLen() < int(kexDHGexRequest.MinBits) {
+		return nil, fmt.Errorf("ssh: server-generated gex p has %d bits, fewer than the %d required", msg.P.BitLen(), kexDHGexRequest.MinBits)
+	}
+	if msg.P.BitLen() > int(kexDHGexRequest.MaxBits) {
 		return nil, fmt.Errorf("ssh: server-generated gex p is out of range (%d bits)", msg.P.BitLen())
 	}
 
@@ -669,9 +722,9 @@ func (gex *dhGEXSHA) Client(c packetConn, randSource io.Reader, magics *handshak
 	h := gex.hashFunc.New()
 	magics.write(h)
 	writeString(h, kexDHGexReply.HostKey)
-	binary.Write(h, binary.BigEndian, uint32(dhGroupExchangeMinimumBits))
-	binary.Write(h, binary.BigEndian, uint32(dhGroupExchangePreferredBits))
-	binary.Write(h, binary.BigEndian, uint32(dhGroupExchangeMaximumBits))
+	binary.Write(h, binary.BigEndian, kexDHGexRequest.MinBits)
+	binary.Write(h, binary.BigEndian, kexDHGexRequest.PreferedBits)
+	binary.Write(h, binary.BigEndian, kexDHGexRequest.MaxBits)
 	writeInt(h, msg.P)
 	writeInt(h, msg.G)
 	writeInt(h, X)
@@ -689,6 +742,32 @@ func (gex *dhGEXSHA) Client(c packetConn, randSource io.Reader, magics *handshak
 	}, nil
 }
 
+// gexGroups are the groups a group exchange server offers, in
+// increasing size: Oakley Groups 14, 16 and 18 of RFC 3526.
+var gexGroups = []string{kexAlgoDH14SHA256, kexAlgoDH16SHA512, kexAlgoDH18SHA512}
+
+// gexGroup returns the group to send in reply to req: the smallest one
+// of at least the preferred size, or else the largest one, within the
+// requested range.
+func gexGroup(req kexDHGexRequestMsg) (*dhGroup, error) {
+	var group *dhGroup
+	for _, name := range gexGroups {
+		candidate := kexAlgoMap[name].(*dhGroup)
+		bits := uint32(candidate.p.BitLen())
+		if bits < req.MinBits || bits > req.MaxBits {
+			continue
+		}
+		group = candidate
+		if bits >= req.PreferedBits {
+			break
+		}
+	}
+	if group == nil {
+		return nil, fmt.Errorf("ssh: no group-exchange group between %d and %d bits", req.MinBits, req.MaxBits)
+	}
+	return group, nil
+}
+
 // Server half implementation of the Diffie Hellman Key Exchange with SHA1 and SHA256.
 //
 // This is a minimal implementation to satisfy the automated tests.
@@ -704,10 +783,11 @@ func (gex dhGEXSHA) Server(c packetConn, randSource io.Reader, magics *handshake
 	}
 
 	// Send GexGroup
-	// This is the group called diffie-hellman-group14-sha1 in RFC
-	// 4253 and Oakley Group 14 in RFC 3526.
-	p, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
-	g := big.NewInt(2)
+	group, err := gexGroup(kexDHGexRequest)
+	if err != nil {
+		return nil, err
+	}
+	p, g := group.p, group.g
 
 	msg := &kexDHGexGroupMsg{
 		P: p,
@@ -746,9 +826,9 @@ func (gex dhGEXSHA) Server(c packetConn, randSource io.Reader, magics *handshake
 	h := gex.hashFunc.New()
 	magics.write(h)
 	writeString(h, hostKeyBytes)
-	binary.Write(h, binary.BigEndian, uint32(dhGroupExchangeMinimumBits))
-	binary.Write(h, binary.BigEndian, uint32(dhGroupExchangePreferredBits))
-	binary.Write(h, binary.BigEndian, uint32(dhGroupExchangeMaximumBits))
+	binary.Write(h, binary.BigEndian, kexDHGexRequest.MinBits)
+	binary.Write(h, binary.BigEndian, kexDHGexRequest.PreferedBits)
+	binary.Write(h, binary.BigEndian, kexDHGexRequest.MaxBits)
 	writeInt(h, p)
 	writeInt(h, g)
 	writeInt(h, kexDHGexInit.X)
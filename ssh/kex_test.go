@@ -7,11 +7,21 @@ package ssh
 // Key exchange tests.
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math/big"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+
+	"golang.org/x/crypto/sha3"
 )
 
 // Runs multiple key exchanges concurrent to detect potential data races with
@@ -104,3 +114,352 @@ func BenchmarkKexes(b *testing.B) {
 		})
 	}
 }
+
+// readRecording returns the bytes sent in each direction of a connection
+// recorded by golang.org/x/crypto/ssh/test, in the ">>> Flow" hex dump format
+// of its testdata files.
+func readRecording(t *testing.T, path string) (clientToServer, serverToClient []byte) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cur *[]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, ">>> Flow"):
+			if strings.Contains(line, "(client to server)") {
+				cur = &clientToServer
+			} else {
+				cur = &serverToClient
+			}
+		case len(line) > 10 && cur != nil:
+			hexBytes, _, _ := strings.Cut(line[10:], "|")
+			b, err := hex.DecodeString(strings.ReplaceAll(hexBytes, " ", ""))
+			if err != nil {
+				t.Fatalf("bad recording line %q: %v", line, err)
+			}
+			*cur = append(*cur, b...)
+		}
+	}
+	return clientToServer, serverToClient
+}
+
+// splitUnencrypted splits the version line and the first n packets, which
+// must be sent before NEWKEYS, off the start of a recorded stream. It also
+// returns the rest of the stream.
+func splitUnencrypted(t *testing.T, stream []byte, n int) (version []byte, packets [][]byte, rest []byte) {
+	version, stream, ok := bytes.Cut(stream, []byte("\r\n"))
+	if !ok {
+		t.Fatal("no version line in recording")
+	}
+	for i := 0; i < n; i++ {
+		if len(stream) < 5 {
+			t.Fatal("recording ends early")
+		}
+		length := int(binary.BigEndian.Uint32(stream))
+		padding := int(stream[4])
+		if length+4 > len(stream) || padding+1 > length {
+			t.Fatal("bad packet in recording")
+		}
+		packets = append(packets, stream[5:4+length-padding])
+		stream = stream[4+length:]
+	}
+	return version, packets, stream
+}
+
+// recordedPacketConn replays a recorded reply to one side of a key exchange,
+// and checks that it sends the recorded request.
+type recordedPacketConn struct {
+	t              *testing.T
+	request, reply []byte
+}
+
+func (c *recordedPacketConn) writePacket(packet []byte) error {
+	if !bytes.Equal(packet, c.request) {
+		c.t.Errorf("sent %x, want the recorded %x", packet, c.request)
+	}
+	return nil
+}
+
+func (c *recordedPacketConn) readPacket() ([]byte, error) { return c.reply, nil }
+
+func (c *recordedPacketConn) Close() error { return nil }
+
+// TestSNTRUP761OpenSSHRecording replays the key exchange of an OpenSSH 9.2
+// client with a Go server, whose randomness was the SHAKE128 stream with no
+// input. The first 7 bytes padded the server's KEXINIT; the Streamlined NTRU
+// Prime encapsulation and the X25519 private key follow. The server must send
+// the recorded ciphertext and, with the resulting K and H, decrypt the first
+// packet OpenSSH encrypted after NEWKEYS.
+func TestSNTRUP761OpenSSHRecording(t *testing.T) {
+	clientToServer, serverToClient := readRecording(t, "testdata/Server-KEX-sntrup761x25519-sha512")
+	clientVersion, clientPackets, encrypted := splitUnencrypted(t, clientToServer, 3)
+	serverVersion, serverPackets, _ := splitUnencrypted(t, serverToClient, 3)
+	if !strings.HasPrefix(string(clientVersion), "SSH-2.0-OpenSSH_9.2") {
+		t.Fatalf("recording is of %q", clientVersion)
+	}
+
+	rand := sha3.NewShake128()
+	io.CopyN(io.Discard, rand, 7)
+
+	magics := handshakeMagics{
+		clientVersion: clientVersion,
+		serverVersion: serverVersion,
+		clientKexInit: clientPackets[0],
+		serverKexInit: serverPackets[0],
+	}
+	c := &recordedPacketConn{t: t, request: serverPackets[1], reply: clientPackets[1]}
+	signer := testSigners["ed25519"].(AlgorithmSigner)
+	result, err := kexAlgoMap[kexAlgoSNTRUP761X25519SHA512OpenSSH].Server(c, rand, &magics, signer, KeyAlgoED25519)
+	if err != nil {
+		t.Fatalf("Server: %v", err)
+	}
+
+	const (
+		wantH = "3680cbee4046e902a3ae3e27f49c72bbed6cb16640f1ca992b6f9b3292111bfaaa8670c5a30bec926a620353235bb64e893491e2537841f05de6b6722453946d"
+		wantK = "00000040e480324ecee62d96a6593f885f7d19bbd6aeed6606db95106892b33949adba22427a7c109c5c5a7ca2184ca9173da8786ac05e750ff61cd8fdc165cb29fb7c32"
+	)
+	if got := hex.EncodeToString(result.H); got != wantH {
+		t.Errorf("got H %s, want %s", got, wantH)
+	}
+	if got := hex.EncodeToString(result.K); got != wantK {
+		t.Errorf("got K %s, want %s", got, wantK)
+	}
+
+	result.SessionID = result.H
+	cipher, err := newPacketCipher(clientKeys, DirectionAlgorithms{Cipher: chacha20Poly1305ID}, result)
+	if err != nil {
+		t.Fatalf("newPacketCipher: %v", err)
+	}
+	// Both sides offered strict key exchange, so NEWKEYS reset the sequence
+	// numbers.
+	packet, err := cipher.readCipherPacket(0, bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatalf("can't decrypt OpenSSH's first encrypted packet: %v", err)
+	}
+	var req serviceRequestMsg
+	if err := Unmarshal(packet, &req); err != nil || req.Service != serviceUserAuth {
+		t.Errorf("got first encrypted packet %x, want a request for %q", packet, serviceUserAuth)
+	}
+}
+
+func TestDHGEXMinBits(t *testing.T) {
+	gex := &dhGEXSHA{hashFunc: kexAlgoMap[kexAlgoDHGEXSHA256].(*dhGEXSHA).hashFunc, minBits: 3072}
+
+	// The server of this package answers with a 4096-bit group.
+	a, b := memPipe()
+	type kexResultErr struct {
+		result *kexResult
+		err    error
+	}
+	s := make(chan kexResultErr, 1)
+	var magics handshakeMagics
+	go func() {
+		r, e := gex.Server(b, rand.Reader, &magics, testSigners["ecdsa"].(AlgorithmSigner), testSigners["ecdsa"].PublicKey().Type())
+		b.Close()
+		s <- kexResultErr{r, e}
+	}()
+	clientRes, err := gex.Client(a, rand.Reader, &magics)
+	a.Close()
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	serverRes := <-s
+	if serverRes.err != nil {
+		t.Fatalf("Server: %v", serverRes.err)
+	}
+	if !reflect.DeepEqual(clientRes, serverRes.result) {
+		t.Errorf("mismatch %#v, %#v", clientRes, serverRes.result)
+	}
+
+	// A server that sends a smaller group is refused.
+	a, b = memPipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		packet, err := b.readPacket()
+		if err != nil {
+			return
+		}
+		var req kexDHGexRequestMsg
+		if err := Unmarshal(packet, &req); err != nil {
+			t.Errorf("Unmarshal: %v", err)
+			return
+		}
+		if req.MinBits != 3072 || req.PreferedBits < 3072 {
+			t.Errorf("got request %+v, want at least 3072 bits", req)
+		}
+		group14 := kexAlgoMap[kexAlgoDH14SHA256].(*dhGroup)
+		b.writePacket(Marshal(&kexDHGexGroupMsg{P: group14.p, G: group14.g}))
+	}()
+	_, err = gex.Client(a, rand.Reader, &magics)
+	if err == nil || !strings.Contains(err.Error(), "fewer than the 3072 required") {
+		t.Errorf("got %v, want an error about the group size", err)
+	}
+
+	// Config.MinDHGroupBits only applies to group exchange.
+	tr := &handshakeTransport{config: &Config{MinDHGroupBits: 3072}}
+	kex, err := tr.kexAlgorithm(kexAlgoDHGEXSHA256)
+	if err != nil || kex.(*dhGEXSHA).minBits != 3072 {
+		t.Errorf("got %#v, %v; want a group exchange with 3072 bits minimum", kex, err)
+	}
+	if kex, err := tr.kexAlgorithm(kexAlgoDH14SHA256); err != nil || kex != kexAlgoMap[kexAlgoDH14SHA256] {
+		t.Errorf("got %#v, %v; want the fixed group unchanged", kex, err)
+	}
+}
+
+// dhReplyConn answers the client half of a Diffie-Hellman key exchange
+// with a fixed reply, and records the client's public value.
+type dhReplyConn struct {
+	reply []byte
+	X     *big.Int
+}
+
+func (c *dhReplyConn) writePacket(packet []byte) error {
+	var msg kexDHInitMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return err
+	}
+	c.X = msg.X
+	return nil
+}
+
+func (c *dhReplyConn) readPacket() ([]byte, error) { return c.reply, nil }
+
+func (c *dhReplyConn) Close() error { return nil }
+
+// TestDHLargeGroups checks the session hash of the 4096 and 8192-bit
+// MODP groups against values computed independently, with the client's
+// private exponent taken from a constant random stream and the server's
+// fixed.
+func TestDHLargeGroups(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		bits  int
+		wantH string
+	}{
+		{kexAlgoDH16SHA512, 4096, "de74ecd29a6687d4bab463535be003c66a2d056443021ba909d5aab1848a3e64274785a95ce84832bf9118762cffcd5936772ea0572d990455121636d72e07b2"},
+		{kexAlgoDH18SHA512, 8192, "ab2164f41c7b55d4a615cc148b8d02beeb9a845350333718ed036b0d3f6408b8a026f25180929e6f63aa3bd14f2deb34989fa330b0752031116b7850a35c5d34"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			group := kexAlgoMap[tt.name].(*dhGroup)
+			if got := group.p.BitLen(); got != tt.bits {
+				t.Fatalf("got a %d-bit prime, want %d bits", got, tt.bits)
+			}
+
+			n := group.privBits / 8
+			y, _ := new(big.Int).SetString(strings.Repeat("cd", n), 16)
+			Y := new(big.Int).Exp(group.g, y, group.p)
+			c := &dhReplyConn{reply: Marshal(&kexDHReplyMsg{
+				HostKey: []byte("host key"),
+				Y:       Y,
+			})}
+			magics := &handshakeMagics{
+				clientVersion: []byte("SSH-2.0-client"),
+				serverVersion: []byte("SSH-2.0-server"),
+				clientKexInit: []byte("client kexinit"),
+				serverKexInit: []byte("server kexinit"),
+			}
+			res, err := group.Client(c, bytes.NewReader(bytes.Repeat([]byte{0xab}, n)), magics)
+			if err != nil {
+				t.Fatalf("Client: %v", err)
+			}
+			if got := hex.EncodeToString(res.H); got != tt.wantH {
+				t.Errorf("got H %s, want %s", got, tt.wantH)
+			}
+			x, _ := new(big.Int).SetString(strings.Repeat("ab", n), 16)
+			if want := new(big.Int).Exp(group.g, x, group.p); c.X.Cmp(want) != 0 {
+				t.Errorf("client sent an unexpected public value")
+			}
+			if res.Hash != crypto.SHA512 {
+				t.Errorf("got hash %v, want SHA-512", res.Hash)
+			}
+
+			for i := 0; i < 10; i++ {
+				x, err := group.generatePrivate(rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if x.Sign() <= 0 || x.BitLen() > group.privBits {
+					t.Fatalf("private exponent of %d bits out of range", x.BitLen())
+				}
+			}
+		})
+	}
+}
+
+// TestDHPrivateExponentSize checks that the large MODP groups draw their
+// private exponents at the sizes that RFC 3526, section 8 recommends for
+// their estimated strength, and that the exponents use all those bits.
+func TestDHPrivateExponentSize(t *testing.T) {
+	for name, want := range map[string]int{
+		kexAlgoDH16SHA512: 512,
+		kexAlgoDH18SHA512: 640,
+	} {
+		group := kexAlgoMap[name].(*dhGroup)
+		if group.privBits != want {
+			t.Errorf("%s: got %d-bit exponents, want %d", name, group.privBits, want)
+			continue
+		}
+		longest := 0
+		for i := 0; i < 64; i++ {
+			x, err := group.generatePrivate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x.Sign() <= 0 || x.BitLen() > want {
+				t.Fatalf("%s: private exponent of %d bits out of range", name, x.BitLen())
+			}
+			if x.BitLen() > longest {
+				longest = x.BitLen()
+			}
+		}
+		// All 64 exponents have their top 8 bits clear with probability
+		// 2^-512.
+		if longest <= want-8 {
+			t.Errorf("%s: longest private exponent has %d bits, want about %d", name, longest, want)
+		}
+	}
+}
+
+func TestDHGEXServerGroup(t *testing.T) {
+	for _, tt := range []struct {
+		min, preferred, max uint32
+		want                int // zero if no group fits
+	}{
+		{2048, 2048, 8192, 2048},
+		{2048, 3072, 3072, 2048},
+		{3072, 3072, 8192, 4096},
+		{2048, 7680, 8192, 8192},
+		{4097, 4097, 8192, 8192},
+		{3000, 3000, 4000, 0},
+		{8193, 8193, 16384, 0},
+	} {
+		req := kexDHGexRequestMsg{MinBits: tt.min, PreferedBits: tt.preferred, MaxBits: tt.max}
+		group, err := gexGroup(req)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("%+v: got a %d-bit group, want an error", req, group.p.BitLen())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", req, err)
+		} else if got := group.p.BitLen(); got != tt.want {
+			t.Errorf("%+v: got a %d-bit group, want %d bits", req, got, tt.want)
+		}
+	}
+
+	// The server fails when no group fits.
+	a, b := memPipe()
+	defer a.Close()
+	defer b.Close()
+	if err := a.writePacket(Marshal(&kexDHGexRequestMsg{MinBits: 8193, PreferedBits: 8193, MaxBits: 16384})); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	gex := kexAlgoMap[kexAlgoDHGEXSHA256].(*dhGEXSHA)
+	var magics handshakeMagics
+	if _, err := gex.Server(b, rand.Reader, &magics, testSigners["ecdsa"].(AlgorithmSigner), testSigners["ecdsa"].PublicKey().Type()); err == nil {
+		t.Error("Server succeeded without a group in the requested range")
+	}
+}
@@ -26,8 +26,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh/internal/bcrypt_pbkdf"
 )
@@ -297,6 +299,112 @@ func MarshalAuthorizedKey(key PublicKey) []byte {
 	return b.Bytes()
 }
 
+const (
+	rfc4716Begin = "---- BEGIN SSH2 PUBLIC KEY ----"
+	rfc4716End   = "---- END SSH2 PUBLIC KEY ----"
+
+	// rfc4716LineLength is the maximum length of a line, not counting
+	// the line terminator. See RFC 4716, section 3.
+	rfc4716LineLength = 72
+
+	// rfc4716Base64Length is the length of the base64 lines written by
+	// MarshalRFC4716PublicKey, the same as ssh-keygen's.
+	rfc4716Base64Length = 70
+)
+
+// ParseRFC4716PublicKey parses a public key in the format described by
+// RFC 4716, as written by "ssh-keygen -e". It returns the key and the
+// value of the Comment header, if any, with surrounding quotes
+// removed. Continued header lines are joined, and other headers are
+// ignored. Lines may end in CR, LF or CRLF. Anything after the end
+// marker is ignored.
+func ParseRFC4716PublicKey(in []byte) (PublicKey, string, error) {
+	s := strings.ReplaceAll(string(in), "\r\n", "\n")
+	lines := strings.Split(strings.ReplaceAll(s, "\r", "\n"), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != rfc4716Begin {
+		return nil, "", errors.New("ssh: missing RFC 4716 begin marker")
+	}
+	lines = lines[1:]
+
+	var comment string
+	for len(lines) > 0 && strings.Contains(lines[0], ":") {
+		header := lines[0]
+		lines = lines[1:]
+		for strings.HasSuffix(header, "\\") {
+			if len(lines) == 0 {
+				return nil, "", errors.New("ssh: truncated RFC 4716 header")
+			}
+			header = header[:len(header)-1] + lines[0]
+			lines = lines[1:]
+		}
+		tag, value, _ := strings.Cut(header, ":")
+		if strings.EqualFold(strings.TrimSpace(tag), "Comment") {
+			comment = strings.TrimSpace(value)
+			if len(comment) >= 2 && comment[0] == '"' && comment[len(comment)-1] == '"' {
+				comment = comment[1 : len(comment)-1]
+			}
+		}
+	}
+
+	var body strings.Builder
+	for {
+		if len(lines) == 0 {
+			return nil, "", errors.New("ssh: missing RFC 4716 end marker")
+		}
+		line := strings.TrimSpace(lines[0])
+		lines = lines[1:]
+		if line == rfc4716End {
+			break
+		}
+		body.WriteString(line)
+	}
+	blob, err := base64.StdEncoding.DecodeString(body.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("ssh: invalid RFC 4716 key data: %v", err)
+	}
+	key, err := ParsePublicKey(blob)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, comment, nil
+}
+
+// MarshalRFC4716PublicKey serializes key in the format described by
+// RFC 4716, in the same layout as "ssh-keygen -e". If comment is not
+// empty, it is written quoted in a Comment header, folded to fit the
+// 72-byte line limit; line breaks in it are replaced by spaces. The
+// return value ends with newline.
+func MarshalRFC4716PublicKey(key PublicKey, comment string) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString(rfc4716Begin + "\n")
+	if comment != "" {
+		comment = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(comment)
+		header := "Comment: \"" + comment + "\""
+		for len(header) > rfc4716LineLength {
+			// Leave room for the continuation backslash, and don't
+			// split a UTF-8 sequence.
+			n := rfc4716LineLength - 1
+			for n > 0 && !utf8.RuneStart(header[n]) {
+				n--
+			}
+			b.WriteString(header[:n] + "\\\n")
+			header = header[n:]
+		}
+		b.WriteString(header + "\n")
+	}
+	data := base64.StdEncoding.EncodeToString(key.Marshal())
+	for len(data) > rfc4716Base64Length {
+		b.WriteString(data[:rfc4716Base64Length] + "\n")
+		data = data[rfc4716Base64Length:]
+	}
+	b.WriteString(data + "\n")
+	b.WriteString(rfc4716End + "\n")
+	return b.Bytes()
+}
+
 // MarshalPrivateKey returns a PEM block with the private key serialized in the
 // OpenSSH format.
 func MarshalPrivateKey(key crypto.PrivateKey, comment string) (*pem.Block, error) {
@@ -306,7 +414,35 @@ func MarshalPrivateKey(key crypto.PrivateKey, comment string) (*pem.Block, error
 // MarshalPrivateKeyWithPassphrase returns a PEM block holding the encrypted
 // private key serialized in the OpenSSH format.
 func MarshalPrivateKeyWithPassphrase(key crypto.PrivateKey, comment string, passphrase []byte) (*pem.Block, error) {
-	return marshalOpenSSHPrivateKey(key, comment, passphraseProtectedOpenSSHMarshaler(passphrase))
+	return marshalOpenSSHPrivateKey(key, comment, passphraseProtectedOpenSSHMarshaler(passphrase, defaultBcryptRounds))
+}
+
+// PassphraseOptions holds the options of
+// MarshalPrivateKeyWithPassphraseOptions.
+type PassphraseOptions struct {
+	// Rounds is the number of bcrypt_pbkdf rounds used to derive the
+	// encryption key from the passphrase, which makes guessing the
+	// passphrase proportionally slower, as does ssh-keygen's -a flag.
+	// If zero, 16 is used, as by ssh-keygen; lower values are
+	// rejected.
+	Rounds int
+}
+
+// defaultBcryptRounds is the default, and minimum, of
+// PassphraseOptions.Rounds.
+const defaultBcryptRounds = 16
+
+// MarshalPrivateKeyWithPassphraseOptions is like
+// MarshalPrivateKeyWithPassphrase, with the key derivation set by opts.
+func MarshalPrivateKeyWithPassphraseOptions(key crypto.PrivateKey, comment string, passphrase []byte, opts PassphraseOptions) (*pem.Block, error) {
+	rounds := opts.Rounds
+	switch {
+	case rounds == 0:
+		rounds = defaultBcryptRounds
+	case rounds < defaultBcryptRounds || uint64(rounds) > math.MaxUint32:
+		return nil, fmt.Errorf("ssh: invalid bcrypt rounds %d, must be at least %d", opts.Rounds, defaultBcryptRounds)
+	}
+	return marshalOpenSSHPrivateKey(key, comment, passphraseProtectedOpenSSHMarshaler(passphrase, uint32(rounds)))
 }
 
 // PublicKey represents a public key using an unspecified algorithm.
@@ -333,6 +469,26 @@ type CryptoPublicKey interface {
 	CryptoPublicKey() crypto.PublicKey
 }
 
+// VerifySignature verifies that sig is a signature on data made by key, as
+// the package does for authentication. sig.Format must be one of the
+// signature algorithms supported for the key type; for example an RSA key
+// accepts rsa-sha2-256, rsa-sha2-512 and ssh-rsa. If key is a
+// *Certificate, the signature is checked against the certified key, and
+// sig.Format must be an algorithm of that key, not a certificate
+// algorithm. The certificate itself is not validated; see CertChecker.
+func VerifySignature(key PublicKey, data []byte, sig *Signature) error {
+	if sig == nil {
+		return errors.New("ssh: nil signature")
+	}
+	if cert, ok := key.(*Certificate); ok {
+		key = cert.Key
+	}
+	if !contains(algorithmsForKeyFormat(key.Type()), sig.Format) {
+		return fmt.Errorf("ssh: signature algorithm %q is not supported for %s keys", sig.Format, key.Type())
+	}
+	return key.Verify(data, sig)
+}
+
 // A Signer can create signatures that verify against a public key.
 //
 // Some Signers provided by this package also implement MultiAlgorithmSigner.
@@ -432,6 +588,78 @@ func (s *multiAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, al
 	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
 }
 
+// NewCachedSigner returns a Signer whose PublicKey method returns a key
+// with the type and wire format of signer's public key computed once, so
+// that they are not recomputed on every authentication attempt or key
+// exchange. If signer is an AlgorithmSigner or a MultiAlgorithmSigner,
+// so is the returned Signer.
+//
+// The slice returned by Marshal is shared and must not be modified. The
+// returned public key implements only the PublicKey interface, so type
+// assertions on it, for example to *Certificate or CryptoPublicKey, must
+// be done on the public key of the original signer.
+func NewCachedSigner(signer Signer) Signer {
+	pub := signer.PublicKey()
+	cs := &cachedSigner{
+		Signer: signer,
+		pub: &cachedPublicKey{
+			PublicKey: pub,
+			keyType:   pub.Type(),
+			blob:      pub.Marshal(),
+		},
+	}
+	as, ok := signer.(AlgorithmSigner)
+	if !ok {
+		return cs
+	}
+	cas := &cachedAlgorithmSigner{cachedSigner: cs, algorithmSigner: as}
+	if ms, ok := signer.(MultiAlgorithmSigner); ok {
+		return &cachedMultiAlgorithmSigner{cachedAlgorithmSigner: cas, algorithms: ms.Algorithms()}
+	}
+	return cas
+}
+
+type cachedPublicKey struct {
+	PublicKey
+	keyType string
+	blob    []byte
+}
+
+func (k *cachedPublicKey) Type() string {
+	return k.keyType
+}
+
+func (k *cachedPublicKey) Marshal() []byte {
+	return k.blob
+}
+
+type cachedSigner struct {
+	Signer
+	pub *cachedPublicKey
+}
+
+func (s *cachedSigner) PublicKey() PublicKey {
+	return s.pub
+}
+
+type cachedAlgorithmSigner struct {
+	*cachedSigner
+	algorithmSigner AlgorithmSigner
+}
+
+func (s *cachedAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	return s.algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+type cachedMultiAlgorithmSigner struct {
+	*cachedAlgorithmSigner
+	algorithms []string
+}
+
+func (s *cachedMultiAlgorithmSigner) Algorithms() []string {
+	return s.algorithms
+}
+
 type rsaPublicKey rsa.PublicKey
 
 func (r *rsaPublicKey) Type() string {
@@ -793,6 +1021,42 @@ type skFields struct {
 	Counter uint32
 }
 
+// Flags that may be set in U2F/FIDO2 signatures.
+// See openssh/PROTOCOL.u2f for details.
+const (
+	SKFlagUserPresent  = 0x01
+	SKFlagUserVerified = 0x04
+)
+
+// SKPublicKey is implemented by public keys backed by a U2F/FIDO2
+// security key, such as those of type KeyAlgoSKED25519 and
+// KeyAlgoSKECDSA256.
+type SKPublicKey interface {
+	PublicKey
+
+	// Application returns the application string the key was
+	// generated for, typically "ssh:".
+	Application() string
+}
+
+// ParseSKSignatureFields returns the flags and counter carried by a
+// signature made with a U2F/FIDO2 security key. Callers can use
+// them to require user presence or verification, or to detect a
+// cloned key through a counter that fails to increase. The
+// signature itself is checked by the key's Verify method.
+func ParseSKSignatureFields(sig *Signature) (flags byte, counter uint32, err error) {
+	switch sig.Format {
+	case KeyAlgoSKECDSA256, KeyAlgoSKED25519:
+	default:
+		return 0, 0, fmt.Errorf("ssh: signature type %s is not a security key signature", sig.Format)
+	}
+	var skf skFields
+	if err := Unmarshal(sig.Rest, &skf); err != nil {
+		return 0, 0, err
+	}
+	return skf.Flags, skf.Counter, nil
+}
+
 type skECDSAPublicKey struct {
 	// application is a URL-like string, typically "ssh:" for SSH.
 	// see openssh/PROTOCOL.u2f for details.
@@ -804,6 +1068,10 @@ func (k *skECDSAPublicKey) Type() string {
 	return KeyAlgoSKECDSA256
 }
 
+func (k *skECDSAPublicKey) Application() string {
+	return k.application
+}
+
 func (k *skECDSAPublicKey) nistID() string {
 	return "nistp256"
 }
@@ -919,6 +1187,10 @@ func (k *skEd25519PublicKey) Type() string {
 	return KeyAlgoSKED25519
 }
 
+func (k *skEd25519PublicKey) Application() string {
+	return k.application
+}
+
 func parseSKEd25519(in []byte) (out PublicKey, rest []byte, err error) {
 	var w struct {
 		KeyBytes    []byte
@@ -1038,7 +1310,10 @@ type wrappedSigner struct {
 
 // NewSignerFromSigner takes any crypto.Signer implementation and
 // returns a corresponding Signer interface. This can be used, for
-// example, with keys kept in hardware modules.
+// example, with keys kept in hardware modules. The Signer is a
+// MultiAlgorithmSigner: for an RSA key it can sign with rsa-sha2-256 and
+// rsa-sha2-512 as well as ssh-rsa, passing the SHA-256, SHA-512 or SHA-1
+// digest and hash to signer.Sign.
 func NewSignerFromSigner(signer crypto.Signer) (Signer, error) {
 	pubKey, err := NewPublicKey(signer.Public())
 	if err != nil {
@@ -1165,6 +1440,42 @@ func ParsePrivateKeyWithPassphrase(pemBytes, passphrase []byte) (Signer, error)
 	return NewSignerFromKey(key)
 }
 
+// maxPassphraseAttempts is the number of times ParsePrivateKeyWithPrompt
+// prompts for a passphrase, as in ssh-keygen.
+const maxPassphraseAttempts = 3
+
+// ParsePrivateKeyWithPrompt returns a Signer from a PEM encoded private
+// key. It supports the same keys as ParseRawPrivateKey. If the private key
+// is encrypted, it calls prompt for the passphrase, and calls it again if
+// the passphrase is wrong, up to three times in total. An error from
+// prompt is returned as is. If every passphrase is wrong, it returns
+// x509.IncorrectPasswordError.
+func ParsePrivateKeyWithPrompt(pemBytes []byte, prompt func() ([]byte, error)) (Signer, error) {
+	key, err := ParseRawPrivateKey(pemBytes)
+	if _, ok := err.(*PassphraseMissingError); !ok {
+		if err != nil {
+			return nil, err
+		}
+		return NewSignerFromKey(key)
+	}
+
+	for i := 0; i < maxPassphraseAttempts; i++ {
+		passphrase, err := prompt()
+		if err != nil {
+			return nil, err
+		}
+		key, err = ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+		if err == x509.IncorrectPasswordError {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return NewSignerFromKey(key)
+	}
+	return nil, x509.IncorrectPasswordError
+}
+
 // encryptedBlock tells whether a private key is
 // encrypted by examining its Proc-Type header
 // for a mention of ENCRYPTED
@@ -1355,7 +1666,7 @@ func unencryptedOpenSSHMarshaler(privKeyBlock []byte) ([]byte, string, string, s
 	return key, "none", "none", "", nil
 }
 
-func passphraseProtectedOpenSSHMarshaler(passphrase []byte) openSSHEncryptFunc {
+func passphraseProtectedOpenSSHMarshaler(passphrase []byte, rounds uint32) openSSHEncryptFunc {
 	return func(privKeyBlock []byte) ([]byte, string, string, string, error) {
 		salt := make([]byte, 16)
 		if _, err := rand.Read(salt); err != nil {
@@ -1365,7 +1676,7 @@ func passphraseProtectedOpenSSHMarshaler(passphrase []byte) openSSHEncryptFunc {
 		opts := struct {
 			Salt   []byte
 			Rounds uint32
-		}{salt, 16}
+		}{salt, rounds}
 
 		// Derive key to encrypt the private key block.
 		k, err := bcrypt_pbkdf.Key(passphrase, salt, int(opts.Rounds), 32+aes.BlockSize)
@@ -1593,6 +1904,18 @@ func marshalOpenSSHPrivateKey(key crypto.PrivateKey, comment string, encrypt ope
 
 	switch k := key.(type) {
 	case *rsa.PrivateKey:
+		// The OpenSSH format has room for two primes only.
+		if len(k.Primes) != 2 {
+			return nil, fmt.Errorf("ssh: unsupported RSA key with %d primes", len(k.Primes))
+		}
+		// Qinv is only set on keys that have been precomputed.
+		iqmp := k.Precomputed.Qinv
+		if iqmp == nil {
+			iqmp = new(big.Int).ModInverse(k.Primes[1], k.Primes[0])
+			if iqmp == nil {
+				return nil, errors.New("ssh: invalid RSA key primes")
+			}
+		}
 		E := new(big.Int).SetInt64(int64(k.PublicKey.E))
 		// Marshal public key:
 		// E and N are in reversed order in the public and private key.
@@ -1611,7 +1934,7 @@ func marshalOpenSSHPrivateKey(key crypto.PrivateKey, comment string, encrypt ope
 			N:       k.PublicKey.N,
 			E:       E,
 			D:       k.D,
-			Iqmp:    k.Precomputed.Qinv,
+			Iqmp:    iqmp,
 			P:       k.Primes[0],
 			Q:       k.Primes[1],
 			Comment: comment,
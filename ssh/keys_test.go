@@ -6,6 +6,7 @@ package ssh
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/dsa"
 	"crypto/ecdsa"
 	"crypto/ed25519"
@@ -19,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"reflect"
 	"strings"
 	"testing"
@@ -232,6 +234,59 @@ func TestParseEncryptedPrivateKeysWithIncorrectPassphrase(t *testing.T) {
 	}
 }
 
+func TestParsePrivateKeyWithPrompt(t *testing.T) {
+	for _, tt := range testdata.PEMEncryptedKeys {
+		t.Run(tt.Name, func(t *testing.T) {
+			passphrases := [][]byte{[]byte("incorrect"), []byte(tt.EncryptionKey)}
+			calls := 0
+			s, err := ParsePrivateKeyWithPrompt(tt.PEMBytes, func() ([]byte, error) {
+				p := passphrases[calls]
+				calls++
+				return p, nil
+			})
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyWithPrompt: %v", err)
+			}
+			if calls != 2 {
+				t.Errorf("got %d prompts, want 2", calls)
+			}
+			want, err := ParsePrivateKeyWithPassphrase(tt.PEMBytes, []byte(tt.EncryptionKey))
+			if err != nil {
+				t.Fatalf("ParsePrivateKeyWithPassphrase: %v", err)
+			}
+			if !bytes.Equal(s.PublicKey().Marshal(), want.PublicKey().Marshal()) {
+				t.Errorf("got public key %v, want %v", s.PublicKey(), want.PublicKey())
+			}
+
+			calls = 0
+			_, err = ParsePrivateKeyWithPrompt(tt.PEMBytes, func() ([]byte, error) {
+				calls++
+				return []byte("incorrect"), nil
+			})
+			if err != x509.IncorrectPasswordError {
+				t.Errorf("got %v want IncorrectPasswordError", err)
+			}
+			if calls != maxPassphraseAttempts {
+				t.Errorf("got %d prompts, want %d", calls, maxPassphraseAttempts)
+			}
+		})
+	}
+
+	promptErr := errors.New("prompt cancelled")
+	if _, err := ParsePrivateKeyWithPrompt(testdata.PEMEncryptedKeys[0].PEMBytes, func() ([]byte, error) {
+		return nil, promptErr
+	}); err != promptErr {
+		t.Errorf("got %v, want %v", err, promptErr)
+	}
+
+	if _, err := ParsePrivateKeyWithPrompt(testdata.PEMBytes["ed25519"], func() ([]byte, error) {
+		t.Error("prompt called for an unencrypted key")
+		return nil, nil
+	}); err != nil {
+		t.Errorf("ParsePrivateKeyWithPrompt(unencrypted): %v", err)
+	}
+}
+
 func TestParseDSA(t *testing.T) {
 	// We actually exercise the ParsePrivateKey codepath here, as opposed to
 	// using the ParseRawPrivateKey+NewSignerFromKey path that testdata_test.go
@@ -360,6 +415,69 @@ func TestMarshalPrivateKeyWithPassphrase(t *testing.T) {
 	}
 }
 
+func TestMarshalPrivateKeyWithPassphraseOptions(t *testing.T) {
+	expected := testPrivateKeys["ed25519"]
+	passphrase := []byte("test-passphrase")
+	block, err := MarshalPrivateKeyWithPassphraseOptions(expected, "test@golang.org", passphrase, PassphraseOptions{Rounds: 20})
+	if err != nil {
+		t.Fatalf("MarshalPrivateKeyWithPassphraseOptions: %v", err)
+	}
+
+	var w openSSHEncryptedPrivateKey
+	if err := Unmarshal(block.Bytes[len(privateKeyAuthMagic):], &w); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	var kdfOpts struct {
+		Salt   string
+		Rounds uint32
+	}
+	if err := Unmarshal([]byte(w.KdfOpts), &kdfOpts); err != nil {
+		t.Fatalf("Unmarshal KDF options: %v", err)
+	}
+	if w.KdfName != "bcrypt" || kdfOpts.Rounds != 20 {
+		t.Errorf("got KDF %q with %d rounds, want bcrypt with 20", w.KdfName, kdfOpts.Rounds)
+	}
+
+	key, err := ParseRawPrivateKeyWithPassphrase(pem.EncodeToMemory(block), passphrase)
+	if err != nil {
+		t.Fatalf("ParseRawPrivateKeyWithPassphrase: %v", err)
+	}
+	if !reflect.DeepEqual(expected, key) {
+		t.Errorf("unexpected marshaled key")
+	}
+
+	for _, rounds := range []int{-1, 1, 15} {
+		if _, err := MarshalPrivateKeyWithPassphraseOptions(expected, "", passphrase, PassphraseOptions{Rounds: rounds}); err == nil {
+			t.Errorf("MarshalPrivateKeyWithPassphraseOptions accepted %d rounds", rounds)
+		}
+	}
+}
+
+func TestMarshalPrivateKeyRSANotPrecomputed(t *testing.T) {
+	expected := testPrivateKeys["rsa-openssh-format"].(*rsa.PrivateKey)
+	key := &rsa.PrivateKey{
+		PublicKey: expected.PublicKey,
+		D:         expected.D,
+		Primes:    expected.Primes,
+	}
+	block, err := MarshalPrivateKey(key, "test@golang.org")
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey: %v", err)
+	}
+	parsed, err := ParseRawPrivateKey(pem.EncodeToMemory(block))
+	if err != nil {
+		t.Fatalf("ParseRawPrivateKey: %v", err)
+	}
+	if !reflect.DeepEqual(expected, parsed) {
+		t.Errorf("unexpected marshaled key")
+	}
+
+	key.Primes = append(key.Primes, big.NewInt(3))
+	if _, err := MarshalPrivateKey(key, ""); err == nil {
+		t.Errorf("MarshalPrivateKey succeeded for a key with 3 primes")
+	}
+}
+
 type testAuthResult struct {
 	pubKey   PublicKey
 	options  []string
@@ -681,6 +799,24 @@ func TestSKKeys(t *testing.T) {
 			t.Errorf("%s: PublicKey.Verify(%v, %v) failed: %v", d.Name, dataBuf, sig, err)
 		}
 
+		skKey, ok := pk.(SKPublicKey)
+		if !ok {
+			t.Fatalf("%s: %T does not implement SKPublicKey", d.Name, pk)
+		}
+		if got := skKey.Application(); got != "ssh:" {
+			t.Errorf("%s: Application() = %q, want %q", d.Name, got, "ssh:")
+		}
+		flags, counter, err := ParseSKSignatureFields(sig)
+		if err != nil {
+			t.Fatalf("%s: ParseSKSignatureFields: %v", d.Name, err)
+		}
+		if flags&SKFlagUserPresent == 0 {
+			t.Errorf("%s: flags %#x missing user presence", d.Name, flags)
+		}
+		if counter == 0 {
+			t.Errorf("%s: got zero signature counter", d.Name)
+		}
+
 		// Invalid data being passed in
 		invalidData := []byte("INVALID DATA")
 		if err := pk.Verify(invalidData, sig); err == nil {
@@ -696,6 +832,74 @@ func TestSKKeys(t *testing.T) {
 	}
 }
 
+func TestParseSKSignatureFieldsRejectsOtherFormats(t *testing.T) {
+	sig := &Signature{Format: KeyAlgoED25519, Rest: []byte{SKFlagUserPresent, 0, 0, 0, 1}}
+	if _, _, err := ParseSKSignatureFields(sig); err == nil {
+		t.Error("ParseSKSignatureFields accepted a non security key signature")
+	}
+}
+
+func TestCachedSigner(t *testing.T) {
+	for name, signer := range testSigners {
+		cached := NewCachedSigner(signer)
+		pub := cached.PublicKey()
+		if pub.Type() != signer.PublicKey().Type() || !bytes.Equal(pub.Marshal(), signer.PublicKey().Marshal()) {
+			t.Errorf("%s: cached public key differs from %v", name, signer.PublicKey())
+		}
+		data := []byte("sign me")
+		sig, err := cached.Sign(rand.Reader, data)
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", name, err)
+		}
+		if err := pub.Verify(data, sig); err != nil {
+			t.Errorf("%s: Verify: %v", name, err)
+		}
+		if _, ok := signer.(AlgorithmSigner); ok {
+			if _, ok := cached.(AlgorithmSigner); !ok {
+				t.Errorf("%s: cached signer lost the AlgorithmSigner interface", name)
+			}
+		}
+	}
+
+	mas, err := NewSignerWithAlgorithms(testSigners["rsa"].(AlgorithmSigner), []string{KeyAlgoRSASHA512})
+	if err != nil {
+		t.Fatalf("NewSignerWithAlgorithms: %v", err)
+	}
+	cached, ok := NewCachedSigner(mas).(MultiAlgorithmSigner)
+	if !ok {
+		t.Fatal("cached signer lost the MultiAlgorithmSigner interface")
+	}
+	if !reflect.DeepEqual(cached.Algorithms(), []string{KeyAlgoRSASHA512}) {
+		t.Errorf("got algorithms %v, want %v", cached.Algorithms(), []string{KeyAlgoRSASHA512})
+	}
+	if _, err := cached.SignWithAlgorithm(rand.Reader, []byte("data"), KeyAlgoRSASHA256); err == nil {
+		t.Error("cached signer signed with a restricted algorithm")
+	}
+}
+
+func BenchmarkSignerPublicKeyMarshal(b *testing.B) {
+	for _, tt := range []struct {
+		name   string
+		signer Signer
+	}{
+		{"plain", testSigners["ed25519"]},
+		{"cached", NewCachedSigner(testSigners["ed25519"])},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// Public key authentication sends the key twice, once
+				// in the query and once with the signature, and checks
+				// its type on each attempt.
+				pub := tt.signer.PublicKey()
+				_ = pub.Type()
+				_ = pub.Marshal()
+				_ = pub.Marshal()
+			}
+		})
+	}
+}
+
 func TestNewSignerWithAlgos(t *testing.T) {
 	algorithSigner, ok := testSigners["rsa"].(AlgorithmSigner)
 	if !ok {
@@ -772,3 +976,215 @@ func TestCryptoPublicKey(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRFC4716PublicKey(t *testing.T) {
+	// As written by "ssh-keygen -e".
+	keygen := `---- BEGIN SSH2 PUBLIC KEY ----
+Comment: "256-bit ED25519, converted by root@vm from OpenSSH"
+AAAAC3NzaC1lZDI1NTE5AAAAINJ+DV22gbffyE2fT4ceP2egFl7hfwTgJD0zwe3jI7Ce
+---- END SSH2 PUBLIC KEY ----
+`
+	want, _, _, _, err := ParseAuthorizedKey([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINJ+DV22gbffyE2fT4ceP2egFl7hfwTgJD0zwe3jI7Ce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, comment, err := ParseRFC4716PublicKey([]byte(keygen))
+	if err != nil {
+		t.Fatalf("ParseRFC4716PublicKey: %v", err)
+	}
+	if !bytes.Equal(key.Marshal(), want.Marshal()) {
+		t.Errorf("got key %s, want %s", MarshalAuthorizedKey(key), MarshalAuthorizedKey(want))
+	}
+	if want := "256-bit ED25519, converted by root@vm from OpenSSH"; comment != want {
+		t.Errorf("got comment %q, want %q", comment, want)
+	}
+
+	// Other headers, a continued header, wrapped key data and CRLF
+	// line endings.
+	data := base64.StdEncoding.EncodeToString(testPublicKeys["rsa"].Marshal())
+	in := "\r\n---- BEGIN SSH2 PUBLIC KEY ----\r\n" +
+		"Subject: user\r\n" +
+		"comment: \"2048-bit rsa, created by user@example.com Mon Jan 15 \\\r\n" +
+		"08:31:24 2001\"\r\n" +
+		"x-private: \\\r\nfolded\r\n" +
+		data[:64] + "\r\n" + data[64:] + "\r\n" +
+		"---- END SSH2 PUBLIC KEY ----\r\n"
+	key, comment, err = ParseRFC4716PublicKey([]byte(in))
+	if err != nil {
+		t.Fatalf("ParseRFC4716PublicKey: %v", err)
+	}
+	if !bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+		t.Errorf("got key %s, want the rsa test key", MarshalAuthorizedKey(key))
+	}
+	if want := "2048-bit rsa, created by user@example.com Mon Jan 15 08:31:24 2001"; comment != want {
+		t.Errorf("got comment %q, want %q", comment, want)
+	}
+
+	for _, bad := range []string{
+		"",
+		"AAAA\n---- END SSH2 PUBLIC KEY ----\n",
+		"---- BEGIN SSH2 PUBLIC KEY ----\n" + data + "\n",
+		"---- BEGIN SSH2 PUBLIC KEY ----\nComment: \\\n",
+		"---- BEGIN SSH2 PUBLIC KEY ----\n!!!!\n---- END SSH2 PUBLIC KEY ----\n",
+	} {
+		if _, _, err := ParseRFC4716PublicKey([]byte(bad)); err == nil {
+			t.Errorf("ParseRFC4716PublicKey(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestMarshalRFC4716PublicKey(t *testing.T) {
+	for _, comment := range []string{
+		"",
+		"short",
+		strings.Repeat("a long comment ", 10),
+		strings.Repeat("ü", 100),
+	} {
+		for name, pub := range testPublicKeys {
+			out := MarshalRFC4716PublicKey(pub, comment)
+			for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+				if len(line) > 72 {
+					t.Errorf("%s: line %q is longer than 72 bytes", name, line)
+				}
+			}
+			key, gotComment, err := ParseRFC4716PublicKey(out)
+			if err != nil {
+				t.Fatalf("%s: ParseRFC4716PublicKey: %v\n%s", name, err, out)
+			}
+			if !bytes.Equal(key.Marshal(), pub.Marshal()) {
+				t.Errorf("%s: round trip changed the key", name)
+			}
+			if gotComment != comment {
+				t.Errorf("%s: got comment %q, want %q", name, gotComment, comment)
+			}
+		}
+	}
+}
+
+// recordingSigner is a crypto.Signer, like one backed by a hardware
+// module, that records the options it is called with.
+type recordingSigner struct {
+	crypto.Signer
+	opts []crypto.SignerOpts
+}
+
+func (s *recordingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.opts = append(s.opts, opts)
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+func TestNewSignerFromSignerAlgorithms(t *testing.T) {
+	data := []byte("sign me")
+
+	rsaSigner := &recordingSigner{Signer: testPrivateKeys["rsa"].(crypto.Signer)}
+	signer, err := NewSignerFromSigner(rsaSigner)
+	if err != nil {
+		t.Fatalf("NewSignerFromSigner: %v", err)
+	}
+	as, ok := signer.(MultiAlgorithmSigner)
+	if !ok {
+		t.Fatalf("signer of type %T is not a MultiAlgorithmSigner", signer)
+	}
+	if want := []string{KeyAlgoRSASHA256, KeyAlgoRSASHA512, KeyAlgoRSA}; !reflect.DeepEqual(as.Algorithms(), want) {
+		t.Errorf("got algorithms %q, want %q", as.Algorithms(), want)
+	}
+	for algo, hash := range map[string]crypto.Hash{
+		KeyAlgoRSASHA256: crypto.SHA256,
+		KeyAlgoRSASHA512: crypto.SHA512,
+		KeyAlgoRSA:       crypto.SHA1,
+	} {
+		rsaSigner.opts = nil
+		sig, err := as.SignWithAlgorithm(rand.Reader, data, algo)
+		if err != nil {
+			t.Fatalf("SignWithAlgorithm(%q): %v", algo, err)
+		}
+		if sig.Format != algo {
+			t.Errorf("got signature format %q, want %q", sig.Format, algo)
+		}
+		if err := signer.PublicKey().Verify(data, sig); err != nil {
+			t.Errorf("Verify(%q): %v", algo, err)
+		}
+		if len(rsaSigner.opts) != 1 || rsaSigner.opts[0].HashFunc() != hash {
+			t.Errorf("%s: underlying signer called with %v, want %v", algo, rsaSigner.opts, hash)
+		}
+	}
+
+	// Ed25519 signs the message itself.
+	edSigner := &recordingSigner{Signer: testPrivateKeys["ed25519"].(crypto.Signer)}
+	signer, err = NewSignerFromSigner(edSigner)
+	if err != nil {
+		t.Fatalf("NewSignerFromSigner: %v", err)
+	}
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := signer.PublicKey().Verify(data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if len(edSigner.opts) != 1 || edSigner.opts[0].HashFunc() != 0 {
+		t.Errorf("ed25519: underlying signer called with %v, want no hash", edSigner.opts)
+	}
+
+	// A wrapped RSA host key is usable by clients that only accept SHA-2
+	// signatures.
+	hostKey, err := NewSignerFromSigner(testPrivateKeys["rsa"].(crypto.Signer))
+	if err != nil {
+		t.Fatalf("NewSignerFromSigner: %v", err)
+	}
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(hostKey)
+	client, _, _ := testClientServerConn(t, serverConf, &ClientConfig{
+		User:              "user",
+		HostKeyCallback:   InsecureIgnoreHostKey(),
+		HostKeyAlgorithms: []string{KeyAlgoRSASHA512},
+	})
+	if got := client.(AlgorithmsConnMetadata).Algorithms().HostKey; got != KeyAlgoRSASHA512 {
+		t.Errorf("got host key algorithm %q, want %q", got, KeyAlgoRSASHA512)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	data := []byte("challenge")
+	rsaSigner := testSigners["rsa"].(MultiAlgorithmSigner)
+	for _, algo := range []string{KeyAlgoRSASHA256, KeyAlgoRSASHA512, KeyAlgoRSA} {
+		sig, err := rsaSigner.SignWithAlgorithm(rand.Reader, data, algo)
+		if err != nil {
+			t.Fatalf("SignWithAlgorithm(%q): %v", algo, err)
+		}
+		if err := VerifySignature(testPublicKeys["rsa"], data, sig); err != nil {
+			t.Errorf("VerifySignature(%q): %v", algo, err)
+		}
+		if err := VerifySignature(testPublicKeys["rsa"], []byte("other"), sig); err == nil {
+			t.Errorf("VerifySignature(%q) succeeded on other data", algo)
+		}
+	}
+
+	cert := &Certificate{
+		Key:         testPublicKeys["ed25519"],
+		ValidBefore: CertTimeInfinity,
+		CertType:    UserCert,
+	}
+	if err := cert.SignCert(rand.Reader, testSigners["ecdsa"]); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	sig, err := testSigners["ed25519"].Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := VerifySignature(cert, data, sig); err != nil {
+		t.Errorf("VerifySignature with a certificate: %v", err)
+	}
+
+	// The format must be an algorithm of the key.
+	for _, format := range []string{CertAlgoED25519v01, KeyAlgoECDSA256} {
+		bad := *sig
+		bad.Format = format
+		if err := VerifySignature(cert, data, &bad); err == nil {
+			t.Errorf("VerifySignature accepted format %q for an ed25519 key", format)
+		}
+	}
+	if err := VerifySignature(cert, data, nil); err == nil {
+		t.Error("VerifySignature accepted a nil signature")
+	}
+}
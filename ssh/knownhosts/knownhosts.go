@@ -160,8 +160,23 @@ func (db *hostKeyDB) IsHostAuthority(remote ssh.PublicKey, address string) bool
 
 // IsRevoked can be used as a callback in ssh.CertChecker
 func (db *hostKeyDB) IsRevoked(key *ssh.Certificate) bool {
-	_, ok := db.revoked[string(key.Marshal())]
-	return ok
+	return db.revokedKey(key) != nil
+}
+
+// revokedKey returns the @revoked line for key, if any. A certificate is
+// revoked if it, the key it certifies or the key that signed it is
+// revoked, as in OpenSSH.
+func (db *hostKeyDB) revokedKey(key ssh.PublicKey) *KnownKey {
+	if revoked := db.revoked[string(key.Marshal())]; revoked != nil {
+		return revoked
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if revoked := db.revoked[string(cert.Key.Marshal())]; revoked != nil {
+			return revoked
+		}
+		return db.revoked[string(cert.SignatureKey.Marshal())]
+	}
+	return nil
 }
 
 const markerCert = "@cert-authority"
@@ -285,7 +300,8 @@ func newHostnameMatcher(pattern string) (matcher, error) {
 	return hps, nil
 }
 
-// KnownKey represents a key declared in a known_hosts file.
+// KnownKey represents a key declared in a known_hosts file. Filename
+// is empty for keys read by NewFromReader or NewDB.
 type KnownKey struct {
 	Key      ssh.PublicKey
 	Filename string
@@ -293,7 +309,16 @@ type KnownKey struct {
 }
 
 func (k *KnownKey) String() string {
-	return fmt.Sprintf("%s:%d: %s", k.Filename, k.Line, serialize(k.Key))
+	return fmt.Sprintf("%s: %s", location(k.Filename, k.Line), serialize(k.Key))
+}
+
+// location formats a position in known_hosts data, which has no file
+// name if it was not read from a file.
+func location(filename string, line int) string {
+	if filename == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", filename, line)
 }
 
 // KeyError is returned if we did not find the key in the host key
@@ -306,16 +331,26 @@ type KeyError struct {
 	// unknown. If Want is non-empty, there was a mismatch, which
 	// can signify a MITM attack.
 	Want []KnownKey
+
+	// Authorities holds the @cert-authority keys trusted for the
+	// host. If Want is empty and Authorities is not, the host is
+	// known only through its certificate authorities, and the key
+	// presented was not a host certificate signed by one of them.
+	Authorities []KnownKey
 }
 
 func (u *KeyError) Error() string {
 	if len(u.Want) == 0 {
+		if len(u.Authorities) > 0 {
+			return "knownhosts: key is not signed by a trusted certificate authority"
+		}
 		return "knownhosts: key is unknown"
 	}
 	return "knownhosts: key mismatch"
 }
 
-// RevokedError is returned if we found a key that was revoked.
+// RevokedError is returned if we found a key that was revoked. It takes
+// precedence over any other line matching the host.
 type RevokedError struct {
 	Revoked KnownKey
 }
@@ -327,13 +362,23 @@ func (r *RevokedError) Error() string {
 // check checks a key against the host database. This should not be
 // used for verifying certificates.
 func (db *hostKeyDB) check(address string, remote net.Addr, remoteKey ssh.PublicKey) error {
-	if revoked := db.revoked[string(remoteKey.Marshal())]; revoked != nil {
+	if revoked := db.revokedKey(remoteKey); revoked != nil {
 		return &RevokedError{Revoked: *revoked}
 	}
 
+	hostToCheck, err := checkedAddr(address, remote)
+	if err != nil {
+		return err
+	}
+	return db.checkAddr(hostToCheck, remoteKey)
+}
+
+// checkedAddr returns the address to look up for a host: the hostname
+// if available, otherwise the remote address.
+func checkedAddr(address string, remote net.Addr) (addr, error) {
 	host, port, err := net.SplitHostPort(remote.String())
 	if err != nil {
-		return fmt.Errorf("knownhosts: SplitHostPort(%s): %v", remote, err)
+		return addr{}, fmt.Errorf("knownhosts: SplitHostPort(%s): %v", remote, err)
 	}
 
 	hostToCheck := addr{host, port}
@@ -341,48 +386,59 @@ func (db *hostKeyDB) check(address string, remote net.Addr, remoteKey ssh.Public
 		// Give preference to the hostname if available.
 		host, port, err := net.SplitHostPort(address)
 		if err != nil {
-			return fmt.Errorf("knownhosts: SplitHostPort(%s): %v", address, err)
+			return addr{}, fmt.Errorf("knownhosts: SplitHostPort(%s): %v", address, err)
 		}
 
 		hostToCheck = addr{host, port}
 	}
-
-	return db.checkAddr(hostToCheck, remoteKey)
+	return hostToCheck, nil
 }
 
-// checkAddr checks if we can find the given public key for the
-// given address.  If we only find an entry for the IP address,
-// or only the hostname, then this still succeeds.
-func (db *hostKeyDB) checkAddr(a addr, remoteKey ssh.PublicKey) error {
-	// TODO(hanwen): are these the right semantics? What if there
-	// is just a key for the IP address, but not for the
-	// hostname?
+// keyError returns the KeyError for a host key that doesn't match the
+// lines for a.
+func (db *hostKeyDB) keyError(a addr) *KeyError {
+	keyErr := &KeyError{}
+	for _, v := range db.knownKeys(a) {
+		keyErr.Want = append(keyErr.Want, v)
+	}
+	for _, l := range db.lines {
+		if l.cert && l.match(a) {
+			keyErr.Authorities = append(keyErr.Authorities, l.knownKey)
+		}
+	}
+	return keyErr
+}
 
-	// Algorithm => key.
+// knownKeys returns the plain host keys for a, by algorithm. Lines
+// marked @cert-authority are not host keys, and are left out.
+func (db *hostKeyDB) knownKeys(a addr) map[string]KnownKey {
 	knownKeys := map[string]KnownKey{}
 	for _, l := range db.lines {
-		if l.match(a) {
+		if !l.cert && l.match(a) {
 			typ := l.knownKey.Key.Type()
 			if _, ok := knownKeys[typ]; !ok {
 				knownKeys[typ] = l.knownKey
 			}
 		}
 	}
+	return knownKeys
+}
 
-	keyErr := &KeyError{}
-	for _, v := range knownKeys {
-		keyErr.Want = append(keyErr.Want, v)
-	}
+// checkAddr checks if we can find the given public key for the
+// given address.  If we only find an entry for the IP address,
+// or only the hostname, then this still succeeds.
+func (db *hostKeyDB) checkAddr(a addr, remoteKey ssh.PublicKey) error {
+	// TODO(hanwen): are these the right semantics? What if there
+	// is just a key for the IP address, but not for the
+	// hostname?
 
-	// Unknown remote host.
-	if len(knownKeys) == 0 {
-		return keyErr
-	}
+	// Algorithm => key.
+	knownKeys := db.knownKeys(a)
 
-	// If the remote host starts using a different, unknown key type, we
-	// also interpret that as a mismatch.
+	// Unknown remote host, or a different, unknown key type, which we
+	// also interpret as a mismatch.
 	if known, ok := knownKeys[remoteKey.Type()]; !ok || !keyEq(known.Key, remoteKey) {
-		return keyErr
+		return db.keyError(a)
 	}
 
 	return nil
@@ -402,7 +458,7 @@ func (db *hostKeyDB) Read(r io.Reader, filename string) error {
 		}
 
 		if err := db.parseLine(line, filename, lineNum); err != nil {
-			return fmt.Errorf("knownhosts: %s:%d: %v", filename, lineNum, err)
+			return fmt.Errorf("knownhosts: %s: %v", location(filename, lineNum), err)
 		}
 	}
 	return scanner.Err()
@@ -427,12 +483,51 @@ func New(files ...string) (ssh.HostKeyCallback, error) {
 		}
 	}
 
+	return db.hostKeyCallback(), nil
+}
+
+// NewFromReader is like New, but reads the known_hosts data from r
+// instead of a file. It is equivalent to NewDB(r).
+func NewFromReader(r io.Reader) (ssh.HostKeyCallback, error) {
+	return NewDB(r)
+}
+
+// NewDB is like New, but reads the known_hosts data from readers
+// instead of files, in order, as New reads its files. Each reader must
+// hold whole lines, and line numbers, as reported in KnownKey and parse
+// errors, count from the start of each reader.
+func NewDB(readers ...io.Reader) (ssh.HostKeyCallback, error) {
+	db := newHostKeyDB()
+	for _, r := range readers {
+		if err := db.Read(r, ""); err != nil {
+			return nil, err
+		}
+	}
+	return db.hostKeyCallback(), nil
+}
+
+// hostKeyCallback returns a callback that checks plain host keys against
+// the database, and host certificates against its certificate
+// authorities.
+func (db *hostKeyDB) hostKeyCallback() ssh.HostKeyCallback {
 	var certChecker ssh.CertChecker
 	certChecker.IsHostAuthority = db.IsHostAuthority
 	certChecker.IsRevoked = db.IsRevoked
 	certChecker.HostKeyFallback = db.check
 
-	return certChecker.CheckHostKey, nil
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if revoked := db.revokedKey(key); revoked != nil {
+			return &RevokedError{Revoked: *revoked}
+		}
+		if cert, ok := key.(*ssh.Certificate); ok && cert.CertType == ssh.HostCert && !db.IsHostAuthority(cert.SignatureKey, hostname) {
+			a, err := checkedAddr(hostname, remote)
+			if err != nil {
+				return err
+			}
+			return db.keyError(a)
+		}
+		return certChecker.CheckHostKey(hostname, remote, key)
+	}
 }
 
 // Normalize normalizes an address into the form used in known_hosts
@@ -461,8 +556,22 @@ func Line(addresses []string, key ssh.PublicKey) string {
 	return strings.Join(trimmed, ",") + " " + serialize(key)
 }
 
-// HashHostname hashes the given hostname. The hostname is not
-// normalized before hashing.
+// WriteHashedKnownHost writes known_hosts lines for key to w, with each
+// of the addresses normalized and hashed with a fresh salt. As OpenSSH
+// accepts a single hashed host name per line, it writes one line per
+// address, in the same format as "ssh-keygen -H".
+func WriteHashedKnownHost(w io.Writer, addresses []string, key ssh.PublicKey) error {
+	var b bytes.Buffer
+	for _, a := range addresses {
+		b.WriteString(HashHostname(Normalize(a)) + " " + serialize(key) + "\n")
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// HashHostname hashes the given hostname, in the "|1|salt|hash" form
+// written by OpenSSH when HashKnownHosts is set. The hostname is not
+// normalized before hashing; use Normalize for addresses with a port.
 func HashHostname(hostname string) string {
 	// TODO(hanwen): check if we can safely normalize this always.
 	salt := make([]byte, sha1.Size)
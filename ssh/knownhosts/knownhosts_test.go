@@ -6,9 +6,14 @@ package knownhosts
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	"golang.org/x/crypto/ssh"
@@ -76,6 +81,72 @@ func TestRevoked(t *testing.T) {
 	}
 }
 
+func TestRevokedPrecedence(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	ca, revokedCA, host, revokedHost := newSigner(), newSigner(), newSigner(), newSigner()
+	newCert := func(key ssh.PublicKey, signer ssh.Signer) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             key,
+			CertType:        ssh.HostCert,
+			ValidPrincipals: []string{"host.example"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	authorized := func(k ssh.PublicKey) string {
+		return string(ssh.MarshalAuthorizedKey(k))
+	}
+
+	db := testDB(t, "host.example "+edKeyStr+"\n"+
+		"@revoked * "+edKeyStr+"\n"+
+		"host.example "+ecKeyStr+"\n"+
+		"@cert-authority *.example "+authorized(ca.PublicKey())+
+		"@cert-authority *.example "+authorized(revokedCA.PublicKey())+
+		"@revoked * "+authorized(revokedCA.PublicKey())+
+		"@revoked host.other "+authorized(revokedHost.PublicKey()))
+	callback := db.hostKeyCallback()
+	for _, tt := range []struct {
+		name string
+		key  ssh.PublicKey
+		line int
+	}{
+		{name: "valid key", key: ecKey},
+		{name: "revoked key", key: edKey, line: 2},
+		{name: "valid certificate", key: newCert(host.PublicKey(), ca)},
+		{name: "certificate from revoked authority", key: newCert(host.PublicKey(), revokedCA), line: 6},
+		{name: "certificate for revoked key", key: newCert(revokedHost.PublicKey(), ca), line: 7},
+	} {
+		err := callback("host.example:22", testAddr, tt.key)
+		if tt.line == 0 {
+			if err != nil {
+				t.Errorf("%s: got error %v, want none", tt.name, err)
+			}
+			continue
+		}
+		revokedErr, ok := err.(*RevokedError)
+		if !ok {
+			t.Errorf("%s: got %v, want a *RevokedError", tt.name, err)
+			continue
+		}
+		if revokedErr.Revoked.Line != tt.line {
+			t.Errorf("%s: got revoked line %d, want %d", tt.name, revokedErr.Revoked.Line, tt.line)
+		}
+	}
+}
+
 func TestHostAuthority(t *testing.T) {
 	for _, m := range []struct {
 		authorityFor string
@@ -185,6 +256,47 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+func TestNewDB(t *testing.T) {
+	first := fmt.Sprintf("#comment\nserver.org %s\n", edKeyStr)
+	second := fmt.Sprintf("\notherhost %s\n", ecKeyStr)
+	cb, err := NewDB(strings.NewReader(first), strings.NewReader(second))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	if err := cb("server.org:22", testAddr, edKey); err != nil {
+		t.Errorf("key from the first reader: got error %v, want none", err)
+	}
+	if err := cb("otherhost:22", testAddr, ecKey); err != nil {
+		t.Errorf("key from the second reader: got error %v, want none", err)
+	}
+
+	var ke *KeyError
+	err = cb("otherhost:22", testAddr, edKey)
+	if !errors.As(err, &ke) {
+		t.Fatalf("got %v, want *KeyError", err)
+	}
+	want := []KnownKey{{Key: ecKey, Line: 2}}
+	if !reflect.DeepEqual(ke.Want, want) {
+		t.Errorf("got Want %v, want %v", ke.Want, want)
+	}
+
+	cb, err = NewFromReader(strings.NewReader(first))
+	if err != nil {
+		t.Fatalf("NewFromReader: %v", err)
+	}
+	if err := cb("server.org:22", testAddr, edKey); err != nil {
+		t.Errorf("NewFromReader: got error %v, want none", err)
+	}
+	if err := cb("otherhost:22", testAddr, ecKey); !errors.As(err, &ke) || len(ke.Want) != 0 {
+		t.Errorf("NewFromReader: got %v, want an unknown key error", err)
+	}
+
+	_, err = NewDB(strings.NewReader(first), strings.NewReader("\nbadline\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "knownhosts: line 2: ") {
+		t.Errorf("got %v, want a parse error on line 2", err)
+	}
+}
+
 func TestHostNamePrecedence(t *testing.T) {
 	var evilAddr = &net.TCPAddr{
 		IP:   net.IP{66, 66, 66, 66},
@@ -283,7 +395,91 @@ func TestWildcardMatch(t *testing.T) {
 	}
 }
 
-// TODO(hanwen): test coverage for certificates.
+func TestCertAuthority(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	ca, otherCA, host := newSigner(), newSigner(), newSigner()
+	newCert := func(signer ssh.Signer) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             host.PublicKey(),
+			CertType:        ssh.HostCert,
+			ValidPrincipals: []string{"host.example"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	db := testDB(t, "@cert-authority *.example "+string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+	callback := db.hostKeyCallback()
+	authorities := []KnownKey{{Key: ca.PublicKey(), Filename: "testdb", Line: 1}}
+	for _, tt := range []struct {
+		name     string
+		hostname string
+		key      ssh.PublicKey
+		want     *KeyError
+		wantMsg  string
+	}{
+		{name: "trusted certificate", hostname: "host.example:22", key: newCert(ca)},
+		{
+			name:     "untrusted certificate",
+			hostname: "host.example:22",
+			key:      newCert(otherCA),
+			want:     &KeyError{Authorities: authorities},
+			wantMsg:  "knownhosts: key is not signed by a trusted certificate authority",
+		},
+		{
+			name:     "plain key",
+			hostname: "host.example:22",
+			key:      host.PublicKey(),
+			want:     &KeyError{Authorities: authorities},
+			wantMsg:  "knownhosts: key is not signed by a trusted certificate authority",
+		},
+		{
+			name:     "authority key as host key",
+			hostname: "host.example:22",
+			key:      ca.PublicKey(),
+			want:     &KeyError{Authorities: authorities},
+		},
+		{
+			name:     "unknown host",
+			hostname: "host.invalid:22",
+			key:      host.PublicKey(),
+			want:     &KeyError{},
+			wantMsg:  "knownhosts: key is unknown",
+		},
+	} {
+		err := callback(tt.hostname, testAddr, tt.key)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%s: got error %v, want none", tt.name, err)
+			}
+			continue
+		}
+		keyErr, ok := err.(*KeyError)
+		if !ok {
+			t.Errorf("%s: got %v, want a *KeyError", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(keyErr, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, keyErr, tt.want)
+		}
+		if tt.wantMsg != "" && err.Error() != tt.wantMsg {
+			t.Errorf("%s: got message %q, want %q", tt.name, err, tt.wantMsg)
+		}
+	}
+}
 
 const testHostname = "hostname"
 
@@ -354,3 +550,34 @@ func TestHashedHostkeyCheck(t *testing.T) {
 		t.Errorf("got error %v, want %v", got, want)
 	}
 }
+
+func TestWriteHashedKnownHost(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteHashedKnownHost(&b, []string{testHostname, "server.org:23"}, edKey); err != nil {
+		t.Fatalf("WriteHashedKnownHost: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), b.String())
+	}
+	for _, l := range lines {
+		hashed, key, ok := strings.Cut(l, " ")
+		if !ok || key != edKeyStr {
+			t.Errorf("line %q does not end in key %q", l, edKeyStr)
+		}
+		if _, salt, hash, err := decodeHash(hashed); err != nil || len(salt) != sha1.Size || len(hash) != sha1.Size {
+			t.Errorf("decodeHash(%q): salt %d bytes, hash %d bytes, err %v", hashed, len(salt), len(hash), err)
+		}
+	}
+
+	db := testDB(t, b.String())
+	if err := db.check(testHostname+":22", testAddr, edKey); err != nil {
+		t.Errorf("check(%s): %v", testHostname, err)
+	}
+	if err := db.check("server.org:23", testAddr, edKey); err != nil {
+		t.Errorf("check(server.org:23): %v", err)
+	}
+	if err := db.check("server.org:22", testAddr, edKey); err == nil {
+		t.Errorf("check(server.org:22) succeeded, want unknown host")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"fmt"
 	"hash"
 )
 
@@ -46,6 +47,45 @@ func (t truncatingMAC) Size() int {
 
 func (t truncatingMAC) BlockSize() int { return t.hmac.BlockSize() }
 
+// A MACFactory describes a message authentication code for RegisterMAC.
+type MACFactory struct {
+	// KeySize is the length of the key derived for each direction.
+	KeySize int
+
+	// EncryptThenMAC is set if the MAC is computed over the encrypted
+	// packet, as for hmac-sha2-256-etm@openssh.com, rather than over
+	// the plaintext.
+	EncryptThenMAC bool
+
+	// New returns a hash computing the MAC with key. Its Sum is sent
+	// in full after each packet.
+	New func(key []byte) hash.Hash
+}
+
+// RegisterMAC makes the MAC m available under name, so that it can be
+// negotiated by listing name in Config.MACs. It is never used by
+// default. RegisterMAC returns an error if name is not a valid algorithm
+// name, is already taken by a built-in or registered MAC, or if m is
+// incomplete.
+//
+// As with RegisterCipher, this is an advanced API: the package does not
+// check the security of the MAC. RegisterMAC must be called before the
+// MAC is used, typically from an init function; it is not safe to call
+// concurrently with connections being set up.
+func RegisterMAC(name string, m MACFactory) error {
+	if !validAlgorithmName(name) {
+		return fmt.Errorf("ssh: invalid MAC name %q", name)
+	}
+	if _, ok := macModes[name]; ok {
+		return fmt.Errorf("ssh: MAC %q is already registered", name)
+	}
+	if m.KeySize <= 0 || m.New == nil {
+		return fmt.Errorf("ssh: MAC %q must set KeySize and New", name)
+	}
+	macModes[name] = &macMode{m.KeySize, m.EncryptThenMAC, m.New}
+	return nil
+}
+
 var macModes = map[string]*macMode{
 	"hmac-sha2-512-etm@openssh.com": {64, true, func(key []byte) hash.Hash {
 		return hmac.New(sha512.New, key)
@@ -35,16 +35,40 @@ const (
 // See RFC 4253, section 11.1.
 const msgDisconnect = 1
 
-// disconnectMsg is the message that signals a disconnect. It is also
-// the error type returned from mux.Wait()
+// disconnectMsg is the message that signals a disconnect. When
+// received, it is returned as a *DisconnectError.
 type disconnectMsg struct {
 	Reason   uint32 `sshtype:"1"`
 	Message  string
 	Language string
 }
 
-func (d *disconnectMsg) Error() string {
-	return fmt.Sprintf("ssh: disconnect, reason %d: %s", d.Reason, d.Message)
+// toError converts the message to the error returned to callers.
+func (d *disconnectMsg) toError() *DisconnectError {
+	return &DisconnectError{
+		Reason:   DisconnectReason(d.Reason),
+		Message:  d.Message,
+		Language: d.Language,
+	}
+}
+
+// ignoreMsg is sent to make traffic analysis harder. Received ignore
+// messages are discarded by the transport. See RFC 4253, section 11.2.
+type ignoreMsg struct {
+	Data []byte `sshtype:"2"`
+}
+
+// unimplementedMsg is the reply to a message of a type the peer does not
+// know. See RFC 4253, section 11.4.
+type unimplementedMsg struct {
+	SeqNum uint32 `sshtype:"3"`
+}
+
+// debugMsg carries diagnostic text. See RFC 4253, section 11.3.
+type debugMsg struct {
+	AlwaysDisplay bool `sshtype:"4"`
+	Message       string
+	Language      string
 }
 
 // See RFC 4253, section 7.1.
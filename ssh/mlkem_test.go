@@ -0,0 +1,139 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.24
+
+package ssh
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// mlkemPeerReply plays the server side of an mlkem768x25519-sha256 exchange
+// against kex.Client, truncating its public value by truncate bytes. It runs
+// on its own goroutine, so it reports failures with t.Errorf.
+func mlkemPeerReply(t *testing.T, p packetConn, truncate int) {
+	packet, err := p.readPacket()
+	if err != nil {
+		t.Errorf("readPacket: %v", err)
+		return
+	}
+	var init kexECDHInitMsg
+	if err := Unmarshal(packet, &init); err != nil {
+		t.Errorf("Unmarshal: %v", err)
+		return
+	}
+	if len(init.ClientPubKey) != mlkem.EncapsulationKeySize768+32 {
+		t.Errorf("client public value has length %d, want %d", len(init.ClientPubKey), mlkem.EncapsulationKeySize768+32)
+		return
+	}
+	ek, err := mlkem.NewEncapsulationKey768(init.ClientPubKey[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		t.Errorf("NewEncapsulationKey768: %v", err)
+		return
+	}
+	_, ciphertext := ek.Encapsulate()
+	serverPub := append(ciphertext, make([]byte, 32)...)
+	reply := kexECDHReplyMsg{
+		EphemeralPubKey: serverPub[:len(serverPub)-truncate],
+		HostKey:         testSigners["ecdsa"].PublicKey().Marshal(),
+		Signature:       []byte("unchecked"),
+	}
+	if err := p.writePacket(Marshal(&reply)); err != nil {
+		t.Errorf("writePacket: %v", err)
+	}
+}
+
+// TestMLKEMOpenSSHRecording replays the key exchange of a Go client with an
+// OpenSSH 9.9 server, recorded by golang.org/x/crypto/ssh/test. The client's
+// randomness was the SHAKE128 stream with no input: its X25519 private key is
+// at offset 29 and the ML-KEM seed follows at offset 61. The exchange hash H
+// must verify with the signature sent by OpenSSH, which ties both H and the
+// shared secret K it covers to OpenSSH's computation.
+func TestMLKEMOpenSSHRecording(t *testing.T) {
+	clientToServer, serverToClient := readRecording(t, "testdata/Client-KEX-mlkem768x25519-sha256")
+	clientVersion, clientPackets, _ := splitUnencrypted(t, clientToServer, 2)
+	serverVersion, serverPackets, _ := splitUnencrypted(t, serverToClient, 2)
+	if string(serverVersion) != "SSH-2.0-OpenSSH_9.9" {
+		t.Fatalf("recording is of %q", serverVersion)
+	}
+
+	rand := sha3.NewShake128()
+	io.CopyN(io.Discard, rand, 29)
+
+	magics := handshakeMagics{
+		clientVersion: clientVersion,
+		serverVersion: serverVersion,
+		clientKexInit: clientPackets[0],
+		serverKexInit: serverPackets[0],
+	}
+	c := &recordedPacketConn{t: t, request: clientPackets[1], reply: serverPackets[1]}
+	result, err := kexAlgoMap[kexAlgoMLKEM768xCurve25519SHA256].Client(c, rand, &magics)
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+
+	const (
+		wantH = "01bf822b312734a0641694c5772abd98244a94679883708c7f72f8f6b3d39a39"
+		wantK = "0000002067701b91802f907a39e1f9031afa57b9fb84e1ff42322d76e8063584891d65fe"
+	)
+	if got := hex.EncodeToString(result.H); got != wantH {
+		t.Errorf("got H %s, want %s", got, wantH)
+	}
+	if got := hex.EncodeToString(result.K); got != wantK {
+		t.Errorf("got K %s, want %s", got, wantK)
+	}
+
+	hostKey, err := ParsePublicKey(result.HostKey)
+	if err != nil {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+	sig, rest, ok := parseSignatureBody(result.Signature)
+	if !ok || len(rest) > 0 {
+		t.Fatal("bad signature in recording")
+	}
+	if err := hostKey.Verify(result.H, sig); err != nil {
+		t.Errorf("OpenSSH's signature doesn't verify with the computed exchange hash: %v", err)
+	}
+}
+
+func TestMLKEMWrongLength(t *testing.T) {
+	kex := kexAlgoMap[kexAlgoMLKEM768xCurve25519SHA256]
+
+	t.Run("ciphertext", func(t *testing.T) {
+		a, b := memPipe()
+		defer a.Close()
+		defer b.Close()
+
+		var magics handshakeMagics
+		go mlkemPeerReply(t, b, 1)
+		if _, err := kex.Client(a, rand.Reader, &magics); err == nil {
+			t.Error("Client accepted a truncated ciphertext")
+		}
+	})
+
+	t.Run("encapsulation key", func(t *testing.T) {
+		a, b := memPipe()
+		defer a.Close()
+		defer b.Close()
+
+		go a.writePacket(Marshal(&kexECDHInitMsg{make([]byte, mlkem.EncapsulationKeySize768+31)}))
+		var magics handshakeMagics
+		if _, err := kex.Server(b, rand.Reader, &magics, testSigners["ecdsa"].(AlgorithmSigner), testSigners["ecdsa"].PublicKey().Type()); err == nil {
+			t.Error("Server accepted a truncated client public value")
+		}
+	})
+}
+
+func TestMLKEMPreferred(t *testing.T) {
+	if preferredKexAlgos[0] != kexAlgoMLKEM768xCurve25519SHA256 {
+		t.Errorf("got preferred key exchanges %v, want %q first", preferredKexAlgos, kexAlgoMLKEM768xCurve25519SHA256)
+	}
+}
@@ -5,7 +5,9 @@
 package ssh
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,6 +19,10 @@ import (
 // logged.
 const debugMux = false
 
+// noMoreSessionsRequest is the global request with which OpenSSH clients
+// ask the server to refuse further "session" channels.
+const noMoreSessionsRequest = "no-more-sessions@openssh.com"
+
 // chanList is a thread safe channel list.
 type chanList struct {
 	// protects concurrent access to chans
@@ -26,24 +32,77 @@ type chanList struct {
 	// other side should send in the PeersId field.
 	chans []*channel
 
+	// n is the number of non-nil entries in chans.
+	n int
+
+	// closed is set by dropAll, after which no channels can be added.
+	closed bool
+
 	// This is a debugging aid: it offsets all IDs by this
 	// amount. This helps distinguish otherwise identical
 	// server/client muxes
 	offset uint32
 }
 
-// Assigns a channel ID to the given channel.
-func (c *chanList) add(ch *channel) uint32 {
+// Assigns a channel ID to the given channel. If limit is positive and
+// there are already limit channels, or the list has been closed by
+// dropAll, it fails and returns false.
+func (c *chanList) add(ch *channel, limit int) (uint32, bool) {
 	c.Lock()
 	defer c.Unlock()
+	if c.closed || (limit > 0 && c.n >= limit) {
+		return 0, false
+	}
+	c.n++
+	// The ID is set under the lock for channels.
 	for i := range c.chans {
 		if c.chans[i] == nil {
 			c.chans[i] = ch
-			return uint32(i) + c.offset
+			ch.localId = uint32(i) + c.offset
+			return ch.localId, true
 		}
 	}
 	c.chans = append(c.chans, ch)
-	return uint32(len(c.chans)-1) + c.offset
+	ch.localId = uint32(len(c.chans)-1) + c.offset
+	return ch.localId, true
+}
+
+// setRemote records id as the peer's ID for ch. It is set under the lock
+// for channels and hasRemote.
+func (c *chanList) setRemote(ch *channel, id uint32) {
+	c.Lock()
+	defer c.Unlock()
+	ch.remoteId = id
+	ch.remoteKnown = true
+}
+
+// channels describes the channels in the list, in the order of their
+// local IDs.
+func (c *chanList) channels() []ChannelInfo {
+	c.Lock()
+	defer c.Unlock()
+	infos := make([]ChannelInfo, 0, c.n)
+	for _, ch := range c.chans {
+		if ch == nil {
+			continue
+		}
+		infos = append(infos, ChannelInfo{
+			LocalID:         ch.localId,
+			RemoteID:        ch.remoteId,
+			Type:            ch.chanType,
+			Inbound:         ch.direction == channelInbound,
+			Opening:         !ch.remoteKnown,
+			PendingRequests: len(ch.incomingRequests),
+		})
+	}
+	return infos
+}
+
+// count returns the number of channels in the list.
+func (c *chanList) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.n
 }
 
 // getChan returns the channel for the given ID.
@@ -61,12 +120,27 @@ func (c *chanList) getChan(id uint32) *channel {
 func (c *chanList) remove(id uint32) {
 	id -= c.offset
 	c.Lock()
-	if id < uint32(len(c.chans)) {
+	if id < uint32(len(c.chans)) && c.chans[id] != nil {
 		c.chans[id] = nil
+		c.n--
 	}
 	c.Unlock()
 }
 
+// hasRemote reports whether the list has a channel to which the peer has
+// assigned the ID id. It must only be called by the mux loop, which
+// learns those IDs.
+func (c *chanList) hasRemote(id uint32) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, ch := range c.chans {
+		if ch != nil && ch.remoteKnown && ch.remoteId == id {
+			return true
+		}
+	}
+	return false
+}
+
 // dropAll forgets all channels it knows, returning them in a slice.
 func (c *chanList) dropAll() []*channel {
 	c.Lock()
@@ -80,9 +154,18 @@ func (c *chanList) dropAll() []*channel {
 		r = append(r, ch)
 	}
 	c.chans = nil
+	c.n = 0
+	c.closed = true
 	return r
 }
 
+// isClosed reports whether dropAll has been called.
+func (c *chanList) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
 // mux represents the state for the SSH connection protocol, which
 // multiplexes many channels onto a single packet transport.
 type mux struct {
@@ -91,10 +174,55 @@ type mux struct {
 
 	incomingChannels chan NewChannel
 
-	globalSentMu     sync.Mutex
-	globalResponses  chan interface{}
+	// globalSentMu protects globalResponses and globalClosed. It is
+	// held while sending a global request that wants a reply, so
+	// that globalResponses is in the order the requests were sent.
+	globalSentMu sync.Mutex
+	// globalResponses holds a channel for each global request that is
+	// still waiting for its reply. Replies arrive in request order, so
+	// the first entry receives the next reply, even if its caller has
+	// stopped waiting.
+	globalResponses []chan interface{}
+	globalClosed    bool
+
 	incomingRequests chan *Request
 
+	// honorNoMoreSessions is set on servers that handle the
+	// no-more-sessions request, and noMoreSessions once it is received.
+	// noMoreSessions is only used by the loop goroutine.
+	honorNoMoreSessions bool
+	noMoreSessions      bool
+
+	// handleRequest, if set, is offered each incoming global request
+	// before it is queued on incomingRequests. It returns true if it
+	// has consumed the request. It is called from the loop goroutine.
+	handleRequest func(*Request) bool
+
+	// unhandledRequest, if set, takes the global requests that
+	// handleRequest doesn't consume instead of incomingRequests. It is
+	// called from the loop goroutine.
+	unhandledRequest func(*Request)
+
+	// acceptEnv, if set, decides the "env" requests of inbound
+	// "session" channels, which are then not passed on.
+	acceptEnv func(name string) bool
+
+	// checkPtyRequests makes the mux refuse malformed "pty-req"
+	// requests of inbound "session" channels.
+	checkPtyRequests bool
+
+	// maxChannels, if positive, limits the number of open channels.
+	maxChannels int
+
+	// replies orders the replies to global requests from the peer.
+	replies replyQueue
+
+	// maxPendingRequests, if positive, limits the number of global
+	// requests that want a reply and have not been replied to.
+	maxPendingRequests int
+
+	logger Logger
+
 	errCond *sync.Cond
 	err     error
 }
@@ -114,12 +242,56 @@ func (m *mux) Wait() error {
 
 // newMux returns a mux that runs over the given connection.
 func newMux(p packetConn) *mux {
+	return newMuxWithOptions(p, muxOptions{})
+}
+
+// muxOptions holds the optional behaviour of a mux.
+type muxOptions struct {
+	// honorNoMoreSessions makes the mux reject "session" channels once
+	// it has received a no-more-sessions request. It is set on servers.
+	honorNoMoreSessions bool
+
+	// handleRequest, if non-nil, is offered global requests before
+	// they are passed on to the application.
+	handleRequest func(*Request) bool
+
+	// unhandledRequest is Config.unhandledGlobalRequest.
+	unhandledRequest func(*Request)
+
+	// acceptEnv, if non-nil, makes the mux handle the "env" requests
+	// of inbound "session" channels itself. It is set on servers.
+	acceptEnv func(name string) bool
+
+	// checkPtyRequests makes the mux refuse malformed "pty-req"
+	// requests of inbound "session" channels instead of passing them
+	// on. It is set on servers.
+	checkPtyRequests bool
+
+	// maxChannels is Config.MaxChannels.
+	maxChannels int
+
+	// maxPendingRequests is Config.maxPendingGlobalRequests.
+	maxPendingRequests int
+
+	// logger, if non-nil, receives channel open events.
+	logger Logger
+}
+
+// newMuxWithOptions is like newMux, with the behaviour set in opts.
+func newMuxWithOptions(p packetConn, opts muxOptions) *mux {
 	m := &mux{
-		conn:             p,
-		incomingChannels: make(chan NewChannel, chanSize),
-		globalResponses:  make(chan interface{}, 1),
-		incomingRequests: make(chan *Request, chanSize),
-		errCond:          newCond(),
+		conn:                p,
+		incomingChannels:    make(chan NewChannel, chanSize),
+		incomingRequests:    make(chan *Request, chanSize),
+		honorNoMoreSessions: opts.honorNoMoreSessions,
+		handleRequest:       opts.handleRequest,
+		unhandledRequest:    opts.unhandledRequest,
+		acceptEnv:           opts.acceptEnv,
+		checkPtyRequests:    opts.checkPtyRequests,
+		maxChannels:         opts.maxChannels,
+		maxPendingRequests:  opts.maxPendingRequests,
+		logger:              opts.logger,
+		errCond:             newCond(),
 	}
 	if debugMux {
 		m.chanList.offset = atomic.AddUint32(&globalOff, 1)
@@ -138,50 +310,83 @@ func (m *mux) sendMessage(msg interface{}) error {
 }
 
 func (m *mux) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
-	if wantReply {
-		m.globalSentMu.Lock()
-		defer m.globalSentMu.Unlock()
-	}
+	return m.SendRequestContext(context.Background(), name, wantReply, payload)
+}
 
-	if err := m.sendMessage(globalRequestMsg{
+func (m *mux) SendRequestContext(ctx context.Context, name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	msg := globalRequestMsg{
 		Type:      name,
 		WantReply: wantReply,
 		Data:      payload,
-	}); err != nil {
+	}
+	if !wantReply {
+		return false, nil, m.sendMessage(msg)
+	}
+	if err := ctx.Err(); err != nil {
 		return false, nil, err
 	}
 
-	if !wantReply {
-		return false, nil, nil
+	reply := make(chan interface{}, 1)
+	m.globalSentMu.Lock()
+	if m.globalClosed {
+		m.globalSentMu.Unlock()
+		return false, nil, io.EOF
+	}
+	if err := m.sendMessage(msg); err != nil {
+		m.globalSentMu.Unlock()
+		return false, nil, err
 	}
+	m.globalResponses = append(m.globalResponses, reply)
+	m.globalSentMu.Unlock()
 
-	msg, ok := <-m.globalResponses
+	var resp interface{}
+	var ok bool
+	select {
+	case resp, ok = <-reply:
+	case <-ctx.Done():
+		// The reply, if it ever arrives, is still delivered to
+		// reply and then discarded.
+		return false, nil, ctx.Err()
+	}
 	if !ok {
 		return false, nil, io.EOF
 	}
-	switch msg := msg.(type) {
+	switch resp := resp.(type) {
 	case *globalRequestFailureMsg:
-		return false, msg.Data, nil
+		return false, resp.Data, nil
 	case *globalRequestSuccessMsg:
-		return true, msg.Data, nil
+		return true, resp.Data, nil
 	default:
-		return false, nil, fmt.Errorf("ssh: unexpected response to request: %#v", msg)
-	}
-}
-
-// ackRequest must be called after processing a global request that
-// has WantReply set.
-func (m *mux) ackRequest(ok bool, data []byte) error {
-	if ok {
-		return m.sendMessage(globalRequestSuccessMsg{Data: data})
+		return false, nil, fmt.Errorf("ssh: unexpected response to request: %#v", resp)
 	}
-	return m.sendMessage(globalRequestFailureMsg{Data: data})
 }
 
 func (m *mux) Close() error {
 	return m.conn.Close()
 }
 
+// channelDisconnectedError is returned by the Write method of the
+// channels of a connection that was ended by an SSH_MSG_DISCONNECT.
+// It unwraps to the *DisconnectError, and matches io.EOF so that code
+// checking for the end of the channel keeps working. Read returns
+// io.EOF itself, as io.Reader requires; the *DisconnectError is also
+// returned by the connection's Wait method.
+type channelDisconnectedError struct {
+	err *DisconnectError
+}
+
+func (e *channelDisconnectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *channelDisconnectedError) Unwrap() error {
+	return e.err
+}
+
+func (e *channelDisconnectedError) Is(target error) bool {
+	return target == io.EOF
+}
+
 // loop runs the connection machine. It will process packets until an
 // error is encountered. To synchronize on loop exit, use mux.Wait.
 func (m *mux) loop() {
@@ -190,13 +395,25 @@ func (m *mux) loop() {
 		err = m.onePacket()
 	}
 
+	var chErr error
+	var d *DisconnectError
+	if errors.As(err, &d) {
+		chErr = &channelDisconnectedError{d}
+	}
 	for _, ch := range m.chanList.dropAll() {
-		ch.close()
+		ch.closeWithError(chErr)
 	}
 
 	close(m.incomingChannels)
 	close(m.incomingRequests)
-	close(m.globalResponses)
+
+	m.globalSentMu.Lock()
+	m.globalClosed = true
+	for _, reply := range m.globalResponses {
+		close(reply)
+	}
+	m.globalResponses = nil
+	m.globalSentMu.Unlock()
 
 	m.conn.Close()
 
@@ -260,14 +477,52 @@ func (m *mux) handleGlobalPacket(packet []byte) error {
 
 	switch msg := msg.(type) {
 	case *globalRequestMsg:
-		m.incomingRequests <- &Request{
+		req := &Request{
 			Type:      msg.Type,
 			WantReply: msg.WantReply,
 			Payload:   msg.Data,
 			mux:       m,
 		}
+		if msg.WantReply {
+			if m.maxPendingRequests > 0 && m.replies.len() >= m.maxPendingRequests {
+				// Replies must be sent in the order of the
+				// requests, so this one can't be refused ahead
+				// of the pending ones.
+				disc := &DisconnectError{
+					Reason:  DisconnectByApplication,
+					Message: "too many pending global requests",
+				}
+				m.sendMessage(disconnectMsg{Reason: uint32(disc.Reason), Message: disc.Message})
+				return disc
+			}
+			m.replies.add(req)
+		}
+		if m.honorNoMoreSessions && msg.Type == noMoreSessionsRequest {
+			m.noMoreSessions = true
+			return req.Reply(true, nil)
+		}
+		if m.handleRequest != nil && m.handleRequest(req) {
+			return nil
+		}
+		if m.unhandledRequest != nil {
+			m.unhandledRequest(req)
+			return nil
+		}
+		m.incomingRequests <- req
 	case *globalRequestSuccessMsg, *globalRequestFailureMsg:
-		m.globalResponses <- msg
+		m.globalSentMu.Lock()
+		if len(m.globalResponses) == 0 {
+			m.globalSentMu.Unlock()
+			// A reply that doesn't match any request we sent.
+			if debugMux {
+				log.Printf("unexpected global request reply(%d): %#v", m.chanList.offset, msg)
+			}
+			return nil
+		}
+		reply := m.globalResponses[0]
+		m.globalResponses = m.globalResponses[1:]
+		m.globalSentMu.Unlock()
+		reply <- msg
 	default:
 		panic(fmt.Sprintf("not a global message %#v", msg))
 	}
@@ -292,8 +547,40 @@ func (m *mux) handleChannelOpen(packet []byte) error {
 		return m.sendMessage(failMsg)
 	}
 
+	if m.noMoreSessions && msg.ChanType == "session" {
+		if m.logger != nil {
+			m.logger.Log(LogInfo, "channel open rejected", "type", msg.ChanType, "reason", "no more sessions")
+		}
+		failMsg := channelOpenFailureMsg{
+			PeersID:  msg.PeersID,
+			Reason:   Prohibited,
+			Message:  "no more sessions",
+			Language: "en_US.UTF-8",
+		}
+		return m.sendMessage(failMsg)
+	}
+
+	if m.chanList.hasRemote(msg.PeersID) {
+		return m.protocolError("channel open with the ID %d of an open channel", msg.PeersID)
+	}
+
+	if m.logger != nil {
+		m.logger.Log(LogDebug, "channel open", "type", msg.ChanType)
+	}
 	c := m.newChannel(msg.ChanType, channelInbound, msg.TypeSpecificData)
-	c.remoteId = msg.PeersID
+	if c == nil {
+		if m.logger != nil {
+			m.logger.Log(LogInfo, "channel open rejected", "type", msg.ChanType, "reason", "too many channels")
+		}
+		failMsg := channelOpenFailureMsg{
+			PeersID:  msg.PeersID,
+			Reason:   ResourceShortage,
+			Message:  "too many channels",
+			Language: "en_US.UTF-8",
+		}
+		return m.sendMessage(failMsg)
+	}
+	m.chanList.setRemote(c, msg.PeersID)
 	c.maxRemotePayload = msg.MaxPacketSize
 	c.remoteWin.add(msg.PeersWindow)
 	m.incomingChannels <- c
@@ -301,7 +588,11 @@ func (m *mux) handleChannelOpen(packet []byte) error {
 }
 
 func (m *mux) OpenChannel(chanType string, extra []byte) (Channel, <-chan *Request, error) {
-	ch, err := m.openChannel(chanType, extra)
+	return m.OpenChannelWithOptions(chanType, extra, ChannelOptions{})
+}
+
+func (m *mux) OpenChannelWithOptions(chanType string, extra []byte, opts ChannelOptions) (Channel, <-chan *Request, error) {
+	ch, err := m.openChannel(chanType, extra, opts)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -309,10 +600,37 @@ func (m *mux) OpenChannel(chanType string, extra []byte) (Channel, <-chan *Reque
 	return ch, ch.incomingRequests, nil
 }
 
-func (m *mux) openChannel(chanType string, extra []byte) (*channel, error) {
+func (m *mux) OpenChannelContext(ctx context.Context, chanType string, extra []byte) (Channel, <-chan *Request, error) {
+	ch, err := m.openChannelContext(ctx, chanType, extra, ChannelOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ch, ch.incomingRequests, nil
+}
+
+func (m *mux) openChannel(chanType string, extra []byte, opts ChannelOptions) (*channel, error) {
+	return m.openChannelContext(context.Background(), chanType, extra, opts)
+}
+
+func (m *mux) openChannelContext(ctx context.Context, chanType string, extra []byte, opts ChannelOptions) (*channel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	window, maxPacketSize, err := opts.values()
+	if err != nil {
+		return nil, err
+	}
 	ch := m.newChannel(chanType, channelOutbound, extra)
+	if ch == nil {
+		if m.chanList.isClosed() {
+			return nil, m.Wait()
+		}
+		return nil, fmt.Errorf("ssh: cannot open more than %d channels", m.maxChannels)
+	}
 
-	ch.maxIncomingPayload = channelMaxPacket
+	ch.myWindow, ch.windowSize = window, window
+	ch.maxIncomingPayload = maxPacketSize
 
 	open := channelOpenMsg{
 		ChanType:         chanType,
@@ -325,11 +643,26 @@ func (m *mux) openChannel(chanType string, extra []byte) (*channel, error) {
 		return nil, err
 	}
 
-	switch msg := (<-ch.msg).(type) {
+	var resp interface{}
+	var ok bool
+	select {
+	case resp, ok = <-ch.msg:
+		if !ok {
+			// The connection ended before the peer responded.
+			return nil, m.Wait()
+		}
+	case <-ctx.Done():
+		// The channel keeps its local ID until the peer responds, so
+		// that a late confirmation is not mistaken for one of a
+		// later channel.
+		ch.abandon()
+		return nil, ctx.Err()
+	}
+	switch msg := resp.(type) {
 	case *channelOpenConfirmMsg:
 		return ch, nil
 	case *channelOpenFailureMsg:
-		return nil, &OpenChannelError{msg.Reason, msg.Message}
+		return nil, &OpenChannelError{Reason: msg.Reason, Message: msg.Message, Language: msg.Language}
 	default:
 		return nil, fmt.Errorf("ssh: unexpected packet in response to channel open: %T", msg)
 	}
@@ -352,6 +685,20 @@ func (m *mux) handleUnknownChannelPacket(id uint32, packet []byte) error {
 		}
 		return nil
 	default:
-		return fmt.Errorf("ssh: invalid channel %d", id)
+		// The channel was never opened, or the peer has already
+		// closed it.
+		return m.protocolError("message %d for unknown channel %d", packet[0], id)
+	}
+}
+
+// protocolError sends an SSH_MSG_DISCONNECT with DisconnectProtocolError
+// to the peer, and returns it as the *DisconnectError that ends the mux
+// loop.
+func (m *mux) protocolError(format string, args ...interface{}) error {
+	disc := &DisconnectError{
+		Reason:  DisconnectProtocolError,
+		Message: fmt.Sprintf(format, args...),
 	}
+	m.sendMessage(disconnectMsg{Reason: uint32(disc.Reason), Message: disc.Message})
+	return disc
 }
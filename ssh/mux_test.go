@@ -5,11 +5,16 @@
 package ssh
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func muxPair() (*mux, *mux) {
@@ -49,7 +54,7 @@ func channelPair(t *testing.T) (*channel, *channel, *mux) {
 		res <- ch.(*channel)
 	}()
 
-	ch, err := c.openChannel("chan", nil)
+	ch, err := c.openChannel("chan", nil, ChannelOptions{})
 	if err != nil {
 		t.Fatalf("OpenChannel: %v", err)
 	}
@@ -286,7 +291,7 @@ func TestMuxReject(t *testing.T) {
 		ch.Reject(RejectionReason(42), "message")
 	}()
 
-	ch, err := client.openChannel("ch", []byte("extra"))
+	ch, err := client.openChannel("ch", []byte("extra"), ChannelOptions{})
 	if ch != nil {
 		t.Fatal("openChannel not rejected")
 	}
@@ -294,8 +299,8 @@ func TestMuxReject(t *testing.T) {
 	ocf, ok := err.(*OpenChannelError)
 	if !ok {
 		t.Errorf("got %#v want *OpenChannelError", err)
-	} else if ocf.Reason != 42 || ocf.Message != "message" {
-		t.Errorf("got %#v, want {Reason: 42, Message: %q}", ocf, "message")
+	} else if ocf.Reason != 42 || ocf.Message != "message" || ocf.Language != "en" {
+		t.Errorf("got %#v, want {Reason: 42, Message: %q, Language: %q}", ocf, "message", "en")
 	}
 
 	want := "ssh: rejected: unknown reason 42 (message)"
@@ -304,6 +309,34 @@ func TestMuxReject(t *testing.T) {
 	}
 }
 
+func TestMuxRejectWithLang(t *testing.T) {
+	client, server := muxPair()
+	defer server.Close()
+	defer client.Close()
+
+	extra := Marshal(&channelOpenDirectMsg{"example.com", 80, "127.0.0.1", 1234})
+	go func() {
+		ch, ok := <-server.incomingChannels
+		if !ok {
+			t.Error("cannot accept channel")
+			return
+		}
+		if !bytes.Equal(ch.ExtraData(), extra) {
+			t.Errorf("got extra data %q, want %q", ch.ExtraData(), extra)
+		}
+		ch.(LanguageNewChannel).RejectWithLang(Prohibited, "verboten", "de")
+	}()
+
+	_, err := client.openChannel("direct-tcpip", extra, ChannelOptions{})
+	var ocf *OpenChannelError
+	if !errors.As(err, &ocf) {
+		t.Fatalf("got %v, want *OpenChannelError", err)
+	}
+	if ocf.Reason != Prohibited || ocf.Message != "verboten" || ocf.Language != "de" {
+		t.Errorf("got %#v, want {Reason: Prohibited, Message: %q, Language: %q}", ocf, "verboten", "de")
+	}
+}
+
 func TestMuxChannelRequest(t *testing.T) {
 	client, server, mux := channelPair(t)
 	defer server.Close()
@@ -554,7 +587,7 @@ func TestMuxClosedChannel(t *testing.T) {
 	}()
 
 	// Open a channel.
-	ch, err := client.openChannel("chan", nil)
+	ch, err := client.openChannel("chan", nil, ChannelOptions{})
 	if err != nil {
 		t.Fatalf("OpenChannel: %v", err)
 	}
@@ -647,6 +680,151 @@ func TestMuxGlobalRequestUnblock(t *testing.T) {
 	}
 }
 
+func TestMuxGlobalRequestContext(t *testing.T) {
+	clientMux, serverMux := muxPair()
+	defer serverMux.Close()
+	defer clientMux.Close()
+
+	go func() {
+		for r := range serverMux.incomingRequests {
+			if r.Type == "slow" {
+				// Delay the reply past the client's deadline.
+				time.Sleep(100 * time.Millisecond)
+			}
+			r.Reply(r.Type != "slow", []byte(r.Type))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := clientMux.SendRequestContext(ctx, "slow", true, nil); err != context.DeadlineExceeded {
+		t.Fatalf("SendRequestContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The late reply to "slow" must not be taken as the reply to the
+	// next request.
+	ok, data, err := clientMux.SendRequestContext(context.Background(), "fast", true, nil)
+	if err != nil || !ok || string(data) != "fast" {
+		t.Errorf("SendRequestContext(\"fast\"): %v %q %v", ok, data, err)
+	}
+}
+
+func TestMuxOpenChannelContext(t *testing.T) {
+	clientMux, serverMux := muxPair()
+	defer serverMux.Close()
+	defer clientMux.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := clientMux.OpenChannelContext(ctx, "slow", nil); err != context.DeadlineExceeded {
+		t.Fatalf("OpenChannelContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Confirm the abandoned channel late: the client must close it
+	// and then release its ID.
+	newCh := <-serverMux.incomingChannels
+	ch, _, err := newCh.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if _, err := ch.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read on the abandoned channel: got %v, want io.EOF", err)
+	}
+	ch.Close()
+	waitReleased := func() {
+		deadline := time.Now().Add(time.Second)
+		for clientMux.chanList.count() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("abandoned channel still registered")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitReleased()
+
+	// A rejection that arrives late releases the ID too.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := clientMux.OpenChannelContext(ctx, "slow", nil); err != context.DeadlineExceeded {
+		t.Fatalf("OpenChannelContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	(<-serverMux.incomingChannels).Reject(Prohibited, "too late")
+	waitReleased()
+
+	go func() {
+		for newCh := range serverMux.incomingChannels {
+			newCh.Accept()
+		}
+	}()
+	fast, _, err := clientMux.OpenChannelContext(context.Background(), "fast", nil)
+	if err != nil {
+		t.Fatalf("OpenChannelContext: %v", err)
+	}
+	if id := fast.(*channel).localId; id != 0 {
+		t.Errorf("got local ID %d for the new channel, want the released ID 0", id)
+	}
+}
+
+func TestMuxOpenChannelConnClosed(t *testing.T) {
+	clientMux, serverMux := muxPair()
+	defer serverMux.Close()
+	defer clientMux.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := clientMux.OpenChannel("unanswered", nil)
+		errc <- err
+	}()
+
+	// The server never answers; the transport fails under the pending
+	// open instead.
+	<-serverMux.incomingChannels
+	serverMux.conn.Close()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenChannel did not return after the connection closed")
+	}
+	if err == nil {
+		t.Fatal("OpenChannel succeeded on a closed connection")
+	}
+	if want := clientMux.Wait(); err != want {
+		t.Errorf("OpenChannel: got %v, want the connection error %v", err, want)
+	}
+
+	// Opening after the shutdown fails the same way.
+	if _, _, err := clientMux.OpenChannel("late", nil); err != clientMux.Wait() {
+		t.Errorf("OpenChannel after close: got %v, want %v", err, clientMux.Wait())
+	}
+}
+
+func TestMuxGlobalRequestConcurrent(t *testing.T) {
+	clientMux, serverMux := muxPair()
+	defer serverMux.Close()
+	defer clientMux.Close()
+
+	go func() {
+		for r := range serverMux.incomingRequests {
+			r.Reply(true, []byte(r.Type))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			ok, data, err := clientMux.SendRequest(name, true, nil)
+			if err != nil || !ok || string(data) != name {
+				t.Errorf("SendRequest(%q): %v %q %v", name, ok, data, err)
+			}
+		}(fmt.Sprintf("req%d", i))
+	}
+	wg.Wait()
+}
+
 func TestMuxChannelRequestUnblock(t *testing.T) {
 	a, b, connB := channelPair(t)
 	defer a.Close()
@@ -668,6 +846,55 @@ func TestMuxChannelRequestUnblock(t *testing.T) {
 	}
 }
 
+func TestMuxChannelRequestContext(t *testing.T) {
+	a, b, connB := channelPair(t)
+	defer a.Close()
+	defer b.Close()
+	defer connB.Close()
+
+	release := make(chan struct{})
+	go func() {
+		for r := range b.incomingRequests {
+			if r.Type == "slow" {
+				// Hold the reply past the sender's deadline.
+				<-release
+			}
+			r.Reply(r.Type != "slow", nil)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.SendRequestContext(ctx, "slow", true, nil); err != context.DeadlineExceeded {
+		t.Fatalf("SendRequestContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+
+	// The late failure reply to "slow" must not be taken as the reply
+	// to the next request.
+	ok, err := a.SendRequestContext(context.Background(), "fast", true, nil)
+	if err != nil || !ok {
+		t.Errorf("SendRequestContext(\"fast\"): %v %v", ok, err)
+	}
+}
+
+func TestMuxChannelRequestContextWaiting(t *testing.T) {
+	a, b, connB := channelPair(t)
+	defer a.Close()
+	defer b.Close()
+	defer connB.Close()
+
+	// Leave the first request unanswered; the second must give up
+	// waiting for its turn once its context is done.
+	go a.SendRequest("first", true, nil)
+	<-b.incomingRequests
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.SendRequestContext(ctx, "second", true, nil); err != context.DeadlineExceeded {
+		t.Errorf("SendRequestContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
 func TestMuxCloseChannel(t *testing.T) {
 	r, w, mux := channelPair(t)
 	defer mux.Close()
@@ -757,6 +984,98 @@ func TestZeroWindowAdjust(t *testing.T) {
 	}
 }
 
+func TestWindowAdjustOverflow(t *testing.T) {
+	clientPipe, serverPipe := memPipe()
+	client := newMux(clientPipe)
+	defer serverPipe.Close()
+	defer client.Close()
+
+	go client.openChannel("chan", nil, ChannelOptions{})
+	packet, err := serverPipe.readPacket()
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	var openMsg channelOpenMsg
+	if err := Unmarshal(packet, &openMsg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	// The adjustments add up to exactly 2^32-1 bytes, and then one more.
+	for _, msg := range []interface{}{
+		channelOpenConfirmMsg{
+			PeersID:       openMsg.PeersID,
+			MyWindow:      1 << 31,
+			MaxPacketSize: channelMaxPacket,
+		},
+		windowAdjustMsg{PeersID: openMsg.PeersID, AdditionalBytes: 1<<31 - 2},
+		windowAdjustMsg{PeersID: openMsg.PeersID, AdditionalBytes: 1},
+		windowAdjustMsg{PeersID: openMsg.PeersID, AdditionalBytes: 1},
+	} {
+		if err := serverPipe.writePacket(Marshal(msg)); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+
+	packet, err = serverPipe.readPacket()
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	var disc disconnectMsg
+	if err := Unmarshal(packet, &disc); err != nil {
+		t.Fatalf("got packet type %d, want a disconnect: %v", packet[0], err)
+	}
+	if DisconnectReason(disc.Reason) != DisconnectProtocolError {
+		t.Errorf("got disconnect reason %v, want %v", DisconnectReason(disc.Reason), DisconnectProtocolError)
+	}
+
+	var discErr *DisconnectError
+	if err := client.Wait(); !errors.As(err, &discErr) || discErr.Reason != DisconnectProtocolError {
+		t.Errorf("got %v, want a protocol error disconnect", err)
+	}
+}
+
+func TestMuxChannelStats(t *testing.T) {
+	writer, reader, mux := channelPair(t)
+	defer writer.Close()
+	defer reader.Close()
+	defer mux.Close()
+
+	data := make([]byte, 3*channelWindowSize)
+	go func() {
+		if _, err := writer.Write(data); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+	}()
+	if _, err := io.ReadFull(reader, make([]byte, len(data))); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	// The reply is sent after the window adjustments, so once it is read
+	// the writer has seen them all.
+	if _, err := reader.Write([]byte{1}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(writer, make([]byte, 1)); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	ws, rs := writer.Stats(), reader.Stats()
+	if ws.BytesWritten != uint64(len(data)) || rs.BytesRead != uint64(len(data)) {
+		t.Errorf("got %d bytes written and %d read, want %d", ws.BytesWritten, rs.BytesRead, len(data))
+	}
+	if ws.BytesRead != 1 || rs.BytesWritten != 1 {
+		t.Errorf("got %d bytes written and %d read in reply, want 1", rs.BytesWritten, ws.BytesRead)
+	}
+	if rs.WindowAdjustsSent == 0 || rs.WindowAdjustsSent != ws.WindowAdjustsReceived {
+		t.Errorf("got %d window adjustments sent and %d received", rs.WindowAdjustsSent, ws.WindowAdjustsReceived)
+	}
+	if ws.RemoteWindow != rs.LocalWindow {
+		t.Errorf("writer's remote window %d differs from reader's local window %d", ws.RemoteWindow, rs.LocalWindow)
+	}
+	if rs.RemoteWindow != channelWindowSize-1 {
+		t.Errorf("got reader's remote window %d, want %d", rs.RemoteWindow, channelWindowSize-1)
+	}
+}
+
 func TestMuxMaxPacketSize(t *testing.T) {
 	a, b, mux := channelPair(t)
 	defer a.Close()
@@ -826,6 +1145,228 @@ func TestMuxChannelWindowDeferredUpdates(t *testing.T) {
 }
 
 // Don't ship code with debug=true.
+func TestMuxChannelDeadlines(t *testing.T) {
+	reader, writer, mux := channelPair(t)
+	defer reader.Close()
+	defer writer.Close()
+	defer mux.Close()
+
+	// Reads time out, and the channel remains usable.
+	reader.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	buf := make([]byte, 10)
+	_, err := reader.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read: got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Read: error %v is not a timeout", err)
+	}
+	if _, err := reader.Stderr().Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Stderr().Read: got %v, want os.ErrDeadlineExceeded", err)
+	}
+	reader.SetReadDeadline(time.Time{})
+	if _, err := writer.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n, err := reader.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read: got %q, %v, want %q", buf[:n], err, "hello")
+	}
+
+	// Buffered data is returned even after the deadline.
+	if _, err := writer.Write([]byte("world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := reader.Read(buf[:1]); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	reader.SetReadDeadline(time.Now().Add(-time.Second))
+	if n, err := reader.Read(buf); err != nil || string(buf[:n]) != "orld" {
+		t.Fatalf("Read of buffered data: got %q, %v, want %q", buf[:n], err, "orld")
+	}
+	reader.SetReadDeadline(time.Time{})
+
+	// Writes blocked by flow control time out after sending what the
+	// window allows.
+	writer.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	n, err := writer.Write(make([]byte, channelWindowSize+10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write: got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if n != channelWindowSize-10 {
+		t.Errorf("Write: wrote %d bytes, want %d", n, channelWindowSize-10)
+	}
+
+	// Extending the deadline wakes up a blocked writer.
+	writer.SetWriteDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := writer.Write(make([]byte, 1))
+		errc <- err
+	}()
+	writer.remoteWin.waitWriterBlocked()
+	writer.SetWriteDeadline(time.Now())
+	if err := <-errc; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write: got %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	// Once the window opens, writes succeed again.
+	writer.SetWriteDeadline(time.Time{})
+	go func() {
+		_, err := writer.Write([]byte("again"))
+		errc <- err
+	}()
+	if _, err := io.ReadFull(reader, make([]byte, channelWindowSize-10)); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(reader, buf[:5]); err != nil || string(buf[:5]) != "again" {
+		t.Fatalf("Read: got %q, %v, want %q", buf[:5], err, "again")
+	}
+
+	// The net.Conn wrapping forwarded channels uses the deadlines.
+	var conn net.Conn = &chanConn{Channel: reader}
+	if err := conn.SetDeadline(time.Now()); err != nil {
+		t.Fatalf("SetDeadline: %v", err)
+	}
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("chanConn.Read: got %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestMuxChannelCloseGraceful(t *testing.T) {
+	local, remote, mux := channelPair(t)
+	defer local.Close()
+	defer remote.Close()
+	defer mux.Close()
+
+	if _, err := remote.Write([]byte("before")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := local.CloseGraceful(); err != nil {
+		t.Fatalf("CloseGraceful: %v", err)
+	}
+
+	// The remote side sees our EOF, and can still send data.
+	if _, err := io.ReadAll(remote); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if _, err := remote.Write([]byte(" after")); err != nil {
+		t.Fatalf("Write after EOF: %v", err)
+	}
+	if err := remote.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+
+	// None of it is lost by the close on our side.
+	got, err := io.ReadAll(local)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := "before after"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Once we have read the EOF, the channel is closed.
+	for range remote.incomingRequests {
+	}
+	if _, err := remote.SendRequest("hello", false, nil); err == nil {
+		t.Errorf("SendRequest succeeded on closed channel")
+	}
+
+	// If Read has already returned io.EOF, CloseGraceful closes the
+	// channel at once.
+	local, remote, mux = channelPair(t)
+	defer mux.Close()
+	remote.CloseWrite()
+	if _, err := io.ReadAll(local); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := local.CloseGraceful(); err != nil {
+		t.Fatalf("CloseGraceful: %v", err)
+	}
+	for range remote.incomingRequests {
+	}
+}
+
+func TestMuxChannelOptions(t *testing.T) {
+	client, server := muxPair()
+	defer server.Close()
+	defer client.Close()
+
+	serverOpts := ChannelOptions{WindowSize: 1<<32 - 1, MaxPacketSize: 128 * 1024}
+	clientOpts := ChannelOptions{WindowSize: 8 << 20, MaxPacketSize: 64 * 1024}
+
+	accepted := make(chan *channel, 1)
+	go func() {
+		defer close(accepted)
+		newCh, ok := <-server.incomingChannels
+		if !ok {
+			t.Error("no incoming channel")
+			return
+		}
+		optsCh := newCh.(ChannelOptionsNewChannel)
+		if _, _, err := optsCh.AcceptWithOptions(ChannelOptions{MaxPacketSize: 1024}); err == nil {
+			t.Error("AcceptWithOptions accepted a maximum packet size below 32 KiB")
+		}
+		ch, _, err := optsCh.AcceptWithOptions(serverOpts)
+		if err != nil {
+			t.Errorf("AcceptWithOptions: %v", err)
+			return
+		}
+		accepted <- ch.(*channel)
+	}()
+
+	if _, _, err := client.OpenChannelWithOptions("chan", nil, ChannelOptions{WindowSize: 40000, MaxPacketSize: 64 * 1024}); err == nil {
+		t.Error("OpenChannelWithOptions accepted a window smaller than the maximum packet size")
+	}
+	ch, err := client.openChannel("chan", nil, clientOpts)
+	if err != nil {
+		t.Fatalf("openChannel: %v", err)
+	}
+	defer ch.Close()
+	sch := <-accepted
+	if sch == nil {
+		t.FailNow()
+	}
+	defer sch.Close()
+
+	if ch.maxRemotePayload != serverOpts.MaxPacketSize || sch.maxRemotePayload != clientOpts.MaxPacketSize {
+		t.Errorf("got maximum packet sizes %d, %d, want %d, %d", ch.maxRemotePayload, sch.maxRemotePayload, serverOpts.MaxPacketSize, clientOpts.MaxPacketSize)
+	}
+	ch.remoteWin.L.Lock()
+	remoteWin := ch.remoteWin.win
+	ch.remoteWin.L.Unlock()
+	if got := remoteWin; got != serverOpts.WindowSize {
+		t.Errorf("got client window %d, want %d", got, serverOpts.WindowSize)
+	}
+
+	// Send more than the window in both directions, so that the
+	// window is adjusted several times.
+	data := make([]byte, 3*clientOpts.WindowSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		sch.Write(data)
+		sch.CloseWrite()
+	}()
+	got, err := io.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+	ch.windowMu.Lock()
+	window := ch.myWindow + ch.myConsumed
+	ch.windowMu.Unlock()
+	if window != clientOpts.WindowSize {
+		t.Errorf("got window %d after transfer, want %d", window, clientOpts.WindowSize)
+	}
+}
+
 func TestDebug(t *testing.T) {
 	if debugMux {
 		t.Error("mux debug switched on")
@@ -837,3 +1378,410 @@ func TestDebug(t *testing.T) {
 		t.Error("transport debug switched on")
 	}
 }
+
+func TestMaxChannels(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.MaxChannels = 2
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverConn := make(chan *ServerConn, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			serverConn <- nil
+			return
+		}
+		serverConn <- conn
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			if newCh.ChannelType() == "reject" {
+				newCh.Reject(Prohibited, "rejected")
+				continue
+			}
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go DiscardRequests(in)
+			go func() {
+				io.Copy(io.Discard, ch)
+				ch.Close()
+			}()
+		}
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	client, _, _, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer client.Close()
+	server := <-serverConn
+	if server == nil {
+		t.FailNow()
+	}
+	waitChannels := func(conn Conn, want int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); conn.(ChannelCountConn).NumChannels() != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d channels, want %d", conn.(ChannelCountConn).NumChannels(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A rejected channel stops counting at once.
+	if _, _, err := client.OpenChannel("reject", nil); err == nil {
+		t.Fatal("OpenChannel(reject) succeeded")
+	}
+	waitChannels(client, 0)
+	waitChannels(server.Conn, 0)
+
+	var chans []Channel
+	for i := 0; i < 2; i++ {
+		ch, _, err := client.OpenChannel("ch", nil)
+		if err != nil {
+			t.Fatalf("OpenChannel %d: %v", i, err)
+		}
+		chans = append(chans, ch)
+	}
+	waitChannels(client, 2)
+	waitChannels(server.Conn, 2)
+
+	// The server refuses a third channel.
+	_, _, err = client.OpenChannel("ch", nil)
+	var openErr *OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ResourceShortage {
+		t.Fatalf("got %v, want a ResourceShortage rejection", err)
+	}
+
+	// Once a channel is closed, another one can be opened.
+	chans[0].Close()
+	waitChannels(client, 1)
+	waitChannels(server.Conn, 1)
+	if _, _, err := client.OpenChannel("ch", nil); err != nil {
+		t.Fatalf("OpenChannel after Close: %v", err)
+	}
+
+	// The limit applies to channels opened locally, too.
+	_, _, err = server.OpenChannel("from-server", nil)
+	if err == nil || errors.As(err, &openErr) {
+		t.Errorf("got %v, want the local channel limit error", err)
+	}
+}
+
+func TestConnChannels(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	client, server, chans, reqs, err := NewPipeClientServer(clientConf, serverConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	defer client.Close()
+	go DiscardRequests(reqs)
+
+	// The server accepts the first channel and never reads its
+	// requests, and leaves the second one unanswered.
+	accepted := make(chan struct{})
+	go func() {
+		newCh := <-chans
+		if _, _, err := newCh.Accept(); err != nil {
+			t.Errorf("Accept: %v", err)
+		}
+		close(accepted)
+		<-chans
+	}()
+	ch, _, err := client.OpenChannel("stuck", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	<-accepted
+	for i := 0; i < 2; i++ {
+		if _, err := ch.SendRequest("unread", false, nil); err != nil {
+			t.Fatalf("SendRequest: %v", err)
+		}
+	}
+	go client.OpenChannel("unanswered", nil)
+
+	var serverChans, clientChans []ChannelInfo
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		serverChans = server.Conn.(ChannelsConn).Channels()
+		clientChans = client.Conn.(ChannelsConn).Channels()
+		if len(serverChans) == 2 && serverChans[0].PendingRequests == 2 && len(clientChans) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got server channels %+v and client channels %+v", serverChans, clientChans)
+		}
+	}
+
+	stuck, clientStuck := serverChans[0], clientChans[0]
+	if stuck.Type != "stuck" || !stuck.Inbound || stuck.Opening || stuck.LocalID != clientStuck.RemoteID || stuck.RemoteID != clientStuck.LocalID {
+		t.Errorf("server reports %+v for the client's %+v", stuck, clientStuck)
+	}
+	if clientStuck.Inbound || clientStuck.Opening || clientStuck.PendingRequests != 0 {
+		t.Errorf("client reports %+v for its accepted channel", clientStuck)
+	}
+	if got := clientChans[1]; got.Type != "unanswered" || !got.Opening || got.Inbound {
+		t.Errorf("client reports %+v for its unanswered channel", got)
+	}
+}
+
+func TestChannelDisconnectError(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		go DiscardRequests(reqs)
+		newCh := <-chans
+		if _, _, err := newCh.Accept(); err != nil {
+			serverDone <- err
+			return
+		}
+		serverDone <- conn.Conn.(*connection).transport.writePacket(Marshal(&disconnectMsg{
+			Reason:  uint32(DisconnectTooManyConnections),
+			Message: "too many connections",
+		}))
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	conn, _, reqs, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	go DiscardRequests(reqs)
+	ch, _, err := conn.OpenChannel("chan", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	if err := <-serverDone; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	// Reads end with a plain io.EOF, so io.Copy reports success.
+	if n, err := io.Copy(io.Discard, ch); n != 0 || err != nil {
+		t.Errorf("io.Copy: got %d, %v, want 0, nil", n, err)
+	}
+	if _, err := ch.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read: got %v, want io.EOF", err)
+	}
+
+	waitErr := conn.Wait()
+	_, writeErr := ch.Write([]byte("x"))
+	for name, err := range map[string]error{"Wait": waitErr, "Write": writeErr} {
+		var d *DisconnectError
+		if !errors.As(err, &d) {
+			t.Errorf("%s: got %v, want a *DisconnectError", name, err)
+		} else if d.Reason != DisconnectTooManyConnections {
+			t.Errorf("%s: got reason %v, want %v", name, d.Reason, DisconnectTooManyConnections)
+		}
+	}
+	if !errors.Is(writeErr, io.EOF) {
+		t.Errorf("Write: got %v, want an error matching io.EOF", writeErr)
+	}
+}
+
+// checkDisconnect checks that m ends with a disconnect for reason.
+func checkDisconnect(t *testing.T, m *mux, reason DisconnectReason) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- m.Wait() }()
+	select {
+	case err := <-done:
+		var d *DisconnectError
+		if !errors.As(err, &d) || d.Reason != reason {
+			t.Errorf("got %v, want a disconnect for reason %v", err, reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mux did not stop")
+	}
+}
+
+func TestMuxDesync(t *testing.T) {
+	t.Run("confirm for unallocated channel", func(t *testing.T) {
+		local, peer := muxPair()
+		defer local.Close()
+		defer peer.Close()
+		peer.sendMessage(channelOpenConfirmMsg{PeersID: 5, MyID: 7, MyWindow: 1024, MaxPacketSize: 1024})
+		checkDisconnect(t, local, DisconnectProtocolError)
+	})
+
+	t.Run("duplicate confirm", func(t *testing.T) {
+		local, peer := muxPair()
+		defer local.Close()
+		defer peer.Close()
+		go func() {
+			for newCh := range peer.incomingChannels {
+				newCh.Accept()
+			}
+		}()
+		ch, err := local.openChannel("chan", nil, ChannelOptions{})
+		if err != nil {
+			t.Fatalf("openChannel: %v", err)
+		}
+		peer.sendMessage(channelOpenConfirmMsg{PeersID: ch.localId, MyID: 7, MyWindow: 1024, MaxPacketSize: 1024})
+		checkDisconnect(t, local, DisconnectProtocolError)
+	})
+
+	t.Run("data after close", func(t *testing.T) {
+		local, peer := muxPair()
+		defer local.Close()
+		defer peer.Close()
+		go func() {
+			for newCh := range peer.incomingChannels {
+				ch, _, _ := newCh.Accept()
+				ch.Close()
+			}
+		}()
+		ch, err := local.openChannel("chan", nil, ChannelOptions{})
+		if err != nil {
+			t.Fatalf("openChannel: %v", err)
+		}
+		io.Copy(io.Discard, ch)
+		for local.chanList.count() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		peer.sendMessage(channelDataMsg{PeersID: ch.localId, Length: 1, Rest: []byte("x")})
+		checkDisconnect(t, local, DisconnectProtocolError)
+	})
+
+	t.Run("open reusing an open channel's ID", func(t *testing.T) {
+		local, peer := muxPair()
+		defer local.Close()
+		defer peer.Close()
+		go func() {
+			for newCh := range local.incomingChannels {
+				newCh.Accept()
+			}
+		}()
+		ch, err := peer.openChannel("chan", nil, ChannelOptions{})
+		if err != nil {
+			t.Fatalf("openChannel: %v", err)
+		}
+		peer.sendMessage(channelOpenMsg{
+			ChanType:      "chan",
+			PeersID:       ch.localId,
+			PeersWindow:   1024,
+			MaxPacketSize: 1024,
+		})
+		checkDisconnect(t, local, DisconnectProtocolError)
+	})
+}
+
+// FuzzMuxPacket feeds a packet from the peer to a mux with an open
+// channel, which must not panic: the packet is either handled, or ends
+// the connection.
+func FuzzMuxPacket(f *testing.F) {
+	for _, msg := range []interface{}{
+		channelOpenConfirmMsg{PeersID: 0, MyID: 1, MyWindow: 1024, MaxPacketSize: 1024},
+		channelOpenConfirmMsg{PeersID: 1, MyID: 1, MyWindow: 1024, MaxPacketSize: 1024},
+		channelOpenFailureMsg{PeersID: 0, Reason: Prohibited},
+		channelDataMsg{PeersID: 0, Length: 1, Rest: []byte("x")},
+		channelDataMsg{PeersID: 9, Length: 1, Rest: []byte("x")},
+		channelEOFMsg{PeersID: 0},
+		channelCloseMsg{PeersID: 3},
+		windowAdjustMsg{PeersID: 0, AdditionalBytes: 1 << 31},
+		channelRequestMsg{PeersID: 4, Request: "x", WantReply: true},
+		channelOpenMsg{ChanType: "chan", PeersID: 0, PeersWindow: 1024, MaxPacketSize: 1024},
+	} {
+		f.Add(Marshal(msg))
+	}
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if len(packet) == 0 {
+			return
+		}
+		local, peer := muxPair()
+		defer local.Close()
+		defer peer.Close()
+		go func() {
+			for newCh := range peer.incomingChannels {
+				newCh.Accept()
+			}
+		}()
+		go func() {
+			for newCh := range local.incomingChannels {
+				newCh.Reject(Prohibited, "")
+			}
+		}()
+		go DiscardRequests(local.incomingRequests)
+		ch, err := local.openChannel("chan", nil, ChannelOptions{})
+		if err != nil {
+			t.Fatalf("openChannel: %v", err)
+		}
+		go DiscardRequests(ch.incomingRequests)
+		go io.Copy(io.Discard, ch)
+		peer.conn.writePacket(packet)
+	})
+}
+
+func TestMuxMaxPendingGlobalRequests(t *testing.T) {
+	a, b := memPipe()
+	peer := newMux(a)
+	local := newMuxWithOptions(b, muxOptions{maxPendingRequests: 2})
+	defer peer.Close()
+	defer local.Close()
+
+	// Requests that are replied to don't count.
+	go func() {
+		for i := 0; i < 5; i++ {
+			peer.SendRequest("ok", true, nil)
+		}
+		peer.SendRequest("held", false, nil)
+		// Two pending requests are allowed, but not a third.
+		for i := 0; i < 3; i++ {
+			go peer.SendRequest("held", true, nil)
+		}
+	}()
+	next := func() *Request {
+		t.Helper()
+		r, ok := <-local.incomingRequests
+		if !ok {
+			t.Fatalf("mux stopped early: %v", local.Wait())
+		}
+		return r
+	}
+	for i := 0; i < 5; i++ {
+		r := next()
+		r.Reply(true, nil)
+		// Replying twice must not count twice.
+		r.Reply(true, nil)
+	}
+	if r := next(); r.WantReply {
+		t.Fatal("got a request wanting a reply, want the one without")
+	}
+	next()
+	next()
+	checkDisconnect(t, local, DisconnectByApplication)
+}
@@ -0,0 +1,71 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"io"
+	"net"
+)
+
+// NewPipeClientServer connects a client and a server over an in-memory
+// connection built on net.Pipe, and runs the handshake with the given
+// configurations, which may restrict the algorithms to test their
+// negotiation. It returns the client, the server side of the connection,
+// and the channels of incoming channels and requests that would be
+// returned by NewServerConn, which the caller must service.
+//
+// If either side of the handshake fails, both ends are closed and the
+// error is returned. Closing the client or the server closes the pipe,
+// and causes the goroutines of both sides to return.
+func NewPipeClientServer(clientConfig *ClientConfig, serverConfig *ServerConfig) (*Client, *ServerConn, <-chan NewChannel, <-chan *Request, error) {
+	c1, c2 := bufferedPipe()
+
+	type serverResult struct {
+		conn  *ServerConn
+		chans <-chan NewChannel
+		reqs  <-chan *Request
+		err   error
+	}
+	done := make(chan serverResult, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c2, serverConfig)
+		done <- serverResult{conn, chans, reqs, err}
+	}()
+
+	// A side that fails closes its end, which ends the handshake of
+	// the other.
+	conn, chans, reqs, err := NewClientConn(c1, "pipe", clientConfig)
+	if err != nil {
+		<-done
+		return nil, nil, nil, nil, err
+	}
+	res := <-done
+	if res.err != nil {
+		conn.Close()
+		return nil, nil, nil, nil, res.err
+	}
+	return NewClient(conn, chans, reqs), res.conn, res.chans, res.reqs, nil
+}
+
+// bufferedPipe returns the ends of an in-memory connection. Writes to a
+// net.Pipe block until the peer reads them, so the two sides would
+// deadlock writing their version lines at the same time; here a
+// goroutine in each direction takes the data off the writer. Once
+// either end is closed, the other reads what was sent before and then
+// io.EOF, and the goroutines return.
+func bufferedPipe() (net.Conn, net.Conn) {
+	c1, p1 := net.Pipe()
+	p2, c2 := net.Pipe()
+	relay := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		// Keep the writer from blocking until the relay in the
+		// other direction closes src.
+		io.Copy(io.Discard, src)
+	}
+	go relay(p2, p1)
+	go relay(p1, p2)
+	return c1, c2
+}
@@ -0,0 +1,88 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNewPipeClientServer(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverConf.Ciphers = []string{"aes128-ctr", "chacha20-poly1305@openssh.com"}
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.Ciphers = []string{"chacha20-poly1305@openssh.com"}
+
+	client, server, chans, reqs, err := NewPipeClientServer(clientConf, serverConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	defer client.Close()
+	go DiscardRequests(reqs)
+	go func() {
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go DiscardRequests(in)
+			go func() {
+				io.Copy(ch, ch)
+				ch.CloseWrite()
+			}()
+		}
+	}()
+
+	algs := server.Conn.(AlgorithmsConnMetadata).Algorithms()
+	if algs.Read.Cipher != "chacha20-poly1305@openssh.com" {
+		t.Errorf("got cipher %q, want the only one the client allows", algs.Read.Cipher)
+	}
+
+	ch, in, err := client.OpenChannel("echo", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(in)
+	want := []byte("hello over the pipe")
+	if _, err := ch.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	ch.CloseWrite()
+	got, err := io.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Closing one side ends the other.
+	client.Close()
+	if err := server.Wait(); err == nil {
+		t.Errorf("server Wait returned nil after the client closed")
+	}
+}
+
+func TestNewPipeClientServerHandshakeError(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverConf.Ciphers = []string{"aes128-ctr"}
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.Ciphers = []string{"aes256-ctr"}
+
+	_, _, _, _, err := NewPipeClientServer(clientConf, serverConf)
+	if err == nil || !strings.Contains(err.Error(), "no common algorithm") {
+		t.Fatalf("NewPipeClientServer: got %v, want a negotiation error", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Server.Serve after a call to
+// Server.Shutdown.
+var ErrServerClosed = errors.New("ssh: Server closed")
+
+// A Server accepts SSH connections on listeners and hands them to a
+// handler, and can be shut down gracefully, like net/http.Server.
+type Server struct {
+	// Config is the configuration of the connections.
+	Config *ServerConfig
+
+	// Handler is called in its own goroutine for each connection that
+	// completes the handshake, with the values returned by
+	// NewServerConn. The connection is closed when Handler returns.
+	Handler func(conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*trackedConn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// trackedConn is a connection of a Server. sc is nil until the
+// handshake has completed, and ending is set once Shutdown has started
+// to end the connection.
+type trackedConn struct {
+	nc     net.Conn
+	sc     *ServerConn
+	ending bool
+}
+
+// Serve accepts connections on l, running the handshake and then
+// Handler for each in a new goroutine, until l fails or Shutdown is
+// called. It always returns a non-nil error, and closes l; after
+// Shutdown it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		tc := &trackedConn{nc: nc}
+		if !s.trackConn(tc, true) {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(tc)
+	}
+}
+
+func (s *Server) serveConn(tc *trackedConn) {
+	defer s.wg.Done()
+	defer s.trackConn(tc, false)
+
+	sc, chans, reqs, err := NewServerConn(tc.nc, s.Config)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+
+	s.mu.Lock()
+	tc.sc = sc
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		// Shutdown started during the handshake; don't hand the
+		// connection to Handler.
+		disconnect(sc)
+		return
+	}
+	s.Handler(sc, chans, reqs)
+}
+
+// Shutdown stops the server gracefully. It closes all listeners, ends
+// the connections that have not completed their handshake, and sends
+// an SSH_MSG_DISCONNECT with DisconnectByApplication to, and closes,
+// the connections without an open channel. It then waits for the
+// remaining connections to become idle, ending them too, and for all
+// Handler calls to return, or for ctx to be done, in which case it
+// returns ctx.Err() and leaves the busy connections open. New
+// connections are refused once Shutdown is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	const pollInterval = 50 * time.Millisecond
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		s.closeIdle()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdle ends the connections that are still in their handshake or
+// have no open channels.
+func (s *Server) closeIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tc := range s.conns {
+		switch {
+		case tc.ending:
+		case tc.sc == nil:
+			tc.ending = true
+			tc.nc.Close()
+		case tc.sc.Conn.(ChannelCountConn).NumChannels() == 0:
+			// The write may block on a client that doesn't read.
+			tc.ending = true
+			go disconnect(tc.sc)
+		}
+	}
+}
+
+// disconnect sends an SSH_MSG_DISCONNECT to the client of sc, and closes
+// the connection.
+func disconnect(sc *ServerConn) {
+	if c, ok := sc.Conn.(*connection); ok {
+		c.transport.writePacket(Marshal(&disconnectMsg{
+			Reason:  uint32(DisconnectByApplication),
+			Message: "server shutting down",
+		}))
+	}
+	sc.Close()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes l. It returns false if l cannot be
+// added because the server is shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes tc. Adding it counts it in s.wg, and fails
+// if the server is shutting down.
+func (s *Server) trackConn(tc *trackedConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, tc)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*trackedConn]struct{})
+	}
+	s.conns[tc] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
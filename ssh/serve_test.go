@@ -0,0 +1,130 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T) (*Server, string, <-chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	conf := &ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(testSigners["rsa"])
+	s := &Server{
+		Config: conf,
+		Handler: func(conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+			go DiscardRequests(reqs)
+			for newCh := range chans {
+				ch, in, err := newCh.Accept()
+				if err != nil {
+					continue
+				}
+				go DiscardRequests(in)
+				go func() {
+					io.Copy(io.Discard, ch)
+					ch.Close()
+				}()
+			}
+		},
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(l)
+	}()
+	return s, l.Addr().String(), serveErr
+}
+
+func dialTestServer(t *testing.T, addr string) *Client {
+	client, err := Dial("tcp", addr, &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return client
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, addr, serveErr := startTestServer(t)
+
+	busy := dialTestServer(t, addr)
+	defer busy.Close()
+	ch, reqs, err := busy.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(reqs)
+	idle := dialTestServer(t, addr)
+	defer idle.Close()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	// The idle connection is ended at once, with a disconnect message.
+	var discErr *DisconnectError
+	if err := idle.Wait(); !errors.As(err, &discErr) || discErr.Reason != DisconnectByApplication {
+		t.Errorf("idle connection: got %v, want a disconnect", err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Serve: got %v, want %v", err, ErrServerClosed)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("Dial succeeded after Shutdown")
+	}
+
+	// The busy connection keeps working until its channel is closed.
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a channel open", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := ch.Write([]byte("still here")); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+	ch.Close()
+	if err := busy.Wait(); !errors.As(err, &discErr) {
+		t.Errorf("busy connection: got %v, want a disconnect", err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the last channel closed")
+	}
+}
+
+func TestServerShutdownContext(t *testing.T) {
+	s, addr, _ := startTestServer(t)
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	if _, _, err := client.OpenChannel("session", nil); err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The busy connection was left open.
+	if ok, _, err := client.SendRequest("ping", true, nil); ok || err != nil {
+		t.Errorf("SendRequest after Shutdown: got %v, %v", ok, err)
+	}
+}
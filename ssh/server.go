@@ -11,6 +11,9 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 // The Permissions type holds fine-grained permissions that are
@@ -30,21 +33,83 @@ type Permissions struct {
 	// "force-command", by checking them after the SSH handshake
 	// is successful. In general, SSH servers should reject
 	// connections that specify critical options that are unknown
-	// or not supported.
+	// or not supported. See Command for "force-command".
 	CriticalOptions map[string]string
 
 	// Extensions are extra functionality that the server may
 	// offer on authenticated connections. Lack of support for an
 	// extension does not preclude authenticating a user. Common
 	// extensions are "permit-agent-forwarding",
-	// "permit-X11-forwarding". The Go SSH library currently does
-	// not act on any extension, and it is up to server
-	// implementations to honor them. Extensions can be used to
+	// "permit-X11-forwarding". The Go SSH library only acts on
+	// NoTouchRequiredExtension, and it is up to server
+	// implementations to honor the others. Extensions can be used to
 	// pass data from the authentication callbacks to the server
 	// application layer.
 	Extensions map[string]string
 }
 
+// Command returns the command a session should run when the client asks
+// for requested, which is the command of an "exec" request or "" for a
+// "shell" request. If p has a "force-command" critical option, its value
+// is returned instead, otherwise requested is returned unchanged. p may
+// be nil.
+//
+// For user certificates checked by CertChecker.Authenticate, list
+// ForceCommandCriticalOption in CertChecker.SupportedCriticalOptions so
+// that such certificates are accepted, and call Command on
+// ServerConn.Permissions in the handlers of "exec" and "shell" requests.
+// Since Certificate embeds Permissions, cert.Command(requested) can also
+// be used on the certificate directly.
+func (p *Permissions) Command(requested string) string {
+	if p == nil {
+		return requested
+	}
+	if cmd, ok := p.CriticalOptions[ForceCommandCriticalOption]; ok {
+		return cmd
+	}
+	return requested
+}
+
+// Merge returns the Permissions that apply when both p and other do,
+// such as those of a user certificate and of a per-user policy. Either
+// may be nil. Since critical options are restrictions, the result has
+// the critical options of both, and a critical option set to different
+// values in p and other, such as two different "force-command"
+// commands, is an error. The extensions of the result are the union of
+// those of p and other; an extension with different values is an error
+// too. Neither p nor other is modified.
+func (p *Permissions) Merge(other *Permissions) (*Permissions, error) {
+	var merged Permissions
+	for _, q := range []*Permissions{p, other} {
+		if q == nil {
+			continue
+		}
+		var err error
+		if merged.CriticalOptions, err = mergeOptions(merged.CriticalOptions, q.CriticalOptions, "critical option"); err != nil {
+			return nil, err
+		}
+		if merged.Extensions, err = mergeOptions(merged.Extensions, q.Extensions, "extension"); err != nil {
+			return nil, err
+		}
+	}
+	return &merged, nil
+}
+
+// mergeOptions adds the entries of src to dst, allocating dst if
+// needed, and fails if an entry has a different value in each.
+func mergeOptions(dst, src map[string]string, kind string) (map[string]string, error) {
+	for k, v := range src {
+		if old, ok := dst[k]; ok && old != v {
+			return nil, fmt.Errorf("ssh: conflicting values for %s %q", kind, k)
+		}
+		if dst == nil {
+			dst = make(map[string]string)
+		}
+		dst[k] = v
+	}
+	return dst, nil
+}
+
 type GSSAPIWithMICConfig struct {
 	// AllowLogin, must be set, is called when gssapi-with-mic
 	// authentication is selected (RFC 4462 section 3). The srcName is from the
@@ -73,6 +138,8 @@ type ServerConfig struct {
 
 	hostKeys []Signer
 
+	globalRequestHandlers map[string]GlobalRequestHandler
+
 	// NoClientAuth is true if clients are allowed to connect without
 	// authenticating.
 	// To determine NoClientAuth at runtime, set NoClientAuth to true
@@ -89,8 +156,25 @@ type ServerConfig struct {
 	// permitted per connection. If set to a negative number, the number of
 	// attempts are unlimited. If set to zero, the number of attempts are limited
 	// to 6.
+	//
+	// As in OpenSSH, every failed or partially successful attempt counts,
+	// except an initial "none" request. A publickey query for a key that
+	// is then accepted with SSH_MSG_USERAUTH_PK_OK does not count, but a
+	// query for a rejected key does. Once the limit is reached, the
+	// server sends SSH_MSG_DISCONNECT with reason DisconnectProtocolError
+	// and message "too many authentication failures", which is what
+	// OpenSSH sends, and NewServerConn returns the corresponding
+	// *DisconnectError.
 	MaxAuthTries int
 
+	// LoginGraceTime, if positive, bounds the time from the end of the
+	// initial key exchange until user authentication succeeds, however
+	// many messages the authentication exchange takes. If it expires,
+	// the server sends SSH_MSG_DISCONNECT with reason
+	// DisconnectByApplication and closes the connection, and
+	// NewServerConn returns the corresponding *DisconnectError.
+	LoginGraceTime time.Duration
+
 	// PasswordCallback, if non-nil, is called when a user
 	// attempts to authenticate using a password.
 	PasswordCallback func(conn ConnMetadata, password []byte) (*Permissions, error)
@@ -105,6 +189,18 @@ type ServerConfig struct {
 	// Permissions.Extensions entry.
 	PublicKeyCallback func(conn ConnMetadata, key PublicKey) (*Permissions, error)
 
+	// HostBasedCallback, if non-nil, is called for hostbased
+	// authentication (RFC 4252, section 9), once the request's
+	// signature by key has been verified. key is the client host's
+	// key, and may be a *Certificate; clientHost is the host name the
+	// client claims, and clientUser the user name on the client host.
+	// The user to log in as is conn.User(). It must return a nil error
+	// to accept the login, and is responsible for checking that key
+	// belongs to clientHost and that clientHost matches
+	// conn.RemoteAddr(). OpenSSH clients send clientHost as a fully
+	// qualified name with a trailing dot.
+	HostBasedCallback func(conn ConnMetadata, key PublicKey, clientHost, clientUser string) (*Permissions, error)
+
 	// KeyboardInteractiveCallback, if non-nil, is called when
 	// keyboard-interactive authentication is selected (RFC
 	// 4256). The client object's Challenge function should be
@@ -114,29 +210,105 @@ type ServerConfig struct {
 	// unknown.
 	KeyboardInteractiveCallback func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error)
 
+	// UnknownAuthCallback, if non-nil, is called for authentication
+	// requests with a method this package does not implement, which are
+	// otherwise rejected. payload is the method-specific part of the
+	// SSH_MSG_USERAUTH_REQUEST, after the method name. An error counts
+	// as a failed attempt, as with the other callbacks. Since the method
+	// names are unknown, they are not listed in the failure messages
+	// sent to the client.
+	UnknownAuthCallback func(conn ConnMetadata, method string, payload []byte) (*Permissions, error)
+
 	// AuthLogCallback, if non-nil, is called to log all authentication
-	// attempts.
+	// attempts. It is not called for "publickey" queries that find the
+	// key acceptable; see AuthLogInfoCallback.
 	AuthLogCallback func(conn ConnMetadata, method string, err error)
 
+	// AuthLogInfoCallback, if non-nil, is called for every authentication
+	// attempt, including "publickey" queries, with details of the attempt
+	// and its result. For a query, a nil err means that the key would be
+	// accepted.
+	AuthLogInfoCallback func(conn ConnMetadata, info AuthLogInfo, err error)
+
 	// ServerVersion is the version identification string to announce in
 	// the public handshake.
 	// If empty, a reasonable default is used.
-	// Note that RFC 4253 section 4.2 requires that this string start with
-	// "SSH-2.0-".
+	// It must start with "SSH-2.0-" and consist of printable US-ASCII
+	// characters, with no whitespace before an optional comment that
+	// follows a single space (RFC 4253, section 4.2); otherwise
+	// NewServerConn fails without sending it.
 	ServerVersion string
 
 	// BannerCallback, if present, is called and the return string is sent to
 	// the client after key exchange completed but before authentication.
+	// It is called once, on the client's first authentication request, and
+	// the banner is sent with an empty language tag before the reply to
+	// that request. If it returns an empty string, no banner is sent.
 	BannerCallback func(conn ConnMetadata) string
 
 	// GSSAPIWithMICConfig includes gssapi server and callback, which if both non-nil, is used
 	// when gssapi-with-mic authentication is selected (RFC 4462 section 3).
 	GSSAPIWithMICConfig *GSSAPIWithMICConfig
+
+	// AllowMoreSessions, if true, makes the server ignore the
+	// "no-more-sessions@openssh.com" global request, and pass it on like
+	// any other. By default, the server handles the request itself, as
+	// OpenSSH does: once a client has sent it, typically after opening
+	// its session, further "session" channels are rejected with
+	// Prohibited. Other channel types are not affected.
+	AllowMoreSessions bool
+
+	// PreHandshakeCallback, if non-nil, is called by NewServerConn with
+	// the remote address of the connection before anything is sent or
+	// read. If it returns an error, the connection is closed without a
+	// version exchange and NewServerConn returns that error. It can be
+	// used to limit connections per source address.
+	PreHandshakeCallback func(remote net.Addr) error
+
+	// AcceptEnv, if non-nil, makes the server handle the "env" requests
+	// of the "session" channels it accepts, instead of passing them on.
+	// As with OpenSSH's AcceptEnv, a variable is accepted if its name
+	// matches one of the patterns, in which '*' matches any sequence of
+	// characters and '?' any single character. Accepted variables are
+	// available from the channel's Env method, see EnvChannel; other
+	// requests are rejected. A non-nil empty list rejects all
+	// variables.
+	AcceptEnv []string
+
+	// HostKeyRing, if non-nil, holds the host keys, which can then be
+	// changed while the server is running. Each connection uses a
+	// snapshot of the ring taken by NewServerConn, so changes apply to
+	// new connections only. Keys added with AddHostKey are ignored.
+	HostKeyRing *HostKeyRing
+
+	// AlgorithmPolicy, if non-nil, is called with each SSH_MSG_KEXINIT
+	// received from the client, in the initial key exchange and in
+	// rekeys, before algorithms are negotiated. If it returns an error,
+	// the server sends an SSH_MSG_DISCONNECT with
+	// DisconnectProtocolError and the error's text, and the key exchange
+	// fails with an error wrapping it. It can be used to refuse clients
+	// that offer weak algorithms, where trimming Config only prevents
+	// them from being chosen.
+	AlgorithmPolicy func(client KexInit) error
+
+	// AllowMalformedPtyRequests, if true, makes the server pass malformed
+	// "pty-req" requests, such as those with badly encoded terminal
+	// modes, on to the application like any other. By default, the
+	// server refuses them itself on the "session" channels it accepts,
+	// so that the application only sees modes that ParseTerminalModes
+	// accepts.
+	AllowMalformedPtyRequests bool
 }
 
 // AddHostKey adds a private key as a host key. If an existing host
 // key exists with the same public key format, it is replaced. Each server
 // config must have at least one host key.
+//
+// The order in which host keys are added doesn't matter: the key used
+// for a connection is the one for the first algorithm in the client's
+// list that any host key supports. An RSA key that is an AlgorithmSigner
+// is offered as rsa-sha2-256, rsa-sha2-512 and ssh-rsa; it can be
+// restricted with NewSignerWithAlgorithms.
 func (s *ServerConfig) AddHostKey(key Signer) {
 	for i, k := range s.hostKeys {
 		if k.PublicKey().Type() == key.PublicKey().Type() {
@@ -148,6 +320,70 @@ func (s *ServerConfig) AddHostKey(key Signer) {
 	s.hostKeys = append(s.hostKeys, key)
 }
 
+// A HostKeyRing is a set of host keys that is safe for concurrent use;
+// see ServerConfig.HostKeyRing. The zero value is an empty ring.
+type HostKeyRing struct {
+	mu   sync.Mutex
+	keys []Signer
+}
+
+// Add adds a private key as a host key. As with ServerConfig.AddHostKey,
+// an existing key with the same public key format is replaced.
+func (r *HostKeyRing) Add(key Signer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]Signer, 0, len(r.keys)+1)
+	for _, k := range r.keys {
+		if k.PublicKey().Type() != key.PublicKey().Type() {
+			keys = append(keys, k)
+		}
+	}
+	r.keys = append(keys, key)
+}
+
+// Remove removes the host key whose public key is pub, and reports
+// whether there was one.
+func (r *HostKeyRing) Remove(pub PublicKey) bool {
+	want := pub.Marshal()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, k := range r.keys {
+		if bytes.Equal(k.PublicKey().Marshal(), want) {
+			keys := make([]Signer, 0, len(r.keys)-1)
+			keys = append(keys, r.keys[:i]...)
+			r.keys = append(keys, r.keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Keys returns the current host keys.
+func (r *HostKeyRing) Keys() []Signer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Signer(nil), r.keys...)
+}
+
+// GlobalRequestHandler handles a global request received by a server.
+// The returned ok and response are sent as the reply if wantReply is set.
+type GlobalRequestHandler func(conn ConnMetadata, wantReply bool, payload []byte) (ok bool, response []byte)
+
+// RegisterGlobalRequestHandler registers h to handle global requests of
+// type name on connections made with this config, replacing any handler
+// previously registered for name. Requests handled this way are not
+// passed on to the <-chan *Request returned by NewServerConn; all other
+// requests are delivered there as before. Handlers are called
+// synchronously while the connection's packets are read, so they must
+// not block, and must not wait on the connection. Their replies are
+// sent in turn with those to other requests, as Request.Reply describes.
+func (s *ServerConfig) RegisterGlobalRequestHandler(name string, h GlobalRequestHandler) {
+	if s.globalRequestHandlers == nil {
+		s.globalRequestHandlers = make(map[string]GlobalRequestHandler)
+	}
+	s.globalRequestHandlers[name] = h
+}
+
 // cachedPubKey contains the results of querying whether a public key is
 // acceptable for a user.
 type cachedPubKey struct {
@@ -190,7 +426,8 @@ type ServerConn struct {
 	Conn
 
 	// If the succeeding authentication callback returned a
-	// non-nil Permissions pointer, it is stored here.
+	// non-nil Permissions pointer, it is stored here. It is also
+	// available from the embedded Conn, see PermissionsConn.
 	Permissions *Permissions
 }
 
@@ -205,6 +442,9 @@ type ServerConn struct {
 func NewServerConn(c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewChannel, <-chan *Request, error) {
 	fullConf := *config
 	fullConf.SetDefaults()
+	if fullConf.HostKeyRing != nil {
+		fullConf.hostKeys = fullConf.HostKeyRing.Keys()
+	}
 	if fullConf.MaxAuthTries == 0 {
 		fullConf.MaxAuthTries = 6
 	}
@@ -218,6 +458,12 @@ func NewServerConn(c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewCha
 			}
 		}
 	}
+	if fullConf.ServerVersion != "" {
+		if err := validateVersion(fullConf.ServerVersion); err != nil {
+			c.Close()
+			return nil, nil, nil, fmt.Errorf("ssh: invalid ServerVersion: %v", err)
+		}
+	}
 	// Check if the config contains any unsupported key exchanges
 	for _, kex := range fullConf.KeyExchanges {
 		if _, ok := serverForbiddenKexAlgos[kex]; ok {
@@ -225,15 +471,32 @@ func NewServerConn(c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewCha
 			return nil, nil, nil, fmt.Errorf("ssh: unsupported key exchange %s for server", kex)
 		}
 	}
+	fullConf.setTCPOptions(c)
+
+	if fullConf.PreHandshakeCallback != nil {
+		if err := fullConf.PreHandshakeCallback(c.RemoteAddr()); err != nil {
+			c.Close()
+			return nil, nil, nil, err
+		}
+	}
 
 	s := &connection{
-		sshConn: sshConn{conn: c},
+		sshConn: sshConn{conn: c, isServer: true},
 	}
 	perms, err := s.serverHandshake(&fullConf)
 	if err != nil {
 		c.Close()
 		return nil, nil, nil, err
 	}
+	if fullConf.IdleTimeout > 0 {
+		go s.idleTimeout(fullConf.IdleTimeout)
+	}
+	if fullConf.KeepAliveInterval > 0 {
+		go s.keepAlive(fullConf.KeepAliveInterval, fullConf.KeepAliveCountMax, fullConf.KeepAliveCallback)
+	}
+	if fullConf.ObfuscationInterval > 0 {
+		go s.sendIgnores(fullConf.ObfuscationInterval, fullConf.Rand)
+	}
 	return &ServerConn{s, perms}, s.mux.incomingChannels, s.mux.incomingRequests, nil
 }
 
@@ -256,7 +519,7 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 	}
 
 	if !config.NoClientAuth && config.PasswordCallback == nil && config.PublicKeyCallback == nil &&
-		config.KeyboardInteractiveCallback == nil && (config.GSSAPIWithMICConfig == nil ||
+		config.HostBasedCallback == nil && config.KeyboardInteractiveCallback == nil && config.UnknownAuthCallback == nil && (config.GSSAPIWithMICConfig == nil ||
 		config.GSSAPIWithMICConfig.AllowLogin == nil || config.GSSAPIWithMICConfig.Server == nil) {
 		return nil, errors.New("ssh: no authentication methods configured but NoClientAuth is also false")
 	}
@@ -266,21 +529,43 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 	} else {
 		s.serverVersion = []byte(packageVersion)
 	}
+	timer := startHandshakeTimer(s.sshConn.conn, config.HandshakeTimeout)
 	var err error
 	s.clientVersion, err = exchangeVersions(s.sshConn.conn, s.serverVersion)
 	if err != nil {
-		return nil, err
+		return nil, timer.stop(err)
 	}
 
 	tr := newTransport(s.sshConn.conn, config.Rand, false /* not client */)
+	tr.debugCallback = config.DebugCallback
+	tr.reader.maxPacket = config.maxPacketSize()
+	tr.writer.padTo = config.PadPacketsTo
+	if config.UnimplementedCallback != nil {
+		tr.unimplementedCallback = config.UnimplementedCallback
+		tr.sent = new(sentTypes)
+	}
 	s.transport = newServerTransport(tr, s.clientVersion, s.serverVersion, config)
 
-	if err := s.transport.waitSession(); err != nil {
+	if err := timer.stop(s.transport.waitSession()); err != nil {
 		return nil, err
 	}
 
 	// We just did the key change, so the session ID is established.
 	s.sessionID = s.transport.getSessionID()
+	s.sessionHash = s.transport.getSessionHash()
+
+	var graceTimer *time.Timer
+	graceMsg := &disconnectMsg{
+		Reason:  uint32(DisconnectByApplication),
+		Message: "login grace time exceeded",
+	}
+	if config.LoginGraceTime > 0 {
+		graceTimer = time.AfterFunc(config.LoginGraceTime, func() {
+			s.transport.writePacket(Marshal(graceMsg))
+			s.sshConn.conn.Close()
+		})
+		defer graceTimer.Stop()
+	}
 
 	var packet []byte
 	if packet, err = s.transport.readPacket(); err != nil {
@@ -302,13 +587,71 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 	}
 
 	perms, err := s.serverAuthenticate(config)
+	if graceTimer != nil && !graceTimer.Stop() {
+		return nil, graceMsg.toError()
+	}
 	if err != nil {
 		return nil, err
 	}
-	s.mux = newMux(s.transport)
+	s.permissions = perms
+	var handleRequest func(*Request) bool
+	if handlers := config.globalRequestHandlers; len(handlers) > 0 {
+		handleRequest = func(r *Request) bool {
+			h, ok := handlers[r.Type]
+			if !ok {
+				return false
+			}
+			ok, response := h(s, r.WantReply, r.Payload)
+			r.Reply(ok, response)
+			return true
+		}
+	}
+	var acceptEnv func(string) bool
+	if patterns := config.AcceptEnv; patterns != nil {
+		acceptEnv = func(name string) bool {
+			for _, p := range patterns {
+				if matchPrincipal(name, p) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	s.mux = newMuxWithOptions(s.muxConn(&config.Config), muxOptions{
+		honorNoMoreSessions: !config.AllowMoreSessions,
+		handleRequest:       handleRequest,
+		unhandledRequest:    config.unhandledGlobalRequest(),
+		acceptEnv:           acceptEnv,
+		checkPtyRequests:    !config.AllowMalformedPtyRequests,
+		maxChannels:         config.MaxChannels,
+		maxPendingRequests:  config.maxPendingGlobalRequests(),
+		logger:              config.Logger,
+	})
 	return perms, err
 }
 
+// checkUserPresence rejects a verified security key signature made
+// without the user present, unless perms carries
+// NoTouchRequiredExtension.
+func checkUserPresence(sig *Signature, perms *Permissions) error {
+	if sig.Format != KeyAlgoSKECDSA256 && sig.Format != KeyAlgoSKED25519 {
+		return nil
+	}
+	flags, _, err := ParseSKSignatureFields(sig)
+	if err != nil {
+		return err
+	}
+	if flags&SKFlagUserPresent != 0 {
+		return nil
+	}
+	if perms != nil {
+		if _, ok := perms.Extensions[NoTouchRequiredExtension]; ok {
+			return nil
+		}
+	}
+	return errors.New("ssh: security key signature made without user presence")
+}
+
 func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
 	if addr == nil {
 		return errors.New("ssh: no address known for client, but source-address match required")
@@ -408,6 +751,23 @@ func isAlgoCompatible(algo, sigFormat string) bool {
 	return underlyingAlgo(algo) == sigFormat
 }
 
+// AuthLogInfo describes an authentication attempt to
+// ServerConfig.AuthLogInfoCallback.
+type AuthLogInfo struct {
+	// Method is the RFC 4252 name of the method.
+	Method string
+
+	// PublicKey is the key offered by a "publickey" attempt, or the
+	// client host's key for a "hostbased" attempt, or nil.
+	// Its fingerprint can be obtained with FingerprintSHA256.
+	PublicKey PublicKey
+
+	// Query reports whether a "publickey" attempt only asked whether
+	// PublicKey is acceptable, without a signature. Such a query does
+	// not authenticate the client.
+	Query bool
+}
+
 // ServerAuthError represents server authentication errors and is
 // sometimes returned by NewServerConn. It appends any authentication
 // errors that may occur, and is returned if all of the authentication
@@ -434,6 +794,9 @@ type ServerAuthCallbacks struct {
 	// PublicKeyCallback behaves like [ServerConfig.PublicKeyCallback].
 	PublicKeyCallback func(conn ConnMetadata, key PublicKey) (*Permissions, error)
 
+	// HostBasedCallback behaves like [ServerConfig.HostBasedCallback].
+	HostBasedCallback func(conn ConnMetadata, key PublicKey, clientHost, clientUser string) (*Permissions, error)
+
 	// KeyboardInteractiveCallback behaves like [ServerConfig.KeyboardInteractiveCallback].
 	KeyboardInteractiveCallback func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error)
 
@@ -443,7 +806,15 @@ type ServerAuthCallbacks struct {
 
 // PartialSuccessError can be returned by any of the [ServerConfig]
 // authentication callbacks to indicate to the client that authentication has
-// partially succeeded, but further steps are required.
+// partially succeeded, but further steps are required. For example, a
+// PublicKeyCallback can accept a key but require a one-time password by
+// returning a PartialSuccessError whose Next has only a
+// KeyboardInteractiveCallback. A nil error still means full success.
+//
+// Permissions returned along with a PartialSuccessError are not
+// dropped: once authentication succeeds, they are merged with those of
+// the later steps as by Permissions.Merge, and a conflict between them
+// fails the connection.
 type PartialSuccessError struct {
 	// Next defines the authentication callbacks to apply to further steps. The
 	// available methods communicated to the client are based on the non-nil
@@ -490,11 +861,15 @@ func (s *connection) serverAuthenticate(config *ServerConfig) (*Permissions, err
 	var authErrs []error
 	var displayedBanner bool
 	partialSuccessReturned := false
+	// partialPerms accumulates the Permissions returned with each
+	// PartialSuccessError, to be merged into the final ones.
+	var partialPerms *Permissions
 	// Set the initial authentication callbacks from the config. They can be
 	// changed if a PartialSuccessError is returned.
 	authConfig := ServerAuthCallbacks{
 		PasswordCallback:            config.PasswordCallback,
 		PublicKeyCallback:           config.PublicKeyCallback,
+		HostBasedCallback:           config.HostBasedCallback,
 		KeyboardInteractiveCallback: config.KeyboardInteractiveCallback,
 		GSSAPIWithMICConfig:         config.GSSAPIWithMICConfig,
 	}
@@ -503,7 +878,7 @@ userAuthLoop:
 	for {
 		if authFailures >= config.MaxAuthTries && config.MaxAuthTries > 0 {
 			discMsg := &disconnectMsg{
-				Reason:  2,
+				Reason:  uint32(DisconnectProtocolError),
 				Message: "too many authentication failures",
 			}
 
@@ -511,7 +886,7 @@ userAuthLoop:
 				return nil, err
 			}
 
-			return nil, discMsg
+			return nil, discMsg.toError()
 		}
 
 		var userAuthReq userAuthRequestMsg
@@ -550,6 +925,7 @@ userAuthLoop:
 
 		perms = nil
 		authErr := ErrNoAuth
+		logInfo := AuthLogInfo{Method: userAuthReq.Method}
 
 		switch userAuthReq.Method {
 		case "none":
@@ -587,7 +963,7 @@ userAuthLoop:
 
 			prompter := &sshClientKeyboardInteractive{s}
 			perms, authErr = authConfig.KeyboardInteractiveCallback(s, prompter.Challenge)
-		case "publickey":
+		case "publickey", publicKeyHostBoundMethod:
 			if authConfig.PublicKeyCallback == nil {
 				authErr = errors.New("ssh: publickey auth not configured")
 				break
@@ -617,6 +993,21 @@ userAuthLoop:
 			if err != nil {
 				return nil, err
 			}
+			logInfo.PublicKey = pubKey
+
+			// A hostbound request names the host key the client
+			// saw, which must be the one of this connection.
+			var hostKeyData []byte
+			if userAuthReq.Method == publicKeyHostBoundMethod {
+				if hostKeyData, payload, ok = parseString(payload); !ok {
+					return nil, parseError(msgUserAuthRequest)
+				}
+				if !bytes.Equal(hostKeyData, s.transport.getSessionHostKey()) {
+					authErr = errors.New("ssh: host key in publickey-hostbound request does not match")
+					break
+				}
+			}
+			logInfo.Query = isQuery
 
 			candidate, ok := cache.get(s.user, pubKeyData)
 			if !ok {
@@ -654,6 +1045,9 @@ userAuthLoop:
 					if err = s.transport.writePacket(Marshal(&okMsg)); err != nil {
 						return nil, err
 					}
+					if config.AuthLogInfoCallback != nil {
+						config.AuthLogInfoCallback(s, logInfo, nil)
+					}
 					continue userAuthLoop
 				}
 				authErr = candidate.result
@@ -687,14 +1081,86 @@ userAuthLoop:
 				}
 
 				signedData := buildDataSignedForAuth(sessionID, userAuthReq, algo, pubKeyData)
+				if hostKeyData != nil {
+					signedData = appendString(signedData, string(hostKeyData))
+				}
 
 				if err := pubKey.Verify(signedData, sig); err != nil {
 					return nil, err
 				}
+				if err := checkUserPresence(sig, candidate.perms); err != nil {
+					authErr = err
+					break
+				}
 
 				authErr = candidate.result
 				perms = candidate.perms
 			}
+		case "hostbased":
+			if authConfig.HostBasedCallback == nil {
+				authErr = errors.New("ssh: hostbased auth not configured")
+				break
+			}
+			var req hostBasedAuthMsg
+			payload := userAuthReq.Payload
+			algoBytes, payload, ok := parseString(payload)
+			if !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			req.Algoname = string(algoBytes)
+			if req.PubKey, payload, ok = parseString(payload); !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			clientHost, payload, ok := parseString(payload)
+			if !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			clientUser, payload, ok := parseString(payload)
+			if !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			sig, payload, ok := parseSignature(payload)
+			if !ok || len(payload) > 0 {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			req.User, req.Service, req.Method = userAuthReq.User, userAuthReq.Service, userAuthReq.Method
+			req.ClientHost, req.ClientUser = string(clientHost), string(clientUser)
+
+			pubKey, err := ParsePublicKey(req.PubKey)
+			if err != nil {
+				return nil, err
+			}
+			logInfo.PublicKey = pubKey
+			algo := req.Algoname
+			if !contains(config.PublicKeyAuthAlgorithms, underlyingAlgo(algo)) {
+				authErr = fmt.Errorf("ssh: algorithm %q not accepted", algo)
+				break
+			}
+			if !contains(algorithmsForKeyFormat(pubKey.Type()), algo) {
+				authErr = fmt.Errorf("ssh: public key type %q not compatible with selected algorithm %q",
+					pubKey.Type(), algo)
+				break
+			}
+			if !contains(config.PublicKeyAuthAlgorithms, sig.Format) {
+				authErr = fmt.Errorf("ssh: algorithm %q not accepted", sig.Format)
+				break
+			}
+			if !isAlgoCompatible(algo, sig.Format) {
+				authErr = fmt.Errorf("ssh: signature %q not compatible with selected algorithm %q", sig.Format, algo)
+				break
+			}
+			if err := pubKey.Verify(buildDataSignedForHostBased(sessionID, req), sig); err != nil {
+				return nil, err
+			}
+
+			perms, authErr = authConfig.HostBasedCallback(s, pubKey, req.ClientHost, req.ClientUser)
+			_, isPartialSuccessError := authErr.(*PartialSuccessError)
+			if (authErr == nil || isPartialSuccessError) && perms != nil &&
+				perms.CriticalOptions[sourceAddressCriticalOption] != "" {
+				if err := checkSourceAddress(s.RemoteAddr(), perms.CriticalOptions[sourceAddressCriticalOption]); err != nil {
+					authErr = err
+				}
+			}
 		case "gssapi-with-mic":
 			if authConfig.GSSAPIWithMICConfig == nil {
 				authErr = errors.New("ssh: gssapi-with-mic auth not configured")
@@ -743,7 +1209,11 @@ userAuthLoop:
 				return nil, err
 			}
 		default:
-			authErr = fmt.Errorf("ssh: unknown method %q", userAuthReq.Method)
+			if config.UnknownAuthCallback == nil {
+				authErr = fmt.Errorf("ssh: unknown method %q", userAuthReq.Method)
+				break
+			}
+			perms, authErr = config.UnknownAuthCallback(s, userAuthReq.Method, userAuthReq.Payload)
 		}
 
 		authErrs = append(authErrs, authErr)
@@ -751,6 +1221,19 @@ userAuthLoop:
 		if config.AuthLogCallback != nil {
 			config.AuthLogCallback(s, userAuthReq.Method, authErr)
 		}
+		if l := config.Logger; l != nil {
+			keyvals := []interface{}{"user", s.user, "method", userAuthReq.Method, "remote", s.RemoteAddr()}
+			if logInfo.PublicKey != nil {
+				keyvals = append(keyvals, "key", FingerprintSHA256(logInfo.PublicKey))
+			}
+			if logInfo.Query {
+				keyvals = append(keyvals, "query", true)
+			}
+			l.Log(LogInfo, "authentication attempt", append(keyvals, "err", authErr)...)
+		}
+		if config.AuthLogInfoCallback != nil {
+			config.AuthLogInfoCallback(s, logInfo, authErr)
+		}
 
 		var bannerErr *BannerError
 		if errors.As(authErr, &bannerErr) {
@@ -774,6 +1257,12 @@ userAuthLoop:
 			// After a partial success error we don't allow changing the user
 			// name and execute the NoClientAuthCallback.
 			partialSuccessReturned = true
+			if perms != nil {
+				var err error
+				if partialPerms, err = partialPerms.Merge(perms); err != nil {
+					return nil, err
+				}
+			}
 
 			// In case a partial success is returned, the server may send
 			// a new set of authentication methods.
@@ -822,6 +1311,9 @@ userAuthLoop:
 		if authConfig.PublicKeyCallback != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "publickey")
 		}
+		if authConfig.HostBasedCallback != nil {
+			failureMsg.Methods = append(failureMsg.Methods, "hostbased")
+		}
 		if authConfig.KeyboardInteractiveCallback != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "keyboard-interactive")
 		}
@@ -830,7 +1322,7 @@ userAuthLoop:
 			failureMsg.Methods = append(failureMsg.Methods, "gssapi-with-mic")
 		}
 
-		if len(failureMsg.Methods) == 0 {
+		if len(failureMsg.Methods) == 0 && config.UnknownAuthCallback == nil {
 			return nil, errors.New("ssh: no authentication methods available")
 		}
 
@@ -839,6 +1331,13 @@ userAuthLoop:
 		}
 	}
 
+	if partialPerms != nil {
+		var err error
+		if perms, err = partialPerms.Merge(perms); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := s.transport.writePacket([]byte{msgUserAuthSuccess}); err != nil {
 		return nil, err
 	}
@@ -852,22 +1351,70 @@ type sshClientKeyboardInteractive struct {
 }
 
 func (c *sshClientKeyboardInteractive) Challenge(name, instruction string, questions []string, echos []bool) (answers []string, err error) {
+	return c.challenge(name, instruction, "", questions, echos)
+}
+
+// challenge is Challenge with the language tag of the info request. A
+// request must fit in minPacketSize, which all clients accept, so
+// prompts that don't fit with the name and instruction are sent in
+// further requests carrying only the name, and their answers are
+// appended; it fails if the name and instruction, or a prompt, are too
+// long on their own.
+func (c *sshClientKeyboardInteractive) challenge(name, instruction, lang string, questions []string, echos []bool) (answers []string, err error) {
 	if len(questions) != len(echos) {
 		return nil, errors.New("ssh: echos and questions must have equal length")
 	}
+	if !validLanguageTag(lang) {
+		return nil, fmt.Errorf("ssh: invalid keyboard-interactive language tag %q", lang)
+	}
+	for _, s := range append([]string{name, instruction}, questions...) {
+		if !utf8.ValidString(s) {
+			return nil, errors.New("ssh: keyboard-interactive text is not valid UTF-8")
+		}
+	}
+
+	for first := true; first || len(questions) > 0; first = false {
+		msg := userAuthInfoRequestMsg{Name: name, Language: lang}
+		if first {
+			msg.Instruction = instruction
+		}
+		size := len(Marshal(&msg))
+		n := 0
+		for ; n < len(questions); n++ {
+			prompt := appendBool(appendString(nil, questions[n]), echos[n])
+			if size+len(msg.Prompts)+len(prompt) > minPacketSize {
+				break
+			}
+			msg.Prompts = append(msg.Prompts, prompt...)
+		}
+		if size > minPacketSize || (n == 0 && len(questions) > 0) {
+			return nil, errors.New("ssh: keyboard-interactive request does not fit in a packet")
+		}
+		msg.NumPrompts = uint32(n)
+		got, err := c.infoRequest(&msg)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, got...)
+		questions, echos = questions[n:], echos[n:]
+	}
+	return answers, nil
+}
 
-	var prompts []byte
-	for i := range questions {
-		prompts = appendString(prompts, questions[i])
-		prompts = appendBool(prompts, echos[i])
+// validLanguageTag reports whether tag is empty or looks like an RFC 3066
+// language tag, such as "en" or "pt-BR".
+func validLanguageTag(tag string) bool {
+	for _, r := range tag {
+		if !(r == '-' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return false
+		}
 	}
+	return true
+}
 
-	if err := c.transport.writePacket(Marshal(&userAuthInfoRequestMsg{
-		Name:        name,
-		Instruction: instruction,
-		NumPrompts:  uint32(len(questions)),
-		Prompts:     prompts,
-	})); err != nil {
+// infoRequest sends msg and returns the answers to its prompts.
+func (c *sshClientKeyboardInteractive) infoRequest(msg *userAuthInfoRequestMsg) (answers []string, err error) {
+	if err := c.transport.writePacket(Marshal(msg)); err != nil {
 		return nil, err
 	}
 
@@ -881,7 +1428,7 @@ func (c *sshClientKeyboardInteractive) Challenge(name, instruction string, quest
 	packet = packet[1:]
 
 	n, packet, ok := parseUint32(packet)
-	if !ok || int(n) != len(questions) {
+	if !ok || n != msg.NumPrompts {
 		return nil, parseError(msgUserAuthInfoResponse)
 	}
 
@@ -900,3 +1447,81 @@ func (c *sshClientKeyboardInteractive) Challenge(name, instruction string, quest
 
 	return answers, nil
 }
+
+// KeyboardInteractivePrompt is a single question of a
+// KeyboardInteractiveRound.
+type KeyboardInteractivePrompt struct {
+	// Question is shown to the user.
+	Question string
+
+	// Echo reports whether the client should echo the answer as
+	// it is typed. It should be false for secrets such as
+	// passwords and one-time codes.
+	Echo bool
+}
+
+// KeyboardInteractiveRound is one SSH_MSG_USERAUTH_INFO_REQUEST of a
+// keyboard-interactive exchange (RFC 4256, section 3.2). A round with no
+// Prompts can be used to display the Name and Instruction only; the
+// client answers it with an empty response.
+type KeyboardInteractiveRound struct {
+	Name        string
+	Instruction string
+	Prompts     []KeyboardInteractivePrompt
+
+	// Language, if set, is the RFC 3066 language tag of Name,
+	// Instruction and the questions, for example "de". As
+	// KeyboardInteractiveChallenge has no language parameter, a round
+	// with a Language is sent to the client of the connection directly
+	// rather than through the challenge passed to the callback; on a
+	// connection that doesn't come from this package, the challenge is
+	// called without it.
+	Language string
+}
+
+// KeyboardInteractiveStep decides the next round of a keyboard-interactive
+// exchange. round is the number of rounds the client has answered so
+// far: step is first called with round 0 and nil answers, and afterwards
+// with the client's answers to the previous round, one per prompt. It
+// returns either the next round to
+// present, or a nil round to end the exchange; as with
+// KeyboardInteractiveCallback, a nil error then accepts the user.
+type KeyboardInteractiveStep func(conn ConnMetadata, round int, answers []string) (next *KeyboardInteractiveRound, perms *Permissions, err error)
+
+// KeyboardInteractiveRounds returns a function suitable for
+// ServerConfig.KeyboardInteractiveCallback that drives step through as
+// many rounds as it asks for, taking care of marshaling the prompts and
+// echo flags and of checking that each response answers every prompt.
+// An error returned by step fails the authentication attempt.
+func KeyboardInteractiveRounds(step KeyboardInteractiveStep) func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error) {
+	return func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error) {
+		var answers []string
+		for round := 0; ; round++ {
+			next, perms, err := step(conn, round, answers)
+			if err != nil {
+				return nil, err
+			}
+			if next == nil {
+				return perms, nil
+			}
+
+			questions := make([]string, len(next.Prompts))
+			echos := make([]bool, len(next.Prompts))
+			for i, p := range next.Prompts {
+				questions[i] = p.Question
+				echos[i] = p.Echo
+			}
+			if c, ok := conn.(*connection); ok && next.Language != "" {
+				answers, err = (&sshClientKeyboardInteractive{c}).challenge(next.Name, next.Instruction, next.Language, questions, echos)
+			} else {
+				answers, err = client(next.Name, next.Instruction, questions, echos)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != len(questions) {
+				return nil, fmt.Errorf("ssh: got %d keyboard-interactive answers, want %d", len(answers), len(questions))
+			}
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -202,6 +203,9 @@ func TestMultiStepAuth(t *testing.T) {
 	if err == nil {
 		t.Fatal("client login with wrong password after public key must fail")
 	}
+	if !strings.Contains(err.Error(), "server still accepts [password]") {
+		t.Errorf("got %v, want the remaining methods in the error", err)
+	}
 	// The error sequence is:
 	// - no auth passed yet
 	// - partial success
@@ -410,3 +414,93 @@ func TestDynamicAuthCallbacks(t *testing.T) {
 		t.Fatal("server not returned partial success")
 	}
 }
+
+// TestMultiStepAuthPublicKeys checks that a partial success with the last key
+// of a PublicKeys method lets the client try the method again for the next
+// step.
+func TestMultiStepAuthPublicKeys(t *testing.T) {
+	secondStep := func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+		if bytes.Equal(key.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+			return nil, nil
+		}
+		return nil, errors.New("want the ecdsa key")
+	}
+	serverConfig := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			if bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+				return nil, &PartialSuccessError{
+					Next: ServerAuthCallbacks{PublicKeyCallback: secondStep},
+				}
+			}
+			return nil, errors.New("want the rsa key")
+		},
+	}
+	clientConfig := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			PublicKeys(testSigners["ecdsa"], testSigners["rsa"]),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if _, err := doClientServerAuth(t, serverConfig, clientConfig); err != nil {
+		t.Fatalf("client login error: %s", err)
+	}
+}
+
+func TestMultiStepAuthPermissions(t *testing.T) {
+	otp := func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error) {
+		ans, err := client("", "", []string{"OTP: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		if len(ans) != 1 || ans[0] != "123456" {
+			return nil, errors.New("bad OTP")
+		}
+		return &Permissions{Extensions: map[string]string{"otp": "ok"}}, nil
+	}
+	serverConfig := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			perms := &Permissions{Extensions: map[string]string{"key-id": "rsa"}}
+			return perms, &PartialSuccessError{
+				Next: ServerAuthCallbacks{KeyboardInteractiveCallback: otp},
+			}
+		},
+	}
+	serverConfig.AddHostKey(testSigners["rsa"])
+	clientConfig := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			PublicKeys(testSigners["rsa"]),
+			KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				return []string{"123456"}, nil
+			}),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConn := make(chan *ServerConn, 1)
+	go func() {
+		conn, _, _, err := NewServerConn(c1, serverConfig)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+		}
+		serverConn <- conn
+	}()
+	if _, _, _, err := NewClientConn(c2, "", clientConfig); err != nil {
+		t.Fatalf("client login error: %s", err)
+	}
+	conn := <-serverConn
+	if conn == nil {
+		t.FailNow()
+	}
+	want := map[string]string{"key-id": "rsa", "otp": "ok"}
+	if conn.Permissions == nil || !reflect.DeepEqual(conn.Permissions.Extensions, want) {
+		t.Errorf("got permissions %+v, want extensions %v", conn.Permissions, want)
+	}
+}
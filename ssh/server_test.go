@@ -5,6 +5,10 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -193,6 +197,124 @@ func TestMaxAuthTriesFirstNoneAuthErrorIgnored(t *testing.T) {
 	}
 }
 
+func TestMaxAuthTriesPublicKeyQueryNotCounted(t *testing.T) {
+	serverConfig := &ServerConfig{
+		MaxAuthTries: 1,
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			if bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	clientConfig := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			PublicKeys(testSigners["rsa"]),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	// The client queries the key before signing with it. The accepted
+	// query must not use up the single allowed attempt.
+	if _, err := doClientServerAuth(t, serverConfig, clientConfig); err != nil {
+		t.Fatalf("client login error: %s", err)
+	}
+
+	// A query for a rejected key counts, so the next key is never tried.
+	clientConfig.Auth = []AuthMethod{
+		PublicKeys(testSigners["ecdsa"], testSigners["rsa"]),
+	}
+	if _, err := doClientServerAuth(t, serverConfig, clientConfig); err == nil {
+		t.Fatal("client login succeeded after a rejected key used up MaxAuthTries")
+	}
+}
+
+func TestLoginGraceTime(t *testing.T) {
+	serverConfig := &ServerConfig{
+		LoginGraceTime: 100 * time.Millisecond,
+		KeyboardInteractiveCallback: func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error) {
+			// Each answer arrives quickly, but the exchange as a whole
+			// outlasts the grace time.
+			for i := 0; i < 10; i++ {
+				if _, err := client("", "", []string{"question"}, []bool{true}); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(testSigners["rsa"])
+	clientConfig := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				time.Sleep(20 * time.Millisecond)
+				return []string{"answer"}, nil
+			}),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, _, _, err := NewServerConn(c1, serverConfig)
+		serverErr <- err
+	}()
+	if _, _, _, err := NewClientConn(c2, "", clientConfig); err == nil {
+		t.Fatal("client login succeeded after the login grace time")
+	}
+	var discErr *DisconnectError
+	if err := <-serverErr; !errors.As(err, &discErr) || discErr.Reason != DisconnectByApplication {
+		t.Fatalf("got server error %v, want a DisconnectByApplication *DisconnectError", err)
+	}
+
+	// A login within the grace time is not affected.
+	serverConfig.LoginGraceTime = time.Minute
+	clientConfig.Auth = []AuthMethod{
+		KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{"answer"}, nil
+		}),
+	}
+	if _, err := doClientServerAuth(t, serverConfig, clientConfig); err != nil {
+		t.Fatalf("client login error: %s", err)
+	}
+}
+
+func TestPreHandshakeCallback(t *testing.T) {
+	errDenied := errors.New("denied")
+	called := false
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		PreHandshakeCallback: func(addr net.Addr) error {
+			called = true
+			return errDenied
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+
+	c := &markerConn{}
+	if _, _, _, err := NewServerConn(c, serverConf); err != errDenied {
+		t.Fatalf("got error %v, want %v", err, errDenied)
+	}
+	if !c.isClosed() {
+		t.Error("denied connection was left open")
+	}
+	if c.isUsed() {
+		t.Error("denied connection was used")
+	}
+	if !called {
+		t.Error("PreHandshakeCallback was not called")
+	}
+}
+
 func TestNewServerConnValidationErrors(t *testing.T) {
 	serverConf := &ServerConfig{
 		PublicKeyAuthAlgorithms: []string{CertAlgoRSAv01},
@@ -341,3 +463,924 @@ func (*markerConn) RemoteAddr() net.Addr { return nil }
 func (*markerConn) SetDeadline(t time.Time) error      { return nil }
 func (*markerConn) SetReadDeadline(t time.Time) error  { return nil }
 func (*markerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestServerNoMoreSessions(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		defer c1.Close()
+		defer c2.Close()
+
+		serverConf := &ServerConfig{NoClientAuth: true, AllowMoreSessions: allow}
+		serverConf.AddHostKey(testSigners["ecdsa"])
+		requests := make(chan string, 10)
+		go func() {
+			_, chans, reqs, err := NewServerConn(c1, serverConf)
+			if err != nil {
+				t.Errorf("NewServerConn: %v", err)
+				return
+			}
+			go func() {
+				for req := range reqs {
+					requests <- req.Type
+					req.Reply(false, nil)
+				}
+				close(requests)
+			}()
+			for newCh := range chans {
+				ch, reqs, err := newCh.Accept()
+				if err != nil {
+					t.Errorf("Accept: %v", err)
+					continue
+				}
+				go DiscardRequests(reqs)
+				defer ch.Close()
+			}
+		}()
+
+		conn, _, _, err := NewClientConn(c2, "", &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()})
+		if err != nil {
+			t.Fatalf("NewClientConn: %v", err)
+		}
+		defer conn.Close()
+
+		if _, _, err := conn.OpenChannel("session", nil); err != nil {
+			t.Fatalf("OpenChannel(session): %v", err)
+		}
+		if _, _, err := conn.SendRequest(noMoreSessionsRequest, false, nil); err != nil {
+			t.Fatalf("SendRequest: %v", err)
+		}
+		_, _, err = conn.OpenChannel("session", nil)
+		if allow {
+			if err != nil {
+				t.Errorf("AllowMoreSessions: OpenChannel(session): %v", err)
+			}
+		} else if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != Prohibited {
+			t.Errorf("OpenChannel(session) after no-more-sessions: got %v, want Prohibited", err)
+		}
+		if _, _, err := conn.OpenChannel("direct-tcpip", nil); err != nil {
+			t.Errorf("OpenChannel(direct-tcpip): %v", err)
+		}
+
+		conn.Close()
+		var got []string
+		for r := range requests {
+			got = append(got, r)
+		}
+		if passedOn := len(got) == 1 && got[0] == noMoreSessionsRequest; passedOn != allow {
+			t.Errorf("AllowMoreSessions %t: server got requests %q", allow, got)
+		}
+	}
+}
+
+func TestServerNoMoreSessionsReplyOrder(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	requests := make(chan *Request, 1)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(ConnectionFailed, "no channels")
+			}
+		}()
+		for req := range reqs {
+			requests <- req
+		}
+	}()
+
+	conn, _, _, err := NewClientConn(c2, "", &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+
+	// The reply to no-more-sessions must wait for the one to the
+	// earlier request the application holds.
+	slow := make(chan bool, 1)
+	go func() {
+		ok, _, _ := conn.SendRequest("slow@example.com", true, nil)
+		slow <- ok
+	}()
+	req := <-requests
+	noMore := make(chan bool, 1)
+	go func() {
+		ok, _, _ := conn.SendRequest(noMoreSessionsRequest, true, nil)
+		noMore <- ok
+	}()
+	// Sessions are prohibited once no-more-sessions is processed.
+	for {
+		_, _, err := conn.OpenChannel("session", nil)
+		if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != ConnectionFailed {
+			break
+		}
+	}
+	req.Reply(false, nil)
+
+	if ok := <-slow; ok {
+		t.Error("slow@example.com: got true, want false")
+	}
+	if ok := <-noMore; !ok {
+		t.Errorf("%s: got false, want true", noMoreSessionsRequest)
+	}
+}
+
+func TestServerGlobalRequestHandler(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverConf.RegisterGlobalRequestHandler("ping@example.com", func(conn ConnMetadata, wantReply bool, payload []byte) (bool, []byte) {
+		return true, append([]byte(conn.User()+":"), payload...)
+	})
+	serverConf.RegisterGlobalRequestHandler("refuse@example.com", func(conn ConnMetadata, wantReply bool, payload []byte) (bool, []byte) {
+		return false, nil
+	})
+	requests := make(chan string, 10)
+	go func() {
+		_, _, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		for req := range reqs {
+			requests <- req.Type
+			req.Reply(false, nil)
+		}
+		close(requests)
+	}()
+
+	conn, _, _, err := NewClientConn(c2, "", &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+
+	ok, payload, err := conn.SendRequest("ping@example.com", true, []byte("hello"))
+	if err != nil || !ok || string(payload) != "user:hello" {
+		t.Errorf("ping: got %t, %q, %v, want true, \"user:hello\", nil", ok, payload, err)
+	}
+	if ok, _, err := conn.SendRequest("refuse@example.com", true, nil); err != nil || ok {
+		t.Errorf("refuse: got %t, %v, want false, nil", ok, err)
+	}
+	if ok, _, err := conn.SendRequest("other@example.com", true, nil); err != nil || ok {
+		t.Errorf("other: got %t, %v, want false, nil", ok, err)
+	}
+
+	conn.Close()
+	var got []string
+	for r := range requests {
+		got = append(got, r)
+	}
+	if len(got) != 1 || got[0] != "other@example.com" {
+		t.Errorf("server got requests %q, want only other@example.com", got)
+	}
+}
+
+func TestServerGlobalRequestHandlerOrder(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	handled := make(chan struct{}, 1)
+	serverConf.RegisterGlobalRequestHandler("ping@example.com", func(conn ConnMetadata, wantReply bool, payload []byte) (bool, []byte) {
+		handled <- struct{}{}
+		return true, []byte("pong")
+	})
+	requests := make(chan *Request, 1)
+	go func() {
+		_, _, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		for req := range reqs {
+			requests <- req
+		}
+	}()
+
+	conn, _, _, err := NewClientConn(c2, "", &ClientConfig{User: "user", HostKeyCallback: InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+
+	type result struct {
+		ok      bool
+		payload string
+		err     error
+	}
+	send := func(name string) <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			ok, payload, err := conn.SendRequest(name, true, nil)
+			c <- result{ok, string(payload), err}
+		}()
+		return c
+	}
+
+	// The handler answers ping@example.com at once, but its reply must
+	// wait for the one to the earlier request the application holds.
+	slow := send("slow@example.com")
+	req := <-requests
+	ping := send("ping@example.com")
+	<-handled
+	req.Reply(false, []byte("slow"))
+
+	if r := <-slow; r.err != nil || r.ok || r.payload != "slow" {
+		t.Errorf("slow: got %t, %q, %v, want false, \"slow\", nil", r.ok, r.payload, r.err)
+	}
+	if r := <-ping; r.err != nil || !r.ok || r.payload != "pong" {
+		t.Errorf("ping: got %t, %q, %v, want true, \"pong\", nil", r.ok, r.payload, r.err)
+	}
+}
+
+func TestAuthLogInfoCallback(t *testing.T) {
+	type logEntry struct {
+		method      string
+		fingerprint string
+		query       bool
+		ok          bool
+	}
+	var entries []logEntry
+	serverConfig := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			if bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+		AuthLogInfoCallback: func(conn ConnMetadata, info AuthLogInfo, err error) {
+			e := logEntry{method: info.Method, query: info.Query, ok: err == nil}
+			if info.PublicKey != nil {
+				e.fingerprint = FingerprintSHA256(info.PublicKey)
+			}
+			entries = append(entries, e)
+		},
+	}
+	clientConfig := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ecdsa"], testSigners["rsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if _, err := doClientServerAuth(t, serverConfig, clientConfig); err != nil {
+		t.Fatalf("client login error: %s", err)
+	}
+
+	ecdsa := FingerprintSHA256(testPublicKeys["ecdsa"])
+	rsa := FingerprintSHA256(testPublicKeys["rsa"])
+	want := []logEntry{
+		{method: "none"},
+		{method: "publickey", fingerprint: ecdsa, query: true},
+		{method: "publickey", fingerprint: rsa, query: true, ok: true},
+		{method: "publickey", fingerprint: rsa, ok: true},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got log %+v, want %+v", entries, want)
+	}
+}
+
+func TestKeyboardInteractiveRounds(t *testing.T) {
+	errBadCode := errors.New("bad code")
+	rounds := []*KeyboardInteractiveRound{
+		{
+			Name:        "OTP",
+			Instruction: "Enter your one-time code",
+			Prompts:     []KeyboardInteractivePrompt{{Question: "Code: "}},
+		},
+		{
+			Name:    "Confirm",
+			Prompts: []KeyboardInteractivePrompt{{Question: "Proceed? ", Echo: true}},
+		},
+	}
+	step := func(conn ConnMetadata, round int, answers []string) (*KeyboardInteractiveRound, *Permissions, error) {
+		switch round {
+		case 0:
+			return rounds[0], nil, nil
+		case 1:
+			if answers[0] != "123456" {
+				return nil, nil, errBadCode
+			}
+			return rounds[1], nil, nil
+		default:
+			if answers[0] != "yes" {
+				return nil, nil, errors.New("not confirmed")
+			}
+			return nil, &Permissions{Extensions: map[string]string{"otp": "ok"}}, nil
+		}
+	}
+
+	var got []KeyboardInteractiveRound
+	client := func(code string) KeyboardInteractiveChallenge {
+		return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			r := KeyboardInteractiveRound{Name: name, Instruction: instruction}
+			for i := range questions {
+				r.Prompts = append(r.Prompts, KeyboardInteractivePrompt{Question: questions[i], Echo: echos[i]})
+			}
+			got = append(got, r)
+			if name == "OTP" {
+				return []string{code}, nil
+			}
+			return []string{"yes"}, nil
+		}
+	}
+
+	serverConfig := &ServerConfig{KeyboardInteractiveCallback: KeyboardInteractiveRounds(step)}
+	clientConfig := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{KeyboardInteractive(client("123456"))},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if _, err := doClientServerAuth(t, serverConfig, clientConfig); err != nil {
+		t.Fatalf("client login failed: %v", err)
+	}
+	if len(got) != len(rounds) {
+		t.Fatalf("client saw %d rounds, want %d", len(got), len(rounds))
+	}
+	for i := range rounds {
+		if !reflect.DeepEqual(got[i], *rounds[i]) {
+			t.Errorf("round %d: got %+v, want %+v", i, got[i], *rounds[i])
+		}
+	}
+
+	got = nil
+	clientConfig.Auth = []AuthMethod{KeyboardInteractive(client("000000"))}
+	serverErrors, err := doClientServerAuth(t, serverConfig, clientConfig)
+	if err == nil {
+		t.Fatal("client login succeeded with a bad code")
+	}
+	if len(got) != 1 {
+		t.Errorf("client saw %d rounds after a bad code, want 1", len(got))
+	}
+	if n := len(serverErrors); n == 0 || !errors.Is(serverErrors[n-1], errBadCode) {
+		t.Errorf("got server errors %v, want the last to be %v", serverErrors, errBadCode)
+	}
+}
+
+func TestKeyboardInteractiveLanguageAndSplit(t *testing.T) {
+	long := func(c string) string { return strings.Repeat(c, 12000) }
+	round := &KeyboardInteractiveRound{
+		Name:        "Anmeldung",
+		Instruction: "Bitte antworten Sie",
+		Language:    "de",
+		Prompts: []KeyboardInteractivePrompt{
+			{Question: long("a")},
+			{Question: long("b"), Echo: true},
+			{Question: long("c")},
+		},
+	}
+	var gotAnswers []string
+	step := func(conn ConnMetadata, n int, answers []string) (*KeyboardInteractiveRound, *Permissions, error) {
+		if n == 0 {
+			return round, nil, nil
+		}
+		gotAnswers = answers
+		return nil, nil, nil
+	}
+
+	var requests []userAuthInfoRequestMsg
+	var asked []string
+	clientConfig := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			var answers []string
+			for i, q := range questions {
+				asked = append(asked, fmt.Sprintf("%s %c %v", name, q[0], echos[i]))
+				answers = append(answers, q[:1])
+			}
+			return answers, nil
+		})},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConfig.PacketTraceReader = func(packet []byte) {
+		if len(packet) > 0 && packet[0] == msgUserAuthInfoRequest {
+			var msg userAuthInfoRequestMsg
+			if err := Unmarshal(packet, &msg); err == nil {
+				requests = append(requests, msg)
+			}
+		}
+	}
+	serverConfig := &ServerConfig{KeyboardInteractiveCallback: KeyboardInteractiveRounds(step)}
+	if _, err := doClientServerAuth(t, serverConfig, clientConfig); err != nil {
+		t.Fatalf("client login failed: %v", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("got %d info requests, want the prompts split in 2", len(requests))
+	}
+	for i, msg := range requests {
+		if msg.Language != "de" || msg.Name != "Anmeldung" {
+			t.Errorf("request %d: got name %q and language %q, want Anmeldung and de", i, msg.Name, msg.Language)
+		}
+		if len(msg.Prompts)+len(Marshal(&userAuthInfoRequestMsg{Name: msg.Name, Instruction: msg.Instruction, Language: msg.Language})) > minPacketSize {
+			t.Errorf("request %d exceeds %d bytes", i, minPacketSize)
+		}
+	}
+	if requests[0].Instruction != round.Instruction || requests[1].Instruction != "" {
+		t.Errorf("got instructions %q and %q, want the instruction in the first request only", requests[0].Instruction, requests[1].Instruction)
+	}
+	if want := []string{"Anmeldung a false", "Anmeldung b true", "Anmeldung c false"}; !reflect.DeepEqual(asked, want) {
+		t.Errorf("client was asked %q, want %q", asked, want)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(gotAnswers, want) {
+		t.Errorf("step got answers %q, want %q", gotAnswers, want)
+	}
+
+	// An instruction that can't fit in a packet fails the attempt
+	// instead of being truncated, as does an invalid language tag.
+	for _, bad := range []KeyboardInteractiveRound{
+		{Name: "n", Instruction: strings.Repeat("x", minPacketSize), Language: "de"},
+		{Name: "n", Language: "de utf8", Prompts: round.Prompts[:1]},
+	} {
+		bad := bad
+		step := func(conn ConnMetadata, n int, answers []string) (*KeyboardInteractiveRound, *Permissions, error) {
+			if n == 0 {
+				return &bad, nil, nil
+			}
+			return nil, nil, nil
+		}
+		serverConfig := &ServerConfig{KeyboardInteractiveCallback: KeyboardInteractiveRounds(step)}
+		clientConfig.PacketTraceReader = nil
+		if _, err := doClientServerAuth(t, serverConfig, clientConfig); err == nil {
+			t.Errorf("login succeeded with an unsendable round %.40q", bad.Instruction+bad.Language)
+		}
+	}
+}
+
+// skTestSigner signs like an Ed25519 security key, with the given flags.
+type skTestSigner struct {
+	priv  ed25519.PrivateKey
+	flags byte
+}
+
+func (s *skTestSigner) PublicKey() PublicKey {
+	return &skEd25519PublicKey{
+		application: "ssh:",
+		PublicKey:   s.priv.Public().(ed25519.PublicKey),
+	}
+}
+
+func (s *skTestSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	appDigest := sha256.Sum256([]byte("ssh:"))
+	dataDigest := sha256.Sum256(data)
+	blob := Marshal(struct {
+		ApplicationDigest []byte `ssh:"rest"`
+		Flags             byte
+		Counter           uint32
+		MessageDigest     []byte `ssh:"rest"`
+	}{appDigest[:], s.flags, 1, dataDigest[:]})
+	return &Signature{
+		Format: KeyAlgoSKED25519,
+		Blob:   ed25519.Sign(s.priv, blob),
+		Rest:   Marshal(skFields{Flags: s.flags, Counter: 1}),
+	}, nil
+}
+
+func TestSKUserPresence(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		flags     byte
+		noTouch   bool
+		cert      bool
+		wantError bool
+	}{
+		{"touched", SKFlagUserPresent, false, false, false},
+		{"untouched", 0, false, false, true},
+		{"untouched with option", 0, true, false, false},
+		{"untouched cert", 0, false, true, true},
+		{"untouched cert with extension", 0, true, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var signer Signer = &skTestSigner{priv: priv, flags: tt.flags}
+			exts := map[string]string{}
+			if tt.noTouch {
+				exts[NoTouchRequiredExtension] = ""
+			}
+			serverConf := &ServerConfig{
+				PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+					return &Permissions{Extensions: exts}, nil
+				},
+			}
+			if tt.cert {
+				cert := &Certificate{
+					Key:             signer.PublicKey(),
+					ValidPrincipals: []string{"user"},
+					ValidBefore:     CertTimeInfinity,
+					CertType:        UserCert,
+					Permissions:     Permissions{Extensions: exts},
+				}
+				if err := cert.SignCert(rand.Reader, testSigners["ecdsa"]); err != nil {
+					t.Fatal(err)
+				}
+				if signer, err = NewCertSigner(cert, signer); err != nil {
+					t.Fatal(err)
+				}
+				checker := &CertChecker{
+					IsUserAuthority: func(auth PublicKey) bool {
+						return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+					},
+				}
+				serverConf.PublicKeyCallback = checker.Authenticate
+			}
+			serverConf.AddHostKey(testSigners["rsa"])
+
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+			go NewServerConn(c1, serverConf)
+			_, _, _, err = NewClientConn(c2, "", &ClientConfig{
+				User:            "user",
+				Auth:            []AuthMethod{PublicKeys(signer)},
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			})
+			if (err != nil) != tt.wantError {
+				t.Errorf("got %v, want error %v", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestHostKeyRing(t *testing.T) {
+	ring := new(HostKeyRing)
+	ring.Add(testSigners["ecdsa"])
+	serverConf := &ServerConfig{NoClientAuth: true, HostKeyRing: ring}
+	// Ignored in favour of the ring.
+	serverConf.AddHostKey(testSigners["ed25519"])
+
+	hostKey := func() PublicKey {
+		var got PublicKey
+		clientConf := &ClientConfig{
+			User: "user",
+			HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+				got = key
+				return nil
+			},
+		}
+		testClientServerConn(t, serverConf, clientConf)
+		return got
+	}
+
+	if got := hostKey(); !bytes.Equal(got.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+		t.Errorf("got host key %s, want the ecdsa key", got.Type())
+	}
+
+	// Rotate while handshakes may be running.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ring.Add(testSigners["rsa"])
+		}
+	}()
+	hostKey()
+	<-done
+	if !ring.Remove(testPublicKeys["ecdsa"]) {
+		t.Fatal("Remove did not find the ecdsa key")
+	}
+	if ring.Remove(testPublicKeys["ecdsa"]) {
+		t.Error("Remove found the ecdsa key twice")
+	}
+	if got := hostKey(); !bytes.Equal(got.Marshal(), testPublicKeys["rsa"].Marshal()) {
+		t.Errorf("got host key %s, want the rsa key", got.Type())
+	}
+	if n := len(ring.Keys()); n != 1 {
+		t.Errorf("got %d keys in the ring, want 1", n)
+	}
+}
+
+func TestUnknownAuthCallback(t *testing.T) {
+	const method = "vendor-token@example.com"
+	var attempts []string
+	serverConfig := &ServerConfig{
+		UnknownAuthCallback: func(conn ConnMetadata, m string, payload []byte) (*Permissions, error) {
+			attempts = append(attempts, m)
+			if m != method || string(payload) != "secret" {
+				return nil, errors.New("bad token")
+			}
+			return &Permissions{Extensions: map[string]string{"method": m}}, nil
+		},
+	}
+	serverConfig.AddHostKey(testSigners["rsa"])
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverDone := make(chan *ServerConn, 1)
+	go func() {
+		conn, _, _, err := NewServerConn(c1, serverConfig)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+		}
+		serverDone <- conn
+	}()
+
+	clientConfig := ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConfig.SetDefaults()
+	v := []byte(packageVersion)
+	if _, err := exchangeVersions(c2, v); err != nil {
+		t.Fatalf("exchangeVersions: %v", err)
+	}
+	tr := newClientTransport(newTransport(c2, clientConfig.Rand, true), v, v, &clientConfig, "", c2.RemoteAddr())
+	if err := tr.waitSession(); err != nil {
+		t.Fatalf("waitSession: %v", err)
+	}
+	if err := tr.writePacket(Marshal(&serviceRequestMsg{serviceUserAuth})); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		packet, err := tr.readPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet[0] == msgServiceAccept {
+			break
+		}
+	}
+
+	send := func(m, payload string) byte {
+		t.Helper()
+		if err := tr.writePacket(Marshal(&userAuthRequestMsg{
+			User:    "user",
+			Service: serviceSSH,
+			Method:  m,
+			Payload: []byte(payload),
+		})); err != nil {
+			t.Fatal(err)
+		}
+		packet, err := tr.readPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packet[0]
+	}
+	if got := send("other-vendor@example.com", "secret"); got != msgUserAuthFailure {
+		t.Errorf("unknown method: got message %d, want failure", got)
+	}
+	if got := send(method, "wrong"); got != msgUserAuthFailure {
+		t.Errorf("wrong token: got message %d, want failure", got)
+	}
+	if got := send(method, "secret"); got != msgUserAuthSuccess {
+		t.Errorf("right token: got message %d, want success", got)
+	}
+	conn := <-serverDone
+	if conn == nil {
+		t.FailNow()
+	}
+	if got := conn.Permissions.Extensions["method"]; got != method {
+		t.Errorf("got permissions for %q, want %q", got, method)
+	}
+	if want := []string{"other-vendor@example.com", method, method}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("got attempts %q, want %q", attempts, want)
+	}
+}
+
+func TestAlgorithmPolicy(t *testing.T) {
+	errWeak := errors.New("client offers only weak ciphers")
+	var seen []string
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		AlgorithmPolicy: func(client KexInit) error {
+			seen = append(seen, client.CiphersClientServer...)
+			for _, c := range client.CiphersClientServer {
+				if c != aes128cbcID && c != tripledescbcID {
+					return nil
+				}
+			}
+			return errWeak
+		},
+	}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverConf.Ciphers = []string{"aes128-ctr", tripledescbcID}
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.Ciphers = []string{tripledescbcID}
+	_, _, _, _, err := NewPipeClientServer(clientConf, serverConf)
+	var de *DisconnectError
+	if !errors.As(err, &de) {
+		t.Fatalf("client error: got %v, want a *DisconnectError", err)
+	}
+	if de.Reason != DisconnectProtocolError || de.Message != errWeak.Error() {
+		t.Errorf("got disconnect %v %q, want %v %q", de.Reason, de.Message, DisconnectProtocolError, errWeak)
+	}
+	if !reflect.DeepEqual(seen, []string{tripledescbcID}) {
+		t.Errorf("policy saw ciphers %q, want the client's list", seen)
+	}
+
+	// A client that also offers a strong cipher is let through.
+	clientConf.Ciphers = []string{tripledescbcID, "aes128-ctr"}
+	client, _, _, reqs, err := NewPipeClientServer(clientConf, serverConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	go DiscardRequests(reqs)
+	client.Close()
+}
+
+func TestUnhandledGlobalRequests(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverConf.UnhandledGlobalRequests = GlobalRequestCallHandler
+	serverConf.UnhandledGlobalRequestHandler = func(req *Request) {
+		req.Reply(true, []byte("caught "+req.Type))
+	}
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	var clientGot atomic.Value
+	clientConf.UnhandledGlobalRequests = GlobalRequestCallHandler
+	clientConf.UnhandledGlobalRequestHandler = func(req *Request) {
+		clientGot.Store(req.Type)
+		req.Reply(true, nil)
+	}
+
+	client, server, _, reqs, err := NewPipeClientServer(clientConf, serverConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	defer client.Close()
+	go func() {
+		for req := range reqs {
+			t.Errorf("request %q delivered on the Request channel", req.Type)
+			req.Reply(false, nil)
+		}
+	}()
+
+	ok, resp, err := client.SendRequest("custom@example.com", true, nil)
+	if err != nil || !ok || string(resp) != "caught custom@example.com" {
+		t.Errorf("server handler: got %v, %q, %v, want true, %q, nil", ok, resp, err, "caught custom@example.com")
+	}
+	if ok, _, err := server.SendRequest("to-client@example.com", true, nil); err != nil || !ok {
+		t.Errorf("client handler: got %v, %v, want true, nil", ok, err)
+	}
+	if got := clientGot.Load(); got != "to-client@example.com" {
+		t.Errorf("client handler got %v, want to-client@example.com", got)
+	}
+}
+
+func TestUnhandledGlobalRequestsIgnore(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverConf.UnhandledGlobalRequests = GlobalRequestIgnore
+	serverConf.MaxPendingGlobalRequests = 1
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	client, server, _, reqs, err := NewPipeClientServer(clientConf, serverConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	defer client.Close()
+
+	// Ignored requests wanting a reply don't count as pending, so the
+	// server doesn't disconnect for too many of them.
+	for i := 0; i < 3; i++ {
+		go client.SendRequest("silent@example.com", true, nil)
+	}
+	if _, _, err := client.SendRequest("silent@example.com", false, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	select {
+	case req := <-reqs:
+		t.Fatalf("request %q delivered on the Request channel", req.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mux := server.Conn.(*connection).mux
+	if n := mux.replies.len(); n != 0 {
+		t.Errorf("got %d pending requests, want 0", n)
+	}
+}
+
+// hostBoundAuth authenticates with the publickey-hostbound-v00@openssh.com
+// method, naming hostKey as the server's host key.
+type hostBoundAuth struct {
+	signer  Signer
+	hostKey []byte
+
+	// advertised records whether the server sent the
+	// publickey-hostbound extension.
+	advertised *bool
+}
+
+// method returns "publickey", which is what servers list in their
+// failure messages for both variants.
+func (a hostBoundAuth) method() string { return "publickey" }
+
+func (a hostBoundAuth) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (authResult, []string, error) {
+	*a.advertised = string(extensions[publicKeyHostBoundExtension]) == "0"
+	algo := a.signer.PublicKey().Type()
+	pubKey := a.signer.PublicKey().Marshal()
+	data := buildDataSignedForAuth(session, userAuthRequestMsg{
+		User:    user,
+		Service: serviceSSH,
+		Method:  publicKeyHostBoundMethod,
+	}, algo, pubKey)
+	data = appendString(data, string(a.hostKey))
+	sig, err := a.signer.Sign(rand, data)
+	if err != nil {
+		return authFailure, nil, err
+	}
+	rest := appendString(nil, string(a.hostKey))
+	rest = appendString(rest, string(Marshal(sig)))
+	if err := c.writePacket(Marshal(&publickeyAuthMsg{
+		User:     user,
+		Service:  serviceSSH,
+		Method:   publicKeyHostBoundMethod,
+		HasSig:   true,
+		Algoname: algo,
+		PubKey:   pubKey,
+		Sig:      rest,
+	})); err != nil {
+		return authFailure, nil, err
+	}
+	return handleAuthResponse(c)
+}
+
+func TestPublicKeyHostBoundAuth(t *testing.T) {
+	newServerConfig := func() *ServerConfig {
+		return &ServerConfig{
+			PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+				if !bytes.Equal(key.Marshal(), testPublicKeys["ed25519"].Marshal()) {
+					return nil, errors.New("unknown key")
+				}
+				return nil, nil
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		hostKey PublicKey
+		wantErr bool
+	}{
+		{"session host key", testPublicKeys["rsa"], false},
+		{"other host key", testPublicKeys["ecdsa"], true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var advertised bool
+			_, err := doClientServerAuth(t, newServerConfig(), &ClientConfig{
+				User: "testuser",
+				Auth: []AuthMethod{hostBoundAuth{
+					signer:     testSigners["ed25519"],
+					hostKey:    tt.hostKey.Marshal(),
+					advertised: &advertised,
+				}},
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if !advertised {
+				t.Error("server did not advertise publickey-hostbound")
+			}
+		})
+	}
+
+	// Clients that don't negotiate ext-info keep using "publickey".
+	clientConfig := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["ed25519"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConfig.DisableExtInfo = true
+	if _, err := doClientServerAuth(t, newServerConfig(), clientConfig); err != nil {
+		t.Errorf("publickey auth without ext-info: %v", err)
+	}
+}
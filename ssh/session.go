@@ -9,11 +9,15 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Signal string
@@ -49,8 +53,66 @@ var signals = map[Signal]int{
 	SIGTERM: 15,
 }
 
+// TerminalModes maps the opcodes of encoded terminal modes, listed in RFC
+// 4254 Section 8, to their arguments.
 type TerminalModes map[uint8]uint32
 
+// MarshalTerminalModes returns the encoding of modes used in pty-req
+// requests, sorted by opcode and terminated by TTY_OP_END. An opcode
+// of 0 in modes is skipped, since it would end the encoding. Opcodes 160
+// to 255 have no defined argument format; they are encoded with a
+// uint32 argument, and, being last, stop the parsing of the rest.
+func MarshalTerminalModes(modes TerminalModes) []byte {
+	opcodes := make([]int, 0, len(modes))
+	for k := range modes {
+		if k != tty_OP_END {
+			opcodes = append(opcodes, int(k))
+		}
+	}
+	sort.Ints(opcodes)
+
+	b := make([]byte, 0, 5*len(opcodes)+1)
+	for _, k := range opcodes {
+		b = append(b, byte(k))
+		b = appendU32(b, modes[uint8(k)])
+	}
+	return append(b, tty_OP_END)
+}
+
+// ParseTerminalModes parses encoded terminal modes, as sent in pty-req
+// requests. Opcodes 1 to 159 all take a uint32 argument, and are
+// returned whether or not they are known. A non-empty encoding must end
+// with TTY_OP_END, with nothing after it. As RFC 4254 requires, parsing
+// stops at an opcode from 160 to 255, which is not returned, and
+// whatever follows it is not checked. Such opcodes cannot be preserved:
+// their argument format is undefined, so neither they nor the modes
+// after them can be told apart. A proxy that must relay them faithfully
+// should forward data itself rather than re-encode the parsed modes.
+func ParseTerminalModes(data []byte) (TerminalModes, error) {
+	modes := make(TerminalModes)
+	for len(data) > 0 {
+		opcode := data[0]
+		if opcode >= 160 {
+			return modes, nil
+		}
+		if opcode == tty_OP_END {
+			if len(data) > 1 {
+				return nil, errors.New("ssh: trailing data after TTY_OP_END in terminal modes")
+			}
+			return modes, nil
+		}
+		if len(data) < 5 {
+			return nil, fmt.Errorf("ssh: truncated argument of terminal mode %d", opcode)
+		}
+		modes[opcode] = binary.BigEndian.Uint32(data[1:5])
+		data = data[5:]
+		if len(data) == 0 {
+			return nil, errors.New("ssh: terminal modes not terminated by TTY_OP_END")
+		}
+	}
+	return modes, nil
+}
+
 // POSIX terminal mode flags as listed in RFC 4254 Section 8.
 const (
 	tty_OP_END    = 0
@@ -131,6 +193,7 @@ type Session struct {
 	Stderr io.Writer
 
 	ch        Channel // the channel backing this session
+	client    *Client // the client that opened the session
 	started   bool    // true once Start, Run or Shell is invoked.
 	copyFuncs []func() error
 	errors    chan error // one send per copyFunc
@@ -138,18 +201,63 @@ type Session struct {
 	// true if pipe method is active
 	stdinpipe, stdoutpipe, stderrpipe bool
 
+	// pty is set once RequestPty has succeeded.
+	pty atomic.Bool
+
 	// stdinPipeWriter is non-nil if StdinPipe has not been called
 	// and Stdin was specified by the user; it is the write end of
 	// a pipe connecting Session.Stdin to the stdin channel.
 	stdinPipeWriter io.WriteCloser
 
 	exitStatus chan error
+
+	// requestHandler is set by SetRequestHandler.
+	requestHandler atomic.Pointer[func(req *Request)]
+}
+
+// SetRequestHandler makes the session pass the channel requests from the
+// server that it doesn't handle itself, that is all but "exit-status"
+// and "exit-signal", to handler, which must call Reply on those that
+// want a reply. Without a handler, or after SetRequestHandler(nil), such
+// requests are refused. The handler is called from the goroutine that
+// services the session's requests, so it should return promptly; to
+// catch early requests, set it before starting the command.
+func (s *Session) SetRequestHandler(handler func(req *Request)) {
+	if handler == nil {
+		s.requestHandler.Store(nil)
+		return
+	}
+	s.requestHandler.Store(&handler)
 }
 
 // SendRequest sends an out-of-band channel request on the SSH channel
 // underlying the session.
 func (s *Session) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
-	return s.ch.SendRequest(name, wantReply, payload)
+	return s.SendRequestContext(context.Background(), name, wantReply, payload)
+}
+
+// SendRequestContext is like SendRequest, but gives up waiting for the
+// reply once ctx is done, as RequestContextChannel.SendRequestContext
+// does. If the underlying channel does not implement
+// RequestContextChannel, ctx is ignored.
+func (s *Session) SendRequestContext(ctx context.Context, name string, wantReply bool, payload []byte) (bool, error) {
+	// The server may open agent channels before its reply arrives, so
+	// they are allowed while the request is pending.
+	forwarding := name == agentForwardRequest && s.client != nil
+	if forwarding {
+		s.client.agentForwarding.Add(1)
+	}
+	var ok bool
+	var err error
+	if ch, isCtx := s.ch.(RequestContextChannel); isCtx {
+		ok, err = ch.SendRequestContext(ctx, name, wantReply, payload)
+	} else {
+		ok, err = s.ch.SendRequest(name, wantReply, payload)
+	}
+	if forwarding && (err != nil || (wantReply && !ok)) {
+		s.client.agentForwarding.Add(-1)
+	}
+	return ok, err
 }
 
 func (s *Session) Close() error {
@@ -186,18 +294,20 @@ type ptyRequestMsg struct {
 	Modelist string
 }
 
+// validPtyRequest reports whether payload is a well-formed pty-req
+// request, including its encoded terminal modes.
+func validPtyRequest(payload []byte) bool {
+	var req ptyRequestMsg
+	if err := Unmarshal(payload, &req); err != nil {
+		return false
+	}
+	_, err := ParseTerminalModes([]byte(req.Modelist))
+	return err == nil
+}
+
 // RequestPty requests the association of a pty with the session on the remote host.
 func (s *Session) RequestPty(term string, h, w int, termmodes TerminalModes) error {
-	var tm []byte
-	for k, v := range termmodes {
-		kv := struct {
-			Key byte
-			Val uint32
-		}{k, v}
-
-		tm = append(tm, Marshal(&kv)...)
-	}
-	tm = append(tm, tty_OP_END)
+	tm := MarshalTerminalModes(termmodes)
 	req := ptyRequestMsg{
 		Term:     term,
 		Columns:  uint32(w),
@@ -210,6 +320,9 @@ func (s *Session) RequestPty(term string, h, w int, termmodes TerminalModes) err
 	if err == nil && !ok {
 		err = errors.New("ssh: pty-req failed")
 	}
+	if err == nil {
+		s.pty.Store(true)
+	}
 	return err
 }
 
@@ -218,15 +331,26 @@ type subsystemRequestMsg struct {
 	Subsystem string
 }
 
+// ErrSubsystemRefused is returned by RequestSubsystem if the server
+// refuses the request, for example because it doesn't provide the
+// subsystem.
+var ErrSubsystemRefused = errors.New("ssh: subsystem request failed")
+
 // RequestSubsystem requests the association of a subsystem with the session on the remote host.
-// A subsystem is a predefined command that runs in the background when the ssh session is initiated
+// A subsystem is a predefined command that runs in the background when the ssh session is initiated.
+// It returns ErrSubsystemRefused if the server refuses the request, and
+// an error if the session has already been started by Run, Start or
+// Shell.
 func (s *Session) RequestSubsystem(subsystem string) error {
+	if s.started {
+		return errors.New("ssh: session already started")
+	}
 	msg := subsystemRequestMsg{
 		Subsystem: subsystem,
 	}
 	ok, err := s.ch.SendRequest("subsystem", true, Marshal(&msg))
 	if err == nil && !ok {
-		err = errors.New("ssh: subsystem request failed")
+		err = ErrSubsystemRefused
 	}
 	return err
 }
@@ -240,12 +364,16 @@ type ptyWindowChangeMsg struct {
 }
 
 // WindowChange informs the remote host about a terminal window dimension change to h rows and w columns.
+// The pixel dimensions are sent as zero, meaning unknown. It returns an
+// error if no pty has been requested with RequestPty. It may be called
+// concurrently with the session's I/O.
 func (s *Session) WindowChange(h, w int) error {
+	if !s.pty.Load() {
+		return errors.New("ssh: window-change without pty")
+	}
 	req := ptyWindowChangeMsg{
 		Columns: uint32(w),
 		Rows:    uint32(h),
-		Width:   uint32(w * 8),
-		Height:  uint32(h * 8),
 	}
 	_, err := s.ch.SendRequest("window-change", false, Marshal(&req))
 	return err
@@ -256,11 +384,22 @@ type signalMsg struct {
 	Signal string
 }
 
-// Signal sends the given signal to the remote process.
-// sig is one of the SIG* constants.
+// Signal sends the given signal to the remote process with a "signal"
+// request. sig is one of the SIG* constants, or another signal name
+// without the "SIG" prefix as RFC 4254 requires; a "SIG" prefix is
+// removed. It returns an error if no command has been started with
+// Start, Shell or Run, and it may be called concurrently with Wait.
+// Servers need not act on signals, and no reply is requested.
 func (s *Session) Signal(sig Signal) error {
+	if !s.started {
+		return errors.New("ssh: session not started")
+	}
+	name := strings.TrimPrefix(string(sig), "SIG")
+	if name == "" {
+		return errors.New("ssh: empty signal name")
+	}
 	msg := signalMsg{
-		Signal: string(sig),
+		Signal: name,
 	}
 
 	_, err := s.ch.SendRequest("signal", false, Marshal(&msg))
@@ -437,9 +576,14 @@ func (s *Session) wait(reqs <-chan *Request) error {
 
 			// Must sanitize strings?
 			wm.signal = sigval.Signal
+			wm.coreDumped = sigval.CoreDumped
 			wm.msg = sigval.Error
 			wm.lang = sigval.Lang
 		default:
+			if h := s.requestHandler.Load(); h != nil {
+				(*h)(msg)
+				continue
+			}
 			// This handles keepalives and matches
 			// OpenSSH's behaviour.
 			if msg.WantReply {
@@ -608,10 +752,11 @@ func (e *ExitError) Error() string {
 // Waitmsg stores the information about an exited remote command
 // as reported by Wait.
 type Waitmsg struct {
-	status int
-	signal string
-	msg    string
-	lang   string
+	status     int
+	signal     string
+	coreDumped bool
+	msg        string
+	lang       string
 }
 
 // ExitStatus returns the exit status of the remote command.
@@ -625,6 +770,12 @@ func (w Waitmsg) Signal() string {
 	return w.signal
 }
 
+// CoreDumped reports whether the remote command dumped core when it was
+// terminated by the signal returned by Signal.
+func (w Waitmsg) CoreDumped() bool {
+	return w.coreDumped
+}
+
 // Msg returns the exit message given by the remote command
 func (w Waitmsg) Msg() string {
 	return w.msg
@@ -639,6 +790,9 @@ func (w Waitmsg) String() string {
 	str := fmt.Sprintf("Process exited with status %v", w.status)
 	if w.signal != "" {
 		str += fmt.Sprintf(" from signal %v", w.signal)
+		if w.coreDumped {
+			str += " (core dumped)"
+		}
 	}
 	if w.msg != "" {
 		str += fmt.Sprintf(". Reason was: %v", w.msg)
@@ -0,0 +1,133 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"errors"
+)
+
+// PtyRequest describes the pseudo-terminal asked for by a "pty-req"
+// request (RFC 4254, section 6.2), as updated by later "window-change"
+// requests.
+type PtyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32 // in pixels, or zero
+	Height  uint32 // in pixels, or zero
+	Modes   TerminalModes
+}
+
+// SessionStart is the state of a server-side "session" channel when it
+// is started, as returned by WaitSessionStart.
+type SessionStart struct {
+	// Type is the type of the request that started the session: "shell",
+	// "exec" or "subsystem".
+	Type string
+
+	// Command is the command of an "exec" request, or the subsystem
+	// name of a "subsystem" request. It is empty for "shell".
+	Command string
+
+	// Env holds the variables sent with "env" requests, by name. It is
+	// never nil.
+	Env map[string]string
+
+	// Pty is the last pseudo-terminal requested, or nil if none was.
+	Pty *PtyRequest
+
+	// Request is the request that started the session. It has not been
+	// replied to: the caller must call Request.Reply once it has
+	// decided whether to run the session.
+	Request *Request
+}
+
+// WaitSessionStart services the requests of a server-side "session"
+// channel until the client starts the session, and returns the state
+// collected so far. in must be the request channel returned with ch by
+// NewChannel.Accept; the caller keeps servicing it after
+// WaitSessionStart returns, for example for "window-change" and
+// "signal" requests.
+//
+// "env" requests are accepted and recorded, and if ServerConfig.AcceptEnv
+// is set, the variables it accepted are included too. "pty-req" requests
+// with valid terminal modes are accepted, and "window-change" requests
+// update the recorded pty. All other requests are refused. If in is
+// closed before the session is started, WaitSessionStart returns an
+// error.
+func WaitSessionStart(ch Channel, in <-chan *Request) (*SessionStart, error) {
+	start := &SessionStart{Env: make(map[string]string)}
+	for req := range in {
+		switch req.Type {
+		case "env":
+			var msg setenvRequest
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			start.Env[msg.Name] = msg.Value
+			req.Reply(true, nil)
+		case "pty-req":
+			var msg ptyRequestMsg
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			modes, err := ParseTerminalModes([]byte(msg.Modelist))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			start.Pty = &PtyRequest{
+				Term:    msg.Term,
+				Columns: msg.Columns,
+				Rows:    msg.Rows,
+				Width:   msg.Width,
+				Height:  msg.Height,
+				Modes:   modes,
+			}
+			req.Reply(true, nil)
+		case "window-change":
+			var msg ptyWindowChangeMsg
+			if err := Unmarshal(req.Payload, &msg); err != nil || start.Pty == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			start.Pty.Columns = msg.Columns
+			start.Pty.Rows = msg.Rows
+			start.Pty.Width = msg.Width
+			start.Pty.Height = msg.Height
+			req.Reply(true, nil)
+		case "shell":
+			start.Type, start.Request = req.Type, req
+		case "exec":
+			var msg execMsg
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			start.Type, start.Command, start.Request = req.Type, msg.Command, req
+		case "subsystem":
+			var msg subsystemRequestMsg
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			start.Type, start.Command, start.Request = req.Type, msg.Subsystem, req
+		default:
+			req.Reply(false, nil)
+		}
+
+		if start.Request != nil {
+			if envCh, ok := ch.(EnvChannel); ok {
+				for k, v := range envCh.Env() {
+					start.Env[k] = v
+				}
+			}
+			return start, nil
+		}
+	}
+	return nil, errors.New("ssh: session channel closed before it was started")
+}
@@ -13,6 +13,8 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 
@@ -23,6 +25,11 @@ type serverType func(Channel, <-chan *Request, *testing.T)
 
 // dial constructs a new test server and returns a *ClientConn.
 func dial(handler serverType, t *testing.T) *Client {
+	return dialConfig(&ServerConfig{NoClientAuth: true}, handler, t)
+}
+
+// dialConfig is like dial, with the server made with conf.
+func dialConfig(conf *ServerConfig, handler serverType, t *testing.T) *Client {
 	c1, c2, err := netPipe()
 	if err != nil {
 		t.Fatalf("netPipe: %v", err)
@@ -36,12 +43,9 @@ func dial(handler serverType, t *testing.T) *Client {
 			c1.Close()
 			wg.Done()
 		}()
-		conf := ServerConfig{
-			NoClientAuth: true,
-		}
 		conf.AddHostKey(testSigners["rsa"])
 
-		conn, chans, reqs, err := NewServerConn(c1, &conf)
+		conn, chans, reqs, err := NewServerConn(c1, conf)
 		if err != nil {
 			t.Errorf("Unable to handshake: %v", err)
 			return
@@ -88,6 +92,271 @@ func dial(handler serverType, t *testing.T) *Client {
 }
 
 // Test a simple string is returned to session.Stdout.
+func TestSessionRequestSubsystem(t *testing.T) {
+	conn := dial(func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		for req := range in {
+			switch req.Type {
+			case "subsystem":
+				var msg subsystemRequestMsg
+				if err := Unmarshal(req.Payload, &msg); err != nil {
+					t.Errorf("Unmarshal: %v", err)
+				}
+				ok := msg.Subsystem == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					io.WriteString(ch, "sftp-ready")
+					sendStatus(0, ch, t)
+					return
+				}
+			case "shell":
+				req.Reply(true, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}, t)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := session.RequestSubsystem("nonexistent"); err != ErrSubsystemRefused {
+		t.Fatalf("RequestSubsystem(nonexistent): got %v, want ErrSubsystemRefused", err)
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("RequestSubsystem(sftp): %v", err)
+	}
+	got, err := io.ReadAll(stdout)
+	if err != nil || string(got) != "sftp-ready" {
+		t.Errorf("got %q, %v, want %q", got, err, "sftp-ready")
+	}
+
+	session, err = conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	if err := session.RequestSubsystem("sftp"); err == nil || err == ErrSubsystemRefused {
+		t.Errorf("RequestSubsystem after Shell: got %v, want a session started error", err)
+	}
+}
+
+func TestSessionWindowChange(t *testing.T) {
+	changes := make(chan ptyWindowChangeMsg, 100)
+	conn := dial(func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		defer close(changes)
+		go io.Copy(ch, ch)
+		for req := range in {
+			switch req.Type {
+			case "pty-req", "shell":
+				req.Reply(true, nil)
+			case "window-change":
+				var msg ptyWindowChangeMsg
+				if err := Unmarshal(req.Payload, &msg); err != nil {
+					t.Errorf("Unmarshal: %v", err)
+				}
+				changes <- msg
+				if msg.Rows == 0 {
+					return
+				}
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}, t)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.WindowChange(24, 80); err == nil {
+		t.Error("WindowChange succeeded without a pty")
+	}
+	if err := session.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if _, err := stdin.Write([]byte("x")); err != nil {
+				t.Errorf("Write: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.ReadFull(stdout, make([]byte, n)); err != nil {
+			t.Errorf("ReadFull: %v", err)
+		}
+	}()
+	for i := 1; i <= n; i++ {
+		if err := session.WindowChange(i, 2*i); err != nil {
+			t.Fatalf("WindowChange: %v", err)
+		}
+	}
+	wg.Wait()
+	if err := session.WindowChange(0, 0); err != nil {
+		t.Fatalf("WindowChange: %v", err)
+	}
+
+	i := 1
+	for msg := range changes {
+		if msg.Rows == 0 {
+			break
+		}
+		want := ptyWindowChangeMsg{Columns: uint32(2 * i), Rows: uint32(i)}
+		if msg != want {
+			t.Errorf("got window change %+v, want %+v", msg, want)
+		}
+		i++
+	}
+	if i != n+1 {
+		t.Errorf("got %d window changes, want %d", i-1, n)
+	}
+}
+
+func TestTerminalModes(t *testing.T) {
+	modes := TerminalModes{ECHO: 0, TTY_OP_ISPEED: 38400, VINTR: 3, 150: 7, tty_OP_END: 1}
+	want := []byte{
+		VINTR, 0, 0, 0, 3,
+		ECHO, 0, 0, 0, 0,
+		TTY_OP_ISPEED, 0, 0, 0x96, 0,
+		150, 0, 0, 0, 7,
+		tty_OP_END,
+	}
+	got := MarshalTerminalModes(modes)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("MarshalTerminalModes: got %v, want %v", got, want)
+	}
+
+	parsed, err := ParseTerminalModes(got)
+	if err != nil {
+		t.Fatalf("ParseTerminalModes: %v", err)
+	}
+	delete(modes, tty_OP_END)
+	if !reflect.DeepEqual(parsed, modes) {
+		t.Errorf("ParseTerminalModes: got %v, want %v", parsed, modes)
+	}
+
+	// Parsing stops at opcodes 160 to 255.
+	parsed, err = ParseTerminalModes([]byte{ECHO, 0, 0, 0, 1, 200, 1, VINTR, 0, 0, 0, 3, tty_OP_END})
+	if err != nil {
+		t.Fatalf("ParseTerminalModes: %v", err)
+	}
+	if want := (TerminalModes{ECHO: 1}); !reflect.DeepEqual(parsed, want) {
+		t.Errorf("ParseTerminalModes: got %v, want %v", parsed, want)
+	}
+
+	if _, err := ParseTerminalModes([]byte{ECHO, 0, 0}); err == nil {
+		t.Error("ParseTerminalModes succeeded on a truncated argument")
+	}
+	if parsed, err := ParseTerminalModes(nil); err != nil || len(parsed) != 0 {
+		t.Errorf("ParseTerminalModes(nil): got %v, %v", parsed, err)
+	}
+	if _, err := ParseTerminalModes([]byte{ECHO, 0, 0, 0, 1}); err == nil {
+		t.Error("ParseTerminalModes succeeded without TTY_OP_END")
+	}
+	if _, err := ParseTerminalModes([]byte{ECHO, 0, 0, 0, 1, tty_OP_END, 0}); err == nil {
+		t.Error("ParseTerminalModes succeeded with data after TTY_OP_END")
+	}
+}
+
+func TestServerRejectsMalformedPtyRequest(t *testing.T) {
+	testServerPtyRequests(t, false)
+}
+
+func TestServerAllowMalformedPtyRequests(t *testing.T) {
+	testServerPtyRequests(t, true)
+}
+
+func testServerPtyRequests(t *testing.T, allowMalformed bool) {
+	received := make(chan []byte, 10)
+	conf := &ServerConfig{NoClientAuth: true, AllowMalformedPtyRequests: allowMalformed}
+	conn := dialConfig(conf, func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		for req := range in {
+			if req.Type == "pty-req" {
+				received <- req.Payload
+			}
+			req.Reply(true, nil)
+		}
+	}, t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	ptyReq := func(modes []byte) []byte {
+		return Marshal(&ptyRequestMsg{Term: "xterm", Columns: 80, Rows: 24, Modelist: string(modes)})
+	}
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		ok      bool
+	}{
+		{"valid", ptyReq([]byte{ECHO, 0, 0, 0, 1, 150, 0, 0, 0, 7, tty_OP_END}), true},
+		{"empty modes", ptyReq(nil), true},
+		{"undefined opcode", ptyReq([]byte{ECHO, 0, 0, 0, 1, 200, 1, 2}), true},
+		{"no TTY_OP_END", ptyReq([]byte{ECHO, 0, 0, 0, 1}), false},
+		{"truncated argument", ptyReq([]byte{ECHO, 0, 0}), false},
+		{"data after TTY_OP_END", ptyReq([]byte{tty_OP_END, ECHO}), false},
+		{"truncated request", ptyReq(nil)[:10], false},
+	} {
+		ok, err := session.SendRequest("pty-req", true, tt.payload)
+		if err != nil {
+			t.Fatalf("%s: SendRequest: %v", tt.name, err)
+		}
+		if allowMalformed {
+			// All requests are passed on, and the handler
+			// accepts them.
+			tt.ok = true
+		}
+		if ok != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, ok, tt.ok)
+		}
+		if tt.ok {
+			// Accepted requests reach the handler unchanged.
+			if got := <-received; !bytes.Equal(got, tt.payload) {
+				t.Errorf("%s: handler got %x, want %x", tt.name, got, tt.payload)
+			}
+		}
+	}
+	if len(received) != 0 {
+		t.Errorf("%d malformed requests reached the handler", len(received))
+	}
+}
+
 func TestSessionShell(t *testing.T) {
 	conn := dial(shellHandler, t)
 	defer conn.Close()
@@ -287,6 +556,41 @@ func TestKnownExitSignalOnly(t *testing.T) {
 	if e.Signal() != "TERM" || e.ExitStatus() != 143 {
 		t.Fatalf("expected command to exit with signal TERM and status 143 but got signal %s and status %v", e.Signal(), e.ExitStatus())
 	}
+	if e.CoreDumped() || e.Msg() != "Process terminated" || e.Lang() != "en-GB-oed" {
+		t.Errorf("got core dumped %t, message %q and language %q", e.CoreDumped(), e.Msg(), e.Lang())
+	}
+}
+
+// Test that a core dump is reported.
+func TestExitSignalCoreDumped(t *testing.T) {
+	conn := dial(func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		shell := newServerShell(ch, in, "> ")
+		readLine(shell, t)
+		sig := exitSignalMsg{Signal: "SEGV", CoreDumped: true}
+		if _, err := ch.SendRequest("exit-signal", false, Marshal(&sig)); err != nil {
+			t.Errorf("unable to send signal: %v", err)
+		}
+	}, t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("Unable to request new session: %v", err)
+	}
+	defer session.Close()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	e, ok := session.Wait().(*ExitError)
+	if !ok {
+		t.Fatalf("expected *ExitError")
+	}
+	if e.Signal() != "SEGV" || !e.CoreDumped() || e.ExitStatus() != 139 {
+		t.Errorf("got signal %q, core dumped %t, status %d; want SEGV, true, 139", e.Signal(), e.CoreDumped(), e.ExitStatus())
+	}
+	if want := "Process exited with status 139 from signal SEGV (core dumped)"; e.Error() != want {
+		t.Errorf("got error %q, want %q", e.Error(), want)
+	}
 }
 
 // Test exit signal and status are both returned correctly.
@@ -314,6 +618,38 @@ func TestUnknownExitSignal(t *testing.T) {
 	}
 }
 
+func TestSessionSignal(t *testing.T) {
+	conn := dial(signalEchoHandler, t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("Unable to request new session: %v", err)
+	}
+	defer session.Close()
+	if err := session.Signal(SIGTERM); err == nil {
+		t.Fatal("Signal succeeded before the command was started")
+	}
+	if err := session.Start("sleep 60"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- session.Wait()
+	}()
+	// The "SIG" prefix is stripped.
+	if err := session.Signal("SIGINT"); err != nil {
+		t.Fatalf("Signal: %v", err)
+	}
+	err = <-waitErr
+	var e *ExitError
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want an *ExitError", err)
+	}
+	if e.Signal() != "INT" {
+		t.Errorf("got signal %q, want INT", e.Signal())
+	}
+}
+
 func TestExitWithoutStatusOrSignal(t *testing.T) {
 	conn := dial(exitWithoutSignalOrStatus, t)
 	defer conn.Close()
@@ -476,6 +812,28 @@ func exitSignalUnknownHandler(ch Channel, in <-chan *Request, t *testing.T) {
 	sendSignal("SYS", ch, t)
 }
 
+// signalEchoHandler runs a command until it gets a "signal" request,
+// and then exits with that signal.
+func signalEchoHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	for req := range in {
+		switch req.Type {
+		case "exec":
+			req.Reply(true, nil)
+		case "signal":
+			var msg signalMsg
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				t.Errorf("Unmarshal: %v", err)
+				return
+			}
+			sendSignal(msg.Signal, ch, t)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
 func exitWithoutSignalOrStatus(ch Channel, in <-chan *Request, t *testing.T) {
 	defer ch.Close()
 	shell := newServerShell(ch, in, "> ")
@@ -595,6 +953,68 @@ func channelKeepaliveSender(ch Channel, in <-chan *Request, t *testing.T) {
 	sendStatus(0, ch, t)
 }
 
+func extensionRequestSender(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	shell := newServerShell(ch, in, "> ")
+	readLine(shell, t)
+	if _, err := ch.SendRequest("eow@openssh.com", false, nil); err != nil {
+		t.Errorf("unable to send eow@openssh.com: %v", err)
+	}
+	ok, err := ch.SendRequest("custom@example.com", true, []byte("payload"))
+	if err != nil {
+		t.Errorf("unable to send custom@example.com: %v", err)
+	}
+	status := uint32(0)
+	if !ok {
+		status = 1
+	}
+	sendStatus(status, ch, t)
+}
+
+func TestSessionRequestHandler(t *testing.T) {
+	conn := dial(extensionRequestSender, t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var got []string
+	session.SetRequestHandler(func(req *Request) {
+		got = append(got, req.Type+" "+string(req.Payload))
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	})
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	if err := session.Wait(); err != nil {
+		t.Fatalf("Wait: %v, want the custom request to be accepted", err)
+	}
+	want := []string{"eow@openssh.com ", "custom@example.com payload"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handler got requests %q, want %q", got, want)
+	}
+
+	// Without a handler, the request is refused.
+	conn2 := dial(extensionRequestSender, t)
+	defer conn2.Close()
+	session2, err := conn2.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session2.Close()
+	if err := session2.Shell(); err != nil {
+		t.Fatalf("Unable to execute command: %v", err)
+	}
+	var exitErr *ExitError
+	if err := session2.Wait(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("Wait without a handler: got %v, want exit status 1", err)
+	}
+}
+
 func TestClientWriteEOF(t *testing.T) {
 	conn := dial(simpleEchoHandler, t)
 	defer conn.Close()
@@ -890,3 +1310,367 @@ func TestServerClientAuthCallback(t *testing.T) {
 		t.Errorf("username = %q; want %q", got, someUsername)
 	}
 }
+
+func TestSessionX11Forwarding(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	cookie, err := NewX11Cookie()
+	if err != nil {
+		t.Fatalf("NewX11Cookie: %v", err)
+	}
+	if len(cookie) != 32 || strings.ToLower(cookie) != cookie {
+		t.Errorf("got cookie %q, want 32 lowercase hex digits", cookie)
+	}
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	x11Opens := make(chan error, 2)
+	go func() {
+		sconn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		newCh := <-chans
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		defer ch.Close()
+		req := <-chReqs
+		want := Marshal(&struct {
+			Single        bool
+			Proto, Cookie string
+			Screen        uint32
+		}{true, X11AuthProtocol, cookie, 2})
+		if req.Type != "x11-req" || !bytes.Equal(req.Payload, want) {
+			t.Errorf("got request %q %x, want x11-req %x", req.Type, req.Payload, want)
+		}
+		req.Reply(true, nil)
+		go DiscardRequests(chReqs)
+
+		payload := Marshal(&x11ChannelOpenMsg{"192.0.2.1", 6010})
+		for i := 0; i < 2; i++ {
+			x11, x11Reqs, err := sconn.OpenChannel("x11", payload)
+			if err == nil {
+				go DiscardRequests(x11Reqs)
+				io.WriteString(x11, "hello")
+				x11.Close()
+			}
+			x11Opens <- err
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	l, err := client.ListenX11(true)
+	if err != nil {
+		t.Fatalf("ListenX11: %v", err)
+	}
+	if _, err := client.ListenX11(false); err == nil {
+		t.Error("second ListenX11 succeeded")
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.RequestX11Forwarding(2, true, "", cookie); err != nil {
+		t.Fatalf("RequestX11Forwarding: %v", err)
+	}
+
+	x11, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer x11.Close()
+	if got := x11.RemoteAddr().String(); got != "192.0.2.1:6010" {
+		t.Errorf("got remote address %s, want 192.0.2.1:6010", got)
+	}
+	if data, err := io.ReadAll(x11); err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v reading the X11 connection, want hello", data, err)
+	}
+	if err := <-x11Opens; err != nil {
+		t.Errorf("first x11 channel: %v", err)
+	}
+
+	// In single connection mode the second channel is rejected.
+	if err := <-x11Opens; err == nil {
+		t.Error("second x11 channel accepted in single connection mode")
+	}
+	if _, err := l.Accept(); err != io.EOF {
+		t.Errorf("got %v from Accept after the single connection, want io.EOF", err)
+	}
+}
+
+func TestServerAcceptEnv(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	conf := &ServerConfig{
+		NoClientAuth: true,
+		AcceptEnv:    []string{"LANG", "LC_*"},
+	}
+	conf.AddHostKey(testSigners["rsa"])
+	type result struct {
+		env  map[string]string
+		reqs []string
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, conf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			done <- result{}
+			return
+		}
+		go DiscardRequests(reqs)
+		newCh := <-chans
+		ch, in, err := newCh.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			done <- result{}
+			return
+		}
+		var r result
+		for req := range in {
+			r.reqs = append(r.reqs, req.Type)
+			if req.Type == "exec" {
+				r.env = ch.(EnvChannel).Env()
+				req.Reply(true, nil)
+				sendStatus(0, ch, t)
+				ch.Close()
+			}
+		}
+		done <- r
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	for _, tt := range []struct {
+		name string
+		ok   bool
+	}{
+		{"LANG", true},
+		{"LC_ALL", true},
+		{"LD_PRELOAD", false},
+		{"LANGUAGE", false},
+	} {
+		err := session.Setenv(tt.name, "value-"+tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("Setenv(%s): got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if err := session.Run("true"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	r := <-done
+	want := map[string]string{"LANG": "value-LANG", "LC_ALL": "value-LC_ALL"}
+	if !reflect.DeepEqual(r.env, want) {
+		t.Errorf("got env %v, want %v", r.env, want)
+	}
+	if !reflect.DeepEqual(r.reqs, []string{"exec"}) {
+		t.Errorf("handler got requests %v, want only exec", r.reqs)
+	}
+}
+
+// testSessionReplyOrder checks that the reply to a name request, which
+// a server made with conf answers itself, waits for the reply to an
+// earlier request the application holds.
+func testSessionReplyOrder(t *testing.T, conf *ServerConfig, name string, payload []byte, wantOK bool) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	conf.AddHostKey(testSigners["rsa"])
+	held := make(chan *Request, 1)
+	synced := make(chan struct{}, 1)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, conf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		newCh := <-chans
+		ch, in, err := newCh.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		defer ch.Close()
+		for req := range in {
+			switch req.Type {
+			case "slow@example.com":
+				held <- req
+			case "sync@example.com":
+				synced <- struct{}{}
+			default:
+				t.Errorf("request %q passed on", req.Type)
+			}
+		}
+	}()
+
+	conn, _, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	go DiscardRequests(reqs)
+	session, _, err := conn.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer session.Close()
+
+	// SendRequest waits for each reply before sending the next
+	// request, so send the requests directly, the way OpenSSH may.
+	ch := session.(*channel)
+	send := func(name string, wantReply bool, payload []byte) {
+		if err := ch.sendMessage(channelRequestMsg{
+			PeersID:             ch.remoteId,
+			Request:             name,
+			WantReply:           wantReply,
+			RequestSpecificData: payload,
+		}); err != nil {
+			t.Fatalf("sending %s: %v", name, err)
+		}
+	}
+	send("slow@example.com", true, nil)
+	req := <-held
+	send(name, true, payload)
+	send("sync@example.com", false, nil)
+	<-synced
+	// Reply to slow@example.com the opposite way, to tell the two
+	// replies apart.
+	req.Reply(!wantOK, nil)
+
+	for _, want := range []struct {
+		name string
+		ok   bool
+	}{{"slow@example.com", !wantOK}, {name, wantOK}} {
+		_, ok := (<-ch.msg).(*channelRequestSuccessMsg)
+		if ok != want.ok {
+			t.Errorf("%s: got %t, want %t", want.name, ok, want.ok)
+		}
+	}
+}
+
+func TestServerAcceptEnvReplyOrder(t *testing.T) {
+	conf := &ServerConfig{
+		NoClientAuth: true,
+		AcceptEnv:    []string{"LANG"},
+	}
+	testSessionReplyOrder(t, conf, "env", Marshal(&setenvRequest{Name: "LANG", Value: "C"}), true)
+}
+
+func TestServerPtyRequestReplyOrder(t *testing.T) {
+	payload := Marshal(&ptyRequestMsg{Term: "xterm", Columns: 80, Rows: 24, Modelist: string([]byte{ECHO, 0, 0})})
+	testSessionReplyOrder(t, &ServerConfig{NoClientAuth: true}, "pty-req", payload, false)
+}
+
+func TestWaitSessionStart(t *testing.T) {
+	starts := make(chan *SessionStart, 1)
+	conn := dial(func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		start, err := WaitSessionStart(ch, in)
+		if err != nil {
+			t.Errorf("WaitSessionStart: %v", err)
+			close(starts)
+			return
+		}
+		starts <- start
+		go DiscardRequests(in)
+		start.Request.Reply(true, nil)
+		sendStatus(0, ch, t)
+	}, t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Errorf("Setenv: %v", err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, TerminalModes{ECHO: 0, 150: 7}); err != nil {
+		t.Errorf("RequestPty: %v", err)
+	}
+	if err := session.WindowChange(50, 132); err != nil {
+		t.Errorf("WindowChange: %v", err)
+	}
+	if ok, err := session.SendRequest("x11-req", true, nil); ok || err != nil {
+		t.Errorf("x11-req: got %v, %v; want a refusal", ok, err)
+	}
+	if err := session.Run("echo hello"); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	start := <-starts
+	if start == nil {
+		t.FailNow()
+	}
+	if start.Type != "exec" || start.Command != "echo hello" {
+		t.Errorf("got %s %q, want exec %q", start.Type, start.Command, "echo hello")
+	}
+	if want := map[string]string{"LANG": "C"}; !reflect.DeepEqual(start.Env, want) {
+		t.Errorf("got env %v, want %v", start.Env, want)
+	}
+	want := &PtyRequest{
+		Term:    "xterm",
+		Columns: 132,
+		Rows:    50,
+		Modes:   TerminalModes{ECHO: 0, 150: 7},
+	}
+	if !reflect.DeepEqual(start.Pty, want) {
+		t.Errorf("got pty %+v, want %+v", start.Pty, want)
+	}
+}
+
+func TestWaitSessionStartClosed(t *testing.T) {
+	in := make(chan *Request)
+	close(in)
+	if _, err := WaitSessionStart(nil, in); err == nil {
+		t.Error("WaitSessionStart succeeded on a closed request channel")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh/internal/sntrup761"
+)
+
+const (
+	kexAlgoSNTRUP761X25519SHA512        = "sntrup761x25519-sha512"
+	kexAlgoSNTRUP761X25519SHA512OpenSSH = "sntrup761x25519-sha512@openssh.com"
+)
+
+func init() {
+	kexAlgoMap[kexAlgoSNTRUP761X25519SHA512] = &sntrup761x25519sha512{}
+	kexAlgoMap[kexAlgoSNTRUP761X25519SHA512OpenSSH] = &sntrup761x25519sha512{}
+}
+
+// sntrup761x25519sha512 implements the hybrid Streamlined NTRU Prime and
+// X25519 key exchange, as defined in
+// draft-josefsson-ntruprime-ssh and implemented by OpenSSH 8.5 and later.
+type sntrup761x25519sha512 struct{}
+
+// sntrupSharedSecret returns the shared secret K for the key exchange. It
+// is the SHA-512 hash of the two shared keys, encoded as a string rather
+// than as an mpint.
+func sntrupSharedSecret(kemKey, ecdhKey []byte) []byte {
+	h := crypto.SHA512.New()
+	h.Write(kemKey)
+	h.Write(ecdhKey)
+	return appendString(nil, string(h.Sum(nil)))
+}
+
+func (kex *sntrup761x25519sha512) Client(c packetConn, rand io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	pk, sk, err := sntrup761.GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+
+	clientPub := make([]byte, 0, sntrup761.PublicKeySize+32)
+	clientPub = append(clientPub, pk...)
+	clientPub = append(clientPub, kp.pub[:]...)
+	if err := c.writePacket(Marshal(&kexECDHInitMsg{clientPub})); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	var reply kexECDHReplyMsg
+	if err = Unmarshal(packet, &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.EphemeralPubKey) != sntrup761.CiphertextSize+32 {
+		return nil, errors.New("ssh: peer's sntrup761x25519 public value has wrong length")
+	}
+
+	kemKey, err := sntrup761.Decapsulate(sk, reply.EphemeralPubKey[:sntrup761.CiphertextSize])
+	if err != nil {
+		return nil, err
+	}
+
+	var servPub, secret [32]byte
+	copy(servPub[:], reply.EphemeralPubKey[sntrup761.CiphertextSize:])
+	curve25519.ScalarMult(&secret, &kp.priv, &servPub)
+	if subtle.ConstantTimeCompare(secret[:], curve25519Zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+
+	h := crypto.SHA512.New()
+	magics.write(h)
+	writeString(h, reply.HostKey)
+	writeString(h, clientPub)
+	writeString(h, reply.EphemeralPubKey)
+
+	K := sntrupSharedSecret(kemKey, secret[:])
+	h.Write(K)
+
+	return &kexResult{
+		H:         h.Sum(nil),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      crypto.SHA512,
+	}, nil
+}
+
+func (kex *sntrup761x25519sha512) Server(c packetConn, rand io.Reader, magics *handshakeMagics, priv AlgorithmSigner, algo string) (result *kexResult, err error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return
+	}
+	var kexInit kexECDHInitMsg
+	if err = Unmarshal(packet, &kexInit); err != nil {
+		return
+	}
+
+	if len(kexInit.ClientPubKey) != sntrup761.PublicKeySize+32 {
+		return nil, errors.New("ssh: peer's sntrup761x25519 public value has wrong length")
+	}
+
+	ciphertext, kemKey, err := sntrup761.Encapsulate(rand, kexInit.ClientPubKey[:sntrup761.PublicKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+
+	var clientPub, secret [32]byte
+	copy(clientPub[:], kexInit.ClientPubKey[sntrup761.PublicKeySize:])
+	curve25519.ScalarMult(&secret, &kp.priv, &clientPub)
+	if subtle.ConstantTimeCompare(secret[:], curve25519Zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+
+	serverPub := make([]byte, 0, sntrup761.CiphertextSize+32)
+	serverPub = append(serverPub, ciphertext...)
+	serverPub = append(serverPub, kp.pub[:]...)
+
+	hostKeyBytes := priv.PublicKey().Marshal()
+
+	h := crypto.SHA512.New()
+	magics.write(h)
+	writeString(h, hostKeyBytes)
+	writeString(h, kexInit.ClientPubKey)
+	writeString(h, serverPub)
+
+	K := sntrupSharedSecret(kemKey, secret[:])
+	h.Write(K)
+
+	H := h.Sum(nil)
+
+	sig, err := signAndMarshal(priv, rand, H, algo)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexECDHReplyMsg{
+		EphemeralPubKey: serverPub,
+		HostKey:         hostKeyBytes,
+		Signature:       sig,
+	}
+	if err := c.writePacket(Marshal(&reply)); err != nil {
+		return nil, err
+	}
+	return &kexResult{
+		H:         H,
+		K:         K,
+		HostKey:   hostKeyBytes,
+		Signature: sig,
+		Hash:      crypto.SHA512,
+	}, nil
+}
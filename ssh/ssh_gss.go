@@ -69,6 +69,10 @@ type GSSAPIServer interface {
 	// client, passing the token to AcceptSecContext via the
 	// token parameters.
 	// The srcName return value is the authenticated username.
+	// Credentials delegated by the client, see
+	// GSSAPIWithMICDelegationAuthMethod, arrive with the tokens passed to
+	// AcceptSecContext, and the implementation is responsible for
+	// keeping them for use once AllowLogin has accepted the login.
 	// See RFC 2743 section 2.2.2 and RFC 4462 section 3.4.
 	AcceptSecContext(token []byte) (outputToken []byte, srcName string, needContinue bool, err error)
 	// VerifyMIC verifies that a cryptographic MIC, contained in the token parameter,
@@ -40,9 +40,11 @@ type FakeClient struct {
 	round     int
 	mic       []byte
 	maxRound  int
+	delegated bool
 }
 
 func (f *FakeClient) InitSecContext(target string, token []byte, isGSSDelegCreds bool) (outputToken []byte, needContinue bool, err error) {
+	f.delegated = isGSSDelegCreds
 	if token == nil {
 		if f.exchanges[f.round].expectedToken != "" {
 			err = fmt.Errorf("got empty token, want %q", f.exchanges[f.round].expectedToken)
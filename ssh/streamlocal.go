@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
 )
 
 // streamLocalChannelOpenDirectMsg is a struct used for SSH_MSG_CHANNEL_OPEN message
@@ -11,10 +12,13 @@ import (
 //
 // See openssh-portable/PROTOCOL, section 2.4. connection: Unix domain socket forwarding
 // https://github.com/openssh/openssh-portable/blob/master/PROTOCOL#L235
+//
+// OpenSSH sends the reserved fields as an empty string and zero, and
+// ignores them on receipt.
 type streamLocalChannelOpenDirectMsg struct {
-	socketPath string
-	reserved0  string
-	reserved1  uint32
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
 }
 
 // forwardedStreamLocalPayload is a struct used for SSH_MSG_CHANNEL_OPEN message
@@ -30,28 +34,61 @@ type streamLocalChannelForwardMsg struct {
 	socketPath string
 }
 
-// ListenUnix is similar to ListenTCP but uses a Unix domain socket.
+// ListenUnix is similar to ListenTCP but uses a Unix domain socket. It
+// sends a "streamlocal-forward@openssh.com" request asking the server to
+// listen on socketPath, and the returned listener yields a connection
+// for each "forwarded-streamlocal@openssh.com" channel the server opens
+// for it.
 func (c *Client) ListenUnix(socketPath string) (net.Listener, error) {
 	c.handleForwardsOnce.Do(c.handleForwards)
 	m := streamLocalChannelForwardMsg{
 		socketPath,
 	}
+	// Register the forward before sending the request: the server may
+	// open forwarded channels as soon as it has replied, before
+	// SendRequest returns.
+	addr := &net.UnixAddr{Name: socketPath, Net: "unix"}
+	ch := c.forwards.add(addr)
 	// send message
 	ok, _, err := c.SendRequest("streamlocal-forward@openssh.com", true, Marshal(&m))
+	if err == nil && !ok {
+		err = errors.New("ssh: streamlocal-forward@openssh.com request denied by peer")
+	}
 	if err != nil {
+		c.forwards.remove(addr)
 		return nil, err
 	}
-	if !ok {
-		return nil, errors.New("ssh: streamlocal-forward@openssh.com request denied by peer")
-	}
-	ch := c.forwards.add(&net.UnixAddr{Name: socketPath, Net: "unix"})
 
 	return &unixListener{socketPath, c, ch}, nil
 }
 
+// DialUnix connects to the Unix domain socket at socketPath on the
+// remote host, using a "direct-streamlocal@openssh.com" channel. If the
+// server rejects the channel, the error is an *OpenChannelError.
+func (c *Client) DialUnix(socketPath string) (net.Conn, error) {
+	if socketPath == "" {
+		return nil, errors.New("ssh: empty socket path")
+	}
+	ch, err := c.dialStreamLocal(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &chanConn{
+		Channel: ch,
+		laddr: &net.UnixAddr{
+			Name: "@",
+			Net:  "unix",
+		},
+		raddr: &net.UnixAddr{
+			Name: socketPath,
+			Net:  "unix",
+		},
+	}, nil
+}
+
 func (c *Client) dialStreamLocal(socketPath string) (Channel, error) {
 	msg := streamLocalChannelOpenDirectMsg{
-		socketPath: socketPath,
+		SocketPath: socketPath,
 	}
 	ch, in, err := c.OpenChannel("direct-streamlocal@openssh.com", Marshal(&msg))
 	if err != nil {
@@ -86,17 +123,20 @@ func (l *unixListener) Accept() (net.Conn, error) {
 			Name: l.socketPath,
 			Net:  "unix",
 		},
-		raddr: &net.UnixAddr{
-			Name: "@",
-			Net:  "unix",
-		},
+		raddr: s.raddr,
 	}, nil
 }
 
-// Close closes the listener.
+// Close closes the listener and sends a
+// "cancel-streamlocal-forward@openssh.com" request. Connections that
+// were already accepted are not affected; forwarded channels that were
+// not yet accepted are rejected.
 func (l *unixListener) Close() error {
 	// this also closes the listener.
 	l.conn.forwards.remove(&net.UnixAddr{Name: l.socketPath, Net: "unix"})
+	for s := range l.in {
+		s.newCh.Reject(Prohibited, "listener closed")
+	}
 	m := streamLocalChannelForwardMsg{
 		l.socketPath,
 	}
@@ -114,3 +154,52 @@ func (l *unixListener) Addr() net.Addr {
 		Net:  "unix",
 	}
 }
+
+// HandleDirectStreamLocal serves an incoming
+// "direct-streamlocal@openssh.com" channel on the server side. It calls
+// dial with the socket path requested by the client; if dial returns an
+// error, the channel is rejected with ConnectionFailed and the error's
+// text. Otherwise the channel is accepted and data is copied in both
+// directions between it and the dialed connection. HandleDirectStreamLocal
+// returns once both directions are done and both ends have been closed.
+func HandleDirectStreamLocal(newCh NewChannel, dial func(socketPath string) (net.Conn, error)) error {
+	if t := newCh.ChannelType(); t != "direct-streamlocal@openssh.com" {
+		return newCh.Reject(UnknownChannelType, "unknown channel type: "+t)
+	}
+	var msg streamLocalChannelOpenDirectMsg
+	if err := Unmarshal(newCh.ExtraData(), &msg); err != nil {
+		newCh.Reject(ConnectionFailed, "could not parse direct-streamlocal@openssh.com payload: "+err.Error())
+		return err
+	}
+	if msg.SocketPath == "" {
+		return newCh.Reject(ConnectionFailed, "empty socket path")
+	}
+	conn, err := dial(msg.SocketPath)
+	if err != nil {
+		return newCh.Reject(ConnectionFailed, err.Error())
+	}
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		conn.Close()
+	}
+	wg.Wait()
+	conn.Close()
+	ch.Close()
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package ssh
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func getsockopt(t *testing.T, c net.Conn, level, opt int) int {
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var v int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		v, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if sockErr != nil {
+		t.Fatalf("getsockopt: %v", sockErr)
+	}
+	return v
+}
+
+func TestTCPOptions(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		config    Config
+		noDelay   int
+		keepAlive int
+		idle      int
+	}{
+		{"default", Config{}, 1, 0, 0},
+		{"keepalive", Config{TCPKeepAlivePeriod: 42 * time.Second}, 1, 1, 42},
+		{"no TCP_NODELAY", Config{DisableTCPNoDelay: true}, 0, 0, 0},
+	} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		// Start from the opposite of the expected settings.
+		c1.(*net.TCPConn).SetNoDelay(tt.noDelay == 0)
+		c1.(*net.TCPConn).SetKeepAlive(false)
+
+		tt.config.setTCPOptions(c1)
+		if got := getsockopt(t, c1, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; got != (tt.noDelay != 0) {
+			t.Errorf("%s: got TCP_NODELAY %v, want %v", tt.name, got, tt.noDelay != 0)
+		}
+		if got := getsockopt(t, c1, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0; got != (tt.keepAlive != 0) {
+			t.Errorf("%s: got SO_KEEPALIVE %v, want %v", tt.name, got, tt.keepAlive != 0)
+		}
+		if tt.idle > 0 {
+			if got := getsockopt(t, c1, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != tt.idle {
+				t.Errorf("%s: got TCP_KEEPIDLE %d, want %d", tt.name, got, tt.idle)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+
+	// Other connections are left alone.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	(&Config{TCPKeepAlivePeriod: time.Second}).setTCPOptions(a)
+}
@@ -101,7 +101,8 @@ func (c *Client) handleForwards() {
 
 // ListenTCP requests the remote peer open a listening socket
 // on laddr. Incoming connections will be available by calling
-// Accept on the returned net.Listener.
+// Accept on the returned net.Listener. If laddr.Port is 0, the peer
+// chooses the port, and the listener's Addr reports it.
 func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 	c.handleForwardsOnce.Do(c.handleForwards)
 	if laddr.Port == 0 && isBrokenOpenSSHVersion(string(c.ServerVersion())) {
@@ -109,7 +110,7 @@ func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 	}
 
 	m := channelForwardMsg{
-		laddr.IP.String(),
+		forwardAddr(laddr),
 		uint32(laddr.Port),
 	}
 	// send message
@@ -127,10 +128,13 @@ func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 		var p struct {
 			Port uint32
 		}
-		if err := Unmarshal(resp, &p); err != nil {
-			return nil, err
+		if err := Unmarshal(resp, &p); err != nil || p.Port == 0 || p.Port > 65535 {
+			// Without the port we can't match incoming connections
+			// to this listener, so give the forward back.
+			c.SendRequest("cancel-tcpip-forward", true, Marshal(&m))
+			return nil, errors.New("ssh: tcpip-forward reply has no valid assigned port")
 		}
-		laddr.Port = int(p.Port)
+		laddr = &net.TCPAddr{IP: laddr.IP, Port: int(p.Port), Zone: laddr.Zone}
 	}
 
 	// Register this forward, using the port number we obtained.
@@ -143,14 +147,21 @@ func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 // forward requests and the tcpListeners.
 type forwardList struct {
 	sync.Mutex
-	entries []forwardEntry
+	entries []*forwardEntry
 }
 
 // forwardEntry represents an established mapping of a laddr on a
 // remote ssh server to a channel connected to a tcpListener.
+//
+// Incoming channels are handed to the listener without holding the
+// forwardList lock, so that a listener nobody accepts from cannot
+// block removing it. done is closed on removal to release those
+// senders, and c is closed once they are all gone.
 type forwardEntry struct {
-	laddr net.Addr
-	c     chan forward
+	laddr   net.Addr
+	c       chan forward
+	done    chan struct{}
+	senders sync.WaitGroup
 }
 
 // forward represents an incoming forwarded tcpip connection. The
@@ -164,9 +175,10 @@ type forward struct {
 func (l *forwardList) add(addr net.Addr) chan forward {
 	l.Lock()
 	defer l.Unlock()
-	f := forwardEntry{
+	f := &forwardEntry{
 		laddr: addr,
 		c:     make(chan forward, 1),
+		done:  make(chan struct{}),
 	}
 	l.entries = append(l.entries, f)
 	return f.c
@@ -185,11 +197,57 @@ func parseTCPAddr(addr string, port uint32) (*net.TCPAddr, error) {
 	if port == 0 || port > 65535 {
 		return nil, fmt.Errorf("ssh: port number out of range: %d", port)
 	}
-	ip := net.ParseIP(string(addr))
+	ip, zone := parseForwardIP(addr)
 	if ip == nil {
 		return nil, fmt.Errorf("ssh: cannot parse IP address %q", addr)
 	}
-	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	return &net.TCPAddr{IP: ip, Port: int(port), Zone: zone}, nil
+}
+
+// parseForwardIP parses an IP address as found in forwarding requests and
+// channels. IPv6 addresses may be enclosed in brackets, and have a zone.
+// It returns a nil IP if addr is not an IP address.
+func parseForwardIP(addr string) (ip net.IP, zone string) {
+	if len(addr) >= 2 && addr[0] == '[' && addr[len(addr)-1] == ']' {
+		addr = addr[1 : len(addr)-1]
+	}
+	if i := strings.LastIndexByte(addr, '%'); i >= 0 {
+		addr, zone = addr[:i], addr[i+1:]
+	}
+	return net.ParseIP(addr), zone
+}
+
+// forwardAddr returns the bind address of laddr as sent in forwarding
+// requests: the bare IP address, with its zone, or the empty string,
+// which binds all addresses, if laddr has no IP.
+func forwardAddr(laddr *net.TCPAddr) string {
+	if len(laddr.IP) == 0 {
+		return ""
+	}
+	if laddr.Zone != "" {
+		return laddr.IP.String() + "%" + laddr.Zone
+	}
+	return laddr.IP.String()
+}
+
+// sameForwardAddr reports whether a and b are the same forwarded
+// address. TCP addresses match if their IPs are equal, or if both
+// bind all addresses, so that the 16-byte and 4-byte forms of an IPv4
+// address, or "" and "0.0.0.0", are not told apart.
+func sameForwardAddr(a, b net.Addr) bool {
+	ta, ok1 := a.(*net.TCPAddr)
+	tb, ok2 := b.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return a.Network() == b.Network() && a.String() == b.String()
+	}
+	if ta.Port != tb.Port {
+		return false
+	}
+	unspecified := func(ip net.IP) bool { return len(ip) == 0 || ip.IsUnspecified() }
+	if unspecified(ta.IP) || unspecified(tb.IP) {
+		return unspecified(ta.IP) && unspecified(tb.IP)
+	}
+	return ta.IP.Equal(tb.IP) && (ta.Zone == "" || tb.Zone == "" || ta.Zone == tb.Zone)
 }
 
 func (l *forwardList) handleChannels(in <-chan NewChannel) {
@@ -211,8 +269,13 @@ func (l *forwardList) handleChannels(in <-chan NewChannel) {
 			// addresses should list the address, in string
 			// format. It is implied that this should be an IP
 			// address, as it would be impossible to connect to it
-			// otherwise.
-			laddr, err = parseTCPAddr(payload.Addr, payload.Port)
+			// otherwise, or the empty string for a forward that
+			// binds all addresses.
+			if payload.Addr == "" && payload.Port != 0 && payload.Port <= 65535 {
+				laddr = &net.TCPAddr{Port: int(payload.Port)}
+			} else {
+				laddr, err = parseTCPAddr(payload.Addr, payload.Port)
+			}
 			if err != nil {
 				ch.Reject(ConnectionFailed, err.Error())
 				continue
@@ -250,40 +313,64 @@ func (l *forwardList) handleChannels(in <-chan NewChannel) {
 	}
 }
 
-// remove removes the forward entry, and the channel feeding its
-// listener.
-func (l *forwardList) remove(addr net.Addr) {
+// remove removes the forward entry, and closes the channel feeding its
+// listener. It reports whether an entry for addr was found.
+func (l *forwardList) remove(addr net.Addr) bool {
 	l.Lock()
-	defer l.Unlock()
+	var found *forwardEntry
 	for i, f := range l.entries {
-		if addr.Network() == f.laddr.Network() && addr.String() == f.laddr.String() {
+		if sameForwardAddr(addr, f.laddr) {
 			l.entries = append(l.entries[:i], l.entries[i+1:]...)
-			close(f.c)
-			return
+			found = f
+			break
 		}
 	}
+	l.Unlock()
+	if found == nil {
+		return false
+	}
+	found.close()
+	return true
 }
 
 // closeAll closes and clears all forwards.
 func (l *forwardList) closeAll() {
 	l.Lock()
-	defer l.Unlock()
-	for _, f := range l.entries {
-		close(f.c)
-	}
+	entries := l.entries
 	l.entries = nil
+	l.Unlock()
+	for _, f := range entries {
+		f.close()
+	}
+}
+
+func (f *forwardEntry) close() {
+	close(f.done)
+	f.senders.Wait()
+	close(f.c)
 }
 
 func (l *forwardList) forward(laddr, raddr net.Addr, ch NewChannel) bool {
 	l.Lock()
-	defer l.Unlock()
+	var found *forwardEntry
 	for _, f := range l.entries {
-		if laddr.Network() == f.laddr.Network() && laddr.String() == f.laddr.String() {
-			f.c <- forward{newCh: ch, raddr: raddr}
-			return true
+		if sameForwardAddr(laddr, f.laddr) {
+			found = f
+			found.senders.Add(1)
+			break
 		}
 	}
-	return false
+	l.Unlock()
+	if found == nil {
+		return false
+	}
+	defer found.senders.Done()
+	select {
+	case found.c <- forward{newCh: ch, raddr: raddr}:
+		return true
+	case <-found.done:
+		return false
+	}
 }
 
 type tcpListener struct {
@@ -312,16 +399,41 @@ func (l *tcpListener) Accept() (net.Conn, error) {
 	}, nil
 }
 
-// Close closes the listener.
+// Close closes the listener and sends a "cancel-tcpip-forward" request,
+// waiting for the server's reply. Connections that were already
+// accepted are not affected; forwarded channels that were not yet
+// accepted are rejected. Closing a listener whose forward was already
+// canceled with CancelForward does nothing.
 func (l *tcpListener) Close() error {
-	m := channelForwardMsg{
-		l.laddr.IP.String(),
-		uint32(l.laddr.Port),
+	// this also closes the listener.
+	removed := l.conn.forwards.remove(l.laddr)
+	for s := range l.in {
+		s.newCh.Reject(Prohibited, "listener closed")
 	}
+	if !removed {
+		return nil
+	}
+	return l.conn.cancelForward(forwardAddr(l.laddr), uint32(l.laddr.Port))
+}
+
+// CancelForward asks the server to stop the remote forward for the
+// given bind address and port, as reported by the Addr of the listener
+// returned by Listen or ListenTCP, and waits for the reply. The
+// listener for that forward, if any, stops accepting connections, but
+// connections it already accepted are not affected and the SSH
+// connection stays usable for other forwards.
+func (c *Client) CancelForward(addr string, port uint32) error {
+	if ip, zone := parseForwardIP(addr); ip != nil || addr == "" {
+		laddr := &net.TCPAddr{IP: ip, Port: int(port), Zone: zone}
+		c.forwards.remove(laddr)
+		addr = forwardAddr(laddr)
+	}
+	return c.cancelForward(addr, port)
+}
 
-	// this also closes the listener.
-	l.conn.forwards.remove(l.laddr)
-	ok, _, err := l.conn.SendRequest("cancel-tcpip-forward", true, Marshal(&m))
+func (c *Client) cancelForward(addr string, port uint32) error {
+	m := channelForwardMsg{addr, port}
+	ok, _, err := c.SendRequest("cancel-tcpip-forward", true, Marshal(&m))
 	if err == nil && !ok {
 		err = errors.New("ssh: cancel-tcpip-forward failed")
 	}
@@ -397,22 +509,7 @@ func (c *Client) Dial(n, addr string) (net.Conn, error) {
 			raddr:   zeroAddr,
 		}, nil
 	case "unix":
-		var err error
-		ch, err = c.dialStreamLocal(addr)
-		if err != nil {
-			return nil, err
-		}
-		return &chanConn{
-			Channel: ch,
-			laddr: &net.UnixAddr{
-				Name: "@",
-				Net:  "unix",
-			},
-			raddr: &net.UnixAddr{
-				Name: addr,
-				Net:  "unix",
-			},
-		}, nil
+		return c.DialUnix(addr)
 	default:
 		return nil, fmt.Errorf("ssh: unsupported protocol: %s", n)
 	}
@@ -420,8 +517,19 @@ func (c *Client) Dial(n, addr string) (net.Conn, error) {
 
 // DialTCP connects to the remote address raddr on the network net,
 // which must be "tcp", "tcp4", or "tcp6".  If laddr is not nil, it is used
-// as the local address for the connection.
+// as the local address for the connection. It is sent to the server as
+// the originator of the direct-tcpip channel, and the returned
+// connection reports laddr and raddr as its LocalAddr and RemoteAddr. If
+// the server rejects the channel, the error is an *OpenChannelError.
 func (c *Client) DialTCP(n string, laddr, raddr *net.TCPAddr) (net.Conn, error) {
+	switch n {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("ssh: unsupported protocol: %s", n)
+	}
+	if raddr == nil {
+		return nil, errors.New("ssh: missing remote address")
+	}
 	if laddr == nil {
 		laddr = &net.TCPAddr{
 			IP:   net.IPv4zero,
@@ -473,6 +581,23 @@ type chanConn struct {
 	laddr, raddr net.Addr
 }
 
+// ChannelConn returns a net.Conn that reads from and writes to ch, and
+// reports localAddr and remoteAddr as its addresses, or an empty
+// *net.TCPAddr for a nil one. It can be passed to NewClientConn to run
+// an SSH connection through a "direct-tcpip" channel of another one, as
+// with OpenSSH's ProxyJump. Closing the net.Conn closes ch. Deadlines
+// are supported if ch is a DeadlineChannel, as the channels of this
+// package are; otherwise setting one fails.
+func ChannelConn(ch Channel, localAddr, remoteAddr net.Addr) net.Conn {
+	if localAddr == nil {
+		localAddr = &net.TCPAddr{}
+	}
+	if remoteAddr == nil {
+		remoteAddr = &net.TCPAddr{}
+	}
+	return &chanConn{Channel: ch, laddr: localAddr, raddr: remoteAddr}
+}
+
 // LocalAddr returns the local network address.
 func (t *chanConn) LocalAddr() net.Addr {
 	return t.laddr
@@ -495,15 +620,23 @@ func (t *chanConn) SetDeadline(deadline time.Time) error {
 // SetReadDeadline sets the read deadline.
 // A zero value for t means Read will not time out.
 // After the deadline, the error from Read will implement net.Error
-// with Timeout() == true.
+// with Timeout() == true. It returns an error if the underlying Channel
+// is not a DeadlineChannel.
 func (t *chanConn) SetReadDeadline(deadline time.Time) error {
+	if ch, ok := t.Channel.(DeadlineChannel); ok {
+		return ch.SetReadDeadline(deadline)
+	}
 	// for compatibility with previous version,
 	// the error message contains "tcpChan"
 	return errors.New("ssh: tcpChan: deadline not supported")
 }
 
-// SetWriteDeadline exists to satisfy the net.Conn interface
-// but is not implemented by this type.  It always returns an error.
+// SetWriteDeadline sets the write deadline, for writes blocked by flow
+// control. A zero value for t means Write will not time out. It returns
+// an error if the underlying Channel is not a DeadlineChannel.
 func (t *chanConn) SetWriteDeadline(deadline time.Time) error {
+	if ch, ok := t.Channel.(DeadlineChannel); ok {
+		return ch.SetWriteDeadline(deadline)
+	}
 	return errors.New("ssh: tcpChan: deadline not supported")
 }
@@ -0,0 +1,190 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"io"
+	"net"
+	"strconv"
+)
+
+// TCPIPForwardServer serves remote port forwarding (RFC 4254, section
+// 7.1) on the server side of a connection: it answers "tcpip-forward"
+// requests by listening locally, opens a "forwarded-tcpip" channel back
+// to the client for each connection accepted on such a listener, and
+// stops the listener on "cancel-tcpip-forward".
+type TCPIPForwardServer struct {
+	// Allow, if non-nil, is called for each "tcpip-forward" request
+	// with the requested bind address and port, and returning false
+	// denies it. If nil, all requests are denied.
+	Allow func(conn ConnMetadata, bindAddr string, bindPort uint32) bool
+
+	// Listen, if non-nil, is used instead of net.Listen to listen on
+	// the "tcp" network at address, which is the bind address and
+	// port joined by net.JoinHostPort. An empty bind address listens
+	// on all interfaces.
+	Listen func(network, address string) (net.Listener, error)
+}
+
+// Serve handles the "tcpip-forward" and "cancel-tcpip-forward" requests
+// received on reqs, which should be the request channel returned by
+// NewServerConn for conn, and returns a channel delivering all other
+// requests. The returned channel must be serviced like reqs. When reqs
+// is closed, all listeners of conn are closed and the returned channel
+// is closed too; connections that were already forwarded last until
+// either side closes them.
+func (s *TCPIPForwardServer) Serve(conn Conn, reqs <-chan *Request) <-chan *Request {
+	out := make(chan *Request)
+	f := &tcpipForwards{
+		server:    s,
+		conn:      conn,
+		listeners: make(map[string]*tcpipForward),
+	}
+	go func() {
+		defer close(out)
+		defer f.closeAll()
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				ok, resp := f.add(req.Payload)
+				req.Reply(ok, resp)
+			case "cancel-tcpip-forward":
+				req.Reply(f.cancel(req.Payload), nil)
+			default:
+				out <- req
+			}
+		}
+	}()
+	return out
+}
+
+// tcpipForwardRequest is the payload of "tcpip-forward" and
+// "cancel-tcpip-forward" requests, RFC 4254 section 7.1.
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpipForwards holds the forwards of a single connection, keyed by the
+// bind address and the port actually listened on. It is only used by
+// the goroutine started by Serve.
+type tcpipForwards struct {
+	server    *TCPIPForwardServer
+	conn      Conn
+	listeners map[string]*tcpipForward
+}
+
+// tcpipForward is a listener set up for a "tcpip-forward" request.
+type tcpipForward struct {
+	l    net.Listener
+	done chan struct{} // closed when the accept loop has returned
+}
+
+func (f *tcpipForwards) add(payload []byte) (bool, []byte) {
+	var req tcpipForwardRequest
+	if err := Unmarshal(payload, &req); err != nil || req.BindPort > 65535 {
+		return false, nil
+	}
+	if f.server.Allow == nil || !f.server.Allow(f.conn, req.BindAddr, req.BindPort) {
+		return false, nil
+	}
+
+	listen := f.server.Listen
+	if listen == nil {
+		listen = net.Listen
+	}
+	l, err := listen("tcp", net.JoinHostPort(req.BindAddr, strconv.FormatUint(uint64(req.BindPort), 10)))
+	if err != nil {
+		return false, nil
+	}
+	port := req.BindPort
+	if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok {
+		port = uint32(tcpAddr.Port)
+	}
+
+	key := net.JoinHostPort(req.BindAddr, strconv.FormatUint(uint64(port), 10))
+	fwd := &tcpipForward{l: l, done: make(chan struct{})}
+	if _, dup := f.listeners[key]; dup {
+		l.Close()
+		return false, nil
+	}
+	f.listeners[key] = fwd
+
+	go f.acceptLoop(fwd, req.BindAddr, port)
+
+	// If the client asked for port 0, the reply carries the port that
+	// was assigned.
+	var resp []byte
+	if req.BindPort == 0 {
+		resp = Marshal(&struct{ Port uint32 }{port})
+	}
+	return true, resp
+}
+
+func (f *tcpipForwards) cancel(payload []byte) bool {
+	var req tcpipForwardRequest
+	if err := Unmarshal(payload, &req); err != nil {
+		return false
+	}
+	key := net.JoinHostPort(req.BindAddr, strconv.FormatUint(uint64(req.BindPort), 10))
+	fwd, ok := f.listeners[key]
+	delete(f.listeners, key)
+	if !ok {
+		return false
+	}
+	fwd.l.Close()
+	<-fwd.done
+	return true
+}
+
+func (f *tcpipForwards) closeAll() {
+	for _, fwd := range f.listeners {
+		fwd.l.Close()
+		<-fwd.done
+	}
+}
+
+func (f *tcpipForwards) acceptLoop(fwd *tcpipForward, bindAddr string, bindPort uint32) {
+	defer close(fwd.done)
+	for {
+		c, err := fwd.l.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(c, bindAddr, bindPort)
+	}
+}
+
+// forward opens a "forwarded-tcpip" channel for c, and copies data
+// between the two until both directions are done.
+func (f *tcpipForwards) forward(c net.Conn, bindAddr string, bindPort uint32) {
+	defer c.Close()
+	payload := forwardedTCPPayload{
+		Addr: bindAddr,
+		Port: bindPort,
+	}
+	if raddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		payload.OriginAddr = raddr.IP.String()
+		payload.OriginPort = uint32(raddr.Port)
+	}
+	ch, reqs, err := f.conn.OpenChannel("forwarded-tcpip", Marshal(&payload))
+	if err != nil {
+		return
+	}
+	go DiscardRequests(reqs)
+	defer ch.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+		close(done)
+	}()
+	io.Copy(c, ch)
+	if tc, ok := c.(interface{ CloseWrite() error }); ok {
+		tc.CloseWrite()
+	}
+	<-done
+}
@@ -5,7 +5,11 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -51,3 +55,822 @@ func TestClientDialContextWithDeadline(t *testing.T) {
 		t.Errorf("DialContext: got nil error, expected %v", context.DeadlineExceeded)
 	}
 }
+
+func TestClientDialTCP(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	type directTCPMsg struct {
+		Raddr string
+		Rport uint32
+		Laddr string
+		Lport uint32
+	}
+	opened := make(chan directTCPMsg, 2)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			var msg directTCPMsg
+			if newCh.ChannelType() != "direct-tcpip" {
+				newCh.Reject(UnknownChannelType, "unknown channel type")
+				continue
+			}
+			if err := Unmarshal(newCh.ExtraData(), &msg); err != nil {
+				t.Errorf("Unmarshal: %v", err)
+			}
+			opened <- msg
+			if msg.Rport != 80 {
+				newCh.Reject(ConnectionFailed, "connection refused")
+				continue
+			}
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go DiscardRequests(chReqs)
+			ch.Close()
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	laddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 4000}
+	raddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+	tunnel, err := client.DialTCP("tcp", laddr, raddr)
+	if err != nil {
+		t.Fatalf("DialTCP: %v", err)
+	}
+	defer tunnel.Close()
+	if tunnel.LocalAddr() != laddr || tunnel.RemoteAddr() != raddr {
+		t.Errorf("got addresses %v, %v, want %v, %v", tunnel.LocalAddr(), tunnel.RemoteAddr(), laddr, raddr)
+	}
+	want := directTCPMsg{Raddr: "10.0.0.1", Rport: 80, Laddr: "127.0.0.2", Lport: 4000}
+	if got := <-opened; got != want {
+		t.Errorf("got channel open %+v, want %+v", got, want)
+	}
+
+	_, err = client.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 81})
+	if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != ConnectionFailed {
+		t.Errorf("got error %v, want *OpenChannelError with reason ConnectionFailed", err)
+	}
+	<-opened
+
+	if _, err := client.DialTCP("udp", nil, raddr); err == nil {
+		t.Error("DialTCP accepted network udp")
+	}
+}
+
+func TestClientDialUnix(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	payloads := make(chan []byte, 2)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			payloads <- newCh.ExtraData()
+			go HandleDirectStreamLocal(newCh, func(socketPath string) (net.Conn, error) {
+				if socketPath != "/run/echo.sock" {
+					return nil, errors.New("no such socket")
+				}
+				local, remote := net.Pipe()
+				go func() {
+					io.Copy(remote, remote)
+					remote.Close()
+				}()
+				return local, nil
+			})
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	if _, err := client.DialUnix(""); err == nil {
+		t.Error("DialUnix accepted an empty path")
+	}
+
+	tunnel, err := client.DialUnix("/run/echo.sock")
+	if err != nil {
+		t.Fatalf("DialUnix: %v", err)
+	}
+	defer tunnel.Close()
+	if got := tunnel.RemoteAddr().String(); got != "/run/echo.sock" {
+		t.Errorf("got remote address %q, want %q", got, "/run/echo.sock")
+	}
+	// The socket path is followed by an empty reserved string and a
+	// zero reserved uint32, as sent by OpenSSH.
+	want := append([]byte{0, 0, 0, 14}, "/run/echo.sock"...)
+	want = append(want, 0, 0, 0, 0, 0, 0, 0, 0)
+	if got := <-payloads; !bytes.Equal(got, want) {
+		t.Errorf("got channel open payload %x, want %x", got, want)
+	}
+
+	if _, err := tunnel.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tunnel, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q, want %q", buf, "ping")
+	}
+
+	_, err = client.DialUnix("/run/missing.sock")
+	if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != ConnectionFailed {
+		t.Errorf("got error %v, want *OpenChannelError with reason ConnectionFailed", err)
+	}
+	<-payloads
+}
+
+func TestClientListenUnix(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	const socketPath = "/run/forwarded.sock"
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	canceled := make(chan string, 1)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- func() error {
+			sconn, chans, reqs, err := NewServerConn(c1, serverConf)
+			if err != nil {
+				return err
+			}
+			go func() {
+				for newCh := range chans {
+					newCh.Reject(Prohibited, "no channels")
+				}
+			}()
+			var msg struct{ SocketPath string }
+			req := <-reqs
+			if req.Type != "streamlocal-forward@openssh.com" {
+				return fmt.Errorf("got request %q", req.Type)
+			}
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				return err
+			}
+			req.Reply(true, nil)
+
+			payload := Marshal(&forwardedStreamLocalPayload{SocketPath: msg.SocketPath})
+			ch, chReqs, err := sconn.OpenChannel("forwarded-streamlocal@openssh.com", payload)
+			if err != nil {
+				return err
+			}
+			go DiscardRequests(chReqs)
+			go func() {
+				io.Copy(ch, ch)
+				ch.Close()
+			}()
+
+			req = <-reqs
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				return err
+			}
+			canceled <- req.Type + " " + msg.SocketPath
+			req.Reply(true, nil)
+			go DiscardRequests(reqs)
+			return nil
+		}()
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	l, err := client.ListenUnix(socketPath)
+	if err != nil {
+		t.Fatalf("ListenUnix: %v", err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer accepted.Close()
+	if got := accepted.LocalAddr().String(); got != socketPath {
+		t.Errorf("got local address %q, want %q", got, socketPath)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, want := <-canceled, "cancel-streamlocal-forward@openssh.com "+socketPath; got != want {
+		t.Errorf("got request %q, want %q", got, want)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept succeeded on a closed listener")
+	}
+
+	// The accepted connection outlives the listener.
+	if _, err := accepted.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q, want %q", buf, "ping")
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestClientListenTCPAssignedPort(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	canceled := make(chan string, 1)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(Prohibited, "no channels")
+			}
+		}()
+		for req := range reqs {
+			var m struct {
+				Addr  string
+				Rport uint32
+			}
+			if err := Unmarshal(req.Payload, &m); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			switch {
+			case req.Type == "cancel-tcpip-forward":
+				canceled <- m.Addr
+				req.Reply(true, nil)
+			case m.Rport != 0 || m.Addr == "127.0.0.2":
+				req.Reply(true, nil)
+			default:
+				req.Reply(true, Marshal(&struct{ Port uint32 }{4321}))
+			}
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	for _, tt := range []struct {
+		laddr string
+		want  string
+	}{
+		{"127.0.0.1:0", "127.0.0.1:4321"},
+		{"127.0.0.1:2222", "127.0.0.1:2222"},
+	} {
+		laddr, err := net.ResolveTCPAddr("tcp", tt.laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := client.ListenTCP(laddr)
+		if err != nil {
+			t.Fatalf("ListenTCP(%s): %v", tt.laddr, err)
+		}
+		if got := l.Addr().String(); got != tt.want {
+			t.Errorf("ListenTCP(%s): got address %s, want %s", tt.laddr, got, tt.want)
+		}
+		if laddr.String() != tt.laddr {
+			t.Errorf("ListenTCP changed its argument to %s", laddr)
+		}
+		go l.Close()
+		<-canceled
+	}
+
+	// A reply without the assigned port fails the listen, and the forward
+	// is canceled.
+	if _, err := client.Listen("tcp", "127.0.0.2:0"); err == nil {
+		t.Error("Listen succeeded without an assigned port")
+	}
+	if got := <-canceled; got != "127.0.0.2" {
+		t.Errorf("got cancel for %q, want 127.0.0.2", got)
+	}
+}
+
+func TestClientListenTCPAddresses(t *testing.T) {
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	client, server, chans, reqs, err := NewPipeClientServer(clientConf, serverConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	defer client.Close()
+	go func() {
+		for newCh := range chans {
+			newCh.Reject(Prohibited, "no channels")
+		}
+	}()
+	requested := make(chan string, 1)
+	go func() {
+		for req := range reqs {
+			var m struct {
+				Addr  string
+				Rport uint32
+			}
+			if err := Unmarshal(req.Payload, &m); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if req.Type == "tcpip-forward" {
+				requested <- m.Addr
+			}
+			req.Reply(true, nil)
+		}
+	}()
+
+	localhost, err := net.ResolveTCPAddr("tcp", "localhost:2225")
+	if err != nil {
+		t.Fatalf("ResolveTCPAddr: %v", err)
+	}
+	for _, tt := range []struct {
+		listen string
+		// wire is the bind address sent in the tcpip-forward request.
+		wire string
+		// forwarded are the addresses the server may report in the
+		// forwarded-tcpip channels of the forward.
+		forwarded []string
+		origin    string
+	}{
+		{"127.0.0.1:2222", "127.0.0.1", []string{"127.0.0.1", "::ffff:127.0.0.1"}, "10.0.0.1"},
+		{"[::1]:2223", "::1", []string{"::1", "[::1]"}, "::1"},
+		{"[2001:db8::1]:2224", "2001:db8::1", []string{"2001:db8::1", "[2001:db8:0::1]"}, "[2001:db8::5]"},
+		{"localhost:2225", localhost.IP.String(), []string{localhost.IP.String()}, "127.0.0.1"},
+		{":2226", "", []string{"", "0.0.0.0"}, "192.0.2.1"},
+	} {
+		l, err := client.Listen("tcp", tt.listen)
+		if err != nil {
+			t.Fatalf("Listen(%q): %v", tt.listen, err)
+		}
+		if got := <-requested; got != tt.wire {
+			t.Errorf("Listen(%q): got bind address %q in the request, want %q", tt.listen, got, tt.wire)
+		}
+		port := uint32(l.Addr().(*net.TCPAddr).Port)
+		for _, addr := range tt.forwarded {
+			go func(addr string) {
+				ch, _, err := server.OpenChannel("forwarded-tcpip", Marshal(&forwardedTCPPayload{
+					Addr:       addr,
+					Port:       port,
+					OriginAddr: tt.origin,
+					OriginPort: 5555,
+				}))
+				if err != nil {
+					t.Errorf("Listen(%q): forwarded-tcpip for %q: %v", tt.listen, addr, err)
+					return
+				}
+				ch.Close()
+			}(addr)
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			origin, _ := parseForwardIP(tt.origin)
+			if got := conn.RemoteAddr().(*net.TCPAddr); !got.IP.Equal(origin) || got.Port != 5555 {
+				t.Errorf("Listen(%q): got originator %v, want %s port 5555", tt.listen, got, tt.origin)
+			}
+			conn.Close()
+		}
+		l.Close()
+	}
+
+	// A channel for an address without a forward is rejected.
+	if _, _, err := server.OpenChannel("forwarded-tcpip", Marshal(&forwardedTCPPayload{
+		Addr: "::2", Port: 2223, OriginAddr: "::1", OriginPort: 5555,
+	})); err == nil {
+		t.Error("forwarded-tcpip without a forward was accepted")
+	}
+}
+
+func TestClientCancelForward(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	type cancel struct {
+		addr string
+		port uint32
+	}
+	canceled := make(chan cancel, 2)
+	serverConn := make(chan *ServerConn, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			serverConn <- nil
+			return
+		}
+		serverConn <- conn
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(Prohibited, "no channels")
+			}
+		}()
+		for req := range reqs {
+			var m struct {
+				Addr  string
+				Rport uint32
+			}
+			if err := Unmarshal(req.Payload, &m); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if req.Type == "cancel-tcpip-forward" {
+				canceled <- cancel{m.Addr, m.Rport}
+			}
+			req.Reply(true, nil)
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+	server := <-serverConn
+	if server == nil {
+		t.FailNow()
+	}
+
+	l, err := client.Listen("tcp", "127.0.0.1:2222")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	payload := Marshal(&forwardedTCPPayload{
+		Addr:       "127.0.0.1",
+		Port:       2222,
+		OriginAddr: "10.0.0.1",
+		OriginPort: 5555,
+	})
+
+	echoErr := make(chan error, 1)
+	go func() {
+		ch, in, err := server.OpenChannel("forwarded-tcpip", payload)
+		if err != nil {
+			echoErr <- err
+			return
+		}
+		go DiscardRequests(in)
+		_, err = io.Copy(ch, ch)
+		echoErr <- err
+	}()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer accepted.Close()
+
+	// Channels nobody accepts must not keep the forward from being
+	// canceled, and are rejected once the listener is closed.
+	pending := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := server.OpenChannel("forwarded-tcpip", payload)
+			pending <- err
+		}()
+	}
+
+	if err := client.CancelForward("127.0.0.1", 2222); err != nil {
+		t.Fatalf("CancelForward: %v", err)
+	}
+	if got, want := <-canceled, (cancel{"127.0.0.1", 2222}); got != want {
+		t.Errorf("got cancel %+v, want %+v", got, want)
+	}
+
+	// The accepted connection outlives the forward.
+	if _, err := accepted.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q, want %q", buf, "ping")
+	}
+
+	// The listener's forward is already gone, so closing it sends
+	// nothing more.
+	if err := l.Close(); err != nil {
+		t.Errorf("Close after CancelForward: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-pending; err == nil {
+			t.Error("forwarded channel accepted after the forward was canceled")
+		}
+	}
+	select {
+	case c := <-canceled:
+		t.Errorf("got a second cancel %+v", c)
+	default:
+	}
+
+	// The connection is still usable for new forwards, and closing
+	// their listener cancels them.
+	l, err = client.Listen("tcp", "127.0.0.1:2223")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, want := <-canceled, (cancel{"127.0.0.1", 2223}); got != want {
+		t.Errorf("got cancel %+v, want %+v", got, want)
+	}
+
+	accepted.Close()
+	<-echoErr
+}
+
+func TestTCPIPForwardServer(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	forwards := &TCPIPForwardServer{
+		Allow: func(conn ConnMetadata, bindAddr string, bindPort uint32) bool {
+			return bindAddr == "127.0.0.1"
+		},
+	}
+	others := make(chan string, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(Prohibited, "no channels")
+			}
+		}()
+		for req := range forwards.Serve(conn, reqs) {
+			others <- req.Type
+			req.Reply(false, nil)
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	if _, err := client.Listen("tcp", "127.0.0.2:0"); err == nil {
+		t.Error("Listen succeeded for a bind address the server denies")
+	}
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+
+	local, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer local.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if got, want := accepted.RemoteAddr().String(), local.LocalAddr().String(); got != want {
+		t.Errorf("got originator %s, want %s", got, want)
+	}
+	if got := accepted.LocalAddr().String(); got != addr {
+		t.Errorf("got local address %s, want %s", got, addr)
+	}
+	go io.Copy(accepted, accepted)
+	if _, err := local.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q, want %q", buf, "ping")
+	}
+
+	// Other global requests are passed on.
+	if ok, _, err := client.SendRequest("other", true, nil); err != nil || ok {
+		t.Errorf("SendRequest: got %v, %v, want false, nil", ok, err)
+	}
+	if got := <-others; got != "other" {
+		t.Errorf("got request %q, want other", got)
+	}
+
+	// Closing the listener cancels the forward, so the server stops
+	// listening, but the forwarded connection keeps working.
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("server still listening after the forward was canceled")
+	}
+	if _, err := local.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(buf) != "pong" {
+		t.Errorf("got %q, want %q", buf, "pong")
+	}
+
+	// Canceling an unknown forward fails.
+	if err := client.CancelForward("127.0.0.1", 1); err == nil {
+		t.Error("CancelForward succeeded for an unknown forward")
+	}
+}
+
+func TestChannelConn(t *testing.T) {
+	jumpConf := &ServerConfig{NoClientAuth: true}
+	jumpConf.AddHostKey(testSigners["rsa"])
+	targetConf := &ServerConfig{NoClientAuth: true}
+	targetConf.AddHostKey(testSigners["ecdsa"])
+
+	client, jump, chans, reqs, err := NewPipeClientServer(&ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}, jumpConf)
+	if err != nil {
+		t.Fatalf("NewPipeClientServer: %v", err)
+	}
+	defer client.Close()
+	defer jump.Close()
+	go DiscardRequests(reqs)
+
+	// The first channel carries the target's connection; later ones are
+	// accepted and left idle.
+	targetDone := make(chan error, 1)
+	go func() {
+		first := true
+		for newCh := range chans {
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				return
+			}
+			go DiscardRequests(chReqs)
+			if !first {
+				continue
+			}
+			first = false
+			go func() {
+				conn, _, targetReqs, err := NewServerConn(ChannelConn(ch, nil, nil), targetConf)
+				if err != nil {
+					targetDone <- err
+					return
+				}
+				go DiscardRequests(targetReqs)
+				targetDone <- conn.Wait()
+			}()
+		}
+	}()
+
+	ch, chReqs, err := client.OpenChannel("direct-tcpip", Marshal(&channelOpenDirectMsg{
+		raddr: "target",
+		rport: 22,
+		laddr: "127.0.0.1",
+		lport: 1234,
+	}))
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(chReqs)
+
+	raddr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	nc := ChannelConn(ch, nil, raddr)
+	if nc.RemoteAddr() != raddr {
+		t.Errorf("RemoteAddr = %v, want %v", nc.RemoteAddr(), raddr)
+	}
+	if nc.LocalAddr() == nil {
+		t.Error("LocalAddr is nil")
+	}
+
+	var hostKey PublicKey
+	conn, newChans, targetReqs, err := NewClientConn(nc, "target:22", &ClientConfig{
+		User: "testuser",
+		HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+			hostKey = key
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn over channel: %v", err)
+	}
+	target := NewClient(conn, newChans, targetReqs)
+	if !bytes.Equal(hostKey.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+		t.Errorf("got host key %s, want the target's", hostKey.Type())
+	}
+	target.Close()
+	if err := <-targetDone; err == nil {
+		t.Error("target Wait returned nil error")
+	}
+
+	// A read deadline times the channel conn out rather than blocking.
+	ch2, chReqs2, err := client.OpenChannel("direct-tcpip", Marshal(&channelOpenDirectMsg{raddr: "target", rport: 22}))
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(chReqs2)
+	nc2 := ChannelConn(ch2, nil, nil)
+	defer nc2.Close()
+	if err := nc2.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	var ne net.Error
+	if _, err := nc2.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("Read after deadline = %v, want a timeout", err)
+	}
+}
@@ -8,8 +8,12 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // debugTransport if set, will print packet types as they go over the
@@ -52,6 +56,74 @@ type transport struct {
 
 	strictMode     bool
 	initialKEXDone bool
+
+	// debugCallback, if set, is called with the SSH_MSG_DEBUG
+	// messages that readPacket discards.
+	debugCallback func(alwaysDisplay bool, message, lang string)
+
+	// unimplementedCallback, if set, is called for each
+	// SSH_MSG_UNIMPLEMENTED that readPacket discards. sent is then
+	// non-nil, and records the types of recently written packets.
+	unimplementedCallback func(seqNum uint32, msgType byte)
+	sent                  *sentTypes
+
+	// authenticated is set once SSH_MSG_USERAUTH_SUCCESS has been
+	// sent by the server, or received by the client. Delayed
+	// compression starts for the packets that follow it.
+	authenticated atomic.Bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// Traffic counters for stats.
+	packetsWritten, packetsRead     atomic.Uint64
+	bytesWritten, bytesRead         atomic.Uint64
+	wireBytesWritten, wireBytesRead atomic.Uint64
+}
+
+// sentTypes records the message types of the last packets written, by
+// sequence number, so that SSH_MSG_UNIMPLEMENTED replies can be matched
+// to them. Each slot holds a valid bit, the sequence number and the
+// type.
+type sentTypes [256]atomic.Uint64
+
+func (s *sentTypes) record(seqNum uint32, msgType byte) {
+	s[seqNum%uint32(len(s))].Store(1<<40 | uint64(seqNum)<<8 | uint64(msgType))
+}
+
+func (s *sentTypes) reset() {
+	for i := range s {
+		s[i].Store(0)
+	}
+}
+
+// lookup returns the type of the packet sent with seqNum, or 0 if it is
+// not known.
+func (s *sentTypes) lookup(seqNum uint32) byte {
+	v := s[seqNum%uint32(len(s))].Load()
+	if v>>40 == 0 || uint32(v>>8) != seqNum {
+		return 0
+	}
+	return byte(v)
+}
+
+// countingReadWriter counts the bytes passed through to the underlying
+// connection.
+type countingReadWriter struct {
+	io.ReadWriter
+	read, written *atomic.Uint64
+}
+
+func (c *countingReadWriter) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingReadWriter) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
 }
 
 // packetCipher represents a combination of SSH encryption/MAC
@@ -61,6 +133,14 @@ type packetCipher interface {
 	// contents of the packet are generally scrambled.
 	writeCipherPacket(seqnum uint32, w io.Writer, rand io.Reader, packet []byte) error
 
+	// setPadTo sets the multiple that written packets are padded to,
+	// see Config.PadPacketsTo.
+	setPadTo(n int)
+
+	// setMaxPacket sets the largest payload that readCipherPacket
+	// accepts, if it is above the default, see Config.MaxPacketSize.
+	setMaxPacket(n uint32)
+
 	// readCipherPacket reads and decrypts a packet of data. The
 	// returned packet may be overwritten by future calls of
 	// readPacket.
@@ -74,7 +154,30 @@ type connectionState struct {
 	packetCipher
 	seqNum           uint32
 	dir              direction
-	pendingKeyChange chan packetCipher
+	pendingKeyChange chan keyChange
+
+	// maxPacket, if non-zero, is the largest payload readPacket
+	// accepts.
+	maxPacket uint32
+
+	// padTo is passed to the setPadTo method of the ciphers of the
+	// writing side.
+	padTo int
+
+	// compression is the compression algorithm negotiated for the
+	// current keys. The compressor or decompressor is created when
+	// compression starts. Like OpenSSH, we start a new zlib stream
+	// after every key change.
+	compression  string
+	compressor   *compressor
+	decompressor *decompressor
+}
+
+// keyChange holds the algorithms that take effect after a msgNewKeys
+// packet.
+type keyChange struct {
+	cipher      packetCipher
+	compression string
 }
 
 func (t *transport) setStrictMode() error {
@@ -89,21 +192,34 @@ func (t *transport) setInitialKEXDone() {
 	t.initialKEXDone = true
 }
 
+func (t *transport) stats() TransportStats {
+	return TransportStats{
+		PacketsWritten:   t.packetsWritten.Load(),
+		PacketsRead:      t.packetsRead.Load(),
+		BytesWritten:     t.bytesWritten.Load(),
+		BytesRead:        t.bytesRead.Load(),
+		WireBytesWritten: t.wireBytesWritten.Load(),
+		WireBytesRead:    t.wireBytesRead.Load(),
+	}
+}
+
 // prepareKeyChange sets up key material for a keychange. The key changes in
 // both directions are triggered by reading and writing a msgNewKey packet
 // respectively.
-func (t *transport) prepareKeyChange(algs *algorithms, kexResult *kexResult) error {
-	ciph, err := newPacketCipher(t.reader.dir, algs.r, kexResult)
+func (t *transport) prepareKeyChange(algs *NegotiatedAlgorithms, kexResult *kexResult) error {
+	ciph, err := newPacketCipher(t.reader.dir, algs.Read, kexResult)
 	if err != nil {
 		return err
 	}
-	t.reader.pendingKeyChange <- ciph
+	ciph.setMaxPacket(t.reader.maxPacket)
+	t.reader.pendingKeyChange <- keyChange{ciph, algs.Read.Compression}
 
-	ciph, err = newPacketCipher(t.writer.dir, algs.w, kexResult)
+	ciph, err = newPacketCipher(t.writer.dir, algs.Write, kexResult)
 	if err != nil {
 		return err
 	}
-	t.writer.pendingKeyChange <- ciph
+	ciph.setPadTo(t.writer.padTo)
+	t.writer.pendingKeyChange <- keyChange{ciph, algs.Write.Compression}
 
 	return nil
 }
@@ -127,14 +243,32 @@ func (t *transport) printPacket(p []byte, write bool) {
 // Read and decrypt next packet.
 func (t *transport) readPacket() (p []byte, err error) {
 	for {
-		p, err = t.reader.readPacket(t.bufReader, t.strictMode)
+		p, err = t.reader.readPacket(t.bufReader, t.strictMode, &t.authenticated, t.closed)
 		if err != nil {
 			break
 		}
-		// in strict mode we pass through DEBUG and IGNORE packets only during the initial KEX
-		if len(p) == 0 || (t.strictMode && !t.initialKEXDone) || (p[0] != msgIgnore && p[0] != msgDebug) {
+		t.packetsRead.Add(1)
+		t.bytesRead.Add(uint64(len(p)))
+		if t.isClient && p[0] == msgUserAuthSuccess {
+			t.authenticated.Store(true)
+		}
+		// in strict mode we pass through DEBUG, IGNORE and UNIMPLEMENTED
+		// packets only during the initial KEX
+		if len(p) == 0 || (t.strictMode && !t.initialKEXDone) || (p[0] != msgIgnore && p[0] != msgDebug && p[0] != msgUnimplemented) {
 			break
 		}
+		if p[0] == msgUnimplemented && t.unimplementedCallback != nil {
+			var msg unimplementedMsg
+			if err := Unmarshal(p, &msg); err == nil {
+				t.unimplementedCallback(msg.SeqNum, t.sent.lookup(msg.SeqNum))
+			}
+		}
+		if p[0] == msgDebug && t.debugCallback != nil {
+			var msg debugMsg
+			if err := Unmarshal(p, &msg); err == nil {
+				t.debugCallback(msg.AlwaysDisplay, msg.Message, msg.Language)
+			}
+		}
 	}
 	if debugTransport {
 		t.printPacket(p, false)
@@ -143,19 +277,35 @@ func (t *transport) readPacket() (p []byte, err error) {
 	return p, err
 }
 
-func (s *connectionState) readPacket(r *bufio.Reader, strictMode bool) ([]byte, error) {
+func (s *connectionState) readPacket(r *bufio.Reader, strictMode bool, authenticated *atomic.Bool, closed <-chan struct{}) ([]byte, error) {
 	packet, err := s.packetCipher.readCipherPacket(s.seqNum, r)
 	s.seqNum++
+	// authenticated is checked only now, as it may have been set while
+	// waiting for the packet.
+	if err == nil && s.compression == compressionZlibOpenSSH && authenticated.Load() {
+		if s.decompressor == nil {
+			s.decompressor = newDecompressor(closed, s.maxPacket)
+		}
+		packet, err = s.decompressor.decompress(packet)
+	}
 	if err == nil && len(packet) == 0 {
 		err = errors.New("ssh: zero length packet")
 	}
+	if err == nil && s.maxPacket > 0 && uint32(len(packet)) > s.maxPacket {
+		err = fmt.Errorf("ssh: packet of %d bytes exceeds the maximum packet size %d", len(packet), s.maxPacket)
+	}
 
 	if len(packet) > 0 {
 		switch packet[0] {
 		case msgNewKeys:
 			select {
-			case cipher := <-s.pendingKeyChange:
-				s.packetCipher = cipher
+			case change := <-s.pendingKeyChange:
+				s.packetCipher = change.cipher
+				s.compression = change.compression
+				if s.decompressor != nil {
+					s.decompressor.close()
+					s.decompressor = nil
+				}
 				if strictMode {
 					s.seqNum = 0
 				}
@@ -173,7 +323,7 @@ func (s *connectionState) readPacket(r *bufio.Reader, strictMode bool) ([]byte,
 			if err := Unmarshal(packet, &msg); err != nil {
 				return nil, err
 			}
-			return nil, &msg
+			return nil, msg.toError()
 		}
 	}
 
@@ -189,13 +339,42 @@ func (t *transport) writePacket(packet []byte) error {
 	if debugTransport {
 		t.printPacket(packet, true)
 	}
-	return t.writer.writePacket(t.bufWriter, t.rand, packet, t.strictMode)
+	// The server's SSH_MSG_USERAUTH_SUCCESS is sent uncompressed, but
+	// the flag is set before writing it, so that the client's first
+	// compressed packet can't arrive before the read side expects it.
+	authSuccess := !t.isClient && len(packet) > 0 && packet[0] == msgUserAuthSuccess
+	if authSuccess {
+		t.authenticated.Store(true)
+	}
+	if t.sent != nil && len(packet) > 0 {
+		t.sent.record(t.writer.seqNum, packet[0])
+	}
+	// Count the packet before writing it, as the cipher may overwrite it.
+	t.packetsWritten.Add(1)
+	t.bytesWritten.Add(uint64(len(packet)))
+	err := t.writer.writePacket(t.bufWriter, t.rand, packet, t.strictMode, t.authenticated.Load() && !authSuccess)
+	if err == nil && t.sent != nil && t.strictMode && packet[0] == msgNewKeys {
+		// The sequence numbers restart, so the recorded ones are stale.
+		t.sent.reset()
+	}
+	return err
 }
 
-func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []byte, strictMode bool) error {
+func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []byte, strictMode, authenticated bool) error {
 	changeKeys := len(packet) > 0 && packet[0] == msgNewKeys
 
-	err := s.packetCipher.writeCipherPacket(s.seqNum, w, rand, packet)
+	payload := packet
+	if s.compression == compressionZlibOpenSSH && authenticated {
+		if s.compressor == nil {
+			s.compressor = newCompressor()
+		}
+		var err error
+		if payload, err = s.compressor.compress(packet); err != nil {
+			return err
+		}
+	}
+
+	err := s.packetCipher.writeCipherPacket(s.seqNum, w, rand, payload)
 	if err != nil {
 		return err
 	}
@@ -205,8 +384,10 @@ func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []
 	s.seqNum++
 	if changeKeys {
 		select {
-		case cipher := <-s.pendingKeyChange:
-			s.packetCipher = cipher
+		case change := <-s.pendingKeyChange:
+			s.packetCipher = change.cipher
+			s.compression = change.compression
+			s.compressor = nil
 			if strictMode {
 				s.seqNum = 0
 			}
@@ -219,19 +400,21 @@ func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []
 
 func newTransport(rwc io.ReadWriteCloser, rand io.Reader, isClient bool) *transport {
 	t := &transport{
-		bufReader: bufio.NewReader(rwc),
-		bufWriter: bufio.NewWriter(rwc),
-		rand:      rand,
+		rand: rand,
 		reader: connectionState{
 			packetCipher:     &streamPacketCipher{cipher: noneCipher{}},
-			pendingKeyChange: make(chan packetCipher, 1),
+			pendingKeyChange: make(chan keyChange, 1),
 		},
 		writer: connectionState{
 			packetCipher:     &streamPacketCipher{cipher: noneCipher{}},
-			pendingKeyChange: make(chan packetCipher, 1),
+			pendingKeyChange: make(chan keyChange, 1),
 		},
 		Closer: rwc,
+		closed: make(chan struct{}),
 	}
+	counter := &countingReadWriter{rwc, &t.wireBytesRead, &t.wireBytesWritten}
+	t.bufReader = bufio.NewReader(counter)
+	t.bufWriter = bufio.NewWriter(counter)
 	t.isClient = isClient
 
 	if isClient {
@@ -245,6 +428,13 @@ func newTransport(rwc io.ReadWriteCloser, rand io.Reader, isClient bool) *transp
 	return t
 }
 
+// Close closes the underlying connection and stops the decompressor,
+// if any.
+func (t *transport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return t.Closer.Close()
+}
+
 type direction struct {
 	ivTag     []byte
 	keyTag    []byte
@@ -259,7 +449,7 @@ var (
 // setupKeys sets the cipher and MAC keys from kex.K, kex.H and sessionId, as
 // described in RFC 4253, section 6.4. direction should either be serverKeys
 // (to setup server->client keys) or clientKeys (for client->server keys).
-func newPacketCipher(d direction, algs directionAlgorithms, kex *kexResult) (packetCipher, error) {
+func newPacketCipher(d direction, algs DirectionAlgorithms, kex *kexResult) (packetCipher, error) {
 	cipherMode := cipherModes[algs.Cipher]
 
 	iv := make([]byte, cipherMode.ivSize)
@@ -307,6 +497,39 @@ func generateKeyMaterial(out, tag []byte, r *kexResult) {
 
 const packageVersion = "SSH-2.0-Go"
 
+// validateVersion checks that v is a valid identification string for
+// this side of the connection, as specified by RFC 4253, section 4.2:
+// "SSH-2.0-softwareversion", optionally followed by a space and a
+// comment, in printable US-ASCII with no whitespace in the
+// softwareversion, and short enough to fit in 255 bytes with the
+// trailing CR LF.
+func validateVersion(v string) error {
+	const prefix = "SSH-2.0-"
+	if !strings.HasPrefix(v, prefix) {
+		return fmt.Errorf("version %q does not start with %q", v, prefix)
+	}
+	if len(v)+2 > maxVersionStringBytes {
+		return fmt.Errorf("version %q is longer than %d bytes", v, maxVersionStringBytes-2)
+	}
+	software, comment, hasComment := strings.Cut(v[len(prefix):], " ")
+	if software == "" {
+		return fmt.Errorf("version %q has an empty softwareversion", v)
+	}
+	for _, c := range []byte(software) {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("version %q has invalid character %q in the softwareversion", v, c)
+		}
+	}
+	if hasComment {
+		for _, c := range []byte(comment) {
+			if c < ' ' || c > '~' {
+				return fmt.Errorf("version %q has invalid character %q in the comment", v, c)
+			}
+		}
+	}
+	return nil
+}
+
 // Sends and receives a version line.  The versionLine string should
 // be US ASCII, start with "SSH-2.0-", and should not include a
 // newline. exchangeVersions returns the other side's version line.
@@ -8,8 +8,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestReadVersion(t *testing.T) {
@@ -74,6 +76,52 @@ func TestExchangeVersions(t *testing.T) {
 	}
 }
 
+func TestValidateVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		ok      bool
+	}{
+		{packageVersion, true},
+		{"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13", true},
+		{"SSH-2.0-", false},
+		{"SSH-2.0- comment", false},
+		{"SSH-1.99-Go", false},
+		{"Go", false},
+		{"SSH-2.0-Go\n", false},
+		{"SSH-2.0-Go\r\nSSH-2.0-Evil", false},
+		{"SSH-2.0-Go\tx", false},
+		{"SSH-2.0-Go comment\x00", false},
+		{"SSH-2.0-Gö", false},
+		{"SSH-2.0-" + strings.Repeat("x", 245), true},
+		{"SSH-2.0-" + strings.Repeat("x", 246), false},
+	} {
+		if err := validateVersion(tt.version); (err == nil) != tt.ok {
+			t.Errorf("validateVersion(%q): got %v, want ok %t", tt.version, err, tt.ok)
+		}
+	}
+}
+
+func TestServerVersionValidated(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	conf := &ServerConfig{NoClientAuth: true, ServerVersion: "SSH-2.0-Go\n"}
+	conf.AddHostKey(testSigners["rsa"])
+	_, _, _, err = NewServerConn(c1, conf)
+	if err == nil || !strings.Contains(err.Error(), "invalid ServerVersion") {
+		t.Fatalf("NewServerConn: got %v, want an invalid ServerVersion error", err)
+	}
+	// The version must not have been sent.
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _ := c2.Read(make([]byte, 1)); n != 0 {
+		t.Errorf("peer received data before the configuration error")
+	}
+}
+
 type closerBuffer struct {
 	bytes.Buffer
 }
@@ -111,3 +159,51 @@ func TestTransportMaxPacketReader(t *testing.T) {
 		t.Errorf("got %q, should mention %q", err.Error(), "large")
 	}
 }
+
+func TestTransportUnimplemented(t *testing.T) {
+	a, b, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	type unimplemented struct {
+		seqNum  uint32
+		msgType byte
+	}
+	var got []unimplemented
+	trC := newTransport(a, rand.Reader, true)
+	trC.unimplementedCallback = func(seqNum uint32, msgType byte) {
+		got = append(got, unimplemented{seqNum, msgType})
+	}
+	trC.sent = new(sentTypes)
+	trS := newTransport(b, rand.Reader, false)
+
+	// An unknown message type, and a packet that the peer understands.
+	for _, p := range [][]byte{{192, 1, 2}, {msgRequestFailure}} {
+		if err := trC.writePacket(p); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+		if _, err := trS.readPacket(); err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+	}
+	// The reply to the first packet, one for a sequence number the
+	// client never used, and a packet that must still be delivered.
+	for _, p := range [][]byte{Marshal(&unimplementedMsg{0}), Marshal(&unimplementedMsg{1000}), {msgRequestSuccess}} {
+		if err := trS.writePacket(p); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+	p, err := trC.readPacket()
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if p[0] != msgRequestSuccess {
+		t.Errorf("readPacket: got message %d, want %d", p[0], msgRequestSuccess)
+	}
+	if want := []unimplemented{{0, 192}, {1000, 0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
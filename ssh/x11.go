@@ -0,0 +1,162 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// RFC 4254 Section 6.3.1.
+type x11RequestMsg struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// RFC 4254 Section 6.3.2.
+type x11ChannelOpenMsg struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+// X11AuthProtocol is the X11 authentication protocol used by OpenSSH.
+const X11AuthProtocol = "MIT-MAGIC-COOKIE-1"
+
+// NewX11Cookie returns a random X11 authentication cookie, encoded as
+// OpenSSH encodes the fake cookies it sends to servers: 16 bytes in
+// lowercase hexadecimal. A client sending a fake cookie must replace it
+// with the real one in the first packet of each forwarded connection.
+func NewX11Cookie() (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// RequestX11Forwarding asks the server to forward X11 connections for the
+// session to the client, for the given screen of the client's display.
+// If singleConnection is true, the server forwards only one connection.
+// An empty authProto stands for X11AuthProtocol. The forwarded
+// connections are available from (*Client).ListenX11.
+func (s *Session) RequestX11Forwarding(screen uint32, singleConnection bool, authProto, authCookie string) error {
+	if authProto == "" {
+		authProto = X11AuthProtocol
+	}
+	msg := x11RequestMsg{
+		SingleConnection: singleConnection,
+		AuthProtocol:     authProto,
+		AuthCookie:       authCookie,
+		ScreenNumber:     screen,
+	}
+	ok, err := s.ch.SendRequest("x11-req", true, Marshal(&msg))
+	if err == nil && !ok {
+		err = errors.New("ssh: x11-req failed")
+	}
+	return err
+}
+
+// ListenX11 returns a listener for the "x11" channels that the server
+// opens for sessions that requested X11 forwarding. The RemoteAddr of an
+// accepted connection is the originator address sent by the server. If
+// singleConnection is true, the listener closes once it has accepted a
+// connection, and rejects any further channels. A Client can have only
+// one X11 listener, even after it is closed.
+func (c *Client) ListenX11(singleConnection bool) (net.Listener, error) {
+	in := c.HandleChannelOpen("x11")
+	if in == nil {
+		return nil, errors.New("ssh: already have handler for x11")
+	}
+	return &x11Listener{
+		in:     in,
+		single: singleConnection,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+type x11Listener struct {
+	in     <-chan NewChannel
+	single bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// x11Addr is the local address of the X11 listener and its connections.
+type x11Addr struct{}
+
+func (x11Addr) Network() string { return "x11" }
+func (x11Addr) String() string  { return "x11" }
+
+// Accept waits for and returns the next X11 connection to the listener.
+func (l *x11Listener) Accept() (net.Conn, error) {
+	for {
+		var newCh NewChannel
+		var ok bool
+		select {
+		case <-l.closed:
+			return nil, io.EOF
+		case newCh, ok = <-l.in:
+			if !ok {
+				return nil, io.EOF
+			}
+		}
+		select {
+		case <-l.closed:
+			newCh.Reject(Prohibited, "x11 listener closed")
+			return nil, io.EOF
+		default:
+		}
+
+		var msg x11ChannelOpenMsg
+		if err := Unmarshal(newCh.ExtraData(), &msg); err != nil {
+			newCh.Reject(ConnectionFailed, "could not parse x11 payload: "+err.Error())
+			continue
+		}
+		ch, incoming, err := newCh.Accept()
+		if err != nil {
+			return nil, err
+		}
+		go DiscardRequests(incoming)
+		if l.single {
+			l.Close()
+		}
+
+		raddr := &net.TCPAddr{Port: int(msg.OriginatorPort)}
+		if ip := net.ParseIP(msg.OriginatorAddress); ip != nil {
+			raddr.IP = ip
+		}
+		return &chanConn{
+			Channel: ch,
+			laddr:   x11Addr{},
+			raddr:   raddr,
+		}, nil
+	}
+}
+
+// Close closes the listener. Channels opened after it is closed are
+// rejected.
+func (l *x11Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		go func() {
+			for newCh := range l.in {
+				newCh.Reject(Prohibited, "x11 listener closed")
+			}
+		}()
+	})
+	return nil
+}
+
+// Addr returns the listener's network address.
+func (l *x11Listener) Addr() net.Addr {
+	return x11Addr{}
+}